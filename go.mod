@@ -8,9 +8,9 @@ require (
 	github.com/dustin/go-humanize v1.0.0
 	github.com/gokrazy/gokapi v0.0.0-20230221201649-f3b6ca76639a
 	github.com/google/go-cmp v0.5.9
-	github.com/google/renameio/v2 v2.0.0
 	github.com/lib/pq v1.10.7
 	github.com/stapelberg/postgrestest v0.0.0-20241116183525-c42666fa9681
+	golang.org/x/mod v0.3.0
 	modernc.org/sqlite v1.20.4
 )
 
@@ -21,7 +21,6 @@ require (
 	github.com/kballard/go-shellquote v0.0.0-20180428030007-95032a82bc51 // indirect
 	github.com/mattn/go-isatty v0.0.16 // indirect
 	github.com/remyoudompheng/bigfft v0.0.0-20200410134404-eec4a21b6bb0 // indirect
-	golang.org/x/mod v0.3.0 // indirect
 	golang.org/x/net v0.6.0 // indirect
 	golang.org/x/oauth2 v0.5.0 // indirect
 	golang.org/x/sys v0.5.0 // indirect
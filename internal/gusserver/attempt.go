@@ -1,11 +1,13 @@
 package gusserver
 
 import (
+	"database/sql"
 	"encoding/json"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
+	"time"
 )
 
 type attemptUpdateRequest struct {
@@ -37,6 +39,10 @@ func (s *server) attempt(w http.ResponseWriter, r *http.Request) error {
 		return httpError(http.StatusBadRequest, fmt.Errorf("sbom_hash not set"))
 	}
 
+	if _, _, err := s.authenticateDevice(r, req.MachineID, false); err != nil {
+		return err
+	}
+
 	// Verify this AttemptUpdate request is for the desired image of the
 	// machine, otherwise perhaps a new image has been ingested between
 	// GetUpdate and AttemptUpdate.
@@ -49,6 +55,8 @@ func (s *server) attempt(w http.ResponseWriter, r *http.Request) error {
 		DesiredImage string
 		RegistryType string
 		DownloadLink string
+		DiskSHA256   sql.NullString
+		Signature    sql.NullString
 	}
 	if !rows.Next() {
 		return httpError(http.StatusNotFound, fmt.Errorf("machine_id not found"))
@@ -57,7 +65,9 @@ func (s *server) attempt(w http.ResponseWriter, r *http.Request) error {
 	err = rows.Scan(
 		&d.DesiredImage,
 		&d.RegistryType,
-		&d.DownloadLink)
+		&d.DownloadLink,
+		&d.DiskSHA256,
+		&d.Signature)
 	if err != nil {
 		return err
 	}
@@ -69,7 +79,7 @@ func (s *server) attempt(w http.ResponseWriter, r *http.Request) error {
 	}
 
 	if d.DesiredImage == req.SBOMHash {
-		if _, err := s.queries.updateUpdateState.ExecContext(ctx, "attempted", req.MachineID); err != nil {
+		if _, err := s.queries.updateUpdateState.ExecContext(ctx, updateStateAttempted, time.Now(), req.MachineID); err != nil {
 			return err
 		}
 	} else {
@@ -16,6 +16,7 @@ func TestAttempt(t *testing.T) {
 		t.Run(tc.databaseType, func(t *testing.T) {
 			ctx := context.Background()
 			ts := newTestServer(t, tc.databaseType)
+			downloadLink := ts.pushImage(t)
 			api := ts.API()
 
 			const machineID = "scan2drive"
@@ -35,7 +36,7 @@ func TestAttempt(t *testing.T) {
 					MachineIdPattern: machineID,
 					SbomHash:         "abcdefg",
 					RegistryType:     "localdisk",
-					DownloadLink:     "/doesnotexist/disk.gaf",
+					DownloadLink:     downloadLink,
 				}),
 			})
 			if err != nil {
@@ -55,7 +56,7 @@ func TestAttempt(t *testing.T) {
 			want := gusapi.UpdateResponse{
 				SbomHash:     "abcdefg",
 				RegistryType: "localdisk",
-				DownloadLink: "/doesnotexist/disk.gaf",
+				DownloadLink: downloadLink,
 			}
 			if diff := cmp.Diff(want, upResp); diff != "" {
 				t.Fatalf("update: diff (-want +got):\n%s", diff)
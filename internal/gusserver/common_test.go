@@ -1,12 +1,17 @@
 package gusserver
 
 import (
+	"bytes"
 	"context"
 	"database/sql"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"os/exec"
 	"testing"
 	"time"
 
@@ -24,6 +29,13 @@ func TestMain(m *testing.M) {
 	if pgurl == "" {
 		// 'go test' was started directly, start one Postgres per process:
 		pgt, err := postgrestest.Start(context.Background())
+		if errors.Is(err, exec.ErrNotFound) {
+			// PostgreSQL is not installed: only test with SQLite (see
+			// testDatabases).
+			fmt.Fprintf(os.Stderr, "skipping PostgreSQL tests (set PGURL or install PostgreSQL): %v\n", err)
+			m.Run()
+			return
+		}
 		if err != nil {
 			panic(err)
 		}
@@ -45,6 +57,9 @@ type testDatabase struct {
 }
 
 func testDatabases() []testDatabase {
+	if dbc == nil {
+		return []testDatabase{{"sqlite"}}
+	}
 	return []testDatabase{
 		{"sqlite"},
 		{"postgres"},
@@ -55,6 +70,9 @@ type testServer struct {
 	srv     *server
 	mux     *http.ServeMux
 	httpsrv *httptest.Server
+
+	// apiToken, if non-empty, is sent with API requests (see authorize).
+	apiToken string
 }
 
 func newTestServer(t *testing.T, databaseType string) *testServer {
@@ -76,7 +94,11 @@ func newTestServer(t *testing.T, databaseType string) *testServer {
 		t.Fatalf("BUG: unknown database type %q", databaseType)
 	}
 
-	srv, mux, err := newServer(databaseType, pgurl, nil)
+	srv, mux, err := newServer(databaseType, pgurl, &config{
+		imageDir: t.TempDir(),
+		// Most tests ingest archives without SBOM, see dummyZip.
+		allowGAFWithoutSBOM: true,
+	})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -100,6 +122,9 @@ func (ts *testServer) Client() *http.Client {
 func (ts *testServer) API() *gusapi.APIClient {
 	cfg := gusapi.NewConfiguration()
 	cfg.BasePath = ts.URL() + "/api/v1"
+	if ts.apiToken != "" {
+		cfg.AddDefaultHeader("Authorization", "Bearer "+ts.apiToken)
+	}
 	return gusapi.NewAPIClient(cfg)
 }
 
@@ -107,6 +132,74 @@ func (ts *testServer) URL() string {
 	return ts.httpsrv.URL
 }
 
+// postJSON sends req as JSON to the specified API path and decodes the
+// response into resp (unless nil). Non-200 responses are returned as error.
+func (ts *testServer) postJSON(path string, req, resp any) error {
+	b, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	hr, err := http.NewRequest("POST", ts.URL()+path, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	hr.Header.Set("Content-Type", "application/json")
+	if ts.apiToken != "" {
+		hr.Header.Set("Authorization", "Bearer "+ts.apiToken)
+	}
+	r, err := ts.Client().Do(hr)
+	if err != nil {
+		return err
+	}
+	defer r.Body.Close()
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return err
+	}
+	if r.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: unexpected HTTP status: got %v, want %v (body: %s)", path, r.Status, http.StatusOK, bytes.TrimSpace(body))
+	}
+	if resp == nil {
+		return nil
+	}
+	return json.Unmarshal(body, resp)
+}
+
+// pushImage pushes a dummy GAF archive and returns its download link, for
+// ingesting it.
+func (ts *testServer) pushImage(t *testing.T) string {
+	t.Helper()
+	return ts.push(t, dummyZip(t)).DownloadLink
+}
+
+func (ts *testServer) push(t *testing.T, gaf []byte) pushResponse {
+	t.Helper()
+	req, err := http.NewRequest("PUT", ts.URL()+"/api/v1/push", bytes.NewReader(gaf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ts.apiToken != "" {
+		req.Header.Set("Authorization", "Bearer "+ts.apiToken)
+	}
+	resp, err := ts.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("push: unexpected HTTP status: got %v, want %v (body: %s)", resp.Status, http.StatusOK, bytes.TrimSpace(b))
+	}
+	var pr pushResponse
+	if err := json.Unmarshal(b, &pr); err != nil {
+		t.Fatal(err)
+	}
+	return pr
+}
+
 func (ts *testServer) ensureEmpty(t *testing.T, table string) {
 	rows, err := ts.srv.db.Query("SELECT * FROM " + table)
 	if err != nil {
@@ -131,7 +224,8 @@ func (ts *testServer) decodeRows(t *testing.T, rows *sql.Rows) []map[string]any
 		var dest []any
 		for _, ct := range colTypes {
 			switch tn := ct.DatabaseTypeName(); tn {
-			case "TEXT":
+			case "TEXT",
+				"": // SQLite does not declare a type for expressions
 				var val string
 				dest = append(dest, &val)
 			default:
@@ -144,7 +238,7 @@ func (ts *testServer) decodeRows(t *testing.T, rows *sql.Rows) []map[string]any
 		for idx, ct := range colTypes {
 			name := ct.Name()
 			switch ct.DatabaseTypeName() {
-			case "TEXT":
+			case "TEXT", "":
 				val := dest[idx].(*string)
 				result[name] = *val
 			}
@@ -0,0 +1,203 @@
+package gusserver
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"strings"
+	"time"
+)
+
+// The image store is content-addressed: each pushed disk.gaf is stored once,
+// under the SHA-256 hash of its contents (see contentKey), no matter how often
+// it is pushed.
+//
+// Push hands out human-readable download links like
+// /images/2024-06-01T10:00:00Z-1234/disk.gaf, which are aliases for the
+// content (image_aliases table). The content can also be referenced directly
+// as /images/sha256/<hex>/disk.gaf.
+//
+// Older versions of GUS stored each push in its own directory. Their images
+// are moved into the content-addressed layout by migrateImageStore, and their
+// download links become aliases, so that already ingested images keep
+// working.
+
+const contentKeyPrefix = "sha256/"
+
+// contentKey returns the key under which the image with the specified
+// (hex-encoded) SHA-256 hash is stored.
+func contentKey(diskSHA256 string) string {
+	return contentKeyPrefix + diskSHA256 + "/disk.gaf"
+}
+
+// contentDir returns the directory of key, which groups the objects belonging
+// to one image: sha256/<hex> for content-addressed keys, the push directory
+// for keys of older versions of GUS, or "" if key does not belong to an
+// image.
+func contentDir(key string) string {
+	if rest, ok := strings.CutPrefix(key, contentKeyPrefix); ok {
+		hash, _, ok := strings.Cut(rest, "/")
+		if !ok {
+			return ""
+		}
+		return contentKeyPrefix + hash
+	}
+	dir, _, ok := strings.Cut(key, "/")
+	if !ok {
+		return ""
+	}
+	return dir
+}
+
+// resolveImage returns the key of the image with the specified download link
+// and, if known, its SHA-256 hash.
+func (s *server) resolveImage(ctx context.Context, downloadLink string) (key, diskSHA256 string, _ error) {
+	key, err := imageKey(downloadLink)
+	if err != nil {
+		return "", "", err
+	}
+	if rest, ok := strings.CutPrefix(key, contentKeyPrefix); ok {
+		hash, file, _ := strings.Cut(rest, "/")
+		if file != "disk.gaf" || !sha256DigestRe.MatchString("sha256:"+hash) {
+			return "", "", fmt.Errorf("download_link %q is not a valid content link (expected /images/sha256/<hex>/disk.gaf)", downloadLink)
+		}
+		return key, hash, nil
+	}
+	err = s.queries.selectAlias.QueryRowContext(ctx, downloadLink).Scan(&diskSHA256)
+	if err == sql.ErrNoRows {
+		// Not (yet) migrated, see migrateImageStore.
+		return key, "", nil
+	}
+	if err != nil {
+		return "", "", err
+	}
+	return contentKey(diskSHA256), diskSHA256, nil
+}
+
+// storeContent commits the pending image under its content key, unless the
+// store already contains an image with the same contents.
+func storeContent(ctx context.Context, store imageStore, pending pendingImage, diskSHA256 string) (deduplicated bool, _ error) {
+	key := contentKey(diskSHA256)
+	existing, err := store.Open(ctx, key)
+	if err == nil {
+		existing.Close()
+		return true, pending.Cleanup()
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return false, err
+	}
+	return false, pending.Commit(ctx, key)
+}
+
+// migrateImageStore moves images stored by older versions of GUS (one
+// directory per push) into the content-addressed layout. Their download links
+// become aliases of the content.
+func (s *server) migrateImageStore(ctx context.Context) (int, error) {
+	store := s.store()
+	if store == nil {
+		return 0, nil
+	}
+	objects, err := store.List(ctx)
+	if err != nil {
+		return 0, err
+	}
+	var migrated int
+	for _, obj := range objects {
+		if strings.HasPrefix(obj.Key, contentKeyPrefix) {
+			continue
+		}
+		if _, file, ok := strings.Cut(obj.Key, "/"); !ok || file != "disk.gaf" {
+			continue // not pushed by GUS
+		}
+		diskSHA256, size, err := s.migrateObject(ctx, store, obj.Key)
+		if err != nil {
+			return migrated, fmt.Errorf("migrating %s: %v", obj.Key, err)
+		}
+		downloadLink := "/images/" + obj.Key
+		if _, err := s.queries.insertAlias.ExecContext(ctx, downloadLink, diskSHA256, obj.ModTime, size, nil); err != nil {
+			return migrated, err
+		}
+		if _, err := s.queries.updateMigratedImage.ExecContext(ctx, diskSHA256, size, downloadLink); err != nil {
+			return migrated, err
+		}
+		if err := store.Delete(ctx, obj.Key); err != nil {
+			return migrated, err
+		}
+		log.Printf("migrated %s to %s", obj.Key, contentKey(diskSHA256))
+		migrated++
+	}
+	return migrated, nil
+}
+
+// migrateObject moves the object stored under key to its content key and
+// returns its hash and size. The file system store renames the object, other
+// stores copy it, which needs free space in the spool directory.
+func (s *server) migrateObject(ctx context.Context, store imageStore, key string) (string, int64, error) {
+	img, err := store.Open(ctx, key)
+	if err != nil {
+		return "", 0, err
+	}
+	defer img.Close()
+	diskSHA256, err := readerSHA256(img)
+	if err != nil {
+		return "", 0, err
+	}
+	if fss, ok := store.(*fsStore); ok {
+		// An existing image with the same content key has the same contents,
+		// so replacing it is fine.
+		if err := fss.move(fss.path(key), contentKey(diskSHA256)); err != nil {
+			return "", 0, err
+		}
+		return diskSHA256, img.Size(), nil
+	}
+	limits := &pushLimits{dir: s.spoolDir(), minFree: s.cfg.minFreeSpace}
+	if err := limits.checkFreeSpace(img.Size()); err != nil {
+		return "", 0, err
+	}
+	if _, err := img.Seek(0, io.SeekStart); err != nil {
+		return "", 0, err
+	}
+	pending, err := store.Create(ctx)
+	if err != nil {
+		return "", 0, err
+	}
+	defer pending.Cleanup()
+	if _, err := io.Copy(pending, img); err != nil {
+		return "", 0, err
+	}
+	if _, err := storeContent(ctx, store, pending, diskSHA256); err != nil {
+		return "", 0, err
+	}
+	return diskSHA256, img.Size(), nil
+}
+
+// aliasTimestamps returns the creation time of the newest alias of each
+// image (by SHA-256 hash).
+func (s *server) aliasTimestamps(ctx context.Context) (map[string]time.Time, error) {
+	rows, err := s.queries.selectAliases.QueryContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	newest := make(map[string]time.Time)
+	for rows.Next() {
+		var (
+			diskSHA256 string
+			created    time.Time
+		)
+		if err := rows.Scan(&diskSHA256, &created); err != nil {
+			return nil, err
+		}
+		if created.After(newest[diskSHA256]) {
+			newest[diskSHA256] = created
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return newest, rows.Close()
+}
@@ -0,0 +1,170 @@
+package gusserver
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestContentAddressedStore(t *testing.T) {
+	for _, tc := range testDatabases() {
+		t.Run(tc.databaseType, func(t *testing.T) {
+			ts := newTestServer(t, tc.databaseType)
+
+			get := func(link string) (*http.Response, []byte) {
+				t.Helper()
+				resp, err := ts.Client().Get(ts.URL() + link)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer resp.Body.Close()
+				b, err := io.ReadAll(resp.Body)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return resp, b
+			}
+
+			// Pushing identical contents twice stores them once, under two
+			// aliases.
+			zipb := dummyZip(t)
+			first := ts.push(t, zipb)
+			second := ts.push(t, zipb)
+			if first.DownloadLink == second.DownloadLink {
+				t.Fatalf("identical pushes got the same download link %q, want distinct aliases", first.DownloadLink)
+			}
+			if first.DiskSHA256 != second.DiskSHA256 {
+				t.Fatalf("identical pushes got different hashes: %q vs. %q", first.DiskSHA256, second.DiskSHA256)
+			}
+			objects, err := ts.srv.store().List(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(objects) != 1 || objects[0].Key != contentKey(first.DiskSHA256) {
+				t.Errorf("image store: got %+v, want only %s", objects, contentKey(first.DiskSHA256))
+			}
+			if diff := ts.diffQuery(t, []map[string]any{
+				{"disk_sha256": first.DiskSHA256},
+				{"disk_sha256": first.DiskSHA256},
+			}, "SELECT disk_sha256 FROM image_aliases"); diff != "" {
+				t.Errorf("image_aliases table: unexpected diff (-want +got):\n%s", diff)
+			}
+
+			// Images can be ingested with an alias or with the content link.
+			contentLink := "/images/" + contentKey(first.DiskSHA256)
+			for sbomHash, link := range map[string]string{
+				"img1": first.DownloadLink,
+				"img2": contentLink,
+			} {
+				if err := ts.postJSON("/api/v1/ingest", &ingestRequest{
+					MachineIDPattern: "router-*",
+					SBOMHash:         sbomHash,
+					RegistryType:     "localdisk",
+					DownloadLink:     link,
+				}, nil); err != nil {
+					t.Fatal(err)
+				}
+				if resp, b := get(link); resp.StatusCode != http.StatusOK || !bytes.Equal(b, zipb) {
+					t.Errorf("GET %s: got %v (%d bytes), want the pushed image", link, resp.Status, len(b))
+				}
+			}
+			if resp, _ := get(second.DownloadLink); resp.StatusCode != http.StatusNotFound {
+				t.Errorf("GET %s (not ingested): got %v, want %v", second.DownloadLink, resp.Status, http.StatusNotFound)
+			}
+			if err := ts.postJSON("/api/v1/ingest", &ingestRequest{
+				MachineIDPattern: "router-*",
+				SBOMHash:         "bogus",
+				RegistryType:     "localdisk",
+				DownloadLink:     "/images/sha256/nothex/disk.gaf",
+			}, nil); err == nil {
+				t.Errorf("ingesting an invalid content link unexpectedly succeeded")
+			}
+		})
+	}
+}
+
+func TestMigrateImageStore(t *testing.T) {
+	for _, tc := range testDatabases() {
+		t.Run(tc.databaseType, func(t *testing.T) {
+			ctx := context.Background()
+			ts := newTestServer(t, tc.databaseType)
+			imageDir := ts.srv.cfg.imageDir
+
+			// Set up an image as pushed and ingested by older versions of GUS,
+			// which did not record disk_sha256.
+			zipb := dummyZip(t)
+			sum := sha256.Sum256(zipb)
+			diskSHA256 := hex.EncodeToString(sum[:])
+			const legacyLink = "/images/2024-06-01T10:00:00Z-1234/disk.gaf"
+			legacyDir := filepath.Join(imageDir, "2024-06-01T10:00:00Z-1234")
+			if err := os.MkdirAll(legacyDir, 0700); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(filepath.Join(legacyDir, "disk.gaf"), zipb, 0600); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := ts.srv.db.Exec("INSERT INTO images (sbom_hash, ingestion_timestamp, machine_id_pattern, registry_type, download_url) VALUES ($1, $2, $3, $4, $5)", "legacy", time.Now(), "router-*", "localdisk", legacyLink); err != nil {
+				t.Fatal(err)
+			}
+			legacyInfo, err := os.Stat(filepath.Join(legacyDir, "disk.gaf"))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			n, err := ts.srv.migrateImageStore(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n != 1 {
+				t.Errorf("migrateImageStore: migrated %d images, want 1", n)
+			}
+			if _, err := os.Stat(legacyDir); !os.IsNotExist(err) {
+				t.Errorf("legacy directory %s not removed (err: %v)", legacyDir, err)
+			}
+			// The file system store renames instead of copying.
+			contentInfo, err := os.Stat(filepath.Join(imageDir, filepath.FromSlash(contentKey(diskSHA256))))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !os.SameFile(legacyInfo, contentInfo) {
+				t.Errorf("migrated image was copied, want it renamed")
+			}
+			if diff := ts.diffQuery(t, []map[string]any{
+				{"download_url": legacyLink, "disk_sha256": diskSHA256},
+			}, "SELECT download_url, disk_sha256 FROM image_aliases"); diff != "" {
+				t.Errorf("image_aliases table: unexpected diff (-want +got):\n%s", diff)
+			}
+			if diff := ts.diffQuery(t, []map[string]any{
+				{"sbom_hash": "legacy", "disk_sha256": diskSHA256},
+			}, "SELECT sbom_hash, disk_sha256 FROM images"); diff != "" {
+				t.Errorf("images table: unexpected diff (-want +got):\n%s", diff)
+			}
+
+			// The legacy download link keeps working.
+			resp, err := ts.Client().Get(ts.URL() + legacyLink)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			b, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != http.StatusOK || !bytes.Equal(b, zipb) {
+				t.Errorf("GET %s: got %v (%d bytes), want the pushed image", legacyLink, resp.Status, len(b))
+			}
+
+			// Migrating again is a no-op.
+			if n, err := ts.srv.migrateImageStore(ctx); err != nil || n != 0 {
+				t.Errorf("second migrateImageStore = %d, %v; want 0, nil", n, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,619 @@
+package gusserver
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// A delta describes how to construct a target image from a base image, so
+// that devices which run the base image only need to download the
+// differences. Deltas are computed rsync-style: the base image is split into
+// blocks, which are located in the target image with a rolling checksum.
+//
+// The following specifies the delta format for implementations on devices;
+// applyDelta is the reference implementation. Images are the GAF archives
+// (disk.gaf) as served from the download links, and hashes are their SHA-256
+// hashes (disk_sha256).
+//
+// A delta starts with a header of 72 bytes, followed by the operations:
+//
+//	offset  length  contents
+//	0       8       magic "GUSDLT01" (ASCII)
+//	8       32      SHA-256 hash of the base image (binary, not hex-encoded)
+//	40      32      SHA-256 hash of the target image (binary)
+//	72      …       operations, compressed with raw DEFLATE (RFC 1951,
+//	                without zlib or gzip framing)
+//
+// Incompatible changes to the format change the magic, so devices must reject
+// deltas with an unknown magic. Once decompressed, each operation starts with
+// a type byte, optionally followed by unsigned varints (the encoding of
+// binary.PutUvarint, i.e. the base 128 varints of Protocol Buffers):
+//
+//	'C' offset length  append length bytes of the base image, starting at
+//	                   offset (the range must be within the base image)
+//	'D' length data    append the length bytes of data which follow (at
+//	                   most 64 KiB)
+//	'E'                end of the delta, anything after it is ignored
+//
+// Operations append to the target image in order; copies can refer to any
+// range of the base image, in any order. Applying a delta consists of:
+//
+//  1. reading the header, verifying the magic and verifying that the base
+//     image hashes to the base hash (devices only receive deltas from the
+//     image they reported to run, see deltaFor, but their copy of it may
+//     differ),
+//  2. applying the operations until 'E', writing the target image and
+//     hashing it on the fly,
+//  3. verifying that the target image hashes to the target hash (which
+//     equals disk_sha256 of the /api/v1/update response).
+//
+// Deltas which fail any of these checks (or operations with an unknown type
+// byte, or a stream which ends before 'E') must be discarded. Devices then
+// download the full image from download_link instead.
+
+const (
+	deltaMagic     = "GUSDLT01"
+	deltaBlockSize = 4096
+
+	deltaOpCopy = 'C'
+	deltaOpData = 'D'
+	deltaOpEnd  = 'E'
+
+	// maxDeltaData is the maximum length of one data operation.
+	maxDeltaData = 64 << 10
+)
+
+// weakSum is the rsync rolling checksum of a block.
+type weakSum struct {
+	a, b uint32
+	n    uint32
+}
+
+func newWeakSum(block []byte) weakSum {
+	s := weakSum{n: uint32(len(block))}
+	for i, c := range block {
+		s.a += uint32(c)
+		s.b += uint32(len(block)-i) * uint32(c)
+	}
+	return s
+}
+
+func (s *weakSum) roll(out, in byte) {
+	s.a += uint32(in) - uint32(out)
+	s.b += s.a - s.n*uint32(out)
+}
+
+func (s weakSum) sum() uint32 {
+	return s.a&0xffff | s.b<<16
+}
+
+type deltaWriter struct {
+	w   io.Writer // compressed
+	buf [2 * binary.MaxVarintLen64]byte
+
+	// pending copy operation, merged with adjacent copies
+	copyOff, copyLen int64
+	data             []byte
+}
+
+func (dw *deltaWriter) flushCopy() error {
+	if dw.copyLen == 0 {
+		return nil
+	}
+	n := binary.PutUvarint(dw.buf[:], uint64(dw.copyOff))
+	n += binary.PutUvarint(dw.buf[n:], uint64(dw.copyLen))
+	if _, err := dw.w.Write([]byte{deltaOpCopy}); err != nil {
+		return err
+	}
+	if _, err := dw.w.Write(dw.buf[:n]); err != nil {
+		return err
+	}
+	dw.copyLen = 0
+	return nil
+}
+
+func (dw *deltaWriter) flushData() error {
+	if len(dw.data) == 0 {
+		return nil
+	}
+	n := binary.PutUvarint(dw.buf[:], uint64(len(dw.data)))
+	if _, err := dw.w.Write([]byte{deltaOpData}); err != nil {
+		return err
+	}
+	if _, err := dw.w.Write(dw.buf[:n]); err != nil {
+		return err
+	}
+	if _, err := dw.w.Write(dw.data); err != nil {
+		return err
+	}
+	dw.data = dw.data[:0]
+	return nil
+}
+
+func (dw *deltaWriter) copy(off, length int64) error {
+	if err := dw.flushData(); err != nil {
+		return err
+	}
+	if dw.copyLen > 0 && dw.copyOff+dw.copyLen == off {
+		dw.copyLen += length
+		return nil
+	}
+	if err := dw.flushCopy(); err != nil {
+		return err
+	}
+	dw.copyOff, dw.copyLen = off, length
+	return nil
+}
+
+func (dw *deltaWriter) literal(b ...byte) error {
+	if err := dw.flushCopy(); err != nil {
+		return err
+	}
+	for len(b) > 0 {
+		n := min(len(b), maxDeltaData-len(dw.data))
+		dw.data = append(dw.data, b[:n]...)
+		b = b[n:]
+		if len(dw.data) == maxDeltaData {
+			if err := dw.flushData(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (dw *deltaWriter) end() error {
+	if err := dw.flushCopy(); err != nil {
+		return err
+	}
+	if err := dw.flushData(); err != nil {
+		return err
+	}
+	_, err := dw.w.Write([]byte{deltaOpEnd})
+	return err
+}
+
+// writeDelta writes the delta from base (of size baseSize, with SHA-256 hash
+// baseSHA256) to the target image read from target (with SHA-256 hash
+// targetSHA256) to w.
+func writeDelta(w io.Writer, base io.ReaderAt, baseSize int64, baseSHA256 string, target io.Reader, targetSHA256 string) error {
+	baseSum, err := hex.DecodeString(baseSHA256)
+	if err != nil || len(baseSum) != sha256.Size {
+		return fmt.Errorf("invalid base SHA-256 %q", baseSHA256)
+	}
+	targetSum, err := hex.DecodeString(targetSHA256)
+	if err != nil || len(targetSum) != sha256.Size {
+		return fmt.Errorf("invalid target SHA-256 %q", targetSHA256)
+	}
+
+	// Index the blocks of the base image by their weak checksum.
+	index := make(map[uint32][]int64)
+	block := make([]byte, deltaBlockSize)
+	for off := int64(0); off+deltaBlockSize <= baseSize; off += deltaBlockSize {
+		if _, err := base.ReadAt(block, off); err != nil {
+			return err
+		}
+		sum := newWeakSum(block).sum()
+		index[sum] = append(index[sum], off)
+	}
+
+	header := make([]byte, 0, len(deltaMagic)+2*sha256.Size)
+	header = append(header, deltaMagic...)
+	header = append(header, baseSum...)
+	header = append(header, targetSum...)
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	fw, err := flate.NewWriter(w, flate.BestCompression)
+	if err != nil {
+		return err
+	}
+	dw := &deltaWriter{w: fw}
+
+	// window holds the current deltaBlockSize bytes of the target image. It
+	// is a slice of buf, which is compacted when the window reaches its end.
+	br := bufio.NewReaderSize(target, 1<<20)
+	buf := make([]byte, 64*deltaBlockSize)
+	fill := func() ([]byte, error) {
+		n, err := io.ReadFull(br, buf[:deltaBlockSize])
+		if err == io.ErrUnexpectedEOF || err == io.EOF {
+			err = nil
+		}
+		return buf[:n], err
+	}
+	window, err := fill()
+	if err != nil {
+		return err
+	}
+	sum := newWeakSum(window)
+	for len(window) == deltaBlockSize {
+		matched := false
+		for _, off := range index[sum.sum()] {
+			if _, err := base.ReadAt(block, off); err != nil {
+				return err
+			}
+			if bytes.Equal(block, window) {
+				if err := dw.copy(off, deltaBlockSize); err != nil {
+					return err
+				}
+				matched = true
+				break
+			}
+		}
+		if matched {
+			if window, err = fill(); err != nil {
+				return err
+			}
+			sum = newWeakSum(window)
+			continue
+		}
+
+		// No match: emit the first byte of the window as data and slide
+		// the window by one byte.
+		c, err := br.ReadByte()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		out := window[0]
+		if err := dw.literal(out); err != nil {
+			return err
+		}
+		start := len(buf) - cap(window) + 1 // offset of window[1] in buf
+		if start+deltaBlockSize > len(buf) {
+			copy(buf, window[1:])
+			start = 0
+		}
+		window = buf[start : start+deltaBlockSize]
+		window[deltaBlockSize-1] = c
+		sum.roll(out, c)
+	}
+	// The remainder is shorter than a block (or did not match).
+	if err := dw.literal(window...); err != nil {
+		return err
+	}
+	if err := dw.end(); err != nil {
+		return err
+	}
+	return fw.Close()
+}
+
+var errInvalidDelta = errors.New("invalid delta")
+
+// applyDelta writes the target image described by delta to w, reading from
+// base, and verifies the SHA-256 hashes of base and target. This is the
+// reference implementation for devices; GUS uses it to verify deltas before
+// offering them (see computeDelta).
+func applyDelta(w io.Writer, base io.ReaderAt, baseSize int64, delta io.Reader) error {
+	header := make([]byte, len(deltaMagic)+2*sha256.Size)
+	if _, err := io.ReadFull(delta, header); err != nil {
+		return fmt.Errorf("%w: reading header: %v", errInvalidDelta, err)
+	}
+	if string(header[:len(deltaMagic)]) != deltaMagic {
+		return fmt.Errorf("%w: unexpected magic %q", errInvalidDelta, header[:len(deltaMagic)])
+	}
+	baseSum := header[len(deltaMagic) : len(deltaMagic)+sha256.Size]
+	targetSum := header[len(deltaMagic)+sha256.Size:]
+
+	bh := sha256.New()
+	if _, err := io.Copy(bh, io.NewSectionReader(base, 0, baseSize)); err != nil {
+		return err
+	}
+	if got := bh.Sum(nil); !bytes.Equal(got, baseSum) {
+		return fmt.Errorf("delta is based on image %x, not %x", baseSum, got)
+	}
+
+	th := sha256.New()
+	out := io.MultiWriter(w, th)
+	ops := bufio.NewReader(flate.NewReader(delta))
+	for {
+		op, err := ops.ReadByte()
+		if err != nil {
+			return fmt.Errorf("%w: %v", errInvalidDelta, err)
+		}
+		switch op {
+		case deltaOpCopy:
+			off, err := binary.ReadUvarint(ops)
+			if err != nil {
+				return fmt.Errorf("%w: %v", errInvalidDelta, err)
+			}
+			length, err := binary.ReadUvarint(ops)
+			if err != nil {
+				return fmt.Errorf("%w: %v", errInvalidDelta, err)
+			}
+			if off > uint64(baseSize) || length > uint64(baseSize)-off {
+				return fmt.Errorf("%w: copy of %d bytes at offset %d exceeds the base image (%d bytes)", errInvalidDelta, length, off, baseSize)
+			}
+			if _, err := io.Copy(out, io.NewSectionReader(base, int64(off), int64(length))); err != nil {
+				return err
+			}
+
+		case deltaOpData:
+			length, err := binary.ReadUvarint(ops)
+			if err != nil {
+				return fmt.Errorf("%w: %v", errInvalidDelta, err)
+			}
+			if length > maxDeltaData {
+				return fmt.Errorf("%w: data operation of %d bytes", errInvalidDelta, length)
+			}
+			if _, err := io.CopyN(out, ops, int64(length)); err != nil {
+				return fmt.Errorf("%w: %v", errInvalidDelta, err)
+			}
+
+		case deltaOpEnd:
+			if got := th.Sum(nil); !bytes.Equal(got, targetSum) {
+				return fmt.Errorf("applying delta resulted in image %x, want %x", got, targetSum)
+			}
+			return nil
+
+		default:
+			return fmt.Errorf("%w: unknown operation %q", errInvalidDelta, op)
+		}
+	}
+}
+
+// Devices learn about deltas via /api/v1/update (see deltaFor). Deltas are
+// computed in the background (see scheduleDelta) the first time a device
+// which runs a locally stored image asks for a locally stored desired image,
+// and are stored next to the target image, so that garbage collection
+// removes them along with it.
+
+const deltaLinkPrefix = "/deltas/"
+
+// deltaKey returns the key under which the delta from the base image to the
+// target image (by SHA-256 hash) is stored.
+func deltaKey(baseSHA256, targetSHA256 string) string {
+	return contentKeyPrefix + targetSHA256 + "/from-" + baseSHA256 + ".delta"
+}
+
+func deltaLink(baseSHA256, targetSHA256 string) string {
+	return deltaLinkPrefix + baseSHA256 + "/" + targetSHA256 + ".delta"
+}
+
+// deltaFor returns the link to the delta from the image with the specified
+// sbom hash (which the device currently runs) to the image with SHA-256 hash
+// targetSHA256, and the SHA-256 hash of the base image. If the delta was not
+// computed yet, deltaFor schedules its computation and returns empty strings,
+// like when no (worthwhile) delta is possible.
+func (s *server) deltaFor(ctx context.Context, currentSBOMHash, targetSHA256 string) (link, baseSHA256 string, _ error) {
+	err := s.queries.selectLocalDigest.QueryRowContext(ctx, currentSBOMHash).Scan(&baseSHA256)
+	if err == sql.ErrNoRows {
+		return "", "", nil // base image not in the image store
+	}
+	if err != nil {
+		return "", "", err
+	}
+	if baseSHA256 == targetSHA256 {
+		return "", "", nil
+	}
+	var deltaSHA256 sql.NullString
+	var deltaSize sql.NullInt64
+	err = s.queries.selectDelta.QueryRowContext(ctx, baseSHA256, targetSHA256).Scan(
+		&deltaSHA256,
+		&deltaSize)
+	if err == sql.ErrNoRows {
+		s.scheduleDelta(baseSHA256, targetSHA256)
+		return "", "", nil
+	}
+	if err != nil {
+		return "", "", err
+	}
+	if !deltaSize.Valid {
+		return "", "", nil // not worthwhile
+	}
+	return deltaLink(baseSHA256, targetSHA256), baseSHA256, nil
+}
+
+// scheduleDelta computes the specified delta in the background, unless its
+// computation is already in progress.
+func (s *server) scheduleDelta(baseSHA256, targetSHA256 string) {
+	key := baseSHA256 + "/" + targetSHA256
+	s.deltasMu.Lock()
+	defer s.deltasMu.Unlock()
+	if s.deltasPending[key] {
+		return
+	}
+	if s.deltasPending == nil {
+		s.deltasPending = make(map[string]bool)
+	}
+	s.deltasPending[key] = true
+	go func() {
+		defer func() {
+			s.deltasMu.Lock()
+			defer s.deltasMu.Unlock()
+			delete(s.deltasPending, key)
+		}()
+		if err := s.computeDelta(context.Background(), baseSHA256, targetSHA256); err != nil {
+			log.Printf("computing delta %s → %s: %v", baseSHA256, targetSHA256, err)
+		}
+	}()
+}
+
+type countingWriter struct {
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	cw.n += int64(len(p))
+	return len(p), nil
+}
+
+// computeDelta computes, verifies and stores the delta from the base image to
+// the target image (by SHA-256 hash). Deltas which are not substantially
+// smaller than the target image are only recorded as not worthwhile.
+func (s *server) computeDelta(ctx context.Context, baseSHA256, targetSHA256 string) error {
+	store := s.store()
+	if store == nil {
+		return errNoImageStore
+	}
+
+	// Computing deltas is CPU and I/O intensive, so only compute one at a
+	// time.
+	s.deltaComputeMu.Lock()
+	defer s.deltaComputeMu.Unlock()
+
+	var deltaSHA256 sql.NullString
+	var deltaSize sql.NullInt64
+	err := s.queries.selectDelta.QueryRowContext(ctx, baseSHA256, targetSHA256).Scan(
+		&deltaSHA256,
+		&deltaSize)
+	if err == nil {
+		return nil // already computed
+	}
+	if err != sql.ErrNoRows {
+		return err
+	}
+
+	base, err := store.Open(ctx, contentKey(baseSHA256))
+	if err != nil {
+		return err
+	}
+	defer base.Close()
+	target, err := store.Open(ctx, contentKey(targetSHA256))
+	if err != nil {
+		return err
+	}
+	defer target.Close()
+
+	// The delta (about the size of the target image at worst) and, for
+	// remote stores, a local copy of the base image are written to the spool
+	// directory.
+	_, local := store.(*fsStore)
+	spool := s.spoolDir()
+	pending := target.Size()
+	if !local {
+		pending += base.Size()
+	}
+	limits := &pushLimits{dir: spool, minFree: s.cfg.minFreeSpace}
+	if err := limits.checkFreeSpace(pending); err != nil {
+		return err
+	}
+	baseReader := io.ReaderAt(base)
+	if !local {
+		// Matching reads many small blocks at random offsets, so keep a
+		// local copy of remote base images.
+		f, err := os.CreateTemp(spool, "gus-delta-base-")
+		if err != nil {
+			return err
+		}
+		defer os.Remove(f.Name())
+		defer f.Close()
+		if _, err := io.Copy(f, base); err != nil {
+			return err
+		}
+		baseReader = f
+	}
+
+	start := time.Now()
+	out, err := store.Create(ctx)
+	if err != nil {
+		return err
+	}
+	defer out.Cleanup()
+	h := sha256.New()
+	var cw countingWriter
+	if err := writeDelta(io.MultiWriter(out, h, &cw), baseReader, base.Size(), baseSHA256, target, targetSHA256); err != nil {
+		return err
+	}
+	if cw.n >= target.Size()*9/10 {
+		log.Printf("delta %s → %s not worthwhile (%d of %d bytes)", baseSHA256, targetSHA256, cw.n, target.Size())
+		_, err := s.queries.upsertDelta.ExecContext(ctx, baseSHA256, targetSHA256, nil, nil, time.Now())
+		return err
+	}
+	if err := applyDelta(io.Discard, baseReader, base.Size(), io.NewSectionReader(out, 0, cw.n)); err != nil {
+		return fmt.Errorf("verifying delta: %v", err)
+	}
+	if err := out.Commit(ctx, deltaKey(baseSHA256, targetSHA256)); err != nil {
+		return err
+	}
+	sum := hex.EncodeToString(h.Sum(nil))
+	if _, err := s.queries.upsertDelta.ExecContext(ctx, baseSHA256, targetSHA256, sum, cw.n, time.Now()); err != nil {
+		return err
+	}
+	log.Printf("computed delta %s → %s in %v: %d of %d bytes", baseSHA256, targetSHA256, time.Since(start), cw.n, target.Size())
+	return nil
+}
+
+type storedDelta struct {
+	baseSHA256, targetSHA256 string
+	stored                   bool // false if not worthwhile
+}
+
+// loadDeltas returns all computed deltas.
+func (s *server) loadDeltas(ctx context.Context) ([]storedDelta, error) {
+	rows, err := s.queries.selectDeltas.QueryContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var deltas []storedDelta
+	for rows.Next() {
+		var (
+			d           storedDelta
+			deltaSHA256 sql.NullString
+		)
+		if err := rows.Scan(&d.baseSHA256, &d.targetSHA256, &deltaSHA256); err != nil {
+			return nil, err
+		}
+		d.stored = deltaSHA256.Valid
+		deltas = append(deltas, d)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return deltas, rows.Close()
+}
+
+// downloadDelta serves the deltas advertised by deltaFor.
+func (s *server) downloadDelta(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		return httpError(http.StatusMethodNotAllowed, fmt.Errorf("invalid method (expected GET or HEAD)"))
+	}
+	rest := strings.TrimPrefix(r.URL.Path, deltaLinkPrefix)
+	baseSHA256, file, _ := strings.Cut(rest, "/")
+	targetSHA256, ok := strings.CutSuffix(file, ".delta")
+	if !ok || !sha256DigestRe.MatchString("sha256:"+baseSHA256) || !sha256DigestRe.MatchString("sha256:"+targetSHA256) {
+		return httpError(http.StatusNotFound, fmt.Errorf("invalid delta link %q (expected %s<base>/<target>.delta)", r.URL.Path, deltaLinkPrefix))
+	}
+	var deltaSHA256 sql.NullString
+	var deltaSize sql.NullInt64
+	err := s.queries.selectDelta.QueryRowContext(r.Context(), baseSHA256, targetSHA256).Scan(
+		&deltaSHA256,
+		&deltaSize)
+	if err == sql.ErrNoRows || (err == nil && !deltaSHA256.Valid) {
+		return httpError(http.StatusNotFound, fmt.Errorf("no delta %s → %s", baseSHA256, targetSHA256))
+	}
+	if err != nil {
+		return err
+	}
+	store := s.store()
+	if store == nil {
+		return httpError(http.StatusNotFound, errNoImageStore)
+	}
+	img, err := store.Open(r.Context(), deltaKey(baseSHA256, targetSHA256))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return httpError(http.StatusNotFound, err)
+		}
+		return err
+	}
+	defer img.Close()
+	return serveBlob(w, r, "disk.gaf.delta", "application/octet-stream", img, deltaSHA256.String)
+}
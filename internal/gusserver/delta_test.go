@@ -0,0 +1,226 @@
+package gusserver
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/fs"
+	"math/rand"
+	"net/http"
+	"testing"
+)
+
+func sha256Hex(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+func TestDelta(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	random := func(n int) []byte {
+		b := make([]byte, n)
+		rnd.Read(b)
+		return b
+	}
+	base := random(1 << 20)
+	concat := func(parts ...[]byte) []byte {
+		return bytes.Join(parts, nil)
+	}
+	modified := bytes.Clone(base)
+	copy(modified[300000:], random(100))
+
+	for _, tt := range []struct {
+		name         string
+		base, target []byte
+		maxSize      int // maximum expected delta size, or 0
+	}{
+		{name: "identical", base: base, target: base, maxSize: 1024},
+		{name: "modified", base: base, target: modified, maxSize: 2 * deltaBlockSize},
+		{name: "inserted", base: base, target: concat(base[:500000], random(1000), base[500000:]), maxSize: 2*deltaBlockSize + 1000},
+		{name: "deleted", base: base, target: concat(base[:500000], base[510000:]), maxSize: 2 * deltaBlockSize},
+		{name: "appended", base: base, target: concat(base, random(10)), maxSize: 1024},
+		{name: "unaligned", base: base, target: base[123:]},
+		{name: "unrelated", base: base, target: random(100000)},
+		{name: "empty base", base: nil, target: random(10000)},
+		{name: "empty target", base: base, target: nil},
+		{name: "shorter than a block", base: base, target: base[:100]},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var delta bytes.Buffer
+			if err := writeDelta(&delta, bytes.NewReader(tt.base), int64(len(tt.base)), sha256Hex(tt.base), bytes.NewReader(tt.target), sha256Hex(tt.target)); err != nil {
+				t.Fatal(err)
+			}
+			if tt.maxSize > 0 && delta.Len() > tt.maxSize {
+				t.Errorf("delta size: got %d bytes, want at most %d", delta.Len(), tt.maxSize)
+			}
+			var got bytes.Buffer
+			if err := applyDelta(&got, bytes.NewReader(tt.base), int64(len(tt.base)), bytes.NewReader(delta.Bytes())); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got.Bytes(), tt.target) {
+				t.Errorf("applying the delta did not result in the target")
+			}
+		})
+	}
+
+	t.Run("wrong base", func(t *testing.T) {
+		var delta bytes.Buffer
+		if err := writeDelta(&delta, bytes.NewReader(base), int64(len(base)), sha256Hex(base), bytes.NewReader(modified), sha256Hex(modified)); err != nil {
+			t.Fatal(err)
+		}
+		if err := applyDelta(io.Discard, bytes.NewReader(modified), int64(len(modified)), bytes.NewReader(delta.Bytes())); err == nil {
+			t.Errorf("applying a delta to the wrong base unexpectedly succeeded")
+		}
+		corrupted := bytes.Clone(delta.Bytes())
+		corrupted[0] = 'X'
+		if err := applyDelta(io.Discard, bytes.NewReader(base), int64(len(base)), bytes.NewReader(corrupted)); !errors.Is(err, errInvalidDelta) {
+			t.Errorf("applying a corrupted delta: got %v, want %v", err, errInvalidDelta)
+		}
+	})
+}
+
+// zipWithFile returns a zip archive which stores (without compression) one
+// file with the specified contents.
+func zipWithFile(t *testing.T, contents []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	f, err := w.CreateHeader(&zip.FileHeader{
+		Name:   "root.squashfs",
+		Method: zip.Store,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write(contents); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestDeltaUpdate(t *testing.T) {
+	for _, tc := range testDatabases() {
+		t.Run(tc.databaseType, func(t *testing.T) {
+			ts := newTestServer(t, tc.databaseType)
+			ts.srv.cfg.deltaUpdates = true
+
+			const machineID = "router-1"
+			rnd := rand.New(rand.NewSource(1))
+			contents := make([]byte, 512<<10)
+			rnd.Read(contents)
+			baseGAF := zipWithFile(t, contents)
+			copy(contents[200000:], "a small change")
+			targetGAF := zipWithFile(t, contents)
+
+			ingest := func(sbomHash string, gaf []byte) pushResponse {
+				t.Helper()
+				pr := ts.push(t, gaf)
+				if err := ts.postJSON("/api/v1/ingest", &ingestRequest{
+					MachineIDPattern: "router-*",
+					SBOMHash:         sbomHash,
+					RegistryType:     "localdisk",
+					DownloadLink:     pr.DownloadLink,
+				}, nil); err != nil {
+					t.Fatal(err)
+				}
+				return pr
+			}
+			update := func() updateResponse {
+				t.Helper()
+				var ur updateResponse
+				if err := ts.postJSON("/api/v1/update", &updateRequest{MachineID: machineID}, &ur); err != nil {
+					t.Fatal(err)
+				}
+				return ur
+			}
+
+			base := ingest("base", baseGAF)
+			if err := ts.postJSON("/api/v1/heartbeat", &heartbeatRequest{
+				MachineID: machineID,
+				SBOMHash:  "base",
+			}, nil); err != nil {
+				t.Fatal(err)
+			}
+			target := ingest("target", targetGAF)
+
+			// The first update request schedules the delta computation.
+			if ur := update(); ur.SBOMHash != "target" || ur.DeltaLink != "" {
+				t.Fatalf("first update: got %+v, want target without delta", ur)
+			}
+			// Wait for the computation (computeDelta is idempotent and
+			// serialized).
+			if err := ts.srv.computeDelta(context.Background(), base.DiskSHA256, target.DiskSHA256); err != nil {
+				t.Fatal(err)
+			}
+
+			ur := update()
+			if ur.DeltaLink != deltaLink(base.DiskSHA256, target.DiskSHA256) || ur.DeltaBaseSHA256 != base.DiskSHA256 {
+				t.Fatalf("update: got %+v, want delta from %s", ur, base.DiskSHA256)
+			}
+			if ur.DownloadLink != target.DownloadLink || ur.DiskSHA256 != target.DiskSHA256 {
+				t.Errorf("update: got %+v, want full image %s as fallback", ur, target.DownloadLink)
+			}
+
+			resp, err := ts.Client().Get(ts.URL() + ur.DeltaLink)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			delta, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("GET %s: got %v, want %v", ur.DeltaLink, resp.Status, http.StatusOK)
+			}
+			if len(delta) > len(targetGAF)/10 {
+				t.Errorf("delta size: got %d bytes, want less than a tenth of the image (%d bytes)", len(delta), len(targetGAF))
+			}
+			var got bytes.Buffer
+			if err := applyDelta(&got, bytes.NewReader(baseGAF), int64(len(baseGAF)), bytes.NewReader(delta)); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got.Bytes(), targetGAF) {
+				t.Errorf("applying the downloaded delta did not result in the target image")
+			}
+
+			// Devices which run an image that is not in the image store get no
+			// delta.
+			if err := ts.postJSON("/api/v1/heartbeat", &heartbeatRequest{
+				MachineID: machineID,
+				SBOMHash:  "unknown",
+			}, nil); err != nil {
+				t.Fatal(err)
+			}
+			if ur := update(); ur.DeltaLink != "" {
+				t.Errorf("update for unknown base image: got delta %q, want none", ur.DeltaLink)
+			}
+
+			if resp, err := ts.Client().Get(ts.URL() + deltaLink(target.DiskSHA256, base.DiskSHA256)); err != nil {
+				t.Fatal(err)
+			} else if resp.Body.Close(); resp.StatusCode != http.StatusNotFound {
+				t.Errorf("GET of a non-existing delta: got %v, want %v", resp.Status, http.StatusNotFound)
+			}
+
+			// Garbage collection removes deltas from removed images.
+			ts.srv.cfg.gcKeep = 1
+			if _, err := ts.srv.collectGarbage(context.Background(), false); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := ts.srv.store().Open(context.Background(), contentKey(base.DiskSHA256)); !errors.Is(err, fs.ErrNotExist) {
+				t.Fatalf("base image not removed by garbage collection (err: %v)", err)
+			}
+			if _, err := ts.srv.store().Open(context.Background(), deltaKey(base.DiskSHA256, target.DiskSHA256)); !errors.Is(err, fs.ErrNotExist) {
+				t.Errorf("delta from removed image not removed (err: %v)", err)
+			}
+			ts.ensureEmpty(t, "image_deltas")
+		})
+	}
+}
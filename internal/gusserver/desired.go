@@ -4,86 +4,222 @@ import (
 	"context"
 	"database/sql"
 	"log"
+	"time"
 )
 
-func (s *server) updateDesired() error {
-	// Intentionally not using a passed-in context so that this request keeps
-	// running even if a client terminates the connection early.
-	ctx := context.Background()
+type desiredImage struct {
+	SBOMHash         string
+	MachineIDPattern string
 
-	// TODO: check if ingestion policy is auto-update
+	pattern *machinePattern
+}
 
+type desiredMachine struct {
+	MachineID            string
+	DesiredImage         sql.NullString
+	IngestionPolicy      sql.NullString
+	PendingImage         sql.NullString
+	PinnedImage          sql.NullString
+	UpdateState          sql.NullString
+	UpdateStateTimestamp sql.NullTime
+	Enrollment           sql.NullString
+	LastHeartbeat        sql.NullTime
+	Hostname             sql.NullString
+	Model                sql.NullString
+	MaintenanceWindow    sql.NullString
+}
+
+func (m *desiredMachine) attrs() machineAttrs {
+	return machineAttrs{
+		MachineID: m.MachineID,
+		Hostname:  m.Hostname.String,
+		Model:     m.Model.String,
+	}
+}
+
+// bestImage returns the image whose machine ID pattern most specifically
+// matches the machine, or nil if no pattern matches. images must be sorted by
+// ingestion timestamp, newest first, so that ties are resolved in favor of the
+// most recently ingested image.
+func bestImage(images []desiredImage, attrs machineAttrs) *desiredImage {
+	patterns := make([]*machinePattern, len(images))
+	for idx, img := range images {
+		patterns[idx] = img.pattern
+	}
+	if idx := mostSpecific(patterns, attrs); idx > -1 {
+		return &images[idx]
+	}
+	return nil
+}
+
+func (s *server) loadDesiredMachines(ctx context.Context) ([]desiredMachine, error) {
 	rows, err := s.queries.selectMachinesForDesired.QueryContext(ctx)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer rows.Close()
-	type machine struct {
-		MachineID       string
-		DesiredImage    sql.NullString
-		IngestionPolicy sql.NullString
-	}
-	var machines []machine
+	var machines []desiredMachine
 	for rows.Next() {
-		var m machine
-		if err := rows.Scan(&m.MachineID, &m.DesiredImage, &m.IngestionPolicy); err != nil {
-			return err
+		var m desiredMachine
+		err := rows.Scan(
+			&m.MachineID,
+			&m.DesiredImage,
+			&m.IngestionPolicy,
+			&m.PendingImage,
+			&m.PinnedImage,
+			&m.UpdateState,
+			&m.UpdateStateTimestamp,
+			&m.Enrollment,
+			&m.LastHeartbeat,
+			&m.Hostname,
+			&m.Model,
+			&m.MaintenanceWindow)
+		if err != nil {
+			return nil, err
 		}
 		machines = append(machines, m)
 	}
 	if err := rows.Err(); err != nil {
-		return err
-	}
-	if err := rows.Close(); err != nil {
-		return err
+		return nil, err
 	}
+	return machines, rows.Close()
+}
 
-	rows, err = s.queries.selectImagesForDesired.QueryContext(ctx)
+// loadDesiredImages returns the latest image per machine ID pattern, newest
+// first.
+func (s *server) loadDesiredImages(ctx context.Context) ([]desiredImage, error) {
+	rows, err := s.queries.selectImagesForDesired.QueryContext(ctx)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer rows.Close()
-	type image struct {
-		SBOMHash         string
-		MachineIDPattern string
-	}
 	seen := make(map[string]bool)
-	var images []image
+	var images []desiredImage
 	for rows.Next() {
-		var i image
+		var i desiredImage
 		if err := rows.Scan(&i.SBOMHash, &i.MachineIDPattern); err != nil {
-			return err
+			return nil, err
 		}
 		// While Postgres has a DISTINCT ON feature, SQLite lacks it, so it is
 		// easier to do grouping ourselves: we only use the latest image sbom
 		// hash per machine id pattern.
-		if !seen[i.MachineIDPattern] {
-			images = append(images, i)
-			seen[i.MachineIDPattern] = true
+		if seen[i.MachineIDPattern] {
+			continue
+		}
+		seen[i.MachineIDPattern] = true
+		pattern, err := parseMachinePattern(i.MachineIDPattern)
+		if err != nil {
+			// Patterns are validated at ingestion time, but images ingested
+			// by older versions of GUS might not be valid.
+			log.Printf("skipping image %q: %v", i.SBOMHash, err)
+			continue
 		}
+		i.pattern = pattern
+		images = append(images, i)
 	}
 	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return images, rows.Close()
+}
+
+func (s *server) updateDesired() error {
+	// Intentionally not using a passed-in context so that this request keeps
+	// running even if a client terminates the connection early.
+	ctx := context.Background()
+
+	s.desiredMu.Lock()
+	defer s.desiredMu.Unlock()
+	start := time.Now()
+	defer func() { s.metrics.updateDesiredDuration.observe(time.Since(start)) }()
+
+	machines, err := s.loadDesiredMachines(ctx)
+	if err != nil {
 		return err
 	}
-	if err := rows.Close(); err != nil {
+
+	images, err := s.loadDesiredImages(ctx)
+	if err != nil {
 		return err
 	}
 
-	for _, img := range images {
-		for _, mach := range machines {
-			// TODO: pattern matching
-			if mach.MachineID != img.MachineIDPattern {
+	rollouts, err := s.loadRollouts(ctx)
+	if err != nil {
+		return err
+	}
+
+	windows, err := s.loadMaintenanceWindows(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, mach := range machines {
+		// Record which maintenance window applies to the machine, so that
+		// /api/v1/update only needs to load that window.
+		var window string
+		if w := windowFor(windows, mach.attrs()); w != nil {
+			window = w.MachineIDPattern
+		}
+		if window != mach.MaintenanceWindow.String {
+			if _, err := s.queries.updateMachineWindow.ExecContext(ctx, nullIfEmpty(window), mach.MachineID); err != nil {
+				return err
+			}
+		}
+
+		if s.cfg.requireEnrollment && mach.Enrollment.String != enrollmentApproved {
+			continue // see authenticateDevice
+		}
+
+		policy := mach.IngestionPolicy.String
+		if policy == policyPinned {
+			if !mach.PinnedImage.Valid || mach.DesiredImage.String == mach.PinnedImage.String {
 				continue
 			}
-			if mach.DesiredImage.String == img.SBOMHash {
-				continue // machine is already on the desired image
+			log.Printf("Setting desired image for machine %q to pinned image %q", mach.MachineID, mach.PinnedImage.String)
+			if _, err := s.queries.updateDesiredImage.ExecContext(ctx, mach.PinnedImage.String, mach.MachineID); err != nil {
+				return err
 			}
-			log.Printf("Setting desired image for machine %q to %q", mach.MachineID, img.SBOMHash)
+			continue
+		}
 
-			if _, err := s.queries.updateDesiredImage.ExecContext(ctx, img.SBOMHash, mach.MachineID); err != nil {
+		img := bestImage(images, mach.attrs())
+		if img == nil {
+			continue
+		}
+		if mach.DesiredImage.String == img.SBOMHash {
+			// machine is already on the desired image
+			if mach.PendingImage.Valid {
+				if _, err := s.queries.updatePendingImage.ExecContext(ctx, nil, mach.MachineID); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+
+		if ro, ok := rollouts.bySBOMHash[img.SBOMHash]; ok && !ro.admits(mach.MachineID) {
+			continue // staged rollout has not reached this machine (yet)
+		}
+
+		if policy == policyManual {
+			if mach.PendingImage.String == img.SBOMHash {
+				continue // already awaiting approval
+			}
+			log.Printf("Setting pending image for machine %q to %q (matching %q), awaiting approval", mach.MachineID, img.SBOMHash, img.MachineIDPattern)
+			if _, err := s.queries.updatePendingImage.ExecContext(ctx, img.SBOMHash, mach.MachineID); err != nil {
 				return err
 			}
+			continue
+		}
+
+		log.Printf("Setting desired image for machine %q to %q (matching %q)", mach.MachineID, img.SBOMHash, img.MachineIDPattern)
 
+		if _, err := s.queries.updateDesiredImage.ExecContext(ctx, img.SBOMHash, mach.MachineID); err != nil {
+			return err
+		}
+		if mach.PendingImage.Valid {
+			if _, err := s.queries.updatePendingImage.ExecContext(ctx, nil, mach.MachineID); err != nil {
+				return err
+			}
 		}
 	}
 
@@ -0,0 +1,105 @@
+package gusserver
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+)
+
+// download serves the disk images pushed to this server. Only images which
+// were ingested (i.e. whose download link is in the images table) are served;
+// there are no directory listings.
+//
+// http.ServeContent handles Range requests, so that devices can resume
+// interrupted downloads, and conditional requests based on the ETag, which is
+// the SHA-256 hash of the disk image.
+//
+// When config.presignExpiry is set and the image store supports it, devices
+// download images from the store directly (see presignedDownload) and this
+// handler is only used by clients which were handed the /images/ link.
+func (s *server) download(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		return httpError(http.StatusMethodNotAllowed, fmt.Errorf("invalid method (expected GET or HEAD)"))
+	}
+	var (
+		sbomHash   string
+		diskSHA256 sql.NullString
+	)
+	err := s.queries.selectImageByDownloadURL.QueryRowContext(r.Context(), r.URL.Path).Scan(
+		&sbomHash,
+		&diskSHA256)
+	if err == sql.ErrNoRows {
+		return httpError(http.StatusNotFound, fmt.Errorf("no image with download link %q", r.URL.Path))
+	}
+	if err != nil {
+		return err
+	}
+	store := s.store()
+	if store == nil {
+		return httpError(http.StatusNotFound, errNoImageStore)
+	}
+	key, _, err := s.resolveImage(r.Context(), r.URL.Path)
+	if err != nil {
+		return httpError(http.StatusNotFound, err)
+	}
+	img, err := store.Open(r.Context(), key)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return httpError(http.StatusNotFound, fmt.Errorf("image %q: %v", sbomHash, err))
+		}
+		return err
+	}
+	defer img.Close()
+
+	if !diskSHA256.Valid {
+		// Images ingested by older versions of GUS do not have their hash
+		// recorded yet. Compute it once and store it for subsequent requests.
+		sum, err := readerSHA256(img)
+		if err != nil {
+			return err
+		}
+		if _, err := img.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		if _, err := s.queries.updateImageDigest.ExecContext(r.Context(), sum, img.Size(), sbomHash); err != nil {
+			return err
+		}
+		log.Printf("recorded SHA-256 %s of image %q", sum, sbomHash)
+		diskSHA256 = sql.NullString{String: sum, Valid: true}
+	}
+
+	return serveImage(w, r, img, diskSHA256.String)
+}
+
+// serveImage serves img, whose hex-encoded SHA-256 hash is diskSHA256, with
+// headers that allow clients to verify and resume the download.
+func serveImage(w http.ResponseWriter, r *http.Request, img storedImage, diskSHA256 string) error {
+	return serveBlob(w, r, "disk.gaf", "application/zip", img, diskSHA256)
+}
+
+// serveBlob serves img (named name, for http.ServeContent), whose hex-encoded
+// SHA-256 hash is sha256Hex.
+func serveBlob(w http.ResponseWriter, r *http.Request, name, contentType string, img storedImage, sha256Hex string) error {
+	sum, err := hex.DecodeString(sha256Hex)
+	if err != nil {
+		return fmt.Errorf("invalid SHA-256 %q: %v", sha256Hex, err)
+	}
+
+	h := w.Header()
+	h.Set("Content-Type", contentType)
+	h.Set("X-Content-Type-Options", "nosniff")
+	h.Set("ETag", `"`+sha256Hex+`"`)
+	// Digest (RFC 3230) and its successor Repr-Digest (RFC 9530) allow clients
+	// to verify the complete download.
+	b64 := base64.StdEncoding.EncodeToString(sum)
+	h.Set("Digest", "sha-256="+b64)
+	h.Set("Repr-Digest", "sha-256=:"+b64+":")
+	http.ServeContent(w, r, name, img.ModTime(), img)
+	return nil
+}
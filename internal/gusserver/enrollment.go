@@ -0,0 +1,179 @@
+package gusserver
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+)
+
+// With config.requireEnrollment, devices need to be enrolled before GUS
+// accepts their heartbeats, update and attempt requests:
+//
+//  1. The first heartbeat for a machine ID creates the machine in enrollment
+//     state pending. GUS generates a device secret and returns it in the
+//     heartbeat response (device_secret field), exactly once.
+//  2. The device sends its secret as bearer token (Authorization: Bearer
+//     gusdev_…) with all subsequent heartbeat, update and attempt requests.
+//     Requests for enrolled machines without the correct secret are rejected.
+//  3. An operator verifies the machine (hostname, model, IP address) on the
+//     index page and approves it. Only approved machines are assigned desired
+//     images.
+//
+// The first device to send a heartbeat for a machine ID receives its secret
+// (trust on first use), which is why operators need to approve machines. If a
+// device loses its secret (or a different device enrolled first), operators
+// can reset the enrollment, so that the next heartbeat enrolls the machine
+// again.
+//
+// Machines which sent heartbeats before enrollment was required enroll with
+// their next heartbeat, like new machines.
+const (
+	enrollmentPending  = "pending"
+	enrollmentApproved = "approved"
+)
+
+const deviceSecretPrefix = "gusdev_"
+
+// authenticateDevice verifies the device secret of the request for the
+// specified machine and returns the enrollment state of the machine. When
+// enroll is true, machines without device secret are enrolled and their newly
+// generated secret is returned.
+func (s *server) authenticateDevice(r *http.Request, machineID string, enroll bool) (enrollment, secret string, _ error) {
+	if !s.cfg.requireEnrollment {
+		return "", "", nil
+	}
+	if machineID == "" {
+		return "", "", httpError(http.StatusBadRequest, fmt.Errorf("machine_id not set"))
+	}
+	var (
+		state      sql.NullString
+		secretHash sql.NullString
+	)
+	err := s.queries.selectEnrollment.QueryRowContext(r.Context(), machineID).Scan(&state, &secretHash)
+	if err != nil && err != sql.ErrNoRows {
+		return "", "", err
+	}
+	if !secretHash.Valid {
+		if !enroll {
+			return "", "", httpError(http.StatusForbidden, fmt.Errorf("machine %q is not enrolled (send a heartbeat first)", machineID))
+		}
+		var b [32]byte
+		if _, err := rand.Read(b[:]); err != nil {
+			return "", "", err
+		}
+		secret := deviceSecretPrefix + hex.EncodeToString(b[:])
+		res, err := s.queries.enrollMachine.ExecContext(r.Context(), machineID, enrollmentPending, hashToken(secret))
+		if err != nil {
+			return "", "", err
+		}
+		if n, err := res.RowsAffected(); err != nil {
+			return "", "", err
+		} else if n == 0 {
+			// A concurrent heartbeat enrolled the machine first.
+			return "", "", httpError(http.StatusUnauthorized, fmt.Errorf("machine %q was enrolled concurrently", machineID))
+		}
+		log.Printf("machine %q enrolled, awaiting approval", machineID)
+		return enrollmentPending, secret, nil
+	}
+	got := hashToken(requestToken(r))
+	if subtle.ConstantTimeCompare([]byte(got), []byte(secretHash.String)) != 1 {
+		return "", "", httpError(http.StatusUnauthorized, fmt.Errorf("invalid or missing device secret for machine %q", machineID))
+	}
+	return state.String, "", nil
+}
+
+type enrollRequest struct {
+	MachineID string `json:"machine_id"`
+	// Action is approve (allow the machine to receive desired images) or reset
+	// (forget the device secret, so that the machine enrolls again).
+	Action string `json:"action"`
+}
+
+type enrollResponse struct{}
+
+func (s *server) changeEnrollment(ctx context.Context, req enrollRequest) error {
+	if req.MachineID == "" {
+		return httpError(http.StatusBadRequest, fmt.Errorf("machine_id not set"))
+	}
+	var (
+		res sql.Result
+		err error
+	)
+	switch req.Action {
+	case "approve":
+		res, err = s.queries.approveEnrollment.ExecContext(ctx, enrollmentApproved, req.MachineID)
+	case "reset":
+		res, err = s.queries.resetEnrollment.ExecContext(ctx, req.MachineID)
+	default:
+		return httpError(http.StatusBadRequest, fmt.Errorf("invalid action %q: must be one of [approve reset]", req.Action))
+	}
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return httpError(http.StatusNotFound, fmt.Errorf("no enrolled machine with machine_id %q", req.MachineID))
+	}
+	log.Printf("Enrollment of machine %q: %s", req.MachineID, req.Action)
+	return s.updateDesired()
+}
+
+func (s *server) enroll(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "POST" {
+		return httpError(http.StatusBadRequest, fmt.Errorf("invalid method (expected POST)"))
+	}
+	var req enrollRequest
+	b, err := io.ReadAll(r.Body)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(b, &req); err != nil {
+		return err
+	}
+
+	if err := s.authorizeMachine(r, req.MachineID); err != nil {
+		return err
+	}
+
+	if err := s.changeEnrollment(r.Context(), req); err != nil {
+		return err
+	}
+
+	b, err = json.Marshal(&enrollResponse{})
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+	return nil
+}
+
+// enrollForm handles the enrollment buttons on the index page.
+func (s *server) enrollForm(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "POST" {
+		return httpError(http.StatusBadRequest, fmt.Errorf("invalid method (expected POST)"))
+	}
+	req := enrollRequest{
+		MachineID: r.FormValue("machine_id"),
+		Action:    r.FormValue("action"),
+	}
+	if err := s.authorizeMachineForm(r, req.MachineID); err != nil {
+		return err
+	}
+
+	if err := s.changeEnrollment(r.Context(), req); err != nil {
+		return err
+	}
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+	return nil
+}
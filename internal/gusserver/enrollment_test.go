@@ -0,0 +1,153 @@
+package gusserver
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestEnrollment(t *testing.T) {
+	for _, tc := range testDatabases() {
+		t.Run(tc.databaseType, func(t *testing.T) {
+			ts := newTestServer(t, tc.databaseType)
+			downloadLink := ts.pushImage(t)
+			ts.srv.cfg.requireEnrollment = true
+
+			const machineID = "router-1"
+
+			if err := ts.postJSON("/api/v1/ingest", &ingestRequest{
+				MachineIDPattern: "router-*",
+				SBOMHash:         "abcdefg",
+				RegistryType:     "localdisk",
+				DownloadLink:     downloadLink,
+			}, nil); err != nil {
+				t.Fatal(err)
+			}
+
+			heartbeat := func(secret string) (heartbeatResponse, error) {
+				ts.apiToken = secret
+				var resp heartbeatResponse
+				err := ts.postJSON("/api/v1/heartbeat", &heartbeatRequest{
+					MachineID: machineID,
+					SBOMHash:  "old",
+				}, &resp)
+				return resp, err
+			}
+			update := func(secret string) (updateResponse, error) {
+				ts.apiToken = secret
+				var resp updateResponse
+				err := ts.postJSON("/api/v1/update", &updateRequest{
+					MachineID: machineID,
+				}, &resp)
+				return resp, err
+			}
+			enroll := func(action string) error {
+				ts.apiToken = ""
+				return ts.postJSON("/api/v1/enroll", &enrollRequest{
+					MachineID: machineID,
+					Action:    action,
+				}, nil)
+			}
+			wantStatus := func(desc string, err error, status string) {
+				t.Helper()
+				if err == nil || !strings.Contains(err.Error(), status) {
+					t.Errorf("%s: got err %v, want HTTP %s", desc, err, status)
+				}
+			}
+
+			// The first heartbeat enrolls the machine.
+			hr, err := heartbeat("")
+			if err != nil {
+				t.Fatal(err)
+			}
+			secret := hr.DeviceSecret
+			if !strings.HasPrefix(secret, deviceSecretPrefix) {
+				t.Fatalf("heartbeat response: unexpected device secret %q", secret)
+			}
+			const q = "SELECT enrollment, COALESCE(desired_image, '') AS desired_image FROM machines"
+			if diff := ts.diffQuery(t, []map[string]any{
+				{"enrollment": "pending", "desired_image": ""},
+			}, q); diff != "" {
+				t.Errorf("machines table: unexpected diff (-want +got):\n%s", diff)
+			}
+
+			// Subsequent requests need to carry the device secret.
+			_, err = heartbeat("")
+			wantStatus("heartbeat without secret", err, "401")
+			_, err = heartbeat(deviceSecretPrefix + "wrong")
+			wantStatus("heartbeat with wrong secret", err, "401")
+			hr, err = heartbeat(secret)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if hr.DeviceSecret != "" {
+				t.Errorf("device secret unexpectedly sent again")
+			}
+
+			// Unapproved machines do not receive updates.
+			_, err = update(secret)
+			wantStatus("update before approval", err, "403")
+
+			if err := enroll("approve"); err != nil {
+				t.Fatal(err)
+			}
+			if diff := ts.diffQuery(t, []map[string]any{
+				{"enrollment": "approved", "desired_image": "abcdefg"},
+			}, q); diff != "" {
+				t.Errorf("machines table: unexpected diff (-want +got):\n%s", diff)
+			}
+
+			ur, err := update(secret)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := ur.SBOMHash, "abcdefg"; got != want {
+				t.Errorf("update response: got sbom_hash %q, want %q", got, want)
+			}
+			_, err = update("")
+			wantStatus("update without secret", err, "401")
+
+			ts.apiToken = deviceSecretPrefix + "wrong"
+			err = ts.postJSON("/api/v1/attempt", &attemptUpdateRequest{
+				MachineID: machineID,
+				SBOMHash:  "abcdefg",
+			}, nil)
+			wantStatus("attempt with wrong secret", err, "401")
+
+			// The index page offers to reset the enrollment.
+			resp, err := ts.Client().Get(ts.URL())
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, err := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("GET /: unexpected HTTP status %v", resp.Status)
+			}
+			if !strings.Contains(string(body), "enrollment: approved") {
+				t.Errorf("index page does not show enrollment state")
+			}
+
+			// After a reset, the next heartbeat enrolls the machine again.
+			if err := enroll("reset"); err != nil {
+				t.Fatal(err)
+			}
+			hr, err = heartbeat("")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if hr.DeviceSecret == "" || hr.DeviceSecret == secret {
+				t.Errorf("re-enrollment: got device secret %q, want a new secret", hr.DeviceSecret)
+			}
+			if diff := ts.diffQuery(t, []map[string]any{
+				{"enrollment": "pending", "desired_image": "abcdefg"},
+			}, q); diff != "" {
+				t.Errorf("machines table: unexpected diff (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,9 @@
+//go:build !(linux || darwin || freebsd)
+
+package gusserver
+
+// freeSpace is not implemented on this platform, so the free space reserve
+// (config.minFreeSpace) is not enforced.
+func freeSpace(dir string) (int64, error) {
+	return 0, errFreeSpaceUnsupported
+}
@@ -0,0 +1,18 @@
+//go:build linux || darwin || freebsd
+
+package gusserver
+
+import (
+	"os"
+	"syscall"
+)
+
+// freeSpace returns the number of bytes available to unprivileged users on
+// the file system containing dir.
+func freeSpace(dir string) (int64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return 0, &os.PathError{Op: "statfs", Path: dir, Err: err}
+	}
+	return int64(st.Bavail) * int64(st.Bsize), nil
+}
@@ -0,0 +1,75 @@
+package gusserver
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// A GAF (gokrazy archive format) file is a zip archive containing the disk
+// image partitions of a gokrazy build and the build's SBOM in sbom.json:
+//
+//	{
+//	  "sbom_hash": "…",
+//	  "sbom": { "config_hash": {…}, "go_mod_hashes": […] }
+//	}
+//
+// The SBOM hash is the hex-encoded SHA-256 hash of the SBOM, marshaled as
+// indented JSON (two spaces), which is what gokrazy devices report in their
+// heartbeats.
+const gafSBOMName = "sbom.json"
+
+type gafSBOM struct {
+	SBOMHash string          `json:"sbom_hash"`
+	SBOM     json.RawMessage `json:"sbom"`
+}
+
+// sbomHash returns the SBOM hash of the (JSON-encoded) SBOM.
+func sbomHash(sbom json.RawMessage) (string, error) {
+	var compact, indented bytes.Buffer
+	if err := json.Compact(&compact, sbom); err != nil {
+		return "", err
+	}
+	if err := json.Indent(&indented, compact.Bytes(), "", "  "); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", sha256.Sum256(indented.Bytes())), nil
+}
+
+// readGAFSBOM verifies that r is a valid GAF archive and returns the SBOM it
+// contains and its (computed) hash. Archives without SBOM (created by older
+// versions of gok) are valid and result in an empty hash, but can only be
+// ingested with config.allowGAFWithoutSBOM.
+func readGAFSBOM(r io.ReaderAt, size int64) (sbom json.RawMessage, hash string, _ error) {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return nil, "", fmt.Errorf("not a valid GAF (zip) archive: %v", err)
+	}
+	f, err := zr.Open(gafSBOMName)
+	if err != nil {
+		return nil, "", nil // no SBOM
+	}
+	defer f.Close()
+	b, err := io.ReadAll(f)
+	if err != nil {
+		return nil, "", fmt.Errorf("reading %s from GAF: %v", gafSBOMName, err)
+	}
+	var gs gafSBOM
+	if err := json.Unmarshal(b, &gs); err != nil {
+		return nil, "", fmt.Errorf("invalid %s in GAF: %v", gafSBOMName, err)
+	}
+	if len(gs.SBOM) == 0 {
+		return nil, "", fmt.Errorf("invalid %s in GAF: sbom not set", gafSBOMName)
+	}
+	hash, err = sbomHash(gs.SBOM)
+	if err != nil {
+		return nil, "", fmt.Errorf("invalid %s in GAF: %v", gafSBOMName, err)
+	}
+	if gs.SBOMHash != "" && gs.SBOMHash != hash {
+		return nil, "", fmt.Errorf("inconsistent %s in GAF: sbom_hash is %q, but the sbom hashes to %q", gafSBOMName, gs.SBOMHash, hash)
+	}
+	return gs.SBOM, hash, nil
+}
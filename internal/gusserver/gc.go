@@ -0,0 +1,405 @@
+package gusserver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Garbage collection keeps the image store (see imageStore) from growing
+// without bounds. Each run removes:
+//
+//   - files in image_dir/tmp (left behind by aborted pushes) older than
+//     config.gcTmpAge (file system store only),
+//   - pushed images which were not ingested within config.gcGracePeriod,
+//   - ingested images beyond the config.gcKeep newest images per machine ID
+//     pattern (retention). Images which any machine currently runs, desires,
+//     has pending or is pinned to, images of unfinished rollouts and the
+//     images to which unfinished rollouts would roll back their machines (see
+//     halt) are never removed,
+//   - deltas from removed images. Deltas to an image are stored next to it
+//     (see deltaKey) and removed along with it.
+//
+// In dry-run mode, garbage collection only reports what it would remove.
+
+type gcItem struct {
+	Path     string `json:"path"` // image directory (see contentDir), or tmp file
+	SBOMHash string `json:"sbom_hash,omitempty"`
+	Reason   string `json:"reason"`
+}
+
+type gcReport struct {
+	Timestamp time.Time `json:"timestamp"`
+	DryRun    bool      `json:"dry_run"`
+	Removed   []gcItem  `json:"removed"`
+}
+
+// imageDir returns the directory (see contentDir) in which the specified
+// image is stored, or "" if the image was not pushed to this server.
+func imageDir(img image) string {
+	rel, ok := strings.CutPrefix(img.DownloadURL, "/images/")
+	if !ok {
+		return ""
+	}
+	if img.DiskSHA256.Valid && img.DiskSHA256.String != "" {
+		return contentKeyPrefix + img.DiskSHA256.String
+	}
+	// Ingested before disk_sha256 was recorded and not yet migrated.
+	return contentDir(rel)
+}
+
+// protectedImages returns the sbom hashes of all images which must not be
+// removed.
+func (s *server) protectedImages(ctx context.Context) (map[string]bool, error) {
+	rows, err := s.queries.selectProtectedImages.QueryContext(ctx, rolloutRunning, rolloutPaused, rolloutHalted)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	protected := make(map[string]bool)
+	for rows.Next() {
+		var sbomHash string
+		if err := rows.Scan(&sbomHash); err != nil {
+			return nil, err
+		}
+		protected[sbomHash] = true
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+
+	rollouts, err := s.loadRollouts(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, ro := range rollouts.rollouts {
+		if !ro.Rollback || (ro.State != rolloutRunning && ro.State != rolloutPaused) {
+			continue
+		}
+		for machineID := range ro.admitted {
+			knownGood, err := s.knownGoodImage(ctx, machineID, ro.SBOMHash)
+			if err != nil {
+				return nil, err
+			}
+			if knownGood != "" {
+				protected[knownGood] = true
+			}
+		}
+	}
+	return protected, nil
+}
+
+func (s *server) collectGarbage(ctx context.Context, dryRun bool) (*gcReport, error) {
+	store := s.store()
+	if store == nil {
+		return nil, httpError(http.StatusForbidden, errNoImageStore)
+	}
+
+	s.gcMu.Lock()
+	defer s.gcMu.Unlock()
+	s.contentMu.Lock()
+	defer s.contentMu.Unlock()
+
+	now := time.Now()
+	report := &gcReport{
+		Timestamp: now,
+		DryRun:    dryRun,
+	}
+
+	// Stale temporary files (only the file system store keeps them in the
+	// image store itself)
+	if fss, ok := store.(*fsStore); ok {
+		tmpEntries, err := os.ReadDir(filepath.Join(fss.dir, "tmp"))
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		for _, ent := range tmpEntries {
+			info, err := ent.Info()
+			if err != nil {
+				continue // removed concurrently
+			}
+			if now.Sub(info.ModTime()) < s.cfg.gcTmpAge {
+				continue
+			}
+			item := gcItem{
+				Path:   filepath.Join("tmp", ent.Name()),
+				Reason: "stale temporary file",
+			}
+			report.Removed = append(report.Removed, item)
+			if dryRun {
+				log.Printf("gc: would remove %s (%s)", item.Path, item.Reason)
+				continue
+			}
+			log.Printf("gc: removing %s (%s)", item.Path, item.Reason)
+			if err := os.RemoveAll(filepath.Join(fss.dir, item.Path)); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	objects, err := store.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	stored := make(map[string][]storedObject) // image dir → objects
+	for _, obj := range objects {
+		dir := contentDir(obj.Key)
+		if dir == "" {
+			continue // not pushed by GUS
+		}
+		stored[dir] = append(stored[dir], obj)
+	}
+	removedDirs := make(map[string]bool)
+	remove := func(item gcItem) error {
+		removedDirs[item.Path] = true
+		report.Removed = append(report.Removed, item)
+		if dryRun {
+			log.Printf("gc: would remove %s (%s)", item.Path, item.Reason)
+			return nil
+		}
+		log.Printf("gc: removing %s (%s)", item.Path, item.Reason)
+		for _, obj := range stored[item.Path] {
+			if err := store.Delete(ctx, obj.Key); err != nil {
+				return err
+			}
+		}
+		if hash, ok := strings.CutPrefix(item.Path, contentKeyPrefix); ok {
+			if _, err := s.queries.deleteAliases.ExecContext(ctx, hash); err != nil {
+				return err
+			}
+			if _, err := s.queries.deleteDeltas.ExecContext(ctx, hash); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	// Retention
+	protected, err := s.protectedImages(ctx)
+	if err != nil {
+		return nil, err
+	}
+	images, err := s.loadImages(ctx)
+	if err != nil {
+		return nil, err
+	}
+	refs := make(map[string]int) // image dir → number of images
+	for _, img := range images {
+		if dir := imageDir(img); dir != "" {
+			refs[dir]++
+		}
+	}
+	perPattern := make(map[string]int)
+	for _, img := range images { // newest first
+		perPattern[img.MachineIDPattern]++
+		if s.cfg.gcKeep <= 0 || perPattern[img.MachineIDPattern] <= s.cfg.gcKeep {
+			continue
+		}
+		if protected[img.SBOMHash] {
+			continue
+		}
+		reason := fmt.Sprintf("retention: %d newer images for %q", s.cfg.gcKeep, img.MachineIDPattern)
+		if !dryRun {
+			if _, err := s.queries.deleteImage.ExecContext(ctx, img.SBOMHash); err != nil {
+				return nil, err
+			}
+		}
+		dir := imageDir(img)
+		if dir == "" {
+			// Not stored on this server, only the images row is removed.
+			report.Removed = append(report.Removed, gcItem{
+				SBOMHash: img.SBOMHash,
+				Reason:   reason,
+			})
+			continue
+		}
+		if refs[dir]--; refs[dir] > 0 {
+			continue // still referenced by another image
+		}
+		if err := remove(gcItem{
+			Path:     dir,
+			SBOMHash: img.SBOMHash,
+			Reason:   reason,
+		}); err != nil {
+			return nil, err
+		}
+	}
+
+	// Pushed, but never ingested. Pushing identical contents again (which
+	// adds an alias) restarts the grace period.
+	aliased, err := s.aliasTimestamps(ctx)
+	if err != nil {
+		return nil, err
+	}
+	dirs := make([]string, 0, len(stored))
+	for dir := range stored {
+		dirs = append(dirs, dir)
+	}
+	sort.Strings(dirs)
+	for _, dir := range dirs {
+		if refs[dir] > 0 || removedDirs[dir] {
+			continue
+		}
+		var newest time.Time
+		for _, obj := range stored[dir] {
+			if obj.ModTime.After(newest) {
+				newest = obj.ModTime
+			}
+		}
+		if hash, ok := strings.CutPrefix(dir, contentKeyPrefix); ok && aliased[hash].After(newest) {
+			newest = aliased[hash]
+		}
+		if now.Sub(newest) < s.cfg.gcGracePeriod {
+			continue
+		}
+		if err := remove(gcItem{
+			Path:   dir,
+			Reason: fmt.Sprintf("not ingested within %v", s.cfg.gcGracePeriod),
+		}); err != nil {
+			return nil, err
+		}
+	}
+
+	// Deltas from removed images
+	deltas, err := s.loadDeltas(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range deltas {
+		baseDir := contentKeyPrefix + d.baseSHA256
+		if len(stored[baseDir]) > 0 && !removedDirs[baseDir] {
+			continue
+		}
+		if removedDirs[contentKeyPrefix+d.targetSHA256] {
+			continue // removed along with the target image
+		}
+		if d.stored {
+			item := gcItem{
+				Path:   deltaKey(d.baseSHA256, d.targetSHA256),
+				Reason: "delta from removed image " + d.baseSHA256,
+			}
+			report.Removed = append(report.Removed, item)
+			if dryRun {
+				log.Printf("gc: would remove %s (%s)", item.Path, item.Reason)
+				continue
+			}
+			log.Printf("gc: removing %s (%s)", item.Path, item.Reason)
+			if err := store.Delete(ctx, item.Path); err != nil {
+				return nil, err
+			}
+		}
+		if dryRun {
+			continue
+		}
+		if _, err := s.queries.deleteDelta.ExecContext(ctx, d.baseSHA256, d.targetSHA256); err != nil {
+			return nil, err
+		}
+	}
+
+	log.Printf("gc: %d items removed (dry run: %v)", len(report.Removed), dryRun)
+	s.lastGC = report
+	return report, nil
+}
+
+// loadImages returns all ingested images, newest first.
+func (s *server) loadImages(ctx context.Context) ([]image, error) {
+	rows, err := s.queries.selectImagesForIndex.QueryContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var images []image
+	for rows.Next() {
+		var i image
+		err := rows.Scan(
+			&i.SBOMHash,
+			&i.IngestionTimestamp,
+			&i.MachineIDPattern,
+			&i.RegistryType,
+			&i.DownloadURL,
+			&i.DiskSize,
+			&i.CheckError,
+			&i.DiskSHA256)
+		if err != nil {
+			return nil, err
+		}
+		images = append(images, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return images, rows.Close()
+}
+
+// lastGCReport returns the report of the most recent garbage collection run,
+// or nil.
+func (s *server) lastGCReport() *gcReport {
+	s.gcMu.Lock()
+	defer s.gcMu.Unlock()
+	return s.lastGC
+}
+
+type gcRequest struct {
+	DryRun bool `json:"dry_run"`
+}
+
+func (s *server) gc(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "POST" {
+		return httpError(http.StatusBadRequest, fmt.Errorf("invalid method (expected POST)"))
+	}
+	var req gcRequest
+	b, err := io.ReadAll(r.Body)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(b, &req); err != nil {
+		return err
+	}
+
+	if err := s.authorizeAll(r); err != nil {
+		return err
+	}
+
+	report, err := s.collectGarbage(r.Context(), req.DryRun)
+	if err != nil {
+		return err
+	}
+
+	b, err = json.Marshal(report)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+	return nil
+}
+
+// gcForm handles the garbage collection buttons on the index page.
+func (s *server) gcForm(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "POST" {
+		return httpError(http.StatusBadRequest, fmt.Errorf("invalid method (expected POST)"))
+	}
+	if err := s.checkSameOrigin(r); err != nil {
+		return err
+	}
+	if err := s.authorizeAll(r); err != nil {
+		return err
+	}
+
+	if _, err := s.collectGarbage(r.Context(), r.FormValue("dry_run") != ""); err != nil {
+		return err
+	}
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+	return nil
+}
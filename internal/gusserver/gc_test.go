@@ -0,0 +1,214 @@
+package gusserver
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestCollectGarbage(t *testing.T) {
+	for _, tc := range testDatabases() {
+		t.Run(tc.databaseType, func(t *testing.T) {
+			ctx := context.Background()
+			ts := newTestServer(t, tc.databaseType)
+			imageDir := ts.srv.cfg.imageDir
+			ts.srv.cfg.gcTmpAge = time.Hour
+			ts.srv.cfg.gcGracePeriod = time.Hour
+			ts.srv.cfg.gcKeep = 2
+
+			old := time.Now().Add(-2 * time.Hour)
+			age := func(path string) {
+				t.Helper()
+				if err := os.Chtimes(path, old, old); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			push := func(contents string) pushResponse {
+				t.Helper()
+				req, err := http.NewRequest("PUT", ts.URL()+"/api/v1/push", bytes.NewReader(zipWithContents(t, contents)))
+				if err != nil {
+					t.Fatal(err)
+				}
+				resp, err := ts.Client().Do(req)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer resp.Body.Close()
+				b, err := io.ReadAll(resp.Body)
+				if err != nil {
+					t.Fatal(err)
+				}
+				var pr pushResponse
+				if err := json.Unmarshal(b, &pr); err != nil {
+					t.Fatal(err)
+				}
+				return pr
+			}
+			ingest := func(sbomHash, downloadLink string) {
+				t.Helper()
+				if err := ts.postJSON("/api/v1/ingest", &ingestRequest{
+					MachineIDPattern: "router-*",
+					SBOMHash:         sbomHash,
+					RegistryType:     "localdisk",
+					DownloadLink:     downloadLink,
+				}, nil); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			dirs := make(map[string]string)
+			for _, sbomHash := range []string{"img1", "img2", "img3", "img4"} {
+				pr := push(sbomHash)
+				dirs[sbomHash] = contentKeyPrefix + pr.DiskSHA256
+				ingest(sbomHash, pr.DownloadLink)
+				age(filepath.Join(imageDir, dirs[sbomHash], "disk.gaf"))
+				if sbomHash == "img1" {
+					// router-1 runs img1, which protects it from retention.
+					if err := ts.postJSON("/api/v1/heartbeat", &heartbeatRequest{
+						MachineID: "router-1",
+						SBOMHash:  "img1",
+					}, nil); err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+			abandonedPush := push("abandoned")
+			abandoned := contentKeyPrefix + abandonedPush.DiskSHA256
+			age(filepath.Join(imageDir, abandoned, "disk.gaf"))
+			if _, err := ts.srv.db.Exec("UPDATE image_aliases SET creation_timestamp = $1 WHERE disk_sha256 = $2", old, abandonedPush.DiskSHA256); err != nil {
+				t.Fatal(err)
+			}
+			recent := contentKeyPrefix + push("recent").DiskSHA256
+
+			if err := os.WriteFile(filepath.Join(imageDir, "tmp", "stale"), nil, 0600); err != nil {
+				t.Fatal(err)
+			}
+			age(filepath.Join(imageDir, "tmp", "stale"))
+			if err := os.WriteFile(filepath.Join(imageDir, "tmp", "fresh"), nil, 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			paths := func(report *gcReport) []string {
+				var paths []string
+				for _, item := range report.Removed {
+					paths = append(paths, item.Path)
+				}
+				sort.Strings(paths)
+				return paths
+			}
+			want := []string{dirs["img2"], abandoned, filepath.Join("tmp", "stale")}
+			sort.Strings(want)
+
+			var report gcReport
+			if err := ts.postJSON("/api/v1/gc", &gcRequest{DryRun: true}, &report); err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(want, paths(&report)); diff != "" {
+				t.Errorf("dry run: unexpected removals: diff (-want +got):\n%s", diff)
+			}
+			for _, path := range want {
+				if _, err := os.Stat(filepath.Join(imageDir, path)); err != nil {
+					t.Errorf("dry run removed %s: %v", path, err)
+				}
+			}
+
+			got, err := ts.srv.collectGarbage(ctx, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(want, paths(got)); diff != "" {
+				t.Errorf("unexpected removals: diff (-want +got):\n%s", diff)
+			}
+			for _, path := range want {
+				if _, err := os.Stat(filepath.Join(imageDir, path)); !os.IsNotExist(err) {
+					t.Errorf("%s unexpectedly not removed (err: %v)", path, err)
+				}
+			}
+			for _, path := range []string{dirs["img1"], dirs["img3"], dirs["img4"], recent, filepath.Join("tmp", "fresh")} {
+				if _, err := os.Stat(filepath.Join(imageDir, path)); err != nil {
+					t.Errorf("%s unexpectedly removed: %v", path, err)
+				}
+			}
+			if diff := ts.diffQuery(t, []map[string]any{
+				{"sbom_hash": "img1"},
+				{"sbom_hash": "img3"},
+				{"sbom_hash": "img4"},
+			}, "SELECT sbom_hash FROM images ORDER BY sbom_hash"); diff != "" {
+				t.Errorf("images table: unexpected diff (-want +got):\n%s", diff)
+			}
+
+			// A second run finds nothing to remove.
+			got, err = ts.srv.collectGarbage(ctx, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got.Removed) > 0 {
+				t.Errorf("second run unexpectedly removed %v", got.Removed)
+			}
+		})
+	}
+}
+
+func TestCollectGarbageKnownGood(t *testing.T) {
+	for _, tc := range testDatabases() {
+		t.Run(tc.databaseType, func(t *testing.T) {
+			ctx := context.Background()
+			ts := newTestServer(t, tc.databaseType)
+			ts.srv.cfg.gcKeep = 1
+
+			ingest := func(sbomHash string, ro *rolloutRequest) {
+				t.Helper()
+				pr := ts.push(t, zipWithContents(t, sbomHash))
+				if err := ts.postJSON("/api/v1/ingest", &ingestRequest{
+					MachineIDPattern: "router-*",
+					SBOMHash:         sbomHash,
+					RegistryType:     "localdisk",
+					DownloadLink:     pr.DownloadLink,
+					Rollout:          ro,
+				}, nil); err != nil {
+					t.Fatal(err)
+				}
+			}
+			heartbeat := func(sbomHash string) {
+				t.Helper()
+				if err := ts.postJSON("/api/v1/heartbeat", &heartbeatRequest{
+					MachineID: "router-1",
+					SBOMHash:  sbomHash,
+				}, nil); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			ingest("img1", nil)
+			heartbeat("img1")
+			ingest("img2", nil)
+			heartbeat("img2")
+			// router-1 updates to img3, which its rollout would roll back to
+			// img2 (the known-good image) if it halted.
+			ingest("img3", &rolloutRequest{CanaryPercent: 100, Rollback: true})
+			heartbeat("img3")
+
+			got, err := ts.srv.collectGarbage(ctx, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var removed []string
+			for _, item := range got.Removed {
+				removed = append(removed, item.SBOMHash)
+			}
+			if diff := cmp.Diff([]string{"img1"}, removed); diff != "" {
+				t.Errorf("unexpected removals: diff (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
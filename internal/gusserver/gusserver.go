@@ -2,6 +2,7 @@ package gusserver
 
 import (
 	"bytes"
+	"context"
 	"database/sql"
 	"flag"
 	"fmt"
@@ -12,6 +13,7 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/dustin/go-humanize"
@@ -32,12 +34,123 @@ import (
 type config struct {
 	imageDir       string
 	reverseProxied bool
+
+	// imageStore, if non-nil, stores pushed images instead of imageDir, see
+	// store.
+	imageStore imageStore
+
+	// presignExpiry, if non-zero, makes the update API hand out pre-signed
+	// URLs of pushed images, valid for the specified duration, if the image
+	// store supports them. Otherwise, devices download via GUS (see
+	// download).
+	presignExpiry time.Duration
+
+	// ociRegistry, if non-nil, is the OCI repository for images of
+	// registry_type oci.
+	ociRegistry *ociRegistry
+
+	// updateTimeout is the duration after which an attempted update is
+	// considered failed if the device still sends heartbeats with its old
+	// image. Zero disables failure detection.
+	updateTimeout time.Duration
+
+	// rolloutInterval is how often staged rollouts are advanced.
+	rolloutInterval time.Duration
+
+	// requireAPIToken enables authentication (see authorize) for the push,
+	// ingest and operator APIs.
+	requireAPIToken bool
+
+	// allowGAFWithoutSBOM allows ingesting pushed images whose GAF archive
+	// contains no SBOM (created by older versions of gok), whose sbom_hash
+	// GUS cannot verify.
+	allowGAFWithoutSBOM bool
+
+	// requireEnrollment enables device enrollment (see authenticateDevice)
+	// for the heartbeat, update and attempt APIs.
+	requireEnrollment bool
+
+	// Garbage collection of image_dir, see collectGarbage. gcInterval zero
+	// disables periodic garbage collection, gcKeep zero disables retention.
+	gcInterval    time.Duration
+	gcTmpAge      time.Duration
+	gcGracePeriod time.Duration
+	gcKeep        int
+	gcDryRun      bool
+
+	// maxImageSize limits the size of pushed images, minFreeSpace is the
+	// free space to keep when storing pushed images (see pushLimits). Zero
+	// disables the respective check.
+	maxImageSize int64
+	minFreeSpace int64
+
+	// deltaUpdates enables offering deltas between locally stored images to
+	// devices, see deltaFor.
+	deltaUpdates bool
+
+	// uploadExpiry is after how long without activity resumable upload
+	// sessions (see createUpload) are removed. Zero disables expiry.
+	uploadExpiry time.Duration
+
+	// Heartbeat history, see recordHistory and pruneHistory. historyGap is
+	// the longest silence between two heartbeats which is not considered a
+	// gap in connectivity (zero: never). Zero historyRetention keeps the
+	// history forever, zero downsampleAge disables downsampling.
+	historyGap       time.Duration
+	historyRetention time.Duration
+	downsampleAge    time.Duration
+	downsampleGap    time.Duration
+
+	// Offline detection, see checkOffline. Zero offlineAfter disables
+	// offline detection.
+	heartbeatInterval time.Duration
+	offlineAfter      int
+	notifyDebounce    time.Duration
+	notifiers         []notifier
+
+	// remoteCheckInterval is how often remote images are checked for
+	// reachability, see checkRemoteImages. Zero disables the checks.
+	remoteCheckInterval time.Duration
+
+	// httpClient is used for requests to remote registries. Defaults to a
+	// client with a 30 second timeout.
+	httpClient *http.Client
 }
 
 type server struct {
 	db      *sql.DB
 	queries *queries
 	cfg     *config
+
+	// desiredMu serializes updateDesired, rolloutMu serializes
+	// advanceRollouts.
+	desiredMu sync.Mutex
+	rolloutMu sync.Mutex
+
+	// gcMu serializes collectGarbage and guards lastGC.
+	gcMu   sync.Mutex
+	lastGC *gcReport
+
+	// contentMu is held for writing by collectGarbage and for reading while
+	// pushes and ingests reference stored content (by adding an alias or an
+	// image), so that garbage collection cannot remove content which it
+	// found unreferenced, but which was referenced concurrently (e.g. by a
+	// push deduplicated onto it).
+	contentMu sync.RWMutex
+
+	// uploadsMu guards uploadsBusy, the upload sessions which are currently
+	// being modified (see lockUpload).
+	uploadsMu   sync.Mutex
+	uploadsBusy map[string]bool
+
+	// deltasMu guards deltasPending, the deltas which are scheduled for
+	// computation (see scheduleDelta). deltaComputeMu serializes
+	// computeDelta.
+	deltasMu       sync.Mutex
+	deltasPending  map[string]bool
+	deltaComputeMu sync.Mutex
+
+	metrics *serverMetrics
 }
 
 var templates = template.Must(template.New("root").
@@ -61,63 +174,70 @@ var templates = template.Must(template.New("root").
 			}
 			return "http://" + ip
 		},
+		"printDuration": func(d time.Duration) string {
+			if d >= 48*time.Hour {
+				return fmt.Sprintf("%d days", d/(24*time.Hour))
+			}
+			if d >= time.Hour {
+				return d.Round(time.Minute).String()
+			}
+			return d.Round(time.Second).String()
+		},
 		"printIngestion": func(ingestion time.Time) string {
 			return ingestion.Format("2006-01-02 15:04:05")
 		},
 		"humanizeBytes": func(b uint64) string {
 			return humanize.Bytes(b)
 		},
+		"rolloutActions": func(state string) []string {
+			switch state {
+			case rolloutRunning:
+				return []string{"pause", "abort"}
+			case rolloutPaused:
+				return []string{"resume", "abort"}
+			case rolloutHalted:
+				return []string{"abort"}
+			}
+			return nil
+		},
 	}).
 	ParseFS(assets.Assets, "*.tmpl.html"))
 
 var versionBrief = version.ReadBrief()
 
 type image struct {
-	imageDir string
-
 	SBOMHash           string
 	IngestionTimestamp time.Time
 	MachineIDPattern   string
 	RegistryType       string
 	DownloadURL        string
+	DiskSize           sql.NullInt64
+	DiskSHA256         sql.NullString
+	// CheckError is set when a remote image was found to be broken, see
+	// checkRemoteImages.
+	CheckError sql.NullString
 }
 
+// Size returns the size of the disk image in bytes, as recorded at ingestion
+// time (for remote images: the Content-Length of the HEAD response), or 0 if
+// unknown.
 func (i *image) Size() uint64 {
-	dl := i.DownloadURL
-	if !strings.HasPrefix(dl, "/images/") {
-		// TODO: implement fetching the size of remote images using HTTP HEAD
+	if !i.DiskSize.Valid {
 		return 0
 	}
-	if i.imageDir == "" {
-		return 0
-	}
-	base := strings.TrimPrefix(dl, "/images/")
-	if idx := strings.IndexRune(base, '/'); idx > 0 {
-		base = base[:idx]
-	}
-	dirents, err := os.ReadDir(i.imageDir)
-	if err != nil {
-		log.Print(err)
-		return 0
-	}
-	for _, ent := range dirents {
-		if ent.Name() != base {
-			continue
-		}
-		st, err := os.Stat(filepath.Join(i.imageDir, ent.Name(), "disk.gaf"))
-		if err != nil {
-			log.Print(err)
-			return 0
-		}
-		return uint64(st.Size())
-	}
-	return 0 // not found
+	return uint64(i.DiskSize.Int64)
 }
 
 func (s *server) index(w http.ResponseWriter, r *http.Request) error {
 	if r.URL.Path != "/" && r.URL.Path != "" {
 		return httpError(http.StatusNotFound, fmt.Errorf("not found"))
 	}
+	windows, err := s.loadMaintenanceWindows(r.Context())
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+
 	rows, err := s.queries.selectMachinesForIndex.QueryContext(r.Context())
 	if err != nil {
 		return err
@@ -128,6 +248,10 @@ func (s *server) index(w http.ResponseWriter, r *http.Request) error {
 		DesiredImage    sql.NullString
 		UpdateState     sql.NullString
 		IngestionPolicy sql.NullString
+		PendingImage    sql.NullString
+		PinnedImage     sql.NullString
+		Enrollment      sql.NullString
+		Availability    sql.NullString
 
 		SBOMHash        string
 		DesiredSBOMHash string
@@ -135,6 +259,10 @@ func (s *server) index(w http.ResponseWriter, r *http.Request) error {
 		Model           string
 		RemoteIP        string
 		Hostname        string
+
+		// NextWindow describes the next maintenance window, if the machine
+		// has a pending update and a maintenance window applies.
+		NextWindow string
 	}
 	var machines []machine
 	for rows.Next() {
@@ -144,6 +272,10 @@ func (s *server) index(w http.ResponseWriter, r *http.Request) error {
 			&m.DesiredImage,
 			&m.UpdateState,
 			&m.IngestionPolicy,
+			&m.PendingImage,
+			&m.PinnedImage,
+			&m.Enrollment,
+			&m.Availability,
 			&m.SBOMHash,
 			&m.LastHeartbeat,
 			&m.Model,
@@ -152,6 +284,16 @@ func (s *server) index(w http.ResponseWriter, r *http.Request) error {
 		if err != nil {
 			return err
 		}
+		if m.DesiredImage.Valid && m.DesiredImage.String != m.SBOMHash {
+			w := windowFor(windows, machineAttrs{
+				MachineID: m.MachineID,
+				Hostname:  m.Hostname,
+				Model:     m.Model,
+			})
+			if w != nil {
+				m.NextWindow = w.Next(now)
+			}
+		}
 		machines = append(machines, m)
 	}
 	if err := rows.Err(); err != nil {
@@ -161,40 +303,37 @@ func (s *server) index(w http.ResponseWriter, r *http.Request) error {
 		return err
 	}
 
-	rows, err = s.queries.selectImagesForIndex.QueryContext(r.Context())
+	images, err := s.loadImages(r.Context())
 	if err != nil {
 		return err
 	}
-	defer rows.Close()
-	var images []image
-	for rows.Next() {
-		i := image{
-			imageDir: s.cfg.imageDir,
-		}
-		err := rows.Scan(
-			&i.SBOMHash,
-			&i.IngestionTimestamp,
-			&i.MachineIDPattern,
-			&i.RegistryType,
-			&i.DownloadURL)
-		if err != nil {
-			return err
-		}
-		images = append(images, i)
-	}
-	if err := rows.Err(); err != nil {
+
+	rollouts, err := s.loadRollouts(r.Context())
+	if err != nil {
 		return err
 	}
 
 	var buf bytes.Buffer
 	if err := templates.ExecuteTemplate(&buf, "index.tmpl.html", struct {
-		Version  string
-		Machines []machine
-		Images   []image
+		Version           string
+		Machines          []machine
+		Images            []image
+		Rollouts          []*rollout
+		Windows           []*maintenanceWindow
+		GCEnabled         bool
+		GC                *gcReport
+		Now               time.Time
+		IngestionPolicies []string
 	}{
-		Version:  versionBrief,
-		Machines: machines,
-		Images:   images,
+		Version:           versionBrief,
+		Machines:          machines,
+		Images:            images,
+		Rollouts:          rollouts.rollouts,
+		Windows:           windows,
+		GCEnabled:         s.store() != nil,
+		GC:                s.lastGCReport(),
+		Now:               now,
+		IngestionPolicies: []string{policyAutoUpdate, policyManual, policyPinned},
 	}); err != nil {
 		return err
 	}
@@ -211,6 +350,11 @@ func newServer(databaseType, databaseSource string, cfg *config) (*server, *http
 	if err != nil {
 		return nil, nil, err
 	}
+	if databaseType == "sqlite" {
+		// Each connection to an in-memory SQLite database opens a separate
+		// database, and SQLite only supports one writer at a time anyway.
+		db.SetMaxOpenConns(1)
+	}
 
 	queries, err := initDatabase(db, databaseType)
 	if err != nil {
@@ -225,23 +369,38 @@ func newServer(databaseType, databaseSource string, cfg *config) (*server, *http
 		db:      db,
 		queries: queries,
 		cfg:     cfg,
+		metrics: newServerMetrics(),
 	}
 	mux := http.NewServeMux()
 	mux.Handle("/assets/", http.StripPrefix("/assets/", http.FileServer(http.FS(assets.Assets))))
-	mux.Handle("/", handleError(s.index))
-	mux.Handle("/api/v1/heartbeat", handleError(s.heartbeat))
-	mux.Handle("/api/v1/push", handleError(s.push))
-	mux.Handle("/api/v1/ingest", handleError(s.ingest))
-	mux.Handle("/api/v1/update", handleError(s.update))
-	mux.Handle("/api/v1/attempt", handleError(s.attempt))
-	if s.cfg.imageDir != "" {
-		// TODO: start periodic s.imageDir+"/tmp" cleanup
-
-		// TODO: add a handler that explicitly only allows access to disk.gaf
-		// and sets Content-Type: application/zip without sniffing. verify that
-		// resume still works.
-		mux.Handle("/images/", http.StripPrefix("/images/", http.FileServer(http.Dir(s.cfg.imageDir))))
-	}
+	s.handle(mux, "/", s.index)
+	s.handle(mux, "/api/v1/heartbeat", s.heartbeat)
+	s.handle(mux, "/metrics", s.metricsHandler)
+	s.handle(mux, machinePathPrefix, s.machine)
+	s.handle(mux, "/api/v1/push", s.push)
+	s.handle(mux, "/api/v1/upload", s.createUpload)
+	s.handle(mux, uploadPathPrefix, s.upload)
+	s.handle(mux, "/api/v1/ingest", s.ingest)
+	s.handle(mux, "/api/v1/update", s.update)
+	s.handle(mux, "/api/v1/attempt", s.attempt)
+	s.handle(mux, "/api/v1/policy", s.policy)
+	s.handle(mux, "/api/v1/approve", s.approve)
+	s.handle(mux, "/api/v1/sbomdiff", s.sbomDiffHandler)
+	s.handle(mux, "/api/v1/modules", s.modules)
+	s.handle(mux, "/modules", s.modulesPage)
+	s.handle(mux, "/ui/policy", s.policyForm)
+	s.handle(mux, "/ui/approve", s.approveForm)
+	s.handle(mux, "/api/v1/rollout", s.rollout)
+	s.handle(mux, "/ui/rollout", s.rolloutForm)
+	s.handle(mux, "/api/v1/window", s.window)
+	s.handle(mux, "/ui/window", s.windowForm)
+	s.handle(mux, "/api/v1/enroll", s.enroll)
+	s.handle(mux, "/ui/enroll", s.enrollForm)
+	s.handle(mux, "/api/v1/gc", s.gc)
+	s.handle(mux, "/ui/gc", s.gcForm)
+	s.handle(mux, "/images/", s.download)
+	s.handle(mux, ociDownloadLinkPrefix, s.downloadOCI)
+	s.handle(mux, deltaLinkPrefix, s.downloadDelta)
 	return s, mux, nil
 }
 
@@ -249,27 +408,215 @@ func (s *server) Close() error {
 	return s.db.Close()
 }
 
+// runPeriodically calls f every interval until ctx is canceled. Errors are
+// logged (and counted, see serverMetrics), but do not stop further calls.
+func (s *server) runPeriodically(ctx context.Context, name string, interval time.Duration, f func(context.Context) error) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := f(ctx); err != nil {
+				s.metrics.countError(err)
+				log.Printf("%s: %v", name, err)
+			}
+		}
+	}
+}
+
 func Main() error {
 	var (
-		listen         = flag.String("listen", "localhost:8655", "[host]:port listen address")
-		databaseType   = flag.String("database_type", "sqlite", "can be one of: sqlite, postgres")
-		databaseSource = flag.String("database_source", ":memory:", "database source for GUS internal state. can be :memory: (default. stores state in memory), directory path (sqlite) or an connection DSN (postgres. reference: https://pkg.go.dev/github.com/lib/pq#hdr-Connection_String_Parameters)")
-		imageDir       = flag.String("image_dir", "", "if non-empty, a directory on disk in which to storage gokrazy disk images (consuming dozens to hundreds of megabytes each)")
-		reverseProxied = flag.Bool("reverse_proxied", false, "use X-Forwarded-For header instead of remote address")
+		listen              = flag.String("listen", "localhost:8655", "[host]:port listen address")
+		databaseType        = flag.String("database_type", "sqlite", "can be one of: sqlite, postgres")
+		databaseSource      = flag.String("database_source", ":memory:", "database source for GUS internal state. can be :memory: (default. stores state in memory), directory path (sqlite) or an connection DSN (postgres. reference: https://pkg.go.dev/github.com/lib/pq#hdr-Connection_String_Parameters)")
+		imageDir            = flag.String("image_dir", "", "if non-empty, a directory on disk in which to storage gokrazy disk images (consuming dozens to hundreds of megabytes each)")
+		s3BucketURL         = flag.String("s3_bucket_url", "", "if non-empty, the URL of an S3-compatible bucket in which to store gokrazy disk images instead of --image_dir, e.g. https://minio.example.net/gus-images. credentials are read from the AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY environment variables")
+		s3Region            = flag.String("s3_region", "us-east-1", "region of the --s3_bucket_url bucket")
+		ociRepository       = flag.String("oci_repository", "", "if non-empty, the URL of an OCI registry repository to which images can be pushed as OCI artifacts (registry_type oci), e.g. https://registry.example.net/gokrazy/images. credentials are read from the OCI_USERNAME and OCI_PASSWORD environment variables")
+		presignExpiry       = flag.Duration("presign_expiry", 0, "if non-zero, devices are handed pre-signed URLs (valid for this duration) to download images from --s3_bucket_url directly, instead of downloading via GUS")
+		reverseProxied      = flag.Bool("reverse_proxied", false, "use X-Forwarded-For header instead of remote address")
+		updateTimeout       = flag.Duration("update_timeout", 30*time.Minute, "after how long an attempted update is considered failed when the device still sends heartbeats with its old image (0 disables failure detection)")
+		rolloutInterval     = flag.Duration("rollout_interval", 1*time.Minute, "how often to check whether staged rollouts can admit their next wave")
+		allowGAFWithoutSBOM = flag.Bool("allow_gaf_without_sbom", false, "allow ingesting pushed images (registry_type localdisk and oci) whose GAF archive contains no sbom.json (created by gok versions before SBOMs were added). GUS cannot verify the sbom_hash of such images")
+		requireEnrollment   = flag.Bool("require_enrollment", false, "require devices to enroll and be approved on the index page before they receive updates. enrolled devices must send their device secret with every request")
+		gcInterval          = flag.Duration("gc_interval", 1*time.Hour, "how often to garbage collect --image_dir or --s3_bucket_url (0 disables periodic garbage collection)")
+		gcTmpAge            = flag.Duration("gc_tmp_age", 1*time.Hour, "after how long temporary files of incomplete pushes are removed")
+		gcGracePeriod       = flag.Duration("gc_grace_period", 24*time.Hour, "after how long pushed images which were never ingested are removed")
+		gcKeep              = flag.Int("gc_keep", 5, "how many images to keep per machine ID pattern (images which machines run, desire or are pinned to are always kept). 0 keeps all images")
+		gcDryRun            = flag.Bool("gc_dry_run", false, "only log what periodic garbage collection would remove")
+		maxImageSizeMiB     = flag.Int64("max_image_size_mib", 4096, "maximum size (in MiB) of pushed images (0 disables the limit)")
+		minFreeSpaceMiB     = flag.Int64("min_free_space_mib", 1024, "free space (in MiB) to keep on the file system of --image_dir (or of the temporary directory in which pushes to --s3_bucket_url and --oci_repository are buffered): pushes which would use it are rejected (0 disables the check)")
+		deltaUpdates        = flag.Bool("delta_updates", true, "compute deltas between the image a device runs and its desired image (when both were pushed to this server) and offer them in /api/v1/update, so that devices can download only the differences")
+		uploadExpiry        = flag.Duration("upload_expiry", 24*time.Hour, "after how long without activity resumable uploads (see /api/v1/upload) are abandoned and removed (0 disables expiry)")
+		historyGap          = flag.Duration("history_gap", 10*time.Minute, "heartbeats which arrive further apart than this are shown as a gap in connectivity in the heartbeat history of a machine")
+		historyRetention    = flag.Duration("history_retention", 90*24*time.Hour, "after how long heartbeat history entries are removed (0 keeps the history forever)")
+		downsampleAge       = flag.Duration("history_downsample_age", 7*24*time.Hour, "after how long heartbeat history entries are downsampled, i.e. gaps shorter than --history_downsample_gap are no longer recorded (0 disables downsampling)")
+		downsampleGap       = flag.Duration("history_downsample_gap", 1*time.Hour, "see --history_downsample_age")
+		heartbeatInterval   = flag.Duration("heartbeat_interval", 1*time.Minute, "the interval in which devices send heartbeats, see --offline_after")
+		offlineAfter        = flag.Int("offline_after", 5, "after how many missed heartbeat intervals a machine is considered offline (0 disables offline detection)")
+		notifyDebounce      = flag.Duration("notify_debounce", 5*time.Minute, "how long a machine must stay offline (or online again) before a notification is sent, so that flapping machines do not flood the notification sinks")
+		notifyWebhook       = flag.String("notify_webhook", "", "if non-empty, a URL to which notifications about machines going offline and recovering are POSTed as JSON")
+		notifySMTP          = flag.String("notify_smtp", "", "if non-empty, the host:port of an SMTP relay (e.g. localhost:25) via which notifications are sent to --notify_smtp_to. the relay must accept mail without authentication")
+		notifySMTPFrom      = flag.String("notify_smtp_from", "gus@localhost", "sender address of notification emails")
+		notifySMTPTo        = flag.String("notify_smtp_to", "", "comma-separated recipient addresses of notification emails")
+		notifyExec          = flag.String("notify_exec", "", "if non-empty, a program which is run for each notification, with the notification as JSON on stdin and in GUS_STATUS, GUS_MACHINE_ID, GUS_HOSTNAME, GUS_LAST_HEARTBEAT and GUS_SUMMARY environment variables")
+		remoteCheckInterval = flag.Duration("remote_check_interval", 15*time.Minute, "how often to check whether images on remote registries (registry_type http) are still reachable (0 disables the checks)")
+		requireAPIToken     = flag.Bool("require_api_token", true, "require an API token (see the token subcommand) for pushing and ingesting images and for changing policies, rollouts and maintenance windows. the server refuses to start if no API token exists. defaults to false with --database_source=:memory:, which cannot hold tokens")
 	)
 	flag.Parse()
 
+	if *databaseSource == ":memory:" {
+		// Tokens (and signing keys) created with the token (key) command
+		// would be stored in a throwaway database, so no token could ever be
+		// valid for the server.
+		if flag.NArg() > 0 {
+			return fmt.Errorf("the %s command requires a persistent --database_source", flag.Arg(0))
+		}
+		explicit := false
+		flag.Visit(func(f *flag.Flag) {
+			if f.Name == "require_api_token" {
+				explicit = true
+			}
+		})
+		if *requireAPIToken {
+			if explicit {
+				return fmt.Errorf("--require_api_token requires a persistent --database_source (API tokens cannot be created for an in-memory database)")
+			}
+			log.Printf("not requiring API tokens: --database_source=:memory: cannot hold any")
+			*requireAPIToken = false
+		}
+	}
+
 	if *databaseType == "sqlite" && *databaseSource != ":memory:" {
 		*databaseSource = filepath.Join(*databaseSource, "gus.db"+"?mode=rwc")
 	}
 
-	_, mux, err := newServer(*databaseType, *databaseSource, &config{
-		imageDir:       *imageDir,
-		reverseProxied: *reverseProxied,
+	var store imageStore
+	if *s3BucketURL != "" {
+		if *imageDir != "" {
+			return fmt.Errorf("--image_dir and --s3_bucket_url are mutually exclusive")
+		}
+		s3, err := newS3Store(*s3BucketURL, *s3Region, os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY"))
+		if err != nil {
+			return err
+		}
+		store = s3
+	}
+
+	var reg *ociRegistry
+	if *ociRepository != "" {
+		var err error
+		reg, err = newOCIRegistry(*ociRepository, os.Getenv("OCI_USERNAME"), os.Getenv("OCI_PASSWORD"))
+		if err != nil {
+			return err
+		}
+	}
+
+	var notifiers []notifier
+	if *notifyWebhook != "" {
+		notifiers = append(notifiers, &webhookNotifier{
+			url:    *notifyWebhook,
+			client: &http.Client{Timeout: 30 * time.Second},
+		})
+	}
+	if *notifySMTP != "" {
+		if *notifySMTPTo == "" {
+			return fmt.Errorf("--notify_smtp requires --notify_smtp_to")
+		}
+		sn, err := newSMTPNotifier(*notifySMTP, *notifySMTPFrom, strings.Split(*notifySMTPTo, ","))
+		if err != nil {
+			return fmt.Errorf("invalid --notify_smtp_from or --notify_smtp_to: %v", err)
+		}
+		notifiers = append(notifiers, sn)
+	}
+	if *notifyExec != "" {
+		notifiers = append(notifiers, &execNotifier{command: *notifyExec})
+	}
+
+	srv, mux, err := newServer(*databaseType, *databaseSource, &config{
+		imageDir:            *imageDir,
+		imageStore:          store,
+		presignExpiry:       *presignExpiry,
+		ociRegistry:         reg,
+		reverseProxied:      *reverseProxied,
+		updateTimeout:       *updateTimeout,
+		rolloutInterval:     *rolloutInterval,
+		requireAPIToken:     *requireAPIToken,
+		allowGAFWithoutSBOM: *allowGAFWithoutSBOM,
+		requireEnrollment:   *requireEnrollment,
+		gcInterval:          *gcInterval,
+		gcTmpAge:            *gcTmpAge,
+		gcGracePeriod:       *gcGracePeriod,
+		gcKeep:              *gcKeep,
+		gcDryRun:            *gcDryRun,
+		maxImageSize:        *maxImageSizeMiB << 20,
+		minFreeSpace:        *minFreeSpaceMiB << 20,
+		deltaUpdates:        *deltaUpdates,
+		uploadExpiry:        *uploadExpiry,
+		historyGap:          *historyGap,
+		historyRetention:    *historyRetention,
+		downsampleAge:       *downsampleAge,
+		downsampleGap:       *downsampleGap,
+		heartbeatInterval:   *heartbeatInterval,
+		offlineAfter:        *offlineAfter,
+		notifyDebounce:      *notifyDebounce,
+		notifiers:           notifiers,
+		remoteCheckInterval: *remoteCheckInterval,
 	})
 	if err != nil {
 		return err
 	}
+	ctx := context.Background()
+	if flag.NArg() > 0 {
+		switch flag.Arg(0) {
+		case "token":
+			return srv.tokenCommand(ctx, flag.Args()[1:])
+		case "key":
+			return srv.keyCommand(ctx, flag.Args()[1:])
+		default:
+			return fmt.Errorf("unknown command %q (expected token or key)", flag.Arg(0))
+		}
+	}
+	if err := srv.checkTokensExist(ctx, os.Args); err != nil {
+		return err
+	}
+	if n, err := srv.migrateImageStore(ctx); err != nil {
+		return fmt.Errorf("migrating image store to content-addressed layout: %v", err)
+	} else if n > 0 {
+		log.Printf("migrated %d images to the content-addressed layout", n)
+	}
+	if err := srv.indexModules(ctx); err != nil {
+		return fmt.Errorf("indexing SBOMs: %v", err)
+	}
+	// Databases of older versions of GUS lack the maintenance window of each
+	// machine, see maintenanceWindowOpen.
+	if err := srv.updateDesired(); err != nil {
+		return fmt.Errorf("updating desired images: %v", err)
+	}
+	go srv.runPeriodically(ctx, "advancing rollouts", srv.cfg.rolloutInterval, srv.advanceRollouts)
+	// Ingested images are indexed right away, SBOMs which machines report in
+	// their heartbeats periodically.
+	go srv.runPeriodically(ctx, "indexing SBOMs", 1*time.Minute, srv.indexModules)
+	if srv.cfg.remoteCheckInterval > 0 {
+		go srv.runPeriodically(ctx, "checking remote images", srv.cfg.remoteCheckInterval, srv.checkRemoteImages)
+	}
+	if srv.offlineThreshold() > 0 {
+		go srv.runPeriodically(ctx, "checking for offline machines", srv.cfg.heartbeatInterval, srv.checkOffline)
+	}
+	if srv.cfg.historyRetention > 0 || srv.cfg.downsampleAge > 0 {
+		go srv.runPeriodically(ctx, "pruning heartbeat history", 1*time.Hour, srv.pruneHistory)
+	}
+	if srv.store() != nil && srv.cfg.gcInterval > 0 {
+		go srv.runPeriodically(ctx, "collecting garbage", srv.cfg.gcInterval, func(ctx context.Context) error {
+			_, err := srv.collectGarbage(ctx, srv.cfg.gcDryRun)
+			return err
+		})
+	}
+	if srv.store() != nil && srv.cfg.uploadExpiry > 0 {
+		go srv.runPeriodically(ctx, "expiring uploads", srv.cfg.uploadExpiry/4, srv.expireUploads)
+	}
 	log.Printf("GUS server listening on %s", *listen)
 	return http.ListenAndServe(*listen, mux)
 }
@@ -0,0 +1,65 @@
+package gusserver
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/antihax/optional"
+	"github.com/gokrazy/gokapi/gusapi"
+)
+
+func TestIndex(t *testing.T) {
+	testDBs := testDatabases()
+
+	for _, tc := range testDBs {
+		t.Run(tc.databaseType, func(t *testing.T) {
+			ctx := context.Background()
+			ts := newTestServer(t, tc.databaseType)
+			downloadLink := ts.pushImage(t)
+			api := ts.API()
+
+			const machineID = "scan2drive"
+
+			_, _, err := api.HeartbeatApi.Heartbeat(ctx, &gusapi.HeartbeatApiHeartbeatOpts{
+				Body: optional.NewInterface(&gusapi.HeartbeatRequest{
+					MachineId: machineID,
+					Hostname:  machineID,
+				}),
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, _, err = api.IngestApi.Ingest(ctx, &gusapi.IngestApiIngestOpts{
+				Body: optional.NewInterface(&gusapi.IngestRequest{
+					MachineIdPattern: machineID,
+					SbomHash:         "abcdefg",
+					RegistryType:     "localdisk",
+					DownloadLink:     downloadLink,
+				}),
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			resp, err := ts.Client().Get(ts.URL() + "/")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			body, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := resp.StatusCode, http.StatusOK; got != want {
+				t.Fatalf("unexpected HTTP status code: got %v, want %v (body: %s)", resp.Status, want, body)
+			}
+			if !strings.Contains(string(body), machineID) {
+				t.Errorf("index page does not mention machine %q", machineID)
+			}
+		})
+	}
+}
@@ -1,6 +1,8 @@
 package gusserver
 
 import (
+	"context"
+	"database/sql"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -21,7 +23,15 @@ type heartbeatRequest struct {
 	} `json:"human_readable"`
 }
 
+type heartbeatResponse struct {
+	// DeviceSecret is set in the response to the first heartbeat of a machine
+	// when enrollment is required, see authenticateDevice.
+	DeviceSecret string `json:"device_secret,omitempty"`
+}
+
 func (s *server) heartbeat(w http.ResponseWriter, r *http.Request) error {
+	start := time.Now()
+	defer func() { s.metrics.heartbeatDuration.observe(time.Since(start)) }()
 	if r.Method != "POST" {
 		return httpError(http.StatusBadRequest, fmt.Errorf("invalid method (expected POST)"))
 	}
@@ -34,6 +44,11 @@ func (s *server) heartbeat(w http.ResponseWriter, r *http.Request) error {
 		return err
 	}
 
+	_, secret, err := s.authenticateDevice(r, req.MachineID, true)
+	if err != nil {
+		return err
+	}
+
 	sbom, err := req.SBOM.MarshalJSON()
 	if err != nil {
 		return err
@@ -78,12 +93,79 @@ func (s *server) heartbeat(w http.ResponseWriter, r *http.Request) error {
 		return err
 	}
 
+	if err := s.recordHistory(r.Context(), req.MachineID, historyState{
+		SBOMHash: req.SBOMHash,
+		Kernel:   req.HumanReadable.Kernel,
+		RemoteIP: addr,
+		Hostname: req.Hostname,
+	}, now); err != nil {
+		return err
+	}
+
+	if req.SBOMHash != "" {
+		// Keep track of the images each machine ran, so that rollouts can
+		// roll back to the previous known-good image.
+		if _, err := s.queries.upsertImageHistory.ExecContext(r.Context(), req.MachineID, req.SBOMHash, now); err != nil {
+			return err
+		}
+	}
+
 	// TODO(optimization): only update the desired image for machine req.MachineID
 	if err := s.updateDesired(); err != nil {
 		return err
 	}
 
+	if err := s.updateStateFromHeartbeat(r.Context(), req.MachineID, req.SBOMHash, now); err != nil {
+		return err
+	}
+
+	b, err = json.Marshal(&heartbeatResponse{DeviceSecret: secret})
+	if err != nil {
+		return err
+	}
 	w.Header().Set("Content-Type", "application/json")
-	fmt.Fprintf(w, "{}")
+	w.Write(b)
 	return nil
 }
+
+// updateStateFromHeartbeat transitions the update state of the machine to
+// succeeded once it runs its desired image, or to failed if it still runs a
+// different image after the update timeout.
+func (s *server) updateStateFromHeartbeat(ctx context.Context, machineID, sbomHash string, now time.Time) error {
+	var (
+		desiredImage   sql.NullString
+		updateState    sql.NullString
+		stateTimestamp sql.NullTime
+	)
+	err := s.queries.selectUpdateState.QueryRowContext(ctx, machineID).Scan(
+		&desiredImage,
+		&updateState,
+		&stateTimestamp)
+	if err != nil {
+		return err
+	}
+	if !desiredImage.Valid {
+		return nil // no desired image, nothing to update to
+	}
+
+	var newState string
+	switch {
+	case sbomHash == desiredImage.String:
+		if updateState.String != updateStateSucceeded {
+			newState = updateStateSucceeded
+		}
+
+	case updateState.String == updateStateAttempted:
+		if s.cfg.updateTimeout > 0 &&
+			stateTimestamp.Valid &&
+			now.Sub(stateTimestamp.Time) > s.cfg.updateTimeout {
+			newState = updateStateFailed
+		}
+	}
+	if newState == "" {
+		return nil
+	}
+	log.Printf("machine %q: update to %q %s", machineID, desiredImage.String, newState)
+	_, err = s.queries.updateUpdateState.ExecContext(ctx, newState, now, machineID)
+	return err
+}
@@ -0,0 +1,406 @@
+package gusserver
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The heartbeats table only contains the most recent heartbeat of each
+// machine. In addition, heartbeats are recorded in the append-only
+// heartbeat_history table, run-length encoded: each row covers a period in
+// which a machine sent heartbeats with the same image, kernel, address and
+// hostname, with no more than config.historyGap between two heartbeats. A
+// longer silence (a gap in connectivity) or a change ends the period.
+//
+// The current period of each machine is kept in the current_history table,
+// which heartbeats extend like they overwrite the heartbeats table. When the
+// period ends, it is inserted into heartbeat_history, whose rows are never
+// modified.
+//
+// pruneHistory downsamples rows older than config.downsampleAge by replacing
+// rows which only differ by gaps shorter than config.downsampleGap with one
+// aggregate row, and removes rows older than config.historyRetention.
+
+const machinePathPrefix = "/machines/"
+
+// historyState is what a heartbeat_history row records about a machine.
+type historyState struct {
+	SBOMHash string
+	Kernel   string
+	RemoteIP string
+	Hostname string
+}
+
+type historyEntry struct {
+	historyState
+	FirstHeartbeat time.Time
+	LastHeartbeat  time.Time
+	Heartbeats     int64
+}
+
+// Kinds of timeline events:
+const (
+	eventFirstHeartbeat = "first heartbeat"
+	eventImage          = "image changed"
+	eventKernel         = "kernel changed"
+	eventAddress        = "address changed"
+	eventHostname       = "hostname changed"
+	eventGap            = "no heartbeats"
+)
+
+type timelineEvent struct {
+	Timestamp time.Time
+	Kind      string
+	Old, New  string
+
+	// Duration is set for eventGap. Ongoing is set if the machine has not
+	// sent a heartbeat since.
+	Duration time.Duration
+	Ongoing  bool
+}
+
+// recordHistory records a heartbeat of machineID in the heartbeat history.
+func (s *server) recordHistory(ctx context.Context, machineID string, st historyState, now time.Time) error {
+	// The SQLite driver stores timestamps formatted by time.Time.String,
+	// which includes the monotonic clock reading. Strip it, so that
+	// pruneHistory can identify entries by the timestamps it reads back.
+	now = now.Round(0)
+	var current historyEntry
+	err := s.queries.selectCurrentHistory.QueryRowContext(ctx, machineID).Scan(
+		&current.FirstHeartbeat,
+		&current.LastHeartbeat,
+		&current.Heartbeats,
+		&current.SBOMHash,
+		&current.Kernel,
+		&current.RemoteIP,
+		&current.Hostname)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	if err == nil &&
+		current.historyState == st &&
+		(s.cfg.historyGap == 0 || now.Sub(current.LastHeartbeat) <= s.cfg.historyGap) {
+		_, err := s.queries.extendCurrentHistory.ExecContext(ctx, machineID, now)
+		return err
+	}
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if current.Heartbeats > 0 {
+		if err := s.insertHistory(ctx, tx, machineID, current); err != nil {
+			return err
+		}
+	}
+	_, err = tx.StmtContext(ctx, s.queries.upsertCurrentHistory).ExecContext(ctx,
+		machineID,
+		now,
+		st.SBOMHash,
+		st.Kernel,
+		st.RemoteIP,
+		st.Hostname)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// insertHistory inserts the (ended) period e into heartbeat_history.
+func (s *server) insertHistory(ctx context.Context, tx *sql.Tx, machineID string, e historyEntry) error {
+	_, err := tx.StmtContext(ctx, s.queries.insertHistory).ExecContext(ctx,
+		machineID,
+		e.FirstHeartbeat,
+		e.LastHeartbeat,
+		e.Heartbeats,
+		e.SBOMHash,
+		e.Kernel,
+		e.RemoteIP,
+		e.Hostname)
+	return err
+}
+
+func scanHistory(rows *sql.Rows) ([]historyEntry, error) {
+	defer rows.Close()
+	var entries []historyEntry
+	for rows.Next() {
+		var e historyEntry
+		err := rows.Scan(
+			&e.FirstHeartbeat,
+			&e.LastHeartbeat,
+			&e.Heartbeats,
+			&e.SBOMHash,
+			&e.Kernel,
+			&e.RemoteIP,
+			&e.Hostname)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return entries, rows.Close()
+}
+
+// loadHistory returns the heartbeat history of machineID, oldest first.
+func (s *server) loadHistory(ctx context.Context, machineID string) ([]historyEntry, error) {
+	rows, err := s.queries.selectHistory.QueryContext(ctx, machineID)
+	if err != nil {
+		return nil, err
+	}
+	return scanHistory(rows)
+}
+
+// timeline returns the events in the heartbeat history (as returned by
+// loadHistory), newest first. Silences longer than gap are reported as
+// eventGap (zero disables gap detection).
+func timeline(entries []historyEntry, gap time.Duration, now time.Time) []timelineEvent {
+	var events []timelineEvent
+	for i, e := range entries {
+		if i == 0 {
+			events = append(events, timelineEvent{
+				Timestamp: e.FirstHeartbeat,
+				Kind:      eventFirstHeartbeat,
+				New:       e.SBOMHash,
+			})
+			continue
+		}
+		prev := entries[i-1]
+		if silence := e.FirstHeartbeat.Sub(prev.LastHeartbeat); gap > 0 && silence > gap {
+			events = append(events, timelineEvent{
+				Timestamp: prev.LastHeartbeat,
+				Kind:      eventGap,
+				Duration:  silence,
+			})
+		}
+		for _, change := range []struct {
+			kind     string
+			old, new string
+		}{
+			{eventImage, prev.SBOMHash, e.SBOMHash},
+			{eventKernel, prev.Kernel, e.Kernel},
+			{eventAddress, prev.RemoteIP, e.RemoteIP},
+			{eventHostname, prev.Hostname, e.Hostname},
+		} {
+			if change.old == change.new {
+				continue
+			}
+			events = append(events, timelineEvent{
+				Timestamp: e.FirstHeartbeat,
+				Kind:      change.kind,
+				Old:       change.old,
+				New:       change.new,
+			})
+		}
+	}
+	if len(entries) > 0 {
+		last := entries[len(entries)-1]
+		if silence := now.Sub(last.LastHeartbeat); gap > 0 && silence > gap {
+			events = append(events, timelineEvent{
+				Timestamp: last.LastHeartbeat,
+				Kind:      eventGap,
+				Duration:  silence,
+				Ongoing:   true,
+			})
+		}
+	}
+	sortTimeline(events)
+	return events
+}
+
+// sortTimeline sorts events newest first, keeping the order of simultaneous
+// events.
+func sortTimeline(events []timelineEvent) {
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].Timestamp.After(events[j].Timestamp)
+	})
+}
+
+// pruneHistory downsamples and expires the heartbeat history.
+func (s *server) pruneHistory(ctx context.Context) error {
+	now := time.Now()
+	if s.cfg.historyRetention > 0 {
+		res, err := s.queries.deleteHistory.ExecContext(ctx, now.Add(-s.cfg.historyRetention))
+		if err != nil {
+			return err
+		}
+		if n, err := res.RowsAffected(); err == nil && n > 0 {
+			log.Printf("removed %d heartbeat history entries older than %v", n, s.cfg.historyRetention)
+		}
+		if _, err := s.queries.deleteCurrentHistory.ExecContext(ctx, now.Add(-s.cfg.historyRetention)); err != nil {
+			return err
+		}
+		if _, err := s.queries.deleteTransitions.ExecContext(ctx, now.Add(-s.cfg.historyRetention)); err != nil {
+			return err
+		}
+	}
+	if s.cfg.downsampleAge <= 0 || s.cfg.downsampleGap <= 0 {
+		return nil
+	}
+	rows, err := s.queries.selectHistoryBefore.QueryContext(ctx, now.Add(-s.cfg.downsampleAge))
+	if err != nil {
+		return err
+	}
+	// selectHistoryBefore returns machine_id as the first column, which
+	// scanHistory does not expect, so scan here.
+	type row struct {
+		machineID string
+		historyEntry
+	}
+	var old []row
+	for rows.Next() {
+		var r row
+		err := rows.Scan(
+			&r.machineID,
+			&r.FirstHeartbeat,
+			&r.LastHeartbeat,
+			&r.Heartbeats,
+			&r.SBOMHash,
+			&r.Kernel,
+			&r.RemoteIP,
+			&r.Hostname)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		old = append(old, r)
+	}
+	if err := rows.Err(); err != nil {
+		rows.Close()
+		return err
+	}
+	if err := rows.Close(); err != nil {
+		return err
+	}
+
+	merged := 0
+	for i := 0; i < len(old); i++ {
+		// Replace old[i] and all following rows of the same machine and
+		// state with one aggregate row, as long as they are close enough.
+		first := old[i]
+		agg := first.historyEntry
+		replaced := []time.Time{first.FirstHeartbeat}
+		j := i + 1
+		for ; j < len(old); j++ {
+			next := old[j]
+			if next.machineID != first.machineID ||
+				next.historyState != first.historyState ||
+				next.FirstHeartbeat.Sub(agg.LastHeartbeat) > s.cfg.downsampleGap {
+				break
+			}
+			agg.LastHeartbeat = next.LastHeartbeat
+			agg.Heartbeats += next.Heartbeats
+			replaced = append(replaced, next.FirstHeartbeat)
+		}
+		if j > i+1 {
+			if err := s.replaceHistory(ctx, first.machineID, replaced, agg); err != nil {
+				return err
+			}
+			merged += j - i - 1
+		}
+		i = j - 1
+	}
+	if merged > 0 {
+		log.Printf("downsampled heartbeat history: merged %d entries", merged)
+	}
+	return nil
+}
+
+// machine serves the machine detail page with the heartbeat history of the
+// machine.
+func (s *server) machine(w http.ResponseWriter, r *http.Request) error {
+	machineID := strings.TrimPrefix(r.URL.Path, machinePathPrefix)
+	var (
+		sbomHash string
+		hostname sql.NullString
+		model    sql.NullString
+	)
+	err := s.queries.selectHeartbeat.QueryRowContext(r.Context(), machineID).Scan(
+		&sbomHash,
+		&hostname,
+		&model)
+	if err == sql.ErrNoRows {
+		return httpError(http.StatusNotFound, fmt.Errorf("machine %q not found", machineID))
+	}
+	if err != nil {
+		return err
+	}
+	history, err := s.loadHistory(r.Context(), machineID)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	events := timeline(history, s.cfg.historyGap, now)
+	availability, err := s.availabilityEvents(r.Context(), machineID)
+	if err != nil {
+		return err
+	}
+	events = append(events, availability...)
+	sortTimeline(events)
+	diff, err := s.machineSBOMDiff(r.Context(), machineID)
+	if err != nil {
+		return err
+	}
+	// Display the history newest first, like the timeline.
+	for i, j := 0, len(history)-1; i < j; i, j = i+1, j-1 {
+		history[i], history[j] = history[j], history[i]
+	}
+
+	var buf bytes.Buffer
+	if err := templates.ExecuteTemplate(&buf, "machine.tmpl.html", struct {
+		Version   string
+		MachineID string
+		Hostname  string
+		Model     string
+		SBOMHash  string
+		Timeline  []timelineEvent
+		History   []historyEntry
+		Retention time.Duration
+		Diff      *sbomDiff
+	}{
+		Version:   versionBrief,
+		MachineID: machineID,
+		Hostname:  hostname.String,
+		Model:     model.String,
+		SBOMHash:  sbomHash,
+		Timeline:  events,
+		History:   history,
+		Retention: s.cfg.historyRetention,
+		Diff:      diff,
+	}); err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	_, err = io.Copy(w, &buf)
+	return err
+}
+
+// replaceHistory replaces the heartbeat_history rows of machineID starting at
+// the specified first heartbeats with the aggregate entry agg.
+func (s *server) replaceHistory(ctx context.Context, machineID string, firstHeartbeats []time.Time, agg historyEntry) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, first := range firstHeartbeats {
+		if _, err := tx.StmtContext(ctx, s.queries.deleteHistoryEntry).ExecContext(ctx, machineID, first); err != nil {
+			return err
+		}
+	}
+	if err := s.insertHistory(ctx, tx, machineID, agg); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
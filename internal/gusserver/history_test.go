@@ -0,0 +1,213 @@
+package gusserver
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestTimeline(t *testing.T) {
+	start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	at := func(d time.Duration) time.Time { return start.Add(d) }
+	st := historyState{
+		SBOMHash: "sbom1",
+		Kernel:   "6.1.0",
+		RemoteIP: "10.0.0.2",
+		Hostname: "router",
+	}
+	updated := st
+	updated.SBOMHash = "sbom2"
+	updated.Kernel = "6.1.1"
+	moved := updated
+	moved.RemoteIP = "10.0.0.3"
+
+	entries := []historyEntry{
+		{historyState: st, FirstHeartbeat: at(0), LastHeartbeat: at(time.Hour)},
+		{historyState: updated, FirstHeartbeat: at(time.Hour + time.Minute), LastHeartbeat: at(2 * time.Hour)},
+		{historyState: moved, FirstHeartbeat: at(5 * time.Hour), LastHeartbeat: at(6 * time.Hour)},
+	}
+	got := timeline(entries, 10*time.Minute, at(8*time.Hour))
+	want := []timelineEvent{
+		{Timestamp: at(6 * time.Hour), Kind: eventGap, Duration: 2 * time.Hour, Ongoing: true},
+		{Timestamp: at(5 * time.Hour), Kind: eventAddress, Old: "10.0.0.2", New: "10.0.0.3"},
+		{Timestamp: at(2 * time.Hour), Kind: eventGap, Duration: 3 * time.Hour},
+		{Timestamp: at(time.Hour + time.Minute), Kind: eventImage, Old: "sbom1", New: "sbom2"},
+		{Timestamp: at(time.Hour + time.Minute), Kind: eventKernel, Old: "6.1.0", New: "6.1.1"},
+		{Timestamp: at(0), Kind: eventFirstHeartbeat, New: "sbom1"},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("timeline: unexpected diff (-want +got):\n%s", diff)
+	}
+
+	// Without gap detection, only changes are reported.
+	got = timeline(entries, 0, at(8*time.Hour))
+	for _, ev := range got {
+		if ev.Kind == eventGap {
+			t.Errorf("timeline without gap detection contains gap %+v", ev)
+		}
+	}
+}
+
+func TestHeartbeatHistory(t *testing.T) {
+	for _, tc := range testDatabases() {
+		t.Run(tc.databaseType, func(t *testing.T) {
+			ctx := context.Background()
+			ts := newTestServer(t, tc.databaseType)
+			ts.srv.cfg.historyGap = 10 * time.Minute
+
+			const machineID = "router-1"
+			heartbeat := func(sbomHash string) {
+				t.Helper()
+				req := &heartbeatRequest{
+					MachineID: machineID,
+					Hostname:  "router",
+					SBOMHash:  sbomHash,
+				}
+				req.HumanReadable.Kernel = "6.1.0"
+				if err := ts.postJSON("/api/v1/heartbeat", req, nil); err != nil {
+					t.Fatal(err)
+				}
+			}
+			heartbeat("sbom1")
+			heartbeat("sbom1")
+			heartbeat("sbom2")
+
+			// Heartbeats with unchanged state extend the current entry, a
+			// change appends it to the history.
+			{
+				want := []map[string]any{
+					{"sbom_hash": "sbom1", "heartbeats": "2"},
+				}
+				q := "SELECT sbom_hash, CAST(heartbeats AS TEXT) AS heartbeats FROM heartbeat_history WHERE machine_id = 'router-1' ORDER BY first_heartbeat ASC"
+				if diff := ts.diffQuery(t, want, q); diff != "" {
+					t.Errorf("heartbeat_history table: unexpected diff (-want +got):\n%s", diff)
+				}
+				heartbeat("sbom2")
+				if diff := ts.diffQuery(t, want, q); diff != "" {
+					t.Errorf("heartbeat_history table after unchanged heartbeat: unexpected diff (-want +got):\n%s", diff)
+				}
+				want = []map[string]any{
+					{"sbom_hash": "sbom2", "heartbeats": "2"},
+				}
+				q = "SELECT sbom_hash, CAST(heartbeats AS TEXT) AS heartbeats FROM current_history WHERE machine_id = 'router-1'"
+				if diff := ts.diffQuery(t, want, q); diff != "" {
+					t.Errorf("current_history table: unexpected diff (-want +got):\n%s", diff)
+				}
+			}
+
+			resp, err := ts.Client().Get(ts.URL() + machinePathPrefix + machineID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, err := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("GET machine page: got %v, want %v (body: %s)", resp.Status, http.StatusOK, b)
+			}
+			for _, want := range []string{eventFirstHeartbeat, eventImage, "sbom2"} {
+				if !strings.Contains(string(b), want) {
+					t.Errorf("machine page does not contain %q", want)
+				}
+			}
+			if resp, err := ts.Client().Get(ts.URL() + machinePathPrefix + "unknown"); err != nil {
+				t.Fatal(err)
+			} else if resp.Body.Close(); resp.StatusCode != http.StatusNotFound {
+				t.Errorf("GET page of unknown machine: got %v, want %v", resp.Status, http.StatusNotFound)
+			}
+
+			// A silence longer than historyGap starts a new entry.
+			now := time.Now()
+			st := historyState{SBOMHash: "sbom2", Kernel: "6.1.0", RemoteIP: "10.0.0.2", Hostname: "router"}
+			for _, d := range []time.Duration{
+				0,
+				5 * time.Minute,
+				time.Hour, // gap
+				time.Hour + 5*time.Minute,
+			} {
+				if err := ts.srv.recordHistory(ctx, "router-2", st, now.Add(d)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			history, err := ts.srv.loadHistory(ctx, "router-2")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := len(history), 2; got != want {
+				t.Fatalf("history entries after gap: got %d, want %d", got, want)
+			}
+			if got, want := history[0].Heartbeats, int64(2); got != want {
+				t.Errorf("heartbeats in first entry: got %d, want %d", got, want)
+			}
+		})
+	}
+}
+
+func TestPruneHistory(t *testing.T) {
+	for _, tc := range testDatabases() {
+		t.Run(tc.databaseType, func(t *testing.T) {
+			ctx := context.Background()
+			ts := newTestServer(t, tc.databaseType)
+			ts.srv.cfg.historyGap = 10 * time.Minute
+			ts.srv.cfg.historyRetention = 30 * 24 * time.Hour
+			ts.srv.cfg.downsampleAge = 7 * 24 * time.Hour
+			ts.srv.cfg.downsampleGap = time.Hour
+
+			now := time.Now().Truncate(time.Second)
+			days := func(n int) time.Time { return now.Add(-time.Duration(n) * 24 * time.Hour) }
+			st := historyState{SBOMHash: "sbom1"}
+			other := historyState{SBOMHash: "sbom2"}
+			for _, hb := range []struct {
+				st historyState
+				ts time.Time
+			}{
+				{st, days(40)}, // expired
+				{st, days(20)},
+				{st, days(20).Add(30 * time.Minute)}, // short gap: merged
+				{st, days(20).Add(time.Hour)},        // short gap: merged
+				{st, days(19)},                       // long gap: kept
+				{other, days(19).Add(time.Minute)},   // change: kept
+				{st, days(1)},                        // not yet downsampled
+				{st, days(1).Add(30 * time.Minute)},
+			} {
+				if err := ts.srv.recordHistory(ctx, "router-1", hb.st, hb.ts); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := ts.srv.pruneHistory(ctx); err != nil {
+				t.Fatal(err)
+			}
+			history, err := ts.srv.loadHistory(ctx, "router-1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			type entry struct {
+				SBOMHash   string
+				First      time.Time
+				Last       time.Time
+				Heartbeats int64
+			}
+			var got []entry
+			for _, e := range history {
+				got = append(got, entry{e.SBOMHash, e.FirstHeartbeat, e.LastHeartbeat, e.Heartbeats})
+			}
+			want := []entry{
+				{"sbom1", days(20), days(20).Add(time.Hour), 3},
+				{"sbom1", days(19), days(19), 1},
+				{"sbom2", days(19).Add(time.Minute), days(19).Add(time.Minute), 1},
+				{"sbom1", days(1), days(1), 1},
+				{"sbom1", days(1).Add(30 * time.Minute), days(1).Add(30 * time.Minute), 1},
+			}
+			if diff := cmp.Diff(want, got, cmp.Comparer(func(a, b time.Time) bool { return a.Equal(b) })); diff != "" {
+				t.Errorf("history after pruning: unexpected diff (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
@@ -35,6 +35,10 @@ func handleError(h func(http.ResponseWriter, *http.Request) error) http.Handler
 			unwrapped = he.err
 		}
 		log.Printf("%s: HTTP %d %s", r.URL.Path, code, unwrapped)
+		if code == http.StatusUnauthorized {
+			// Make browsers prompt for an API token (see authorize).
+			w.Header().Set("WWW-Authenticate", `Basic realm="GUS"`)
+		}
 		http.Error(w, unwrapped.Error(), code)
 	})
 }
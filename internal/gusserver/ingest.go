@@ -1,9 +1,13 @@
 package gusserver
 
 import (
+	"context"
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"log"
 	"net/http"
 	"time"
@@ -14,6 +18,22 @@ type ingestRequest struct {
 	SBOMHash         string `json:"sbom_hash"`
 	RegistryType     string `json:"registry_type"`
 	DownloadLink     string `json:"download_link"`
+	// Signature is the base64-encoded ed25519 signature of the image, see
+	// signedMessage.
+	Signature string `json:"signature,omitempty"`
+	// DiskSHA256 is the hex-encoded SHA-256 hash of the disk image. GUS
+	// computes it for localdisk and oci images. For remote (http) images, it
+	// is required if signing keys are registered (the signature covers it),
+	// and GUS verifies it by downloading the image.
+	DiskSHA256 string `json:"disk_sha256,omitempty"`
+	// SBOM optionally is the SBOM of the image (see sbomDiff). GUS reads the
+	// SBOM of localdisk and oci images from the image, but cannot do so for
+	// remote images.
+	SBOM json.RawMessage `json:"sbom,omitempty"`
+
+	// Rollout optionally stages the assignment of this image, see
+	// rolloutRequest (the action and sbom_hash fields are ignored).
+	Rollout *rolloutRequest `json:"rollout,omitempty"`
 }
 
 func (s *server) ingest(w http.ResponseWriter, r *http.Request) error {
@@ -33,6 +53,14 @@ func (s *server) ingest(w http.ResponseWriter, r *http.Request) error {
 		return httpError(http.StatusBadRequest, fmt.Errorf("machine_id_pattern not set"))
 	}
 
+	if _, err := parseMachinePattern(req.MachineIDPattern); err != nil {
+		return httpError(http.StatusBadRequest, err)
+	}
+
+	if err := s.authorize(r, req.MachineIDPattern); err != nil {
+		return err
+	}
+
 	if req.SBOMHash == "" {
 		return httpError(http.StatusBadRequest, fmt.Errorf("sbom_hash not set"))
 	}
@@ -41,34 +69,222 @@ func (s *server) ingest(w http.ResponseWriter, r *http.Request) error {
 		return httpError(http.StatusBadRequest, fmt.Errorf("registry_type not set"))
 	}
 
-	if req.RegistryType != "localdisk" {
-		return httpError(http.StatusBadRequest, fmt.Errorf("invalid registry_type: must be one of [localdisk]"))
-	}
-
 	if req.DownloadLink == "" {
 		return httpError(http.StatusBadRequest, fmt.Errorf("download_link not set"))
 	}
 
-	// TODO: validate downloadlink actually exists (at least for registrytype == localdisk)
+	var (
+		diskSize    sql.NullInt64
+		diskSHA256  string
+		remote      *remoteImage
+		sbomJSON    json.RawMessage
+		modules     []moduleVersion
+		indexSource = indexSourceSBOM
+	)
+	if len(req.SBOM) > 0 {
+		hash, err := sbomHash(req.SBOM)
+		if err != nil {
+			return httpError(http.StatusBadRequest, fmt.Errorf("invalid sbom: %v", err))
+		}
+		if hash != req.SBOMHash {
+			return httpError(http.StatusBadRequest, fmt.Errorf("sbom_hash %q does not match the sbom (%q)", req.SBOMHash, hash))
+		}
+		sbomJSON = req.SBOM
+	}
+	// Pushed images must not be garbage collected between validating and
+	// inserting the image.
+	s.contentMu.RLock()
+	defer s.contentMu.RUnlock()
+	switch req.RegistryType {
+	case "localdisk", registryOCI:
+		validate := s.validateLocalImage
+		if req.RegistryType == registryOCI {
+			validate = s.validateOCIImage
+		}
+		img, err := validate(r.Context(), req.DownloadLink)
+		if err != nil {
+			return err
+		}
+		if img.SBOMHash == "" {
+			if !s.cfg.allowGAFWithoutSBOM {
+				return httpError(http.StatusBadRequest, fmt.Errorf("download_link %q: GAF archive contains no %s, so its sbom_hash cannot be verified (build the image with a current version of gok, or start GUS with --allow_gaf_without_sbom)", req.DownloadLink, gafSBOMName))
+			}
+			log.Printf("image %q: GAF archive contains no %s, sbom_hash not verified", req.SBOMHash, gafSBOMName)
+		}
+		if img.SBOMHash != "" && img.SBOMHash != req.SBOMHash {
+			return httpError(http.StatusBadRequest, fmt.Errorf("sbom_hash %q does not match the SBOM of the pushed image (%q)", req.SBOMHash, img.SBOMHash))
+		}
+		if req.DiskSHA256 != "" && req.DiskSHA256 != img.SHA256 {
+			return httpError(http.StatusBadRequest, fmt.Errorf("disk_sha256 %q does not match the pushed image (%q)", req.DiskSHA256, img.SHA256))
+		}
+		diskSize = sql.NullInt64{Int64: img.Size, Valid: true}
+		diskSHA256 = img.SHA256
+		if img.SBOM != nil {
+			sbomJSON = img.SBOM
+		}
+		if img.ModulesErr != nil {
+			log.Printf("image %q: module versions unknown: %v", req.SBOMHash, img.ModulesErr)
+		} else {
+			modules = img.Modules
+			indexSource = indexSourcePrograms
+		}
+
+	case registryHTTP:
+		if err := validateRemoteURL(req.DownloadLink); err != nil {
+			return httpError(http.StatusBadRequest, err)
+		}
+		remote, err = s.headRemoteImage(r.Context(), req.DownloadLink)
+		if err != nil {
+			return httpError(http.StatusBadRequest, err)
+		}
+		if remote.Size >= 0 {
+			diskSize = sql.NullInt64{Int64: remote.Size, Valid: true}
+		}
+		if req.DiskSHA256 != "" {
+			sum, err := s.remoteSHA256(r.Context(), req.DownloadLink)
+			if err != nil {
+				return httpError(http.StatusBadRequest, err)
+			}
+			if sum != req.DiskSHA256 {
+				return httpError(http.StatusBadRequest, fmt.Errorf("disk_sha256 %q does not match the remote image (%q)", req.DiskSHA256, sum))
+			}
+		}
+		diskSHA256 = req.DiskSHA256
+
+	default:
+		return httpError(http.StatusBadRequest, fmt.Errorf("invalid registry_type: must be one of [localdisk http oci]"))
+	}
 
+	signingKey, err := s.verifySignature(r.Context(), req, diskSHA256)
+	if err != nil {
+		return err
+	}
+
+	var ro *rollout
+	if req.Rollout != nil {
+		rreq := *req.Rollout
+		rreq.Action = "create"
+		rreq.SBOMHash = req.SBOMHash
+		ro, err = s.newRollout(r.Context(), rreq)
+		if err != nil {
+			return err
+		}
+	}
+
+	// The image and its rollout are inserted in one transaction: otherwise,
+	// updateDesired could assign the image to all machines before the
+	// rollout exists, or a failed insert could leave an orphaned rollout.
+	tx, err := s.db.BeginTx(r.Context(), nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
 	now := time.Now()
-	_, err = s.queries.insertImage.ExecContext(r.Context(),
+	_, err = tx.StmtContext(r.Context(), s.queries.insertImage).ExecContext(r.Context(),
 		req.SBOMHash,
 		now,
 		req.MachineIDPattern,
 		req.RegistryType,
-		req.DownloadLink)
+		req.DownloadLink,
+		nullIfEmpty(diskSHA256),
+		nullIfEmpty(req.Signature),
+		nullIfEmpty(signingKey),
+		diskSize,
+		nullIfEmpty(string(sbomJSON)))
 	if err != nil {
 		return err
 	}
+	if ro != nil {
+		if err := s.insertRollout(r.Context(), tx, ro); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	// The SBOM only fails to parse if it is valid JSON, but not an SBOM, in
+	// which case only the modules of the programs are indexed.
+	parsed, _ := parseSBOM(sbomJSON)
+	if err := s.indexSBOM(r.Context(), req.SBOMHash, parsed, modules, indexSource); err != nil {
+		return err
+	}
+	if remote != nil {
+		if _, err := s.queries.updateRemoteImage.ExecContext(r.Context(), nullIfEmpty(remote.ETag), now, req.SBOMHash); err != nil {
+			return err
+		}
+	}
 
-	log.Printf("Ingested image %q (matching %q)", req.SBOMHash, req.MachineIDPattern)
+	if signingKey != "" {
+		log.Printf("Ingested image %q (matching %q), signed by %q", req.SBOMHash, req.MachineIDPattern, signingKey)
+	} else {
+		log.Printf("Ingested image %q (matching %q)", req.SBOMHash, req.MachineIDPattern)
+	}
 
 	if err := s.updateDesired(); err != nil {
 		return err
 	}
 
+	if req.Rollout != nil {
+		if err := s.advanceRollouts(r.Context()); err != nil {
+			return err
+		}
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	fmt.Fprintf(w, "{}")
 	return nil
 }
+
+// localImage describes an image pushed to this server, see validateLocalImage.
+type localImage struct {
+	Size     int64
+	SHA256   string // hex-encoded
+	SBOMHash string // empty if the GAF archive contains no SBOM
+	SBOM     json.RawMessage
+	// Modules are the Go modules of the programs in the image, unless they
+	// cannot be read (ModulesErr), see readGAFModules.
+	Modules    []moduleVersion
+	ModulesErr error
+}
+
+// validateLocalImage verifies that the image with the specified download link
+// was pushed to this server and is a valid GAF (zip) archive.
+func (s *server) validateLocalImage(ctx context.Context, downloadLink string) (*localImage, error) {
+	store := s.store()
+	if store == nil {
+		return nil, httpError(http.StatusBadRequest, errNoImageStore)
+	}
+	key, wantSHA256, err := s.resolveImage(ctx, downloadLink)
+	if err != nil {
+		return nil, httpError(http.StatusBadRequest, err)
+	}
+	img, err := store.Open(ctx, key)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, httpError(http.StatusBadRequest, fmt.Errorf("download_link %q not found (push the image first)", downloadLink))
+		}
+		return nil, err
+	}
+	defer img.Close()
+	sbomJSON, sbomHash, err := readGAFSBOM(img, img.Size())
+	if err != nil {
+		return nil, httpError(http.StatusBadRequest, fmt.Errorf("download_link %q: %v", downloadLink, err))
+	}
+	sum, err := readerSHA256(img)
+	if err != nil {
+		return nil, err
+	}
+	if wantSHA256 != "" && sum != wantSHA256 {
+		return nil, fmt.Errorf("image store corrupt: %s has SHA-256 %s", key, sum)
+	}
+	modules, modulesErr := readGAFModules(img, img.Size())
+	return &localImage{
+		Size:       img.Size(),
+		SHA256:     sum,
+		SBOMHash:   sbomHash,
+		SBOM:       sbomJSON,
+		Modules:    modules,
+		ModulesErr: modulesErr,
+	}, nil
+}
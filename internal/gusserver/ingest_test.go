@@ -2,6 +2,12 @@ package gusserver
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/antihax/optional"
@@ -15,6 +21,7 @@ func TestIngest(t *testing.T) {
 		t.Run(tc.databaseType, func(t *testing.T) {
 			ctx := context.Background()
 			ts := newTestServer(t, tc.databaseType)
+			downloadLink := ts.pushImage(t)
 			api := ts.API()
 
 			const machineID = "scan2drive"
@@ -37,7 +44,7 @@ func TestIngest(t *testing.T) {
 					MachineIdPattern: "scan2drive",
 					SbomHash:         "abcdefg",
 					RegistryType:     "localdisk",
-					DownloadLink:     "/doesnotexist/disk.gaf",
+					DownloadLink:     downloadLink,
 				}),
 			})
 			if err != nil {
@@ -71,3 +78,86 @@ func TestIngest(t *testing.T) {
 		})
 	}
 }
+
+func TestIngestValidation(t *testing.T) {
+	for _, tc := range testDatabases() {
+		t.Run(tc.databaseType, func(t *testing.T) {
+			ctx := context.Background()
+			ts := newTestServer(t, tc.databaseType)
+
+			ingest := func(downloadLink string) error {
+				return ts.postJSON("/api/v1/ingest", &ingestRequest{
+					MachineIDPattern: "scan2drive",
+					SBOMHash:         "abcdefg",
+					RegistryType:     "localdisk",
+					DownloadLink:     downloadLink,
+				}, nil)
+			}
+
+			// Pushing a file which is not a zip archive fails, so place it in
+			// image_dir directly.
+			req, err := http.NewRequest("PUT", ts.URL()+"/api/v1/push", strings.NewReader("not a zip archive"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err := ts.Client().Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if got, want := resp.StatusCode, http.StatusBadRequest; got != want {
+				t.Errorf("push of invalid archive: got HTTP status %v, want %v", resp.Status, want)
+			}
+			bogus := filepath.Join(ts.srv.cfg.imageDir, "bogus")
+			if err := os.MkdirAll(bogus, 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(filepath.Join(bogus, "disk.gaf"), []byte("not a zip archive"), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			for _, downloadLink := range []string{
+				"/doesnotexist/disk.gaf",
+				"/images/doesnotexist/disk.gaf",
+				"/images/../../etc/passwd",
+				"/images/",
+				"/images/bogus/disk.gaf",
+			} {
+				if err := ingest(downloadLink); err == nil || !strings.Contains(err.Error(), "400") {
+					t.Errorf("ingest(%q): got err %v, want HTTP 400", downloadLink, err)
+				}
+			}
+			ts.ensureEmpty(t, "images")
+
+			// Archives without SBOM are rejected unless explicitly allowed,
+			// as their sbom_hash cannot be verified.
+			downloadLink := ts.pushImage(t)
+			ts.srv.cfg.allowGAFWithoutSBOM = false
+			if err := ingest(downloadLink); err == nil || !strings.Contains(err.Error(), "400") {
+				t.Errorf("ingest of archive without SBOM: got err %v, want HTTP 400", err)
+			}
+			ts.ensureEmpty(t, "images")
+			ts.srv.cfg.allowGAFWithoutSBOM = true
+			if err := ingest(downloadLink); err != nil {
+				t.Fatal(err)
+			}
+			zipb := dummyZip(t)
+			sum := sha256.Sum256(zipb)
+			if diff := ts.diffQuery(t, []map[string]any{
+				{"sbom_hash": "abcdefg", "disk_sha256": hex.EncodeToString(sum[:])},
+			}, "SELECT sbom_hash, disk_sha256 FROM images"); diff != "" {
+				t.Errorf("images table: unexpected diff (-want +got):\n%s", diff)
+			}
+			images, err := ts.srv.loadImages(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(images) != 1 {
+				t.Fatalf("loadImages: got %d images, want 1", len(images))
+			}
+			if got, want := images[0].Size(), uint64(len(zipb)); got != want {
+				t.Errorf("image.Size() = %d, want %d", got, want)
+			}
+		})
+	}
+}
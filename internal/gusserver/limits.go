@@ -0,0 +1,180 @@
+package gusserver
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/dustin/go-humanize"
+)
+
+// Push limits protect the server (and the database, which often lives on the
+// same volume) from clients which push too much:
+//
+//   - Images larger than config.maxImageSize are rejected with HTTP 413
+//     (Content Too Large).
+//   - API tokens can have a quota (see createToken): the total size of the
+//     distinct images pushed to the image store with the token, which are
+//     still stored. Pushes exceeding the quota are rejected with HTTP 507
+//     (Insufficient Storage).
+//   - Pushes are rejected with HTTP 507 if less than config.minFreeSpace
+//     would remain on the file system to which the pushed image is written.
+//     Free space is checked before the push and periodically during the copy.
+//
+// Limits are checked against the Content-Length (or the declared size of a
+// resumable upload, see createUpload) before reading the request body, so that
+// gok can report the error right away, and enforced while reading the body.
+
+var errFreeSpaceUnsupported = errors.New("determining free space is not supported on this platform")
+
+const (
+	noQuota = -1
+
+	// freeSpaceCheckInterval is after how many bytes the free space is
+	// checked again during a push.
+	freeSpaceCheckInterval = 16 << 20
+)
+
+type pushLimits struct {
+	maxSize int64 // zero: unlimited
+
+	tokenHash string // empty if the request carries no API token
+	tokenName string
+	quota     int64 // remaining bytes, or noQuota
+
+	dir     string // to which the pushed image is written, or empty
+	minFree int64
+}
+
+// pushLimits returns the limits for the push request r, whose data is written
+// to dir (empty to skip free space checks).
+func (s *server) pushLimits(r *http.Request, dir string) (*pushLimits, error) {
+	l := &pushLimits{
+		maxSize: s.cfg.maxImageSize,
+		quota:   noQuota,
+		dir:     dir,
+		minFree: s.cfg.minFreeSpace,
+	}
+	token := requestToken(r)
+	if token == "" {
+		return l, nil
+	}
+	var quota sql.NullInt64
+	tokenHash := hashToken(token)
+	err := s.queries.selectTokenQuota.QueryRowContext(r.Context(), tokenHash).Scan(
+		&l.tokenName,
+		&quota)
+	if err == sql.ErrNoRows {
+		return l, nil // authorize rejects invalid tokens, if required
+	}
+	if err != nil {
+		return nil, err
+	}
+	l.tokenHash = tokenHash
+	if !quota.Valid {
+		return l, nil
+	}
+	var used int64
+	if err := s.queries.selectTokenUsage.QueryRowContext(r.Context(), tokenHash).Scan(&used); err != nil {
+		return nil, err
+	}
+	l.quota = max(quota.Int64-used, 0)
+	return l, nil
+}
+
+// spoolDir returns the local directory to which pushed images are written
+// before they are committed to the image store, or "" if unknown.
+func (s *server) spoolDir() string {
+	switch st := s.store().(type) {
+	case *fsStore:
+		return st.dir
+	case *s3Store:
+		if st.tempDir != "" {
+			return st.tempDir
+		}
+		return os.TempDir()
+	}
+	return ""
+}
+
+// check returns an error if an image of the specified size (-1 if unknown)
+// cannot be pushed.
+func (l *pushLimits) check(size int64) error {
+	if size > 0 {
+		if err := l.checkSize(size); err != nil {
+			return err
+		}
+	}
+	return l.checkFreeSpace(max(size, 0))
+}
+
+func (l *pushLimits) checkSize(size int64) error {
+	if l.maxSize > 0 && size > l.maxSize {
+		return httpError(http.StatusRequestEntityTooLarge, fmt.Errorf("image too large: exceeds the maximum image size of %s", humanize.IBytes(uint64(l.maxSize))))
+	}
+	if l.quota != noQuota && size > l.quota {
+		return httpError(http.StatusInsufficientStorage, fmt.Errorf("quota of API token %q exceeded: image needs %s, but only %s of the quota remain (garbage collection of unused images frees quota)", l.tokenName, humanize.IBytes(uint64(size)), humanize.IBytes(uint64(l.quota))))
+	}
+	return nil
+}
+
+// checkFreeSpace returns an error unless pending more bytes can be written
+// while keeping l.minFree bytes free.
+func (l *pushLimits) checkFreeSpace(pending int64) error {
+	if l.dir == "" || l.minFree <= 0 {
+		return nil
+	}
+	// The directory is created on the first push, so check the closest
+	// existing parent directory (on the same file system, typically).
+	dir := l.dir
+	free, err := freeSpace(dir)
+	for os.IsNotExist(err) && filepath.Dir(dir) != dir {
+		dir = filepath.Dir(dir)
+		free, err = freeSpace(dir)
+	}
+	if errors.Is(err, errFreeSpaceUnsupported) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if free-pending < l.minFree {
+		log.Printf("rejecting push: %s free in %s, %s reserved", humanize.IBytes(uint64(free)), l.dir, humanize.IBytes(uint64(l.minFree)))
+		return httpError(http.StatusInsufficientStorage, fmt.Errorf("insufficient storage on the GUS server: pushing would leave less than the reserved %s free", humanize.IBytes(uint64(l.minFree))))
+	}
+	return nil
+}
+
+// reader returns a reader which reads from r and fails once the limits are
+// exceeded. offset is the number of bytes of the image which were already
+// received (for resumable uploads).
+func (l *pushLimits) reader(r io.Reader, offset int64) io.Reader {
+	return &limitedReader{r: r, limits: l, n: offset, nextCheck: offset + freeSpaceCheckInterval}
+}
+
+type limitedReader struct {
+	r         io.Reader
+	limits    *pushLimits
+	n         int64 // bytes of the image, including earlier chunks
+	nextCheck int64
+}
+
+func (lr *limitedReader) Read(p []byte) (int, error) {
+	n, err := lr.r.Read(p)
+	lr.n += int64(n)
+	if lerr := lr.limits.checkSize(lr.n); lerr != nil {
+		return n, lerr
+	}
+	if lr.n >= lr.nextCheck {
+		lr.nextCheck = lr.n + freeSpaceCheckInterval
+		if lerr := lr.limits.checkFreeSpace(0); lerr != nil {
+			return n, lerr
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,121 @@
+package gusserver
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestPushLimits(t *testing.T) {
+	for _, tc := range testDatabases() {
+		t.Run(tc.databaseType, func(t *testing.T) {
+			ctx := context.Background()
+			ts := newTestServer(t, tc.databaseType)
+			ts.srv.cfg.requireAPIToken = true
+			token, err := ts.srv.createToken(ctx, "ci", []string{"*"}, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ts.apiToken = token
+
+			// pushStatus pushes body and returns the HTTP status and response
+			// body. Unless withLength is set, the body is sent without
+			// Content-Length (chunked), so that the limits are only enforced
+			// while reading.
+			pushStatus := func(path string, body []byte, withLength bool) (int, string) {
+				t.Helper()
+				var r io.Reader = bytes.NewReader(body)
+				if !withLength {
+					r = io.MultiReader(r)
+				}
+				req, err := http.NewRequest("PUT", ts.URL()+path, r)
+				if err != nil {
+					t.Fatal(err)
+				}
+				req.Header.Set("Authorization", "Bearer "+ts.apiToken)
+				resp, err := ts.Client().Do(req)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer resp.Body.Close()
+				b, err := io.ReadAll(resp.Body)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return resp.StatusCode, string(b)
+			}
+
+			small := zipWithFile(t, []byte("small"))
+			large := zipWithFile(t, bytes.Repeat([]byte("large"), 1000))
+			ts.srv.cfg.maxImageSize = int64(len(small))
+
+			t.Run("MaxImageSize", func(t *testing.T) {
+				for _, withLength := range []bool{true, false} {
+					if code, body := pushStatus("/api/v1/push", large, withLength); code != http.StatusRequestEntityTooLarge || !strings.Contains(body, "maximum image size") {
+						t.Errorf("push of a too large image (Content-Length: %v): got HTTP %d (%s), want %d", withLength, code, body, http.StatusRequestEntityTooLarge)
+					}
+				}
+				if code, body := pushStatus("/api/v1/push", small, true); code != http.StatusOK {
+					t.Errorf("push of an image within the limit: got HTTP %d (%s), want %d", code, body, http.StatusOK)
+				}
+
+				// Resumable uploads declaring a too large size are rejected
+				// right away.
+				err := ts.postJSON("/api/v1/upload", &createUploadRequest{Size: int64(len(large))}, nil)
+				if err == nil || !strings.Contains(err.Error(), "413") {
+					t.Errorf("creating a too large upload: got %v, want HTTP 413", err)
+				}
+			})
+			ts.srv.cfg.maxImageSize = 0
+
+			t.Run("Quota", func(t *testing.T) {
+				quotaToken, err := ts.srv.createToken(ctx, "limited", []string{"*"}, int64(len(small)+len(large)/2))
+				if err != nil {
+					t.Fatal(err)
+				}
+				ts.apiToken = quotaToken
+				defer func() { ts.apiToken = token }()
+
+				if code, body := pushStatus("/api/v1/push", small, true); code != http.StatusOK {
+					t.Fatalf("push within quota: got HTTP %d (%s), want %d", code, body, http.StatusOK)
+				}
+				for _, withLength := range []bool{true, false} {
+					if code, body := pushStatus("/api/v1/push", large, withLength); code != http.StatusInsufficientStorage || !strings.Contains(body, `"limited"`) {
+						t.Errorf("push exceeding the quota (Content-Length: %v): got HTTP %d (%s), want %d", withLength, code, body, http.StatusInsufficientStorage)
+					}
+				}
+				// Other tokens are not affected.
+				ts.apiToken = token
+				if code, body := pushStatus("/api/v1/push", large, true); code != http.StatusOK {
+					t.Errorf("push with unlimited token: got HTTP %d (%s), want %d", code, body, http.StatusOK)
+				}
+			})
+
+			t.Run("MinFreeSpace", func(t *testing.T) {
+				ts.srv.cfg.minFreeSpace = 1 << 62
+				defer func() { ts.srv.cfg.minFreeSpace = 0 }()
+				if code, body := pushStatus("/api/v1/push", small, true); code != http.StatusInsufficientStorage || !strings.Contains(body, "insufficient storage") {
+					t.Errorf("push without free space: got HTTP %d (%s), want %d", code, body, http.StatusInsufficientStorage)
+				}
+				err := ts.postJSON("/api/v1/upload", &createUploadRequest{}, nil)
+				if err == nil || !strings.Contains(err.Error(), "507") {
+					t.Errorf("creating an upload without free space: got %v, want HTTP 507", err)
+				}
+			})
+
+			// Rejected pushes leave no images behind.
+			objects, err := ts.srv.store().List(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(objects) != 2 {
+				b, _ := json.Marshal(objects)
+				t.Errorf("image store: got %s, want the small and the large image", b)
+			}
+		})
+	}
+}
@@ -0,0 +1,327 @@
+package gusserver
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/lib/pq"
+	"modernc.org/sqlite"
+)
+
+// /metrics exposes fleet and server metrics in the Prometheus text exposition
+// format (version 0.0.4), written by hand to not pull in the Prometheus client
+// library:
+// https://prometheus.io/docs/instrumenting/exposition_formats/#text-based-format
+//
+// Fleet metrics are computed from the database on each scrape. Server metrics
+// are collected in serverMetrics since the server started.
+
+// latencyBuckets are the upper bounds (in seconds) of the latency histograms.
+var latencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+type histogram struct {
+	mu      sync.Mutex
+	buckets []float64
+	counts  []uint64 // per bucket, not cumulative
+	sum     float64
+	count   uint64
+}
+
+func newHistogram(buckets []float64) *histogram {
+	return &histogram{
+		buckets: buckets,
+		counts:  make([]uint64, len(buckets)),
+	}
+}
+
+func (h *histogram) observe(d time.Duration) {
+	v := d.Seconds()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if idx := sort.SearchFloat64s(h.buckets, v); idx < len(h.buckets) {
+		h.counts[idx]++
+	}
+	h.sum += v
+	h.count++
+}
+
+func (h *histogram) write(w io.Writer, name, help string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	writeHeader(w, name, help, "histogram")
+	var cumulative uint64
+	for idx, le := range h.buckets {
+		cumulative += h.counts[idx]
+		fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %d\n", name, formatFloat(le), cumulative)
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, h.count)
+	fmt.Fprintf(w, "%s_sum %s\n", name, formatFloat(h.sum))
+	fmt.Fprintf(w, "%s_count %d\n", name, h.count)
+}
+
+type requestKey struct {
+	endpoint string // pattern of the handler, see handle
+	code     int
+}
+
+type serverMetrics struct {
+	mu       sync.Mutex
+	requests map[requestKey]uint64
+
+	heartbeatDuration     *histogram
+	updateDesiredDuration *histogram
+	dbErrors              atomic.Uint64
+}
+
+func newServerMetrics() *serverMetrics {
+	return &serverMetrics{
+		requests:              make(map[requestKey]uint64),
+		heartbeatDuration:     newHistogram(latencyBuckets),
+		updateDesiredDuration: newHistogram(latencyBuckets),
+	}
+}
+
+// isDBError reports whether err was returned by the database (as opposed to,
+// for example, sql.ErrNoRows or a validation error).
+func isDBError(err error) bool {
+	var (
+		pqErr     *pq.Error
+		sqliteErr *sqlite.Error
+	)
+	return errors.As(err, &pqErr) ||
+		errors.As(err, &sqliteErr) ||
+		errors.Is(err, driver.ErrBadConn) ||
+		errors.Is(err, sql.ErrConnDone) ||
+		errors.Is(err, sql.ErrTxDone)
+}
+
+// countError counts err in gus_db_errors_total if it is a database error.
+func (m *serverMetrics) countError(err error) {
+	if err != nil && isDBError(err) {
+		m.dbErrors.Add(1)
+	}
+}
+
+// statusRecorder records the HTTP status code of a response.
+type statusRecorder struct {
+	http.ResponseWriter
+	code int
+}
+
+func (sr *statusRecorder) WriteHeader(code int) {
+	if sr.code == 0 {
+		sr.code = code
+	}
+	sr.ResponseWriter.WriteHeader(code)
+}
+
+func (sr *statusRecorder) Write(b []byte) (int, error) {
+	if sr.code == 0 {
+		sr.code = http.StatusOK
+	}
+	return sr.ResponseWriter.Write(b)
+}
+
+// Unwrap allows http.ResponseController to access the underlying
+// http.ResponseWriter.
+func (sr *statusRecorder) Unwrap() http.ResponseWriter {
+	return sr.ResponseWriter
+}
+
+// handle registers h for pattern on mux, with request and error metrics.
+func (s *server) handle(mux *http.ServeMux, pattern string, h func(http.ResponseWriter, *http.Request) error) {
+	handler := handleError(func(w http.ResponseWriter, r *http.Request) error {
+		err := h(w, r)
+		s.metrics.countError(err)
+		return err
+	})
+	mux.Handle(pattern, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sr := &statusRecorder{ResponseWriter: w}
+		handler.ServeHTTP(sr, r)
+		key := requestKey{
+			endpoint: pattern,
+			code:     cmp.Or(sr.code, http.StatusOK),
+		}
+		s.metrics.mu.Lock()
+		defer s.metrics.mu.Unlock()
+		s.metrics.requests[key]++
+	}))
+}
+
+func writeHeader(w io.Writer, name, help, typ string) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, typ)
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+var labelValueReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// writeGaugeVec writes a gauge with one label, sorted by label value.
+func writeGaugeVec(w io.Writer, name, help, label string, values map[string]int64) {
+	writeHeader(w, name, help, "gauge")
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(w, "%s{%s=\"%s\"} %d\n", name, label, labelValueReplacer.Replace(k), values[k])
+	}
+}
+
+// countBy runs a query which returns (label value, count) rows. NULL label
+// values are reported as null.
+func (s *server) countBy(ctx context.Context, stmt *sql.Stmt, null string) (map[string]int64, error) {
+	rows, err := stmt.QueryContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	counts := make(map[string]int64)
+	for rows.Next() {
+		var (
+			value sql.NullString
+			count int64
+		)
+		if err := rows.Scan(&value, &count); err != nil {
+			return nil, err
+		}
+		counts[cmp.Or(value.String, null)] += count
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return counts, rows.Close()
+}
+
+// imageDirBytes returns the total size of the files in dir.
+func imageDirBytes(dir string) (int64, error) {
+	var total int64
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil // removed concurrently
+			}
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		total += info.Size()
+		return nil
+	})
+	return total, err
+}
+
+func (s *server) writeFleetMetrics(ctx context.Context, w io.Writer) error {
+	availability, err := s.countBy(ctx, s.queries.countByAvailability, availabilityOnline)
+	if err != nil {
+		return err
+	}
+	var total int64
+	for _, n := range availability {
+		total += n
+	}
+	if s.offlineThreshold() > 0 {
+		// Report both states, even if zero.
+		availability[availabilityOnline] += 0
+		availability[availabilityOffline] += 0
+	} else {
+		// Without offline detection (see checkOffline), the availability of
+		// machines is unknown.
+		availability = map[string]int64{"unknown": total}
+	}
+	writeHeader(w, "gus_machines", "Number of machines known to GUS.", "gauge")
+	fmt.Fprintf(w, "gus_machines %d\n", total)
+	writeGaugeVec(w, "gus_machines_by_availability", "Number of machines by availability (online, offline, or unknown if offline detection is disabled).", "availability", availability)
+
+	sbomHashes, err := s.countBy(ctx, s.queries.countBySBOMHash, "")
+	if err != nil {
+		return err
+	}
+	writeGaugeVec(w, "gus_machines_by_sbom_hash", "Number of machines by the SBOM hash of the image they run, as of their last heartbeat.", "sbom_hash", sbomHashes)
+
+	updateStates, err := s.countBy(ctx, s.queries.countByUpdateState, "none")
+	if err != nil {
+		return err
+	}
+	writeGaugeVec(w, "gus_machines_by_update_state", "Number of machines by update state.", "update_state", updateStates)
+
+	images, err := s.countBy(ctx, s.queries.countImages, "")
+	if err != nil {
+		return err
+	}
+	writeGaugeVec(w, "gus_images", "Number of ingested images by registry type.", "registry_type", images)
+
+	if s.cfg.imageStore == nil && s.cfg.imageDir != "" {
+		size, err := imageDirBytes(s.cfg.imageDir)
+		if err != nil {
+			return err
+		}
+		writeHeader(w, "gus_image_dir_bytes", "Total size of the files in --image_dir.", "gauge")
+		fmt.Fprintf(w, "gus_image_dir_bytes %d\n", size)
+	}
+	return nil
+}
+
+func (s *server) writeServerMetrics(w io.Writer) {
+	m := s.metrics
+	m.mu.Lock()
+	keys := make([]requestKey, 0, len(m.requests))
+	for k := range m.requests {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].endpoint != keys[j].endpoint {
+			return keys[i].endpoint < keys[j].endpoint
+		}
+		return keys[i].code < keys[j].code
+	})
+	writeHeader(w, "gus_http_requests_total", "HTTP requests by endpoint and status code.", "counter")
+	for _, k := range keys {
+		fmt.Fprintf(w, "gus_http_requests_total{endpoint=\"%s\",code=\"%d\"} %d\n", labelValueReplacer.Replace(k.endpoint), k.code, m.requests[k])
+	}
+	m.mu.Unlock()
+
+	m.heartbeatDuration.write(w, "gus_heartbeat_duration_seconds", "Time spent handling heartbeat requests.")
+	m.updateDesiredDuration.write(w, "gus_update_desired_duration_seconds", "Time spent computing the desired images of all machines.")
+
+	writeHeader(w, "gus_db_errors_total", "Database errors returned by request handlers and background jobs.", "counter")
+	fmt.Fprintf(w, "gus_db_errors_total %d\n", m.dbErrors.Load())
+}
+
+func (s *server) metricsHandler(w http.ResponseWriter, r *http.Request) error {
+	var buf bytes.Buffer
+	if err := s.writeFleetMetrics(r.Context(), &buf); err != nil {
+		return err
+	}
+	s.writeServerMetrics(&buf)
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	_, err := io.Copy(w, &buf)
+	return err
+}
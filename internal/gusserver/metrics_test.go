@@ -0,0 +1,110 @@
+package gusserver
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestMetrics(t *testing.T) {
+	for _, tc := range testDatabases() {
+		t.Run(tc.databaseType, func(t *testing.T) {
+			ts := newTestServer(t, tc.databaseType)
+
+			for _, machineID := range []string{"router-1", "router-2"} {
+				if err := ts.postJSON("/api/v1/heartbeat", &heartbeatRequest{
+					MachineID: machineID,
+					SBOMHash:  "sbom1",
+				}, nil); err != nil {
+					t.Fatal(err)
+				}
+			}
+			pr := ts.push(t, dummyZip(t))
+			if err := ts.postJSON("/api/v1/ingest", &ingestRequest{
+				MachineIDPattern: "router-*",
+				SBOMHash:         "sbom2",
+				RegistryType:     "localdisk",
+				DownloadLink:     pr.DownloadLink,
+			}, nil); err != nil {
+				t.Fatal(err)
+			}
+			if resp, err := ts.Client().Get(ts.URL() + "/nonexistent"); err != nil {
+				t.Fatal(err)
+			} else {
+				resp.Body.Close()
+			}
+
+			resp, err := ts.Client().Get(ts.URL() + "/metrics")
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, err := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("GET /metrics: got %v, want %v (body: %s)", resp.Status, http.StatusOK, b)
+			}
+			if got, want := resp.Header.Get("Content-Type"), "text/plain; version=0.0.4"; !strings.HasPrefix(got, want) {
+				t.Errorf("Content-Type: got %q, want prefix %q", got, want)
+			}
+			metrics := string(b)
+
+			sample := regexp.MustCompile(`^[a-z_]+(\{([a-z_]+="[^"]*",?)+\})? [0-9.e+-]+$`)
+			for _, line := range strings.Split(strings.TrimSpace(metrics), "\n") {
+				if strings.HasPrefix(line, "# HELP ") || strings.HasPrefix(line, "# TYPE ") {
+					continue
+				}
+				if !sample.MatchString(line) {
+					t.Errorf("invalid line in text exposition format: %q", line)
+				}
+			}
+
+			for _, want := range []string{
+				"gus_machines 2\n",
+				`gus_machines_by_availability{availability="unknown"} 2` + "\n",
+				`gus_machines_by_sbom_hash{sbom_hash="sbom1"} 2` + "\n",
+				`gus_machines_by_update_state{update_state="none"} 2` + "\n",
+				`gus_images{registry_type="localdisk"} 1` + "\n",
+				`gus_http_requests_total{endpoint="/api/v1/heartbeat",code="200"} 2` + "\n",
+				`gus_http_requests_total{endpoint="/",code="404"} 1` + "\n",
+				"gus_heartbeat_duration_seconds_count 2\n",
+				`gus_heartbeat_duration_seconds_bucket{le="+Inf"} 2` + "\n",
+				"gus_update_desired_duration_seconds_count ",
+				"gus_db_errors_total 0\n",
+				"# TYPE gus_image_dir_bytes gauge\n",
+			} {
+				if !strings.Contains(metrics, want) {
+					t.Errorf("metrics do not contain %q:\n%s", want, metrics)
+				}
+			}
+		})
+	}
+}
+
+func TestIsDBError(t *testing.T) {
+	ts := newTestServer(t, "sqlite")
+	_, dbErr := ts.srv.db.Exec("SELECT * FROM nonexistent")
+	if dbErr == nil {
+		t.Fatal("query of nonexistent table unexpectedly succeeded")
+	}
+	for _, tt := range []struct {
+		err  error
+		want bool
+	}{
+		{dbErr, true},
+		{fmt.Errorf("loading: %w", dbErr), true},
+		{sql.ErrConnDone, true},
+		{sql.ErrNoRows, false},
+		{fmt.Errorf("invalid request"), false},
+	} {
+		if got := isDBError(tt.err); got != tt.want {
+			t.Errorf("isDBError(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,429 @@
+package gusserver
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/mod/semver"
+)
+
+// The sbom_modules table indexes which Go modules each image (identified by
+// its SBOM hash) contains, so that GUS can answer questions like “which
+// machines run golang.org/x/net < v0.17.0?”.
+//
+// The SBOM of a gokrazy build does not contain module versions (see sbomDiff),
+// only the packages which were built. indexSBOM records these packages with an
+// unknown (empty) version. Module versions are only known for images which
+// were pushed to (or through) GUS: when ingesting them, GUS reads the build
+// information of their programs (see readGAFModules). Images which GUS only
+// knows from heartbeats, or which are downloaded from a remote http server,
+// are indexed from their SBOM only.
+
+// Sources of the sbom_modules rows of an image:
+const (
+	indexSourcePrograms = "programs" // module versions from the programs
+	indexSourceSBOM     = "sbom"     // packages from the SBOM only
+)
+
+// moduleVersion is a Go module and its version, like in a go.mod require
+// directive.
+type moduleVersion struct {
+	Path    string `json:"path"`
+	Version string `json:"version"`
+}
+
+// indexSBOM records the packages of sb (if non-nil) and the modules read from
+// the programs of the image (if source is indexSourcePrograms) in the
+// sbom_modules table, replacing previously indexed rows.
+func (s *server) indexSBOM(ctx context.Context, sbomHash string, sb *parsedSBOM, modules []moduleVersion, source string) error {
+	if _, err := s.queries.deleteSBOMModules.ExecContext(ctx, sbomHash); err != nil {
+		return err
+	}
+	if sb != nil {
+		for _, fh := range sb.GoModHashes {
+			if _, err := s.queries.upsertModule.ExecContext(ctx, sbomHash, packageName(fh.Path), ""); err != nil {
+				return err
+			}
+		}
+	}
+	for _, m := range modules {
+		if _, err := s.queries.upsertModule.ExecContext(ctx, sbomHash, m.Path, m.Version); err != nil {
+			return err
+		}
+	}
+	return s.markIndexed(ctx, sbomHash, source, nil)
+}
+
+// markIndexed records that the SBOM with the specified hash was indexed (or
+// that indexing it failed), so that indexModules does not try again.
+func (s *server) markIndexed(ctx context.Context, sbomHash, source string, indexErr error) error {
+	var errMsg any
+	if indexErr != nil {
+		errMsg = indexErr.Error()
+	}
+	_, err := s.queries.upsertSBOMIndex.ExecContext(ctx, sbomHash, time.Now(), source, errMsg)
+	return err
+}
+
+// indexModules indexes the SBOMs of images and heartbeats which were not yet
+// indexed (see markIndexed), and removes images which are neither ingested nor
+// running on any machine.
+func (s *server) indexModules(ctx context.Context) error {
+	if _, err := s.queries.deleteStaleModules.ExecContext(ctx); err != nil {
+		return err
+	}
+	if _, err := s.queries.deleteStaleIndex.ExecContext(ctx); err != nil {
+		return err
+	}
+	rows, err := s.queries.selectUnindexedSBOMs.QueryContext(ctx)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	sboms := make(map[string]string)
+	for rows.Next() {
+		var sbomHash, sbomJSON string
+		if err := rows.Scan(&sbomHash, &sbomJSON); err != nil {
+			return err
+		}
+		sboms[sbomHash] = sbomJSON
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if err := rows.Close(); err != nil {
+		return err
+	}
+	for sbomHash, sbomJSON := range sboms {
+		sb, err := parseSBOM([]byte(sbomJSON))
+		if err != nil {
+			// SBOMs sent in heartbeats are not validated.
+			log.Printf("cannot index SBOM %q: %v", sbomHash, err)
+			if err := s.markIndexed(ctx, sbomHash, indexSourceSBOM, err); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := s.indexSBOM(ctx, sbomHash, sb, nil, indexSourceSBOM); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// versionConstraint is a module version with a comparison operator, e.g.
+// <v0.17.0.
+type versionConstraint struct {
+	op      string
+	version string
+}
+
+var constraintOps = []string{"<=", ">=", "!=", "<", ">", "="}
+
+func parseVersionConstraint(s string) (*versionConstraint, error) {
+	op := "="
+	for _, o := range constraintOps {
+		if strings.HasPrefix(s, o) {
+			op = o
+			s = strings.TrimPrefix(s, o)
+			break
+		}
+	}
+	s = strings.TrimSpace(s)
+	if !strings.HasPrefix(s, "v") {
+		s = "v" + s
+	}
+	if !semver.IsValid(s) {
+		return nil, fmt.Errorf("invalid version %q (expected e.g. <v0.17.0)", s)
+	}
+	return &versionConstraint{op: op, version: s}, nil
+}
+
+// matches reports whether the (valid) version satisfies the constraint.
+func (vc *versionConstraint) matches(version string) bool {
+	c := semver.Compare(version, vc.version)
+	switch vc.op {
+	case "<":
+		return c < 0
+	case "<=":
+		return c <= 0
+	case ">":
+		return c > 0
+	case ">=":
+		return c >= 0
+	case "!=":
+		return c != 0
+	default:
+		return c == 0
+	}
+}
+
+// Scopes of a module search:
+const (
+	scopeMachines = "machines" // machines which run an image with the module
+	scopeImages   = "images"   // images which contain the module
+)
+
+type moduleQuery struct {
+	Module     string
+	Version    string // version constraint, e.g. <v0.17.0
+	Scope      string
+	constraint *versionConstraint
+}
+
+func parseModuleQuery(q url.Values) (*moduleQuery, error) {
+	mq := &moduleQuery{
+		Module:  strings.TrimSpace(q.Get("module")),
+		Version: strings.TrimSpace(q.Get("version")),
+		Scope:   q.Get("scope"),
+	}
+	switch mq.Scope {
+	case "":
+		mq.Scope = scopeMachines
+	case scopeMachines, scopeImages:
+	default:
+		return nil, fmt.Errorf("invalid scope %q (expected %s or %s)", mq.Scope, scopeMachines, scopeImages)
+	}
+	if mq.Version != "" {
+		vc, err := parseVersionConstraint(mq.Version)
+		if err != nil {
+			return nil, err
+		}
+		mq.constraint = vc
+	}
+	return mq, nil
+}
+
+type moduleMatch struct {
+	MachineID        string `json:"machine_id,omitempty"`
+	Hostname         string `json:"hostname,omitempty"`
+	SBOMHash         string `json:"sbom_hash"`
+	MachineIDPattern string `json:"machine_id_pattern,omitempty"`
+	ModulePath       string `json:"module_path"`
+	// Version is empty if unknown, see indexSBOM.
+	Version string `json:"version,omitempty"`
+}
+
+type moduleSearchResult struct {
+	// Matches contains the module (and packages within it) and, if a version
+	// constraint was specified, only versions which satisfy it.
+	Matches []moduleMatch `json:"matches"`
+	// Unknown contains the matches of images whose module versions are
+	// unknown (see indexSBOM) if a version constraint was specified: they
+	// contain the module, but in which version cannot be determined.
+	Unknown []moduleMatch `json:"unknown"`
+}
+
+var errVersionsUnknown = errors.New("module versions are unknown for all images (GUS reads them from the programs of images ingested with registry_type localdisk or oci), search without a version constraint")
+
+// searchModules returns the matches of mq.Module and of the packages within
+// it.
+func (s *server) searchModules(ctx context.Context, mq *moduleQuery) (*moduleSearchResult, error) {
+	if mq.constraint != nil {
+		var versioned int64
+		if err := s.queries.countSBOMIndex.QueryRowContext(ctx, indexSourcePrograms).Scan(&versioned); err != nil {
+			return nil, err
+		}
+		if versioned == 0 {
+			return nil, httpError(http.StatusBadRequest, errVersionsUnknown)
+		}
+	}
+	prefix := mq.Module + "/"
+	stmt := s.queries.selectModuleMachines
+	if mq.Scope == scopeImages {
+		stmt = s.queries.selectModuleImages
+	}
+	rows, err := stmt.QueryContext(ctx, mq.Module, prefix, len(prefix))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	result := &moduleSearchResult{
+		Matches: []moduleMatch{},
+		Unknown: []moduleMatch{},
+	}
+	for rows.Next() {
+		var (
+			m                 moduleMatch
+			hostname, pattern sql.NullString
+			source            string
+		)
+		if mq.Scope == scopeImages {
+			err = rows.Scan(&m.SBOMHash, &pattern, &m.ModulePath, &m.Version, &source)
+		} else {
+			err = rows.Scan(&m.MachineID, &hostname, &m.SBOMHash, &m.ModulePath, &m.Version, &source)
+		}
+		if err != nil {
+			return nil, err
+		}
+		m.Hostname = hostname.String
+		m.MachineIDPattern = pattern.String
+		switch {
+		case mq.constraint == nil:
+			result.Matches = append(result.Matches, m)
+		case m.Version != "":
+			if semver.IsValid(m.Version) && mq.constraint.matches(m.Version) {
+				result.Matches = append(result.Matches, m)
+			}
+		case source != indexSourcePrograms:
+			result.Unknown = append(result.Unknown, m)
+		}
+		// Packages (without version) of images whose module versions are
+		// known are represented by the rows of their modules.
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return result, rows.Close()
+}
+
+// writeModuleMatches writes result in the specified format (json or csv).
+// csvCell neutralizes values which spreadsheet applications would interpret
+// as a formula (CSV injection): machine IDs and hostnames are sent by devices,
+// so a hostname like =HYPERLINK(…) must not be evaluated when an operator opens
+// the export.
+func csvCell(s string) string {
+	if s != "" && strings.ContainsRune("=+-@\t\r", rune(s[0])) {
+		return "'" + s
+	}
+	return s
+}
+
+func writeModuleMatches(w http.ResponseWriter, format, scope string, result *moduleSearchResult) error {
+	switch format {
+	case "", "json":
+		b, err := json.Marshal(result)
+		if err != nil {
+			return err
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(b)
+		return nil
+
+	case "csv":
+		// Matches of unknown version are marked with the version "unknown".
+		var buf bytes.Buffer
+		cw := csv.NewWriter(&buf)
+		if scope == scopeImages {
+			cw.Write([]string{"sbom_hash", "machine_id_pattern", "module_path", "version"})
+		} else {
+			cw.Write([]string{"machine_id", "hostname", "sbom_hash", "module_path", "version"})
+		}
+		for _, matches := range [][]moduleMatch{result.Matches, result.Unknown} {
+			for _, m := range matches {
+				version := m.Version
+				if version == "" {
+					version = "unknown"
+				}
+				if scope == scopeImages {
+					cw.Write([]string{m.SBOMHash, csvCell(m.MachineIDPattern), m.ModulePath, version})
+				} else {
+					cw.Write([]string{csvCell(m.MachineID), csvCell(m.Hostname), m.SBOMHash, m.ModulePath, version})
+				}
+			}
+		}
+		cw.Flush()
+		if err := cw.Error(); err != nil {
+			return err
+		}
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", "gus-"+scope+".csv"))
+		w.Write(buf.Bytes())
+		return nil
+
+	default:
+		return httpError(http.StatusBadRequest, fmt.Errorf("invalid format %q (expected json or csv)", format))
+	}
+}
+
+// modules serves the results of a module search (?module=, and optionally
+// ?version=, ?scope= and ?format=).
+func (s *server) modules(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "GET" {
+		return httpError(http.StatusBadRequest, fmt.Errorf("invalid method (expected GET)"))
+	}
+	if err := s.authorize(r, ""); err != nil {
+		return err
+	}
+	q := r.URL.Query()
+	mq, err := parseModuleQuery(q)
+	if err != nil {
+		return httpError(http.StatusBadRequest, err)
+	}
+	if mq.Module == "" {
+		return httpError(http.StatusBadRequest, fmt.Errorf("module not set"))
+	}
+	result, err := s.searchModules(r.Context(), mq)
+	if err != nil {
+		return err
+	}
+	return writeModuleMatches(w, q.Get("format"), mq.Scope, result)
+}
+
+// modulesPage renders the module search form and its results, which can be
+// exported with ?format=. Like the API, it requires an API token.
+func (s *server) modulesPage(w http.ResponseWriter, r *http.Request) error {
+	if err := s.authorize(r, ""); err != nil {
+		return err
+	}
+	q := r.URL.Query()
+	mq, err := parseModuleQuery(q)
+	if err != nil {
+		return httpError(http.StatusBadRequest, err)
+	}
+	type section struct {
+		Title   string
+		Matches []moduleMatch
+	}
+	var (
+		result   *moduleSearchResult
+		sections []section
+	)
+	if mq.Module != "" {
+		result, err = s.searchModules(r.Context(), mq)
+		if err != nil {
+			return err
+		}
+		if format := q.Get("format"); format != "" {
+			return writeModuleMatches(w, format, mq.Scope, result)
+		}
+		sections = append(sections, section{Matches: result.Matches})
+		if len(result.Unknown) > 0 {
+			sections = append(sections, section{Title: "Unknown version", Matches: result.Unknown})
+		}
+	}
+	var buf bytes.Buffer
+	if err := templates.ExecuteTemplate(&buf, "modules.tmpl.html", struct {
+		Version     string
+		Query       *moduleQuery
+		Result      *moduleSearchResult
+		Sections    []section
+		ExportQuery string
+	}{
+		Version:  versionBrief,
+		Query:    mq,
+		Result:   result,
+		Sections: sections,
+		ExportQuery: url.Values{
+			"module":  {mq.Module},
+			"version": {mq.Version},
+			"scope":   {mq.Scope},
+		}.Encode(),
+	}); err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	_, err = io.Copy(w, &buf)
+	return err
+}
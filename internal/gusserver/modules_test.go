@@ -0,0 +1,298 @@
+package gusserver
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestVersionConstraint(t *testing.T) {
+	for _, tt := range []struct {
+		constraint string
+		version    string
+		want       bool
+	}{
+		{"<v0.17.0", "v0.16.0", true},
+		{"<v0.17.0", "v0.17.0", false},
+		{"<v0.17.0", "v0.9.0", true},
+		{"<v0.17.0", "v0.17.0-rc.1", true},
+		{"<v0.17.0", "v0.0.0-20230221201649-f3b6ca76639a", true},
+		{"<=v0.17.0", "v0.17.0", true},
+		{">v1.2.3", "v1.10.0", true},
+		{">=v1.2.3", "v1.2.3+incompatible", true},
+		{"!=v1.2.3", "v1.2.3", false},
+		{"v1.2.3", "v1.2.3", true},
+		{"1.2.3", "v1.2.3", true},
+		{"=v1.2.3", "v1.2.4", false},
+		{">v1.0.0-alpha", "v1.0.0-alpha.1", true},
+		{">v1.0.0-alpha.2", "v1.0.0-alpha.10", true},
+		{">v1.0.0-alpha.beta", "v1.0.0-beta", true},
+		{"<v1.0.0-1", "v1.0.0-alpha", false},
+	} {
+		vc, err := parseVersionConstraint(tt.constraint)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := vc.matches(tt.version); got != tt.want {
+			t.Errorf("%s matches %s = %v, want %v", tt.constraint, tt.version, got, tt.want)
+		}
+	}
+
+	for _, invalid := range []string{"", "v1.2.3.4", "v01.2.3", "v1.2.3-", "<latest"} {
+		if _, err := parseVersionConstraint(invalid); err == nil {
+			t.Errorf("parseVersionConstraint(%q) unexpectedly succeeded", invalid)
+		}
+	}
+}
+
+func TestModuleSearch(t *testing.T) {
+	for _, tc := range testDatabases() {
+		t.Run(tc.databaseType, func(t *testing.T) {
+			ts := newTestServer(t, tc.databaseType)
+
+			search := func(params url.Values) (*http.Response, []byte) {
+				t.Helper()
+				resp, err := ts.Client().Get(ts.URL() + "/api/v1/modules?" + params.Encode())
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer resp.Body.Close()
+				b, err := io.ReadAll(resp.Body)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return resp, b
+			}
+			searchOK := func(params url.Values) moduleSearchResult {
+				t.Helper()
+				resp, b := search(params)
+				if resp.StatusCode != http.StatusOK {
+					t.Fatalf("GET modules: got %v, want %v (body: %s)", resp.Status, http.StatusOK, b)
+				}
+				var result moduleSearchResult
+				if err := json.Unmarshal(b, &result); err != nil {
+					t.Fatal(err)
+				}
+				return result
+			}
+
+			// router7 runs an image which GUS only knows from its heartbeats,
+			// so its module versions are unknown.
+			if err := ts.postJSON("/api/v1/heartbeat", &heartbeatRequest{
+				MachineID: "router7",
+				Hostname:  "router7",
+				SBOMHash:  "router7-sbom",
+				SBOM: json.RawMessage(`{
+  "config_hash": {"path": "config.json", "hash": "c0ffee"},
+  "go_mod_hashes": [
+    {"path": "builddir/github.com/rtr7/router7/go.mod", "hash": "def"},
+    {"path": "builddir/golang.org/x/mod/go.mod", "hash": "123"}
+  ]
+}`),
+			}, nil); err != nil {
+				t.Fatal(err)
+			}
+			if err := ts.srv.indexModules(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			// Version constraints cannot match while no image has known
+			// module versions.
+			if resp, b := search(url.Values{"module": {"golang.org/x/mod"}, "version": {"<v1.0.0"}}); resp.StatusCode != http.StatusBadRequest {
+				t.Errorf("search with version constraint: got %v, want %v (body: %s)", resp.Status, http.StatusBadRequest, b)
+			}
+
+			// The image pushed to GUS contains a program, whose build
+			// information lists its modules.
+			program, modules := testProgram(t)
+			var xmod moduleVersion
+			for _, m := range modules {
+				if m.Path == "golang.org/x/mod" {
+					xmod = m
+				}
+			}
+			if xmod.Version == "" {
+				t.Fatalf("test binary does not depend on golang.org/x/mod")
+			}
+			gaf, hash := gafWithRootFS(t, gafTestSBOM{
+				ConfigHash: gafTestFileHash{Path: "config.json", Hash: "c0ffee"},
+				GoModHashes: []gafTestFileHash{
+					{Path: "builddir/github.com/stapelberg/scan2drive/cmd/scan2drive/go.mod", Hash: "abc"},
+				},
+			}, squashfsWithFiles(t, program))
+			pr := ts.push(t, gaf)
+			if err := ts.postJSON("/api/v1/ingest", &ingestRequest{
+				MachineIDPattern: "scan2drive",
+				SBOMHash:         hash,
+				RegistryType:     "localdisk",
+				DownloadLink:     pr.DownloadLink,
+			}, nil); err != nil {
+				t.Fatal(err)
+			}
+			if err := ts.postJSON("/api/v1/heartbeat", &heartbeatRequest{
+				MachineID: "scan2drive",
+				Hostname:  "scan2drive",
+				SBOMHash:  hash,
+			}, nil); err != nil {
+				t.Fatal(err)
+			}
+			// SBOMs which cannot be parsed are recorded, so that they are not
+			// retried on every run.
+			if err := ts.postJSON("/api/v1/heartbeat", &heartbeatRequest{
+				MachineID: "broken",
+				SBOMHash:  "broken-sbom",
+				SBOM:      json.RawMessage(`[1]`),
+			}, nil); err != nil {
+				t.Fatal(err)
+			}
+			if err := ts.srv.indexModules(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			if diff := ts.diffQuery(t, []map[string]any{
+				{"sbom_hash": hash, "source": "programs", "state": "ok"},
+				{"sbom_hash": "broken-sbom", "source": "sbom", "state": "failed"},
+				{"sbom_hash": "router7-sbom", "source": "sbom", "state": "ok"},
+			}, "SELECT sbom_hash, source, CASE WHEN error IS NULL THEN 'ok' ELSE 'failed' END AS state FROM sbom_index ORDER BY sbom_hash"); diff != "" {
+				t.Errorf("sbom_index table: unexpected diff (-want +got):\n%s", diff)
+			}
+
+			scan2drive := moduleMatch{MachineID: "scan2drive", Hostname: "scan2drive", SBOMHash: hash, ModulePath: "golang.org/x/mod", Version: xmod.Version}
+			router7 := moduleMatch{MachineID: "router7", Hostname: "router7", SBOMHash: "router7-sbom", ModulePath: "golang.org/x/mod"}
+
+			// Without a version constraint, all machines with the module
+			// match.
+			got := searchOK(url.Values{"module": {"golang.org/x/mod"}})
+			want := moduleSearchResult{
+				Matches: []moduleMatch{router7, scan2drive},
+				Unknown: []moduleMatch{},
+			}
+			if diff := cmp.Diff(want, got); diff != "" {
+				t.Errorf("search for golang.org/x/mod: unexpected diff (-want +got):\n%s", diff)
+			}
+
+			// Matches with a known version are filtered by the constraint,
+			// machines whose module versions are unknown are listed
+			// separately.
+			got = searchOK(url.Values{"module": {"golang.org/x/mod"}, "version": {"<=" + xmod.Version}})
+			want = moduleSearchResult{
+				Matches: []moduleMatch{scan2drive},
+				Unknown: []moduleMatch{router7},
+			}
+			if diff := cmp.Diff(want, got); diff != "" {
+				t.Errorf("search for golang.org/x/mod <=%s: unexpected diff (-want +got):\n%s", xmod.Version, diff)
+			}
+			got = searchOK(url.Values{"module": {"golang.org/x/mod"}, "version": {">" + xmod.Version}})
+			want = moduleSearchResult{
+				Matches: []moduleMatch{},
+				Unknown: []moduleMatch{router7},
+			}
+			if diff := cmp.Diff(want, got); diff != "" {
+				t.Errorf("search for golang.org/x/mod >%s: unexpected diff (-want +got):\n%s", xmod.Version, diff)
+			}
+
+			// Searching for a module matches the packages within it.
+			got = searchOK(url.Values{"module": {"github.com/stapelberg/scan2drive"}, "scope": {"images"}})
+			want = moduleSearchResult{
+				Matches: []moduleMatch{
+					{SBOMHash: hash, MachineIDPattern: "scan2drive", ModulePath: "github.com/stapelberg/scan2drive/cmd/scan2drive"},
+				},
+				Unknown: []moduleMatch{},
+			}
+			if diff := cmp.Diff(want, got); diff != "" {
+				t.Errorf("search for images with github.com/stapelberg/scan2drive: unexpected diff (-want +got):\n%s", diff)
+			}
+
+			if got := searchOK(url.Values{"module": {"golang.org/x/mo"}}); len(got.Matches) != 0 {
+				t.Errorf("search for golang.org/x/mo: got %+v, want no matches", got)
+			}
+
+			// Results can be exported as CSV from the UI.
+			resp, err := ts.Client().Get(ts.URL() + "/modules?" + url.Values{
+				"module":  {"golang.org/x/mod"},
+				"version": {"<=" + xmod.Version},
+				"format":  {"csv"},
+			}.Encode())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			if got, want := resp.Header.Get("Content-Type"), "text/csv"; !strings.HasPrefix(got, want) {
+				t.Errorf("Content-Type: got %q, want prefix %q", got, want)
+			}
+			records, err := csv.NewReader(resp.Body).ReadAll()
+			if err != nil {
+				t.Fatal(err)
+			}
+			wantRecords := [][]string{
+				{"machine_id", "hostname", "sbom_hash", "module_path", "version"},
+				{"scan2drive", "scan2drive", hash, "golang.org/x/mod", xmod.Version},
+				{"router7", "router7", "router7-sbom", "golang.org/x/mod", "unknown"},
+			}
+			if diff := cmp.Diff(wantRecords, records); diff != "" {
+				t.Errorf("CSV export: unexpected diff (-want +got):\n%s", diff)
+			}
+
+			resp, err = ts.Client().Get(ts.URL() + "/modules?" + url.Values{
+				"module":  {"golang.org/x/mod"},
+				"version": {"<=" + xmod.Version},
+			}.Encode())
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, err := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != http.StatusOK || !strings.Contains(string(b), "1 matches, 1 of unknown version") {
+				t.Errorf("GET /modules: got %v, want %v with 1 match and 1 of unknown version", resp.Status, http.StatusOK)
+			}
+
+			if resp, _ := search(url.Values{"module": {"golang.org/x/mod"}, "version": {"latest"}}); resp.StatusCode != http.StatusBadRequest {
+				t.Errorf("search with invalid version: got %v, want %v", resp.Status, http.StatusBadRequest)
+			}
+
+			// The page and its exports require an API token, like the API.
+			ts.srv.cfg.requireAPIToken = true
+			for _, path := range []string{
+				"/api/v1/modules?module=golang.org/x/mod",
+				"/modules?module=golang.org/x/mod&format=csv",
+				"/modules?module=golang.org/x/mod",
+			} {
+				resp, err := ts.Client().Get(ts.URL() + path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				resp.Body.Close()
+				if resp.StatusCode != http.StatusUnauthorized {
+					t.Errorf("GET %s without token: got %v, want %v", path, resp.Status, http.StatusUnauthorized)
+				}
+			}
+		})
+	}
+}
+
+func TestCSVCell(t *testing.T) {
+	for _, tt := range []struct {
+		in, want string
+	}{
+		{"router7", "router7"},
+		{"", ""},
+		{"=HYPERLINK(\"https://evil.example\")", "'=HYPERLINK(\"https://evil.example\")"},
+		{"+1", "'+1"},
+		{"-1+1", "'-1+1"},
+		{"@SUM(A1)", "'@SUM(A1)"},
+		{"\t=1", "'\t=1"},
+		{"router-=1", "router-=1"},
+	} {
+		if got := csvCell(tt.in); got != tt.want {
+			t.Errorf("csvCell(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
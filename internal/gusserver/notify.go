@@ -0,0 +1,212 @@
+package gusserver
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/smtp"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// Notifications about machines going offline (and recovering, see
+// checkOffline) are sent to all configured sinks:
+//
+//   - webhookNotifier POSTs the notification as JSON to a URL.
+//   - smtpNotifier sends an email via an SMTP relay (without authentication,
+//     typically a local relay like the one on localhost:25).
+//   - execNotifier runs a command, passing the notification as JSON on stdin
+//     and as GUS_* environment variables.
+
+const (
+	notificationFiring   = "firing"
+	notificationResolved = "resolved"
+)
+
+type notification struct {
+	// Status is notificationFiring when the machine went offline, or
+	// notificationResolved when it is back online.
+	Status        string    `json:"status"`
+	MachineID     string    `json:"machine_id"`
+	Hostname      string    `json:"hostname,omitempty"`
+	LastHeartbeat time.Time `json:"last_heartbeat"`
+	// Since is when the machine went offline (or back online).
+	Since   time.Time `json:"since"`
+	Summary string    `json:"summary"`
+}
+
+type notifier interface {
+	notify(ctx context.Context, n *notification) error
+	String() string
+}
+
+type webhookNotifier struct {
+	url    string
+	client *http.Client
+}
+
+func (wn *webhookNotifier) String() string { return "webhook " + wn.url }
+
+func (wn *webhookNotifier) notify(ctx context.Context, n *notification) error {
+	b, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", wn.url, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := wn.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("POST %s: unexpected HTTP status %v", wn.url, resp.Status)
+	}
+	return nil
+}
+
+type smtpNotifier struct {
+	addr string // host:port of the SMTP relay
+	from string
+	to   []string
+}
+
+func newSMTPNotifier(addr, from string, to []string) (*smtpNotifier, error) {
+	// Addresses end up in the email headers, so they must not contain line
+	// breaks (which mail.ParseAddress rejects).
+	if _, err := mail.ParseAddress(from); err != nil {
+		return nil, fmt.Errorf("invalid sender address %q: %v", from, err)
+	}
+	for idx, rcpt := range to {
+		to[idx] = strings.TrimSpace(rcpt)
+		if _, err := mail.ParseAddress(to[idx]); err != nil {
+			return nil, fmt.Errorf("invalid recipient address %q: %v", rcpt, err)
+		}
+	}
+	return &smtpNotifier{
+		addr: addr,
+		from: from,
+		to:   to,
+	}, nil
+}
+
+func (sn *smtpNotifier) String() string { return "smtp " + sn.addr }
+
+// singleLine replaces line breaks in s, which might stem from heartbeats
+// (e.g. the hostname), so that s cannot add email headers or body lines.
+func singleLine(s string) string {
+	return strings.NewReplacer("\r", " ", "\n", " ").Replace(s)
+}
+
+// message returns the email for n.
+func (sn *smtpNotifier) message(n *notification) []byte {
+	subject := fmt.Sprintf("[GUS] [%s] %s", n.Status, n.Summary)
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From: %s\r\n", sn.from)
+	fmt.Fprintf(&buf, "To: %s\r\n", strings.Join(sn.to, ", "))
+	fmt.Fprintf(&buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", singleLine(subject)))
+	fmt.Fprintf(&buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&buf, "Content-Type: text/plain; charset=utf-8\r\n")
+	fmt.Fprintf(&buf, "\r\n")
+	fmt.Fprintf(&buf, "%s\r\n\r\n", singleLine(n.Summary))
+	fmt.Fprintf(&buf, "machine ID:     %s\r\n", singleLine(n.MachineID))
+	fmt.Fprintf(&buf, "hostname:       %s\r\n", singleLine(n.Hostname))
+	fmt.Fprintf(&buf, "last heartbeat: %s\r\n", n.LastHeartbeat.Format(time.RFC3339))
+	return buf.Bytes()
+}
+
+// smtpTimeout bounds sending one email, so that an unresponsive relay does not
+// block further notifications.
+const smtpTimeout = 1 * time.Minute
+
+// notify sends the email like smtp.SendMail, which does not support a timeout
+// or a context.
+func (sn *smtpNotifier) notify(ctx context.Context, n *notification) error {
+	ctx, cancel := context.WithTimeout(ctx, smtpTimeout)
+	defer cancel()
+	host, _, err := net.SplitHostPort(sn.addr)
+	if err != nil {
+		return err
+	}
+	dialer := &net.Dialer{Timeout: smtpTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", sn.addr)
+	if err != nil {
+		return err
+	}
+	deadline, _ := ctx.Deadline()
+	if err := conn.SetDeadline(deadline); err != nil {
+		conn.Close()
+		return err
+	}
+	// Abort once ctx is canceled, e.g. on shutdown.
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(sn.from); err != nil {
+		return err
+	}
+	for _, to := range sn.to {
+		if err := c.Rcpt(to); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(sn.message(n)); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+type execNotifier struct {
+	command string
+}
+
+func (en *execNotifier) String() string { return "exec " + en.command }
+
+func (en *execNotifier) notify(ctx context.Context, n *notification) error {
+	b, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, 1*time.Minute)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, en.command)
+	cmd.Stdin = bytes.NewReader(b)
+	cmd.Env = append(os.Environ(),
+		"GUS_STATUS="+n.Status,
+		"GUS_MACHINE_ID="+n.MachineID,
+		"GUS_HOSTNAME="+n.Hostname,
+		"GUS_LAST_HEARTBEAT="+n.LastHeartbeat.Format(time.RFC3339),
+		"GUS_SUMMARY="+n.Summary)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%v: %v (output: %s)", cmd.Args, err, bytes.TrimSpace(out))
+	}
+	return nil
+}
@@ -0,0 +1,203 @@
+package gusserver
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testNotification() *notification {
+	return &notification{
+		Status:        notificationFiring,
+		MachineID:     "router-1",
+		Hostname:      "router",
+		LastHeartbeat: time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC),
+		Since:         time.Date(2024, 3, 1, 12, 5, 0, 0, time.UTC),
+		Summary:       "router is offline",
+	}
+}
+
+func TestExecNotifier(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("test uses a shell script")
+	}
+	dir := t.TempDir()
+	script := filepath.Join(dir, "notify.sh")
+	if err := os.WriteFile(script, []byte(`#!/bin/sh
+cat > "$(dirname "$0")/stdin"
+echo "$GUS_STATUS $GUS_MACHINE_ID" > "$(dirname "$0")/env"
+`), 0755); err != nil {
+		t.Fatal(err)
+	}
+	en := &execNotifier{command: script}
+	if err := en.notify(context.Background(), testNotification()); err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(filepath.Join(dir, "stdin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got notification
+	if err := json.Unmarshal(b, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.MachineID != "router-1" || got.Status != notificationFiring {
+		t.Errorf("stdin: got %+v, want the notification", got)
+	}
+	b, err = os.ReadFile(filepath.Join(dir, "env"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := strings.TrimSpace(string(b)), "firing router-1"; got != want {
+		t.Errorf("environment: got %q, want %q", got, want)
+	}
+
+	failing := &execNotifier{command: filepath.Join(dir, "nonexistent")}
+	if err := failing.notify(context.Background(), testNotification()); err == nil {
+		t.Errorf("notify with nonexistent command unexpectedly succeeded")
+	}
+}
+
+// fakeSMTPRelay accepts one email and sends its DATA to the returned channel.
+func fakeSMTPRelay(t *testing.T) (string, <-chan string) {
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	mails := make(chan string, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		reply := func(s string) { conn.Write([]byte(s + "\r\n")) }
+		reply("220 localhost ESMTP fake")
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			cmd := strings.ToUpper(strings.TrimSpace(line))
+			switch {
+			case strings.HasPrefix(cmd, "EHLO"), strings.HasPrefix(cmd, "HELO"):
+				reply("250 localhost")
+			case strings.HasPrefix(cmd, "DATA"):
+				reply("354 go ahead")
+				var data strings.Builder
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+					if line == ".\r\n" {
+						break
+					}
+					data.WriteString(line)
+				}
+				mails <- data.String()
+				reply("250 ok")
+			case strings.HasPrefix(cmd, "QUIT"):
+				reply("221 bye")
+				return
+			default:
+				reply("250 ok")
+			}
+		}
+	}()
+	return ln.Addr().String(), mails
+}
+
+func TestSMTPNotifier(t *testing.T) {
+	addr, mails := fakeSMTPRelay(t)
+	sn := &smtpNotifier{
+		addr: addr,
+		from: "gus@localhost",
+		to:   []string{"ops@example.net", "oncall@example.net"},
+	}
+	if err := sn.notify(context.Background(), testNotification()); err != nil {
+		t.Fatal(err)
+	}
+	mail := <-mails
+	for _, want := range []string{
+		"To: ops@example.net, oncall@example.net\r\n",
+		"Subject: [GUS] [firing] router is offline\r\n",
+		"machine ID:     router-1\r\n",
+	} {
+		if !strings.Contains(mail, want) {
+			t.Errorf("email does not contain %q:\n%s", want, mail)
+		}
+	}
+}
+
+func TestSMTPNotifierInjection(t *testing.T) {
+	addr, mails := fakeSMTPRelay(t)
+	sn, err := newSMTPNotifier(addr, "gus@localhost", []string{"ops@example.net"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := testNotification()
+	n.Hostname = "router\r\nBcc: x@example.com"
+	n.Summary = n.Hostname + " is offline"
+	if err := sn.notify(context.Background(), n); err != nil {
+		t.Fatal(err)
+	}
+	mail := <-mails
+	if strings.Contains(mail, "\r\nBcc:") {
+		t.Errorf("hostname added an email header:\n%s", mail)
+	}
+	for _, line := range strings.Split(mail, "\r\n") {
+		if strings.Contains(line, "\n") || strings.Contains(line, "\r") {
+			t.Errorf("email contains a bare line break: %q", line)
+		}
+	}
+
+	for _, tc := range []struct {
+		from string
+		to   []string
+	}{
+		{"gus@localhost\r\nBcc: x@example.com", []string{"ops@example.net"}},
+		{"gus@localhost", []string{"ops@example.net\r\nBcc: x@example.com"}},
+	} {
+		if _, err := newSMTPNotifier(addr, tc.from, tc.to); err == nil {
+			t.Errorf("newSMTPNotifier(%q, %q) unexpectedly succeeded", tc.from, tc.to)
+		}
+	}
+}
+
+func TestSMTPNotifierTimeout(t *testing.T) {
+	// A relay which accepts connections, but never replies.
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(io.Discard, conn) // until the client gives up
+	}()
+	sn := &smtpNotifier{
+		addr: ln.Addr().String(),
+		from: "gus@localhost",
+		to:   []string{"ops@example.net"},
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := sn.notify(ctx, testNotification()); err == nil {
+		t.Errorf("notify via unresponsive relay unexpectedly succeeded")
+	}
+}
@@ -0,0 +1,562 @@
+package gusserver
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Images of registry_type oci are stored as OCI artifacts in a repository of
+// an OCI registry (--oci_repository). Push with ?registry_type=oci uploads the
+// GAF archive as an artifact (see pushArtifact), and ingest references the
+// artifact by digest:
+//
+//	registry.example.net/gokrazy/images@sha256:<manifest digest>
+//
+// Devices cannot talk to the registry, so /api/v1/update hands them a
+// GUS-proxied download link (see ociDownloadLink) instead.
+const registryOCI = "oci"
+
+const (
+	ociManifestMediaType = "application/vnd.oci.image.manifest.v1+json"
+	ociEmptyMediaType    = "application/vnd.oci.empty.v1+json"
+
+	gafArtifactType    = "application/vnd.gokrazy.gaf.v1"
+	gafLayerMediaType  = "application/vnd.gokrazy.gaf.v1+zip"
+	sbomLayerMediaType = "application/vnd.gokrazy.sbom.v1+json"
+
+	ociTitleAnnotation    = "org.opencontainers.image.title"
+	ociCreatedAnnotation  = "org.opencontainers.image.created"
+	sbomHashAnnotation    = "dev.gokrazy.sbom_hash"
+	maxOCIManifestSize    = 4 << 20
+	ociDownloadLinkPrefix = "/oci/"
+)
+
+// ociEmptyConfig is the config blob of artifacts, which carry no
+// configuration, see the image-spec “Guidance for an Empty Descriptor”.
+var ociEmptyConfig = []byte("{}")
+
+type ociDescriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+type ociManifest struct {
+	SchemaVersion int               `json:"schemaVersion"`
+	MediaType     string            `json:"mediaType"`
+	ArtifactType  string            `json:"artifactType,omitempty"`
+	Config        ociDescriptor     `json:"config"`
+	Layers        []ociDescriptor   `json:"layers"`
+	Annotations   map[string]string `json:"annotations,omitempty"`
+}
+
+// layer returns the first layer of the specified media type.
+func (m *ociManifest) layer(mediaType string) (ociDescriptor, bool) {
+	for _, l := range m.Layers {
+		if l.MediaType == mediaType {
+			return l, true
+		}
+	}
+	return ociDescriptor{}, false
+}
+
+func sha256Digest(b []byte) string {
+	sum := sha256.Sum256(b)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+var sha256DigestRe = regexp.MustCompile(`^sha256:[0-9a-f]{64}$`)
+
+// ociRegistry is a client for one repository of an OCI registry, speaking the
+// OCI distribution spec.
+type ociRegistry struct {
+	base       *url.URL // scheme and host
+	repository string   // e.g. gokrazy/images
+	username   string
+	password   string
+	client     *http.Client
+
+	// tempDir is where pushes are buffered before they are uploaded. Empty
+	// means os.TempDir.
+	tempDir string
+
+	mu            sync.Mutex
+	authorization string // Authorization header obtained in authenticate
+}
+
+func newOCIRegistry(repositoryURL, username, password string) (*ociRegistry, error) {
+	u, err := url.Parse(repositoryURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid --oci_repository: %v", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("invalid --oci_repository %q: must be an http:// or https:// URL", repositoryURL)
+	}
+	repository := strings.Trim(u.Path, "/")
+	if repository == "" {
+		return nil, fmt.Errorf("invalid --oci_repository %q: no repository name", repositoryURL)
+	}
+	return &ociRegistry{
+		base:       &url.URL{Scheme: u.Scheme, Host: u.Host},
+		repository: repository,
+		username:   username,
+		password:   password,
+		client:     &http.Client{Timeout: storeRequestTimeout},
+	}, nil
+}
+
+// reference returns the reference of the artifact with the specified
+// manifest digest.
+func (reg *ociRegistry) reference(digest string) string {
+	return reg.base.Host + "/" + reg.repository + "@" + digest
+}
+
+// parseReference returns the manifest digest of ref, which must reference an
+// artifact in this repository by digest.
+func (reg *ociRegistry) parseReference(ref string) (string, error) {
+	name, digest, ok := strings.Cut(ref, "@")
+	if !ok {
+		return "", fmt.Errorf("download_link %q does not reference an image by digest (expected %s)", ref, reg.reference("sha256:…"))
+	}
+	if want := reg.base.Host + "/" + reg.repository; name != want {
+		return "", fmt.Errorf("download_link %q does not refer to repository %s", ref, want)
+	}
+	if !sha256DigestRe.MatchString(digest) {
+		return "", fmt.Errorf("download_link %q: invalid digest %q", ref, digest)
+	}
+	return digest, nil
+}
+
+func (reg *ociRegistry) url(path string) string {
+	return reg.base.String() + "/v2/" + reg.repository + path
+}
+
+// authParams parses the parameters of a WWW-Authenticate challenge, e.g.
+// realm="https://auth.example.net/token",service="registry",scope="…".
+func authParams(s string) map[string]string {
+	params := make(map[string]string)
+	for s != "" {
+		s = strings.TrimLeft(s, " ,")
+		key, rest, ok := strings.Cut(s, "=")
+		if !ok {
+			break
+		}
+		var val string
+		if strings.HasPrefix(rest, `"`) {
+			val, rest, _ = strings.Cut(rest[1:], `"`)
+		} else {
+			val, rest, _ = strings.Cut(rest, ",")
+		}
+		params[strings.ToLower(strings.TrimSpace(key))] = val
+		s = rest
+	}
+	return params
+}
+
+// authenticate handles a WWW-Authenticate challenge: Basic authentication uses
+// the configured credentials directly, Bearer authentication (as implemented
+// by most registries) exchanges them for a token.
+func (reg *ociRegistry) authenticate(ctx context.Context, challenge string) error {
+	scheme, rest, _ := strings.Cut(challenge, " ")
+	var authorization string
+	switch strings.ToLower(scheme) {
+	case "basic":
+		if reg.username == "" {
+			return fmt.Errorf("OCI registry requires authentication, but no credentials are configured")
+		}
+		authorization = "Basic " + base64.StdEncoding.EncodeToString([]byte(reg.username+":"+reg.password))
+
+	case "bearer":
+		params := authParams(rest)
+		realm, err := url.Parse(params["realm"])
+		if err != nil || params["realm"] == "" {
+			return fmt.Errorf("OCI registry: invalid token realm %q", params["realm"])
+		}
+		q := realm.Query()
+		for _, key := range []string{"service", "scope"} {
+			if params[key] != "" {
+				q.Set(key, params[key])
+			}
+		}
+		realm.RawQuery = q.Encode()
+		req, err := http.NewRequestWithContext(ctx, "GET", realm.String(), nil)
+		if err != nil {
+			return err
+		}
+		if reg.username != "" {
+			req.SetBasicAuth(reg.username, reg.password)
+		}
+		resp, err := reg.client.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("OCI registry: fetching token: unexpected HTTP status %v", resp.Status)
+		}
+		var token struct {
+			Token       string `json:"token"`
+			AccessToken string `json:"access_token"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+			return fmt.Errorf("OCI registry: fetching token: %v", err)
+		}
+		if token.Token == "" {
+			token.Token = token.AccessToken
+		}
+		authorization = "Bearer " + token.Token
+
+	default:
+		return fmt.Errorf("OCI registry: unsupported authentication challenge %q", challenge)
+	}
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	reg.authorization = authorization
+	return nil
+}
+
+// do sends a request to the registry, authenticating if required, and returns
+// the response if its status code is one of the expected codes. body (if
+// non-nil) is rewound when the request needs to be repeated.
+func (reg *ociRegistry) do(ctx context.Context, method, u string, header http.Header, body io.ReadSeeker, size int64, expected ...int) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		var rbody io.Reader
+		if body != nil {
+			if _, err := body.Seek(0, io.SeekStart); err != nil {
+				return nil, err
+			}
+			rbody = body
+		}
+		req, err := http.NewRequestWithContext(ctx, method, u, rbody)
+		if err != nil {
+			return nil, err
+		}
+		if body != nil {
+			req.ContentLength = size
+		}
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		reg.mu.Lock()
+		if reg.authorization != "" {
+			req.Header.Set("Authorization", reg.authorization)
+		}
+		reg.mu.Unlock()
+		resp, err := reg.client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode == http.StatusUnauthorized && attempt == 0 {
+			resp.Body.Close()
+			if err := reg.authenticate(ctx, resp.Header.Get("WWW-Authenticate")); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		for _, code := range expected {
+			if resp.StatusCode == code {
+				return resp, nil
+			}
+		}
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		resp.Body.Close()
+		err = fmt.Errorf("OCI registry: %s %s: unexpected HTTP status %v: %s", method, req.URL.Path, resp.Status, strings.TrimSpace(string(b)))
+		if resp.StatusCode == http.StatusNotFound {
+			err = fmt.Errorf("%w: %v", fs.ErrNotExist, err)
+		}
+		return nil, err
+	}
+}
+
+// pushBlob uploads a blob (monolithically), unless the registry already has
+// it.
+func (reg *ociRegistry) pushBlob(ctx context.Context, digest string, body io.ReadSeeker, size int64) error {
+	resp, err := reg.do(ctx, "HEAD", reg.url("/blobs/"+digest), nil, nil, 0, http.StatusOK)
+	if err == nil {
+		resp.Body.Close()
+		return nil // already present
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	resp, err = reg.do(ctx, "POST", reg.url("/blobs/uploads/"), nil, nil, 0, http.StatusAccepted)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	location, err := resp.Request.URL.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		return fmt.Errorf("OCI registry: invalid upload location: %v", err)
+	}
+	q := location.Query()
+	q.Set("digest", digest)
+	location.RawQuery = q.Encode()
+	header := http.Header{"Content-Type": []string{"application/octet-stream"}}
+	resp, err = reg.do(ctx, "PUT", location.String(), header, body, size, http.StatusCreated)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// pushArtifact uploads the GAF archive (and its SBOM, if any) as an artifact
+// and returns the digest of its manifest. The artifact is tagged with the SBOM
+// hash, so that it can be found in registry user interfaces.
+func (reg *ociRegistry) pushArtifact(ctx context.Context, gaf io.ReadSeeker, size int64, gafDigest string, sbom json.RawMessage, sbomHash string) (string, error) {
+	if err := reg.pushBlob(ctx, sha256Digest(ociEmptyConfig), bytes.NewReader(ociEmptyConfig), int64(len(ociEmptyConfig))); err != nil {
+		return "", err
+	}
+	if err := reg.pushBlob(ctx, gafDigest, gaf, size); err != nil {
+		return "", err
+	}
+	manifest := ociManifest{
+		SchemaVersion: 2,
+		MediaType:     ociManifestMediaType,
+		ArtifactType:  gafArtifactType,
+		Config: ociDescriptor{
+			MediaType: ociEmptyMediaType,
+			Digest:    sha256Digest(ociEmptyConfig),
+			Size:      int64(len(ociEmptyConfig)),
+		},
+		Layers: []ociDescriptor{
+			{
+				MediaType:   gafLayerMediaType,
+				Digest:      gafDigest,
+				Size:        size,
+				Annotations: map[string]string{ociTitleAnnotation: "disk.gaf"},
+			},
+		},
+		Annotations: map[string]string{
+			ociCreatedAnnotation: time.Now().UTC().Format(time.RFC3339),
+		},
+	}
+	if len(sbom) > 0 {
+		if err := reg.pushBlob(ctx, sha256Digest(sbom), bytes.NewReader(sbom), int64(len(sbom))); err != nil {
+			return "", err
+		}
+		manifest.Layers = append(manifest.Layers, ociDescriptor{
+			MediaType:   sbomLayerMediaType,
+			Digest:      sha256Digest(sbom),
+			Size:        int64(len(sbom)),
+			Annotations: map[string]string{ociTitleAnnotation: "sbom.json"},
+		})
+		manifest.Annotations[sbomHashAnnotation] = sbomHash
+	}
+	b, err := json.Marshal(&manifest)
+	if err != nil {
+		return "", err
+	}
+	digest := sha256Digest(b)
+	tag := digest
+	if sbomHash != "" {
+		tag = sbomHash
+	}
+	header := http.Header{"Content-Type": []string{ociManifestMediaType}}
+	resp, err := reg.do(ctx, "PUT", reg.url("/manifests/"+tag), header, bytes.NewReader(b), int64(len(b)), http.StatusCreated)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	return digest, nil
+}
+
+// manifest fetches the manifest with the specified digest and verifies it.
+func (reg *ociRegistry) manifest(ctx context.Context, digest string) (*ociManifest, error) {
+	header := http.Header{"Accept": []string{ociManifestMediaType}}
+	resp, err := reg.do(ctx, "GET", reg.url("/manifests/"+digest), header, nil, 0, http.StatusOK)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(io.LimitReader(resp.Body, maxOCIManifestSize))
+	if err != nil {
+		return nil, err
+	}
+	if got := sha256Digest(b); got != digest {
+		return nil, fmt.Errorf("OCI registry: manifest %s has digest %s", digest, got)
+	}
+	var m ociManifest
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, fmt.Errorf("OCI registry: manifest %s: %v", digest, err)
+	}
+	return &m, nil
+}
+
+// openBlob returns the blob described by desc, read with ranged requests.
+func (reg *ociRegistry) openBlob(ctx context.Context, desc ociDescriptor) storedImage {
+	return &rangeImage{
+		get: func(off, length int64) (*http.Response, error) {
+			header := http.Header{"Range": []string{fmt.Sprintf("bytes=%d-%d", off, off+length-1)}}
+			return reg.do(ctx, "GET", reg.url("/blobs/"+desc.Digest), header, nil, 0, http.StatusPartialContent, http.StatusOK)
+		},
+		size: desc.Size,
+	}
+}
+
+// pushOCI handles /api/v1/push?registry_type=oci, see push.
+func (s *server) pushOCI(w http.ResponseWriter, r *http.Request) error {
+	reg := s.cfg.ociRegistry
+	if reg == nil {
+		return httpError(http.StatusForbidden, fmt.Errorf("no --oci_repository configured on this GUS server"))
+	}
+
+	limits, err := s.pushLimits(r, cmp.Or(reg.tempDir, os.TempDir()))
+	if err != nil {
+		return err
+	}
+	limits.quota = noQuota // quotas only cover the image store of this server
+	if err := limits.check(r.ContentLength); err != nil {
+		return err
+	}
+
+	f, err := os.CreateTemp(reg.tempDir, "gus-push-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	h := sha256.New()
+	size, err := io.Copy(io.MultiWriter(f, h), limits.reader(r.Body, 0))
+	if err != nil {
+		return err
+	}
+	sbom, sbomHash, err := readGAFSBOM(f, size)
+	if err != nil {
+		return httpError(http.StatusBadRequest, err)
+	}
+	diskSHA256 := hex.EncodeToString(h.Sum(nil))
+	digest, err := reg.pushArtifact(r.Context(), f, size, "sha256:"+diskSHA256, sbom, sbomHash)
+	if err != nil {
+		return err
+	}
+	log.Printf("Pushed image %q to OCI repository %s (manifest %s)", sbomHash, reg.repository, digest)
+
+	resp, err := json.Marshal(pushResponse{
+		RegistryType: registryOCI,
+		DownloadLink: reg.reference(digest),
+		DiskSHA256:   diskSHA256,
+		SBOMHash:     sbomHash,
+	})
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, err = w.Write(resp)
+	return err
+}
+
+// validateOCIImage verifies that the artifact referenced by ref is a gokrazy
+// image in the configured repository, and that its GAF layer is a valid GAF
+// archive matching the layer digest.
+func (s *server) validateOCIImage(ctx context.Context, ref string) (*localImage, error) {
+	reg := s.cfg.ociRegistry
+	if reg == nil {
+		return nil, httpError(http.StatusBadRequest, fmt.Errorf("no --oci_repository configured on this GUS server"))
+	}
+	digest, err := reg.parseReference(ref)
+	if err != nil {
+		return nil, httpError(http.StatusBadRequest, err)
+	}
+	manifest, err := reg.manifest(ctx, digest)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, httpError(http.StatusBadRequest, fmt.Errorf("download_link %q not found (push the image first)", ref))
+		}
+		return nil, err
+	}
+	layer, ok := manifest.layer(gafLayerMediaType)
+	if !ok || !sha256DigestRe.MatchString(layer.Digest) {
+		return nil, httpError(http.StatusBadRequest, fmt.Errorf("download_link %q is not a gokrazy image (no %s layer)", ref, gafLayerMediaType))
+	}
+	img := reg.openBlob(ctx, layer)
+	defer img.Close()
+	sbomJSON, sbomHash, err := readGAFSBOM(img, img.Size())
+	if err != nil {
+		return nil, httpError(http.StatusBadRequest, fmt.Errorf("download_link %q: %v", ref, err))
+	}
+	if annotated := manifest.Annotations[sbomHashAnnotation]; annotated != "" && annotated != sbomHash {
+		return nil, httpError(http.StatusBadRequest, fmt.Errorf("download_link %q: %s annotation %q does not match the SBOM of the image (%q)", ref, sbomHashAnnotation, annotated, sbomHash))
+	}
+	sum, err := readerSHA256(img)
+	if err != nil {
+		return nil, err
+	}
+	if "sha256:"+sum != layer.Digest {
+		return nil, httpError(http.StatusBadRequest, fmt.Errorf("download_link %q: layer %s has digest sha256:%s", ref, layer.Digest, sum))
+	}
+	modules, modulesErr := readGAFModules(img, img.Size())
+	return &localImage{
+		Size:       layer.Size,
+		SHA256:     sum,
+		SBOMHash:   sbomHash,
+		SBOM:       sbomJSON,
+		Modules:    modules,
+		ModulesErr: modulesErr,
+	}, nil
+}
+
+// ociDownloadLink returns the GUS-proxied download link of the OCI image whose
+// GAF layer has the specified (hex-encoded) SHA-256 hash.
+func ociDownloadLink(diskSHA256 string) string {
+	return ociDownloadLinkPrefix + diskSHA256 + "/disk.gaf"
+}
+
+// downloadOCI serves the GAF layer of ingested OCI images, see
+// ociDownloadLink.
+func (s *server) downloadOCI(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		return httpError(http.StatusMethodNotAllowed, fmt.Errorf("invalid method (expected GET or HEAD)"))
+	}
+	rel := strings.TrimPrefix(r.URL.Path, ociDownloadLinkPrefix)
+	diskSHA256, ok := strings.CutSuffix(rel, "/disk.gaf")
+	if !ok || !sha256DigestRe.MatchString("sha256:"+diskSHA256) {
+		return httpError(http.StatusNotFound, fmt.Errorf("not found"))
+	}
+	reg := s.cfg.ociRegistry
+	if reg == nil {
+		return httpError(http.StatusNotFound, fmt.Errorf("no --oci_repository configured on this GUS server"))
+	}
+	var (
+		sbomHash string
+		diskSize sql.NullInt64
+	)
+	err := s.queries.selectImageByDigest.QueryRowContext(r.Context(), registryOCI, diskSHA256).Scan(
+		&sbomHash,
+		&diskSize)
+	if err == sql.ErrNoRows {
+		return httpError(http.StatusNotFound, fmt.Errorf("no OCI image with disk_sha256 %q", diskSHA256))
+	}
+	if err != nil {
+		return err
+	}
+	if !diskSize.Valid {
+		return fmt.Errorf("image %q: disk_size unknown", sbomHash)
+	}
+	img := reg.openBlob(r.Context(), ociDescriptor{
+		MediaType: gafLayerMediaType,
+		Digest:    "sha256:" + diskSHA256,
+		Size:      diskSize.Int64,
+	})
+	defer img.Close()
+	return serveImage(w, r, img, diskSHA256)
+}
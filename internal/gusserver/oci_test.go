@@ -0,0 +1,319 @@
+package gusserver
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRegistry is an in-process stand-in for an OCI registry with a single
+// repository, which requires Bearer token authentication like most registries
+// do.
+type fakeRegistry struct {
+	t          *testing.T
+	srv        *httptest.Server
+	repository string
+
+	mu        sync.Mutex
+	blobs     map[string][]byte // digest → content
+	manifests map[string][]byte // digest → manifest
+	tags      map[string]string // tag → digest
+	uploads   int
+}
+
+const (
+	fakeRegistryUsername = "gus"
+	fakeRegistryPassword = "hunter2"
+	fakeRegistryToken    = "fake-registry-token"
+)
+
+func newFakeRegistry(t *testing.T) *fakeRegistry {
+	f := &fakeRegistry{
+		t:          t,
+		repository: "gokrazy/images",
+		blobs:      make(map[string][]byte),
+		manifests:  make(map[string][]byte),
+		tags:       make(map[string]string),
+	}
+	f.srv = httptest.NewServer(http.HandlerFunc(f.serveHTTP))
+	t.Cleanup(f.srv.Close)
+	return f
+}
+
+// registry returns an ociRegistry client for the repository of f.
+func (f *fakeRegistry) registry(t *testing.T) *ociRegistry {
+	reg, err := newOCIRegistry(f.srv.URL+"/"+f.repository, fakeRegistryUsername, fakeRegistryPassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reg.tempDir = t.TempDir()
+	return reg
+}
+
+func (f *fakeRegistry) manifest(t *testing.T, reference string) *ociManifest {
+	t.Helper()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if digest, ok := f.tags[reference]; ok {
+		reference = digest
+	}
+	b, ok := f.manifests[reference]
+	if !ok {
+		t.Fatalf("fake registry: manifest %q not found", reference)
+	}
+	var m ociManifest
+	if err := json.Unmarshal(b, &m); err != nil {
+		t.Fatal(err)
+	}
+	return &m
+}
+
+func (f *fakeRegistry) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/token" {
+		if user, pass, ok := r.BasicAuth(); !ok || user != fakeRegistryUsername || pass != fakeRegistryPassword {
+			http.Error(w, "invalid credentials", http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprintf(w, `{"token": %q}`, fakeRegistryToken)
+		return
+	}
+	if r.Header.Get("Authorization") != "Bearer "+fakeRegistryToken {
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="fake",scope="repository:%s:pull,push"`, f.srv.URL, f.repository))
+		http.Error(w, "UNAUTHORIZED", http.StatusUnauthorized)
+		return
+	}
+	rest, ok := strings.CutPrefix(r.URL.Path, "/v2/"+f.repository+"/")
+	if !ok {
+		http.Error(w, "NAME_UNKNOWN", http.StatusNotFound)
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	kind, ref, _ := strings.Cut(rest, "/")
+	switch {
+	case kind == "blobs" && ref == "uploads/" && r.Method == "POST":
+		f.uploads++
+		// A relative location, which the client needs to resolve.
+		w.Header().Set("Location", fmt.Sprintf("/v2/%s/blobs/uploads/%d?state=opaque", f.repository, f.uploads))
+		w.WriteHeader(http.StatusAccepted)
+
+	case kind == "blobs" && strings.HasPrefix(ref, "uploads/") && r.Method == "PUT":
+		if r.URL.Query().Get("state") != "opaque" {
+			http.Error(w, "BLOB_UPLOAD_INVALID", http.StatusBadRequest)
+			return
+		}
+		b, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		digest := r.URL.Query().Get("digest")
+		if got := sha256Digest(b); got != digest {
+			http.Error(w, "DIGEST_INVALID", http.StatusBadRequest)
+			return
+		}
+		f.blobs[digest] = b
+		w.WriteHeader(http.StatusCreated)
+
+	case kind == "blobs" && (r.Method == "GET" || r.Method == "HEAD"):
+		b, ok := f.blobs[ref]
+		if !ok {
+			http.Error(w, "BLOB_UNKNOWN", http.StatusNotFound)
+			return
+		}
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(b))
+
+	case kind == "manifests" && r.Method == "PUT":
+		if got, want := r.Header.Get("Content-Type"), ociManifestMediaType; got != want {
+			http.Error(w, "MANIFEST_INVALID", http.StatusBadRequest)
+			return
+		}
+		b, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var m ociManifest
+		if err := json.Unmarshal(b, &m); err != nil {
+			http.Error(w, "MANIFEST_INVALID", http.StatusBadRequest)
+			return
+		}
+		for _, desc := range append([]ociDescriptor{m.Config}, m.Layers...) {
+			if _, ok := f.blobs[desc.Digest]; !ok {
+				http.Error(w, "MANIFEST_BLOB_UNKNOWN", http.StatusBadRequest)
+				return
+			}
+		}
+		digest := sha256Digest(b)
+		f.manifests[digest] = b
+		if ref != digest {
+			f.tags[ref] = digest
+		}
+		w.Header().Set("Docker-Content-Digest", digest)
+		w.WriteHeader(http.StatusCreated)
+
+	case kind == "manifests" && (r.Method == "GET" || r.Method == "HEAD"):
+		if digest, ok := f.tags[ref]; ok {
+			ref = digest
+		}
+		b, ok := f.manifests[ref]
+		if !ok {
+			http.Error(w, "MANIFEST_UNKNOWN", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", ociManifestMediaType)
+		w.Write(b)
+
+	default:
+		http.Error(w, "UNSUPPORTED", http.StatusMethodNotAllowed)
+	}
+}
+
+func TestOCIImage(t *testing.T) {
+	for _, tc := range testDatabases() {
+		t.Run(tc.databaseType, func(t *testing.T) {
+			ts := newTestServer(t, tc.databaseType)
+			fake := newFakeRegistry(t)
+			ts.srv.cfg.ociRegistry = fake.registry(t)
+
+			gaf, sbomHash := gafWithSBOM(t, gafTestSBOM{
+				ConfigHash: gafTestFileHash{Path: "/home/michael/gokrazy/scan2drive/config.json", Hash: "c0ffee"},
+			})
+			diskSum := sha256.Sum256(gaf)
+			diskSHA256 := hex.EncodeToString(diskSum[:])
+
+			push := func(registryType string) (*http.Response, pushResponse) {
+				t.Helper()
+				req, err := http.NewRequest("PUT", ts.URL()+"/api/v1/push?registry_type="+registryType, bytes.NewReader(gaf))
+				if err != nil {
+					t.Fatal(err)
+				}
+				resp, err := ts.Client().Do(req)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer resp.Body.Close()
+				var pr pushResponse
+				if resp.StatusCode == http.StatusOK {
+					if err := json.NewDecoder(resp.Body).Decode(&pr); err != nil {
+						t.Fatal(err)
+					}
+				}
+				return resp, pr
+			}
+			if resp, _ := push("bogus"); resp.StatusCode != http.StatusBadRequest {
+				t.Errorf("push with invalid registry_type: got HTTP status %v, want %v", resp.Status, http.StatusBadRequest)
+			}
+			resp, pr := push(registryOCI)
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("push: unexpected HTTP status %v", resp.Status)
+			}
+			prefix := strings.TrimPrefix(fake.srv.URL, "http://") + "/gokrazy/images@sha256:"
+			if pr.RegistryType != registryOCI || !strings.HasPrefix(pr.DownloadLink, prefix) {
+				t.Fatalf("push response: got %s %q, want oci %s…", pr.RegistryType, pr.DownloadLink, prefix)
+			}
+			if pr.DiskSHA256 != diskSHA256 || pr.SBOMHash != sbomHash {
+				t.Errorf("push response: got disk_sha256 %q, sbom_hash %q, want %q, %q", pr.DiskSHA256, pr.SBOMHash, diskSHA256, sbomHash)
+			}
+
+			// The artifact is tagged with the SBOM hash and carries the SBOM as
+			// a separate layer.
+			m := fake.manifest(t, sbomHash)
+			if m.ArtifactType != gafArtifactType {
+				t.Errorf("manifest: got artifactType %q, want %q", m.ArtifactType, gafArtifactType)
+			}
+			if got := m.Annotations[sbomHashAnnotation]; got != sbomHash {
+				t.Errorf("manifest: got %s annotation %q, want %q", sbomHashAnnotation, got, sbomHash)
+			}
+			if layer, ok := m.layer(gafLayerMediaType); !ok || layer.Digest != "sha256:"+diskSHA256 {
+				t.Errorf("manifest: GAF layer %+v, want digest sha256:%s", layer, diskSHA256)
+			}
+			if _, ok := m.layer(sbomLayerMediaType); !ok {
+				t.Errorf("manifest: no SBOM layer")
+			}
+
+			ingest := func(sbomHash, downloadLink string) error {
+				return ts.postJSON("/api/v1/ingest", &ingestRequest{
+					MachineIDPattern: "scan2drive",
+					SBOMHash:         sbomHash,
+					RegistryType:     registryOCI,
+					DownloadLink:     downloadLink,
+				}, nil)
+			}
+			repo := strings.TrimPrefix(fake.srv.URL, "http://") + "/gokrazy/images"
+			for _, downloadLink := range []string{
+				repo + ":" + sbomHash, // by tag, not by digest
+				"registry.example.net/gokrazy/images@sha256:" + diskSHA256, // other repository
+				repo + "@sha256:" + strings.Repeat("0", 64),                // unknown manifest
+				repo + "@sha256:" + diskSHA256,                             // a blob, not a manifest
+			} {
+				if err := ingest(sbomHash, downloadLink); err == nil || !strings.Contains(err.Error(), "400") {
+					t.Errorf("ingest(%q): got err %v, want HTTP 400", downloadLink, err)
+				}
+			}
+			if err := ingest("mistyped", pr.DownloadLink); err == nil || !strings.Contains(err.Error(), "400") {
+				t.Errorf("ingest with mismatching sbom_hash: got err %v, want HTTP 400", err)
+			}
+			ts.ensureEmpty(t, "images")
+			if err := ingest(sbomHash, pr.DownloadLink); err != nil {
+				t.Fatal(err)
+			}
+			if diff := ts.diffQuery(t, []map[string]any{
+				{"registry_type": registryOCI, "download_url": pr.DownloadLink, "disk_sha256": diskSHA256},
+			}, "SELECT registry_type, download_url, disk_sha256 FROM images"); diff != "" {
+				t.Errorf("images table: unexpected diff (-want +got):\n%s", diff)
+			}
+
+			// Devices get a plain download link, served by GUS from the
+			// registry.
+			if err := ts.postJSON("/api/v1/heartbeat", &heartbeatRequest{MachineID: "scan2drive"}, nil); err != nil {
+				t.Fatal(err)
+			}
+			var ur updateResponse
+			if err := ts.postJSON("/api/v1/update", &updateRequest{MachineID: "scan2drive"}, &ur); err != nil {
+				t.Fatal(err)
+			}
+			if want := "/oci/" + diskSHA256 + "/disk.gaf"; ur.RegistryType != "localdisk" || ur.DownloadLink != want {
+				t.Fatalf("update response: got %s %q, want localdisk %q", ur.RegistryType, ur.DownloadLink, want)
+			}
+			get := func(path string, header http.Header) (*http.Response, []byte) {
+				t.Helper()
+				req, err := http.NewRequest("GET", ts.URL()+path, nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				req.Header = header
+				resp, err := ts.Client().Do(req)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer resp.Body.Close()
+				b, err := io.ReadAll(resp.Body)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return resp, b
+			}
+			if resp, b := get(ur.DownloadLink, nil); resp.StatusCode != http.StatusOK || !bytes.Equal(b, gaf) {
+				t.Errorf("download: got HTTP status %v and %d bytes, want 200 OK and the pushed image (%d bytes)", resp.Status, len(b), len(gaf))
+			} else if got, want := resp.Header.Get("ETag"), `"`+diskSHA256+`"`; got != want {
+				t.Errorf("download: got ETag %s, want %s", got, want)
+			}
+			if resp, b := get(ur.DownloadLink, http.Header{"Range": []string{"bytes=4-9"}}); resp.StatusCode != http.StatusPartialContent || !bytes.Equal(b, gaf[4:10]) {
+				t.Errorf("ranged download: got HTTP status %v and %q, want 206 and %q", resp.Status, b, gaf[4:10])
+			}
+			if resp, _ := get("/oci/"+strings.Repeat("0", 64)+"/disk.gaf", nil); resp.StatusCode != http.StatusNotFound {
+				t.Errorf("download of unknown image: got HTTP status %v, want %v", resp.Status, http.StatusNotFound)
+			}
+		})
+	}
+}
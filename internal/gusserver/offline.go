@@ -0,0 +1,165 @@
+package gusserver
+
+import (
+	"cmp"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+// A machine is considered offline once it missed config.offlineAfter
+// heartbeat intervals (config.heartbeatInterval). checkOffline records
+// transitions between online and offline in the availability_transitions
+// table (shown in the timeline of the machine, see machine) and notifies the
+// configured sinks (see notifier).
+//
+// To not flood the sinks when a machine flaps, a transition is only notified
+// once the machine stayed in its new state for config.notifyDebounce: a
+// machine which comes back online within that time causes no notifications.
+
+const (
+	availabilityOnline  = "online"
+	availabilityOffline = "offline"
+)
+
+// Kinds of timeline events (see timeline) for availability transitions:
+const (
+	eventOffline = "offline"
+	eventOnline  = "back online"
+)
+
+// offlineThreshold returns after how long without heartbeats a machine is
+// considered offline, or 0 if offline detection is disabled.
+func (s *server) offlineThreshold() time.Duration {
+	return s.cfg.heartbeatInterval * time.Duration(s.cfg.offlineAfter)
+}
+
+// checkOffline updates the availability of all machines and sends
+// notifications about debounced transitions.
+func (s *server) checkOffline(ctx context.Context) error {
+	threshold := s.offlineThreshold()
+	if threshold <= 0 {
+		return nil
+	}
+	rows, err := s.queries.selectAvailability.QueryContext(ctx)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	type machine struct {
+		MachineID     string
+		Hostname      sql.NullString
+		LastHeartbeat time.Time
+		Availability  sql.NullString
+		Since         sql.NullTime
+		Notified      sql.NullString
+	}
+	var machines []machine
+	for rows.Next() {
+		var m machine
+		err := rows.Scan(
+			&m.MachineID,
+			&m.Hostname,
+			&m.LastHeartbeat,
+			&m.Availability,
+			&m.Since,
+			&m.Notified)
+		if err != nil {
+			return err
+		}
+		machines = append(machines, m)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if err := rows.Close(); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	var errs []error
+	for _, m := range machines {
+		state, since := availabilityOnline, m.LastHeartbeat
+		if now.Sub(m.LastHeartbeat) > threshold {
+			state, since = availabilityOffline, m.LastHeartbeat.Add(threshold)
+		}
+		// Machines are online until found offline.
+		if state != cmp.Or(m.Availability.String, availabilityOnline) {
+			log.Printf("machine %q: %s (last heartbeat: %v)", m.MachineID, state, m.LastHeartbeat)
+			since = since.Round(0) // see recordHistory
+			if _, err := s.queries.updateAvailability.ExecContext(ctx, m.MachineID, state, since); err != nil {
+				return err
+			}
+			if _, err := s.queries.insertTransition.ExecContext(ctx, m.MachineID, since, state); err != nil {
+				return err
+			}
+		} else if m.Since.Valid {
+			since = m.Since.Time
+		}
+
+		if state == cmp.Or(m.Notified.String, availabilityOnline) {
+			continue // already notified (or back in the notified state)
+		}
+		if now.Sub(since) < s.cfg.notifyDebounce {
+			continue // wait, the machine might be flapping
+		}
+		n := &notification{
+			Status:        notificationFiring,
+			MachineID:     m.MachineID,
+			Hostname:      m.Hostname.String,
+			LastHeartbeat: m.LastHeartbeat,
+			Since:         since,
+			Summary:       fmt.Sprintf("%s is offline: no heartbeat since %s", cmp.Or(m.Hostname.String, m.MachineID), m.LastHeartbeat.Format(time.RFC3339)),
+		}
+		if state == availabilityOnline {
+			n.Status = notificationResolved
+			n.Summary = fmt.Sprintf("%s is back online", cmp.Or(m.Hostname.String, m.MachineID))
+		}
+		// Failing sinks are not retried: retrying would send duplicate
+		// notifications to the other sinks.
+		for _, nt := range s.cfg.notifiers {
+			if err := nt.notify(ctx, n); err != nil {
+				errs = append(errs, fmt.Errorf("notifying %s about machine %q: %v", nt, m.MachineID, err))
+			}
+		}
+		if _, err := s.queries.updateNotified.ExecContext(ctx, m.MachineID, state); err != nil {
+			return err
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// availabilityEvents returns the availability transitions of machineID as
+// timeline events.
+func (s *server) availabilityEvents(ctx context.Context, machineID string) ([]timelineEvent, error) {
+	rows, err := s.queries.selectTransitions.QueryContext(ctx, machineID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var events []timelineEvent
+	for rows.Next() {
+		var (
+			ts    time.Time
+			state string
+		)
+		if err := rows.Scan(&ts, &state); err != nil {
+			return nil, err
+		}
+		kind := eventOnline
+		if state == availabilityOffline {
+			kind = eventOffline
+		}
+		events = append(events, timelineEvent{
+			Timestamp: ts,
+			Kind:      kind,
+		})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return events, rows.Close()
+}
@@ -0,0 +1,166 @@
+package gusserver
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type recordingNotifier struct {
+	mu            sync.Mutex
+	notifications []notification
+}
+
+func (rn *recordingNotifier) String() string { return "recording" }
+
+func (rn *recordingNotifier) notify(ctx context.Context, n *notification) error {
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+	rn.notifications = append(rn.notifications, *n)
+	return nil
+}
+
+// take returns and clears the recorded notifications as "status machine_id"
+// strings.
+func (rn *recordingNotifier) take() []string {
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+	var got []string
+	for _, n := range rn.notifications {
+		got = append(got, n.Status+" "+n.MachineID)
+	}
+	rn.notifications = nil
+	return got
+}
+
+func TestOfflineDetection(t *testing.T) {
+	for _, tc := range testDatabases() {
+		t.Run(tc.databaseType, func(t *testing.T) {
+			ctx := context.Background()
+			ts := newTestServer(t, tc.databaseType)
+
+			var (
+				webhookMu sync.Mutex
+				webhook   []notification
+			)
+			hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				var n notification
+				if err := json.NewDecoder(r.Body).Decode(&n); err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+				webhookMu.Lock()
+				defer webhookMu.Unlock()
+				webhook = append(webhook, n)
+			}))
+			defer hook.Close()
+
+			rec := &recordingNotifier{}
+			ts.srv.cfg.heartbeatInterval = time.Minute
+			ts.srv.cfg.offlineAfter = 5
+			ts.srv.cfg.notifyDebounce = 10 * time.Minute
+			ts.srv.cfg.notifiers = []notifier{
+				rec,
+				&webhookNotifier{url: hook.URL, client: hook.Client()},
+			}
+
+			heartbeat := func(machineID string) {
+				t.Helper()
+				if err := ts.postJSON("/api/v1/heartbeat", &heartbeatRequest{
+					MachineID: machineID,
+					Hostname:  machineID,
+				}, nil); err != nil {
+					t.Fatal(err)
+				}
+			}
+			// lastHeartbeat pretends the last heartbeat of machineID was ago.
+			lastHeartbeat := func(machineID string, ago time.Duration) {
+				t.Helper()
+				if _, err := ts.srv.db.Exec("UPDATE heartbeats SET timestamp = $1 WHERE machine_id = $2", time.Now().Add(-ago), machineID); err != nil {
+					t.Fatal(err)
+				}
+			}
+			check := func(want ...string) {
+				t.Helper()
+				if err := ts.srv.checkOffline(ctx); err != nil {
+					t.Fatal(err)
+				}
+				got := rec.take()
+				if strings.Join(got, ",") != strings.Join(want, ",") {
+					t.Errorf("notifications: got %q, want %q", got, want)
+				}
+			}
+
+			heartbeat("router-1")
+			heartbeat("router-2")
+			check() // both online
+
+			// router-1 missed enough heartbeats for longer than the debounce.
+			lastHeartbeat("router-1", 20*time.Minute)
+			check("firing router-1")
+			check() // not notified twice
+			{
+				want := []map[string]any{
+					{"machine_id": "router-1", "availability": "offline"},
+					{"machine_id": "router-2", "availability": "online"},
+				}
+				q := "SELECT machine_id, COALESCE(availability, 'online') AS availability FROM machines ORDER BY machine_id ASC"
+				if diff := ts.diffQuery(t, want, q); diff != "" {
+					t.Errorf("machines table: unexpected diff (-want +got):\n%s", diff)
+				}
+			}
+			webhookMu.Lock()
+			if len(webhook) != 1 || webhook[0].Status != notificationFiring || webhook[0].MachineID != "router-1" {
+				t.Errorf("webhook: got %+v, want one firing notification for router-1", webhook)
+			}
+			webhookMu.Unlock()
+
+			// router-2 flaps: it is offline for less than the debounce.
+			lastHeartbeat("router-2", 6*time.Minute)
+			check()
+			heartbeat("router-2")
+			check()
+
+			// router-1 recovers: the resolve notification is sent once it is
+			// back online for the debounce.
+			heartbeat("router-1")
+			check()
+			if _, err := ts.srv.db.Exec("UPDATE machines SET availability_timestamp = $1 WHERE machine_id = $2", time.Now().Add(-11*time.Minute), "router-1"); err != nil {
+				t.Fatal(err)
+			}
+			check("resolved router-1")
+
+			// All transitions are recorded for the timeline.
+			{
+				want := []map[string]any{
+					{"machine_id": "router-1", "availability": "offline"},
+					{"machine_id": "router-1", "availability": "online"},
+					{"machine_id": "router-2", "availability": "offline"},
+					{"machine_id": "router-2", "availability": "online"},
+				}
+				q := "SELECT machine_id, availability FROM availability_transitions ORDER BY machine_id, timestamp ASC"
+				if diff := ts.diffQuery(t, want, q); diff != "" {
+					t.Errorf("availability_transitions table: unexpected diff (-want +got):\n%s", diff)
+				}
+			}
+			resp, err := ts.Client().Get(ts.URL() + machinePathPrefix + "router-2")
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, err := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.Contains(string(b), eventOnline) {
+				t.Errorf("machine page does not contain %q event", eventOnline)
+			}
+		})
+	}
+}
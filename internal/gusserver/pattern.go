@@ -0,0 +1,145 @@
+package gusserver
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// A machine ID pattern selects the machines to which an ingested image
+// applies. The grammar is:
+//
+//	pattern  = [ selector ":" ] expr
+//	selector = "id" | "hostname" | "model"
+//	expr     = "/" regexp "/" | glob
+//
+// Without a selector, the pattern matches against the machine ID. A glob
+// without any of the metacharacters *?[\ is an exact match. Regular
+// expressions use Go syntax (RE2) and are always anchored, i.e. they need to
+// match the entire value. Hostname and model are taken from the most recent
+// heartbeat of each machine.
+//
+// Examples:
+//
+//	0123456789abcdef            exact machine ID
+//	router-*                    machine IDs starting with router-
+//	hostname:/router-[0-9]+/    hostnames router-1, router-2, …
+//	model:Raspberry Pi 4*       all Raspberry Pi 4 models
+//
+// When multiple patterns match a machine, the most specific one wins (see
+// machinePattern.specificity). Among equally specific patterns, the most
+// recently ingested image wins.
+type machinePattern struct {
+	selector string
+	literal  string         // exact match, if non-empty
+	glob     string         // path.Match pattern, if non-empty
+	re       *regexp.Regexp // anchored regular expression, if non-nil
+}
+
+// machineAttrs are the machine attributes against which patterns match.
+type machineAttrs struct {
+	MachineID string
+	Hostname  string
+	Model     string
+}
+
+func parseMachinePattern(pattern string) (*machinePattern, error) {
+	p := &machinePattern{selector: "id"}
+	expr := pattern
+	if sel, rest, ok := strings.Cut(pattern, ":"); ok {
+		switch sel {
+		case "id", "hostname", "model":
+			p.selector = sel
+			expr = rest
+		default:
+			return nil, fmt.Errorf("invalid pattern %q: unknown selector %q (must be one of [id hostname model])", pattern, sel)
+		}
+	}
+	if expr == "" {
+		return nil, fmt.Errorf("invalid pattern %q: empty expression", pattern)
+	}
+	if len(expr) >= 2 && strings.HasPrefix(expr, "/") && strings.HasSuffix(expr, "/") {
+		re, err := regexp.Compile("^(?:" + expr[1:len(expr)-1] + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %v", pattern, err)
+		}
+		p.re = re
+		return p, nil
+	}
+	if !strings.ContainsAny(expr, `*?[\`) {
+		p.literal = expr
+		return p, nil
+	}
+	if _, err := path.Match(expr, ""); err != nil {
+		return nil, fmt.Errorf("invalid pattern %q: %v", pattern, err)
+	}
+	p.glob = expr
+	return p, nil
+}
+
+func (p *machinePattern) match(m machineAttrs) bool {
+	var val string
+	switch p.selector {
+	case "id":
+		val = m.MachineID
+	case "hostname":
+		val = m.Hostname
+	case "model":
+		val = m.Model
+	}
+	if val == "" {
+		return false // never match machines lacking the attribute
+	}
+	switch {
+	case p.literal != "":
+		return val == p.literal
+	case p.re != nil:
+		return p.re.MatchString(val)
+	default:
+		matched, _ := path.Match(p.glob, val) // validated in parseMachinePattern
+		return matched
+	}
+}
+
+// specificity returns a rank for resolving conflicts between multiple patterns
+// matching the same machine. Higher is more specific:
+//
+//  5. exact machine ID
+//  4. exact hostname
+//  3. machine ID glob or regexp
+//  2. hostname glob or regexp
+//  1. model (exact, glob or regexp)
+func (p *machinePattern) specificity() int {
+	exact := p.literal != ""
+	switch p.selector {
+	case "id":
+		if exact {
+			return 5
+		}
+		return 3
+	case "hostname":
+		if exact {
+			return 4
+		}
+		return 2
+	default:
+		return 1
+	}
+}
+
+// mostSpecific returns the index of the most specific of the patterns which
+// match the machine, or -1 if none match. Among equally specific patterns,
+// the first one wins.
+func mostSpecific(patterns []*machinePattern, attrs machineAttrs) int {
+	best := -1
+	for idx, p := range patterns {
+		if !p.match(attrs) {
+			continue
+		}
+		if best == -1 || p.specificity() > patterns[best].specificity() {
+			best = idx
+		}
+	}
+	return best
+}
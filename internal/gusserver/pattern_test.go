@@ -0,0 +1,167 @@
+package gusserver
+
+import (
+	"context"
+	"testing"
+
+	"github.com/antihax/optional"
+	"github.com/gokrazy/gokapi/gusapi"
+)
+
+func TestParseMachinePattern(t *testing.T) {
+	for _, tt := range []struct {
+		pattern string
+		attrs   machineAttrs
+		want    bool
+	}{
+		{"scan2drive", machineAttrs{MachineID: "scan2drive"}, true},
+		{"scan2drive", machineAttrs{MachineID: "scan2drive2"}, false},
+		{"id:scan2drive", machineAttrs{MachineID: "scan2drive"}, true},
+		{"router-*", machineAttrs{MachineID: "router-7"}, true},
+		{"router-*", machineAttrs{MachineID: "scan2drive"}, false},
+		{"router-?", machineAttrs{MachineID: "router-12"}, false},
+		{"/router-[0-9]+/", machineAttrs{MachineID: "router-12"}, true},
+		// regular expressions are anchored
+		{"/router/", machineAttrs{MachineID: "router-12"}, false},
+		{"hostname:router7", machineAttrs{MachineID: "abc", Hostname: "router7"}, true},
+		{"hostname:router*", machineAttrs{MachineID: "router7"}, false},
+		{"model:Raspberry Pi 4*", machineAttrs{Model: "Raspberry Pi 4 Model B Rev 1.1"}, true},
+		{"model:Raspberry Pi 4*", machineAttrs{Model: "Raspberry Pi 3 Model B Rev 1.2"}, false},
+		{"model:/Raspberry Pi [34] .*/", machineAttrs{Model: "Raspberry Pi 3 Model B Rev 1.2"}, true},
+		// patterns never match machines lacking the attribute
+		{"hostname:*", machineAttrs{MachineID: "abc"}, false},
+	} {
+		p, err := parseMachinePattern(tt.pattern)
+		if err != nil {
+			t.Fatalf("parseMachinePattern(%q): %v", tt.pattern, err)
+		}
+		if got := p.match(tt.attrs); got != tt.want {
+			t.Errorf("pattern %q match(%+v) = %v, want %v", tt.pattern, tt.attrs, got, tt.want)
+		}
+	}
+
+	for _, pattern := range []string{
+		"",
+		"id:",
+		"serial:1234",
+		"/router-[/",
+		"router-[",
+	} {
+		if _, err := parseMachinePattern(pattern); err == nil {
+			t.Errorf("parseMachinePattern(%q) unexpectedly succeeded", pattern)
+		}
+	}
+}
+
+func TestBestImage(t *testing.T) {
+	var images []desiredImage
+	// newest first
+	for _, img := range []desiredImage{
+		{SBOMHash: "model", MachineIDPattern: "model:Raspberry Pi 4*"},
+		{SBOMHash: "hostglob", MachineIDPattern: "hostname:router*"},
+		{SBOMHash: "idglob", MachineIDPattern: "router-*"},
+		{SBOMHash: "host", MachineIDPattern: "hostname:router7"},
+		{SBOMHash: "id", MachineIDPattern: "router-7"},
+		{SBOMHash: "olderidglob", MachineIDPattern: "/router-.*/"},
+	} {
+		p, err := parseMachinePattern(img.MachineIDPattern)
+		if err != nil {
+			t.Fatal(err)
+		}
+		img.pattern = p
+		images = append(images, img)
+	}
+
+	for _, tt := range []struct {
+		attrs machineAttrs
+		want  string
+	}{
+		{machineAttrs{MachineID: "router-7", Hostname: "router7", Model: "Raspberry Pi 4 Model B"}, "id"},
+		{machineAttrs{MachineID: "router-8", Hostname: "router7", Model: "Raspberry Pi 4 Model B"}, "host"},
+		{machineAttrs{MachineID: "router-8", Hostname: "router8", Model: "Raspberry Pi 4 Model B"}, "idglob"},
+		{machineAttrs{MachineID: "abc", Hostname: "router8", Model: "Raspberry Pi 4 Model B"}, "hostglob"},
+		{machineAttrs{MachineID: "abc", Hostname: "scan2drive", Model: "Raspberry Pi 4 Model B"}, "model"},
+		{machineAttrs{MachineID: "abc", Hostname: "scan2drive", Model: "Raspberry Pi 3 Model B"}, ""},
+	} {
+		got := ""
+		if img := bestImage(images, tt.attrs); img != nil {
+			got = img.SBOMHash
+		}
+		if got != tt.want {
+			t.Errorf("bestImage(%+v) = %q, want %q", tt.attrs, got, tt.want)
+		}
+	}
+}
+
+func TestIngestPattern(t *testing.T) {
+	testDBs := testDatabases()
+
+	for _, tc := range testDBs {
+		t.Run(tc.databaseType, func(t *testing.T) {
+			ctx := context.Background()
+			ts := newTestServer(t, tc.databaseType)
+			downloadLink := ts.pushImage(t)
+			api := ts.API()
+
+			for _, machineID := range []string{"router-1", "router-2", "scan2drive"} {
+				_, _, err := api.HeartbeatApi.Heartbeat(ctx, &gusapi.HeartbeatApiHeartbeatOpts{
+					Body: optional.NewInterface(&gusapi.HeartbeatRequest{
+						MachineId: machineID,
+						Hostname:  machineID,
+						HumanReadable: &gusapi.HeartbeatRequestHumanReadable{
+							Model: "Raspberry Pi 4 Model B Rev 1.1",
+						},
+					}),
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			for _, ingest := range []gusapi.IngestRequest{
+				{
+					MachineIdPattern: "model:Raspberry Pi 4*",
+					SbomHash:         "allpi4",
+					RegistryType:     "localdisk",
+					DownloadLink:     downloadLink,
+				},
+				{
+					MachineIdPattern: "router-*",
+					SbomHash:         "routers",
+					RegistryType:     "localdisk",
+					DownloadLink:     downloadLink,
+				},
+			} {
+				_, _, err := api.IngestApi.Ingest(ctx, &gusapi.IngestApiIngestOpts{
+					Body: optional.NewInterface(&ingest),
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			want := []map[string]any{
+				{"machine_id": "router-1", "desired_image": "routers"},
+				{"machine_id": "router-2", "desired_image": "routers"},
+				{"machine_id": "scan2drive", "desired_image": "allpi4"},
+			}
+			q := "SELECT machine_id, desired_image FROM machines ORDER BY machine_id"
+			if diff := ts.diffQuery(t, want, q); diff != "" {
+				t.Errorf("machines table: unexpected diff (-want +got):\n%s", diff)
+			}
+
+			// Invalid patterns are rejected at ingestion time
+			_, _, err := api.IngestApi.Ingest(ctx, &gusapi.IngestApiIngestOpts{
+				Body: optional.NewInterface(&gusapi.IngestRequest{
+					MachineIdPattern: "serial:1234",
+					SbomHash:         "invalid",
+					RegistryType:     "localdisk",
+					DownloadLink:     downloadLink,
+				}),
+			})
+			if err == nil {
+				t.Fatalf("ingest with invalid pattern unexpectedly succeeded")
+			}
+		})
+	}
+}
@@ -0,0 +1,203 @@
+package gusserver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+)
+
+// Ingestion policies, stored in machines.ingestion_policy. A NULL policy is
+// treated like policyAutoUpdate.
+const (
+	// policyAutoUpdate machines follow newly ingested images automatically.
+	policyAutoUpdate = "auto-update"
+
+	// policyManual machines get newly ingested images as pending_image, which
+	// an operator needs to approve before it becomes the desired_image.
+	policyManual = "manual"
+
+	// policyPinned machines stay on pinned_image, regardless of ingestion.
+	policyPinned = "pinned"
+)
+
+type policyRequest struct {
+	MachineID       string `json:"machine_id"`
+	IngestionPolicy string `json:"ingestion_policy"`
+	PinnedSBOMHash  string `json:"pinned_sbom_hash"`
+}
+
+type policyResponse struct{}
+
+type approveRequest struct {
+	MachineID string `json:"machine_id"`
+}
+
+type approveResponse struct{}
+
+func (s *server) setPolicy(ctx context.Context, req policyRequest) error {
+	if req.MachineID == "" {
+		return httpError(http.StatusBadRequest, fmt.Errorf("machine_id not set"))
+	}
+
+	var pinned any // NULL unless pinned
+	switch req.IngestionPolicy {
+	case policyAutoUpdate, policyManual:
+		if req.PinnedSBOMHash != "" {
+			return httpError(http.StatusBadRequest, fmt.Errorf("pinned_sbom_hash can only be set with ingestion_policy %q", policyPinned))
+		}
+
+	case policyPinned:
+		if req.PinnedSBOMHash == "" {
+			return httpError(http.StatusBadRequest, fmt.Errorf("pinned_sbom_hash not set"))
+		}
+		// The pinned image must be known so that the update API can serve it.
+		rows, err := s.queries.selectImage.QueryContext(ctx, req.PinnedSBOMHash)
+		if err != nil {
+			return err
+		}
+		found := rows.Next()
+		if err := rows.Close(); err != nil {
+			return err
+		}
+		if !found {
+			return httpError(http.StatusNotFound, fmt.Errorf("image %q not found", req.PinnedSBOMHash))
+		}
+		pinned = req.PinnedSBOMHash
+
+	default:
+		return httpError(http.StatusBadRequest, fmt.Errorf("invalid ingestion_policy: must be one of [%s %s %s]", policyAutoUpdate, policyManual, policyPinned))
+	}
+
+	res, err := s.queries.updateIngestionPolicy.ExecContext(ctx, req.IngestionPolicy, pinned, req.MachineID)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return httpError(http.StatusNotFound, fmt.Errorf("machine_id not found"))
+	}
+
+	log.Printf("Set ingestion policy for machine %q to %q", req.MachineID, req.IngestionPolicy)
+
+	return s.updateDesired()
+}
+
+func (s *server) approveMachine(ctx context.Context, machineID string) error {
+	if machineID == "" {
+		return httpError(http.StatusBadRequest, fmt.Errorf("machine_id not set"))
+	}
+	res, err := s.queries.approvePendingImage.ExecContext(ctx, machineID)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return httpError(http.StatusNotFound, fmt.Errorf("no pending image for machine_id %q", machineID))
+	}
+	log.Printf("Approved pending image for machine %q", machineID)
+	return nil
+}
+
+func (s *server) policy(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "POST" {
+		return httpError(http.StatusBadRequest, fmt.Errorf("invalid method (expected POST)"))
+	}
+	var req policyRequest
+	b, err := io.ReadAll(r.Body)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(b, &req); err != nil {
+		return err
+	}
+
+	if err := s.authorizeMachine(r, req.MachineID); err != nil {
+		return err
+	}
+
+	if err := s.setPolicy(r.Context(), req); err != nil {
+		return err
+	}
+
+	b, err = json.Marshal(&policyResponse{})
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+	return nil
+}
+
+func (s *server) approve(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "POST" {
+		return httpError(http.StatusBadRequest, fmt.Errorf("invalid method (expected POST)"))
+	}
+	var req approveRequest
+	b, err := io.ReadAll(r.Body)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(b, &req); err != nil {
+		return err
+	}
+
+	if err := s.authorizeMachine(r, req.MachineID); err != nil {
+		return err
+	}
+
+	if err := s.approveMachine(r.Context(), req.MachineID); err != nil {
+		return err
+	}
+
+	b, err = json.Marshal(&approveResponse{})
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+	return nil
+}
+
+// policyForm handles the ingestion policy form on the index page.
+func (s *server) policyForm(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "POST" {
+		return httpError(http.StatusBadRequest, fmt.Errorf("invalid method (expected POST)"))
+	}
+	req := policyRequest{
+		MachineID:       r.FormValue("machine_id"),
+		IngestionPolicy: r.FormValue("ingestion_policy"),
+	}
+	if req.IngestionPolicy == policyPinned {
+		req.PinnedSBOMHash = r.FormValue("pinned_sbom_hash")
+	}
+	if err := s.authorizeMachineForm(r, req.MachineID); err != nil {
+		return err
+	}
+
+	if err := s.setPolicy(r.Context(), req); err != nil {
+		return err
+	}
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+	return nil
+}
+
+// approveForm handles the approve button on the index page.
+func (s *server) approveForm(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "POST" {
+		return httpError(http.StatusBadRequest, fmt.Errorf("invalid method (expected POST)"))
+	}
+	if err := s.authorizeMachineForm(r, r.FormValue("machine_id")); err != nil {
+		return err
+	}
+
+	if err := s.approveMachine(r.Context(), r.FormValue("machine_id")); err != nil {
+		return err
+	}
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+	return nil
+}
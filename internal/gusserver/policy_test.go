@@ -0,0 +1,119 @@
+package gusserver
+
+import (
+	"context"
+	"testing"
+
+	"github.com/antihax/optional"
+	"github.com/gokrazy/gokapi/gusapi"
+)
+
+func TestPolicy(t *testing.T) {
+	testDBs := testDatabases()
+
+	for _, tc := range testDBs {
+		t.Run(tc.databaseType, func(t *testing.T) {
+			ctx := context.Background()
+			ts := newTestServer(t, tc.databaseType)
+			downloadLink := ts.pushImage(t)
+			api := ts.API()
+
+			for _, machineID := range []string{"manual", "pinned"} {
+				_, _, err := api.HeartbeatApi.Heartbeat(ctx, &gusapi.HeartbeatApiHeartbeatOpts{
+					Body: optional.NewInterface(&gusapi.HeartbeatRequest{
+						MachineId: machineID,
+					}),
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			ingest := func(sbomHash string) {
+				t.Helper()
+				_, _, err := api.IngestApi.Ingest(ctx, &gusapi.IngestApiIngestOpts{
+					Body: optional.NewInterface(&gusapi.IngestRequest{
+						MachineIdPattern: "*",
+						SbomHash:         sbomHash,
+						RegistryType:     "localdisk",
+						DownloadLink:     downloadLink,
+					}),
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			ingest("first")
+
+			if err := ts.postJSON("/api/v1/policy", policyRequest{
+				MachineID:       "manual",
+				IngestionPolicy: policyManual,
+			}, nil); err != nil {
+				t.Fatal(err)
+			}
+			if err := ts.postJSON("/api/v1/policy", policyRequest{
+				MachineID:       "pinned",
+				IngestionPolicy: policyPinned,
+				PinnedSBOMHash:  "first",
+			}, nil); err != nil {
+				t.Fatal(err)
+			}
+
+			// Pinning to unknown images is rejected
+			if err := ts.postJSON("/api/v1/policy", policyRequest{
+				MachineID:       "pinned",
+				IngestionPolicy: policyPinned,
+				PinnedSBOMHash:  "unknown",
+			}, nil); err == nil {
+				t.Fatalf("pinning to unknown image unexpectedly succeeded")
+			}
+
+			ingest("second")
+
+			// The manual machine has a pending image, the pinned machine
+			// stays on its pinned image.
+			const q = "SELECT machine_id, desired_image, COALESCE(pending_image, '') AS pending_image FROM machines ORDER BY machine_id"
+			{
+				want := []map[string]any{
+					{"machine_id": "manual", "desired_image": "first", "pending_image": "second"},
+					{"machine_id": "pinned", "desired_image": "first", "pending_image": ""},
+				}
+				if diff := ts.diffQuery(t, want, q); diff != "" {
+					t.Errorf("machines table: unexpected diff (-want +got):\n%s", diff)
+				}
+			}
+
+			if err := ts.postJSON("/api/v1/approve", approveRequest{
+				MachineID: "manual",
+			}, nil); err != nil {
+				t.Fatal(err)
+			}
+
+			// Switching back to auto-update follows the latest image.
+			if err := ts.postJSON("/api/v1/policy", policyRequest{
+				MachineID:       "pinned",
+				IngestionPolicy: policyAutoUpdate,
+			}, nil); err != nil {
+				t.Fatal(err)
+			}
+
+			{
+				want := []map[string]any{
+					{"machine_id": "manual", "desired_image": "second", "pending_image": ""},
+					{"machine_id": "pinned", "desired_image": "second", "pending_image": ""},
+				}
+				if diff := ts.diffQuery(t, want, q); diff != "" {
+					t.Errorf("machines table: unexpected diff (-want +got):\n%s", diff)
+				}
+			}
+
+			// Nothing left to approve
+			if err := ts.postJSON("/api/v1/approve", approveRequest{
+				MachineID: "manual",
+			}, nil); err == nil {
+				t.Fatalf("approve without pending image unexpectedly succeeded")
+			}
+		})
+	}
+}
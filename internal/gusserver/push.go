@@ -1,68 +1,121 @@
 package gusserver
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
+	"log"
+	"math/rand"
 	"net/http"
-	"os"
-	"path/filepath"
-	"strings"
 	"time"
-
-	"github.com/google/renameio/v2"
 )
 
 type pushResponse struct {
+	// RegistryType and DownloadLink identify the pushed image when ingesting
+	// it. For localdisk, the download link is a human-readable alias of the
+	// content-addressed image (see contentKey).
+	RegistryType string `json:"registry_type"`
 	DownloadLink string `json:"download_link"`
+	// DiskSHA256 is the hex-encoded SHA-256 hash of the pushed disk.gaf, which
+	// is part of the signed message (see signedMessage).
+	DiskSHA256 string `json:"disk_sha256"`
+	// SBOMHash is the hash of the SBOM contained in the pushed GAF archive (see
+	// readGAFSBOM), or empty if the archive contains no SBOM. Use it as
+	// sbom_hash when ingesting the image.
+	SBOMHash string `json:"sbom_hash"`
 }
 
 // For local testing, use:
 //
 //	% gok -i gokrazy overwrite --gaf /tmp/gokrazy.gaf
 //	% gok -i gokrazy push --gaf /tmp/gokrazy.gaf --server http://localhost:8655
+//
+// With ?registry_type=oci, the image is pushed to the OCI repository instead
+// (see pushOCI). Large images can be pushed in resumable chunks instead, see
+// createUpload.
 func (s *server) push(w http.ResponseWriter, r *http.Request) error {
 	if r.Method != "PUT" {
 		return httpError(http.StatusBadRequest, fmt.Errorf("invalid method (expected PUT)"))
 	}
 
-	if s.cfg.imageDir == "" {
-		return httpError(http.StatusForbidden, fmt.Errorf("no --image_dir configured on this GUS server"))
+	if err := s.authorize(r, ""); err != nil {
+		return err
 	}
 
-	if err := os.MkdirAll(s.cfg.imageDir, 0700); err != nil {
-		return err
+	switch rt := r.URL.Query().Get("registry_type"); rt {
+	case "", "localdisk":
+	case registryOCI:
+		return s.pushOCI(w, r)
+	default:
+		return httpError(http.StatusBadRequest, fmt.Errorf("invalid registry_type %q: must be one of [localdisk oci]", rt))
+	}
+
+	store := s.store()
+	if store == nil {
+		return httpError(http.StatusForbidden, errNoImageStore)
 	}
-	timePrefix := time.Now().Format(time.RFC3339)
-	dir, err := os.MkdirTemp(s.cfg.imageDir, timePrefix+"-")
+
+	limits, err := s.pushLimits(r, s.spoolDir())
 	if err != nil {
 		return err
 	}
-
-	tempDir := filepath.Join(s.cfg.imageDir, "tmp")
-	if err := os.MkdirAll(tempDir, 0700); err != nil {
+	if err := limits.check(r.ContentLength); err != nil {
 		return err
 	}
-	out, err := renameio.NewPendingFile(filepath.Join(dir, "disk.gaf"), renameio.WithTempDir(tempDir))
+
+	out, err := store.Create(r.Context())
 	if err != nil {
 		return err
 	}
 	defer out.Cleanup()
-	if _, err := io.Copy(out, r.Body); err != nil {
+	h := sha256.New()
+	size, err := io.Copy(io.MultiWriter(out, h), limits.reader(r.Body, 0))
+	if err != nil {
 		return err
 	}
-	if err := out.CloseAtomicallyReplace(); err != nil {
+	resp, err := s.commitPush(r.Context(), store, out, size, hex.EncodeToString(h.Sum(nil)), limits.tokenHash)
+	if err != nil {
 		return err
 	}
-
-	rel := strings.TrimPrefix(dir, filepath.Clean(s.cfg.imageDir)+"/")
-	resp, err := json.Marshal(pushResponse{
-		DownloadLink: "/images/" + rel + "/disk.gaf",
-	})
+	b, err := json.Marshal(resp)
 	if err != nil {
 		return err
 	}
 	w.Header().Set("Content-Type", "application/json")
-	_, err = w.Write(resp)
+	_, err = w.Write(b)
 	return err
 }
+
+// commitPush stores the pushed image (of the specified size and SHA-256
+// hash), which was completely written to out, and records an alias for it.
+// tokenHash identifies the API token of the push, for quotas (see
+// pushLimits).
+func (s *server) commitPush(ctx context.Context, store imageStore, out pendingImage, size int64, diskSHA256, tokenHash string) (*pushResponse, error) {
+	_, sbomHash, err := readGAFSBOM(out, size)
+	if err != nil {
+		return nil, httpError(http.StatusBadRequest, err)
+	}
+	s.contentMu.RLock()
+	defer s.contentMu.RUnlock()
+	deduplicated, err := storeContent(ctx, store, out, diskSHA256)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	downloadLink := fmt.Sprintf("/images/%s-%d/disk.gaf", now.Format(time.RFC3339), rand.Uint32())
+	if _, err := s.queries.insertAlias.ExecContext(ctx, downloadLink, diskSHA256, now, size, nullIfEmpty(tokenHash)); err != nil {
+		return nil, err
+	}
+	if deduplicated {
+		log.Printf("Pushed image %s is identical to a stored image, added alias %s", diskSHA256, downloadLink)
+	}
+	return &pushResponse{
+		RegistryType: "localdisk",
+		DownloadLink: downloadLink,
+		DiskSHA256:   diskSHA256,
+		SBOMHash:     sbomHash,
+	}, nil
+}
@@ -3,15 +3,28 @@ package gusserver
 import (
 	"archive/zip"
 	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"fmt"
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 )
 
 func dummyZip(t *testing.T) []byte {
 	t.Helper()
+	return zipWithContents(t, "hello world 👋")
+}
+
+// zipWithContents returns a zip archive containing hello.txt with the
+// specified contents. Use distinct contents to push distinct images, as
+// identical pushes are deduplicated.
+func zipWithContents(t *testing.T, contents string) []byte {
+	t.Helper()
 
 	var buf bytes.Buffer
 	w := zip.NewWriter(&buf)
@@ -20,7 +33,7 @@ func dummyZip(t *testing.T) []byte {
 	if err != nil {
 		t.Fatal(err)
 	}
-	if _, err := f.Write([]byte("hello world 👋")); err != nil {
+	if _, err := f.Write([]byte(contents)); err != nil {
 		t.Fatal(err)
 	}
 
@@ -33,11 +46,13 @@ func dummyZip(t *testing.T) []byte {
 }
 
 func TestPush(t *testing.T) {
-	// The push API does not access or modify any database state, so we only
-	// test it with sqlite.
+	// The only database state the push API modifies is the image_aliases row of
+	// the pushed image, which TestContentAddressedStore covers with all
+	// databases, so we only test it with sqlite.
 	t.Run("sqlite", func(t *testing.T) {
 		srv, mux, err := newServer("sqlite", ":memory:", &config{
-			imageDir: t.TempDir(),
+			imageDir:            t.TempDir(),
+			allowGAFWithoutSBOM: true,
 		})
 		if err != nil {
 			t.Fatal(err)
@@ -70,6 +85,33 @@ func TestPush(t *testing.T) {
 			t.Fatalf("push response unexpectedly contains empty download_link")
 		}
 
+		// images are only served once ingested
+		resp, err = client.Get(testsrv.URL + pr.DownloadLink)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if got, want := resp.StatusCode, http.StatusNotFound; got != want {
+			t.Fatalf("download before ingest: unexpected HTTP status code: got %v, want %v", resp.Status, want)
+		}
+		ingest, err := json.Marshal(&ingestRequest{
+			MachineIDPattern: "scan2drive",
+			SBOMHash:         "abcdefg",
+			RegistryType:     "localdisk",
+			DownloadLink:     pr.DownloadLink,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err = client.Post(testsrv.URL+"/api/v1/ingest", "application/json", bytes.NewReader(ingest))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if got, want := resp.StatusCode, http.StatusOK; got != want {
+			t.Fatalf("ingest: unexpected HTTP status code: got %v, want %v", resp.Status, want)
+		}
+
 		// ensure we can download the same content via the download link
 		req, err = http.NewRequest("GET", testsrv.URL+pr.DownloadLink, nil)
 		if err != nil {
@@ -92,5 +134,179 @@ func TestPush(t *testing.T) {
 		if !bytes.Equal(zipb, body) {
 			t.Fatalf("downloaded contents do not match pushed contents")
 		}
+		sum := sha256.Sum256(zipb)
+		if got, want := resp.Header.Get("ETag"), `"`+hex.EncodeToString(sum[:])+`"`; got != want {
+			t.Errorf("unexpected ETag: got %q, want %q", got, want)
+		}
+		if got, want := resp.Header.Get("Digest"), "sha-256="+base64.StdEncoding.EncodeToString(sum[:]); got != want {
+			t.Errorf("unexpected Digest: got %q, want %q", got, want)
+		}
+
+		// ensure interrupted downloads can be resumed
+		req, err = http.NewRequest("GET", testsrv.URL+pr.DownloadLink, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Range", "bytes=10-")
+		req.Header.Set("If-Range", resp.Header.Get("ETag"))
+		resp, err = client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := resp.StatusCode, http.StatusPartialContent; got != want {
+			t.Fatalf("range request: unexpected HTTP status code: got %v, want %v", resp.Status, want)
+		}
+		body, err = io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatalf("reading response: %v", err)
+		}
+		if !bytes.Equal(zipb[10:], body) {
+			t.Fatalf("range request: downloaded contents do not match pushed contents")
+		}
+
+		// only ingested images can be downloaded, no other files
+		for _, path := range []string{"/images/", "/images/tmp/", pr.DownloadLink + "/../"} {
+			resp, err = client.Get(testsrv.URL + path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if got, want := resp.StatusCode, http.StatusNotFound; got != want {
+				t.Errorf("GET %s: unexpected HTTP status code: got %v, want %v", path, resp.Status, want)
+			}
+		}
 	})
 }
+
+// gafWithSBOM returns a GAF archive containing the SBOM, and the SBOM hash.
+func gafWithSBOM(t *testing.T, sbom gafTestSBOM) ([]byte, string) {
+	t.Helper()
+	return gafWithRootFS(t, sbom, []byte("root.img"))
+}
+
+// gafWithRootFS is like gafWithSBOM, but the GAF archive contains the
+// specified root file system (see squashfsWithFiles).
+func gafWithRootFS(t *testing.T, sbom gafTestSBOM, rootfs []byte) ([]byte, string) {
+	t.Helper()
+
+	// Compute the hash like gokrazy does, independently of sbomHash().
+	indented, err := json.MarshalIndent(sbom, "", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash := fmt.Sprintf("%x", sha256.Sum256(indented))
+
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	for _, name := range []string{"mbr.img", "boot.img", "root.img"} {
+		f, err := w.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		contents := []byte(name)
+		if name == "root.img" {
+			contents = rootfs
+		}
+		if _, err := f.Write(contents); err != nil {
+			t.Fatal(err)
+		}
+	}
+	f, err := w.Create("sbom.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.NewEncoder(f).Encode(struct {
+		SBOMHash string      `json:"sbom_hash"`
+		SBOM     gafTestSBOM `json:"sbom"`
+	}{hash, sbom}); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes(), hash
+}
+
+type gafTestFileHash struct {
+	Path string `json:"path"`
+	Hash string `json:"hash"`
+}
+
+type gafTestSBOM struct {
+	ConfigHash  gafTestFileHash   `json:"config_hash"`
+	GoModHashes []gafTestFileHash `json:"go_mod_hashes"`
+}
+
+func TestPushSBOM(t *testing.T) {
+	for _, tc := range testDatabases() {
+		t.Run(tc.databaseType, func(t *testing.T) {
+			ts := newTestServer(t, tc.databaseType)
+
+			push := func(b []byte) (*http.Response, pushResponse) {
+				t.Helper()
+				req, err := http.NewRequest("PUT", ts.URL()+"/api/v1/push", bytes.NewReader(b))
+				if err != nil {
+					t.Fatal(err)
+				}
+				resp, err := ts.Client().Do(req)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer resp.Body.Close()
+				var pr pushResponse
+				if resp.StatusCode == http.StatusOK {
+					if err := json.NewDecoder(resp.Body).Decode(&pr); err != nil {
+						t.Fatal(err)
+					}
+				}
+				return resp, pr
+			}
+
+			gaf, hash := gafWithSBOM(t, gafTestSBOM{
+				ConfigHash: gafTestFileHash{Path: "/home/michael/gokrazy/scan2drive/config.json", Hash: "c0ffee"},
+				GoModHashes: []gafTestFileHash{
+					{Path: "/home/michael/gokrazy/scan2drive/builddir/github.com/stapelberg/scan2drive/go.mod", Hash: "abc"},
+				},
+			})
+			resp, pr := push(gaf)
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("push: unexpected HTTP status %v", resp.Status)
+			}
+			if got, want := pr.SBOMHash, hash; got != want {
+				t.Fatalf("push response: got sbom_hash %q, want %q", got, want)
+			}
+
+			ingest := func(sbomHash string) error {
+				return ts.postJSON("/api/v1/ingest", &ingestRequest{
+					MachineIDPattern: "scan2drive",
+					SBOMHash:         sbomHash,
+					RegistryType:     "localdisk",
+					DownloadLink:     pr.DownloadLink,
+				}, nil)
+			}
+			if err := ingest("mistyped"); err == nil || !strings.Contains(err.Error(), "400") {
+				t.Errorf("ingest with mismatching sbom_hash: got err %v, want HTTP 400", err)
+			}
+			if err := ingest(hash); err != nil {
+				t.Fatal(err)
+			}
+
+			// An archive whose sbom.json contradicts itself is rejected.
+			var buf bytes.Buffer
+			w := zip.NewWriter(&buf)
+			f, err := w.Create("sbom.json")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := f.Write([]byte(`{"sbom_hash": "abcdefg", "sbom": {"config_hash": {}}}`)); err != nil {
+				t.Fatal(err)
+			}
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if resp, _ := push(buf.Bytes()); resp.StatusCode != http.StatusBadRequest {
+				t.Errorf("push of inconsistent SBOM: got HTTP status %v, want %v", resp.Status, http.StatusBadRequest)
+			}
+		})
+	}
+}
@@ -0,0 +1,158 @@
+package gusserver
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Images of registry_type http are hosted on a web server outside of GUS. The
+// download link is the absolute http:// or https:// URL of the GAF archive,
+// which devices download directly.
+//
+// At ingestion time, GUS verifies the URL with an HTTP HEAD request and
+// records the size (Content-Length) and ETag of the image. If the ingest
+// request specifies disk_sha256 (required once signing keys are registered, as
+// signatures cover it), GUS downloads the image to verify it. Every
+// config.remoteCheckInterval, GUS repeats the HEAD request and flags images
+// which became unreachable or whose contents changed on the index page.
+
+const registryHTTP = "http"
+
+// remoteImage is the result of a HEAD request for a remote image.
+type remoteImage struct {
+	Size int64 // -1 if unknown
+	ETag string
+}
+
+func (s *server) httpClient() *http.Client {
+	if s.cfg.httpClient != nil {
+		return s.cfg.httpClient
+	}
+	return &http.Client{Timeout: 30 * time.Second}
+}
+
+func validateRemoteURL(downloadLink string) error {
+	u, err := url.Parse(downloadLink)
+	if err != nil {
+		return fmt.Errorf("invalid download_link: %v", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("invalid download_link %q: must be an http:// or https:// URL", downloadLink)
+	}
+	if u.Host == "" {
+		return fmt.Errorf("invalid download_link %q: no host", downloadLink)
+	}
+	return nil
+}
+
+// headRemoteImage verifies that the remote image is reachable.
+func (s *server) headRemoteImage(ctx context.Context, downloadLink string) (*remoteImage, error) {
+	req, err := http.NewRequestWithContext(ctx, "HEAD", downloadLink, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.httpClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("HEAD %s: unexpected HTTP status %v", downloadLink, resp.Status)
+	}
+	return &remoteImage{
+		Size: resp.ContentLength,
+		ETag: resp.Header.Get("ETag"),
+	}, nil
+}
+
+// remoteDownloadTimeout bounds downloading a remote image, see remoteSHA256.
+const remoteDownloadTimeout = 10 * time.Minute
+
+// remoteSHA256 downloads the remote image and returns its hex-encoded SHA-256
+// hash.
+func (s *server) remoteSHA256(ctx context.Context, downloadLink string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", downloadLink, nil)
+	if err != nil {
+		return "", err
+	}
+	client := *s.httpClient()
+	client.Timeout = remoteDownloadTimeout
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("GET %s: unexpected HTTP status %v", downloadLink, resp.Status)
+	}
+	sum, err := readerSHA256(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("GET %s: %v", downloadLink, err)
+	}
+	return sum, nil
+}
+
+// checkRemoteImages verifies that all remote images are still reachable and
+// unchanged, and records the results for the index page.
+func (s *server) checkRemoteImages(ctx context.Context) error {
+	rows, err := s.queries.selectRemoteImages.QueryContext(ctx, registryHTTP)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	type remote struct {
+		SBOMHash     string
+		DownloadLink string
+		DiskSize     sql.NullInt64
+		ETag         sql.NullString
+		CheckError   sql.NullString
+	}
+	var images []remote
+	for rows.Next() {
+		var i remote
+		if err := rows.Scan(&i.SBOMHash, &i.DownloadLink, &i.DiskSize, &i.ETag, &i.CheckError); err != nil {
+			return err
+		}
+		images = append(images, i)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if err := rows.Close(); err != nil {
+		return err
+	}
+
+	for _, img := range images {
+		remote, err := s.headRemoteImage(ctx, img.DownloadLink)
+		if err == nil {
+			switch {
+			case img.ETag.Valid && remote.ETag != img.ETag.String:
+				err = fmt.Errorf("contents changed: ETag %s, expected %s", remote.ETag, img.ETag.String)
+			case img.DiskSize.Valid && remote.Size != img.DiskSize.Int64:
+				err = fmt.Errorf("contents changed: size %d, expected %d", remote.Size, img.DiskSize.Int64)
+			}
+		}
+		now := time.Now()
+		if err != nil {
+			if img.CheckError.String != err.Error() {
+				log.Printf("remote image %q (%s) is broken: %v", img.SBOMHash, img.DownloadLink, err)
+			}
+			if _, err := s.queries.updateRemoteCheck.ExecContext(ctx, now, err.Error(), img.SBOMHash); err != nil {
+				return err
+			}
+			continue
+		}
+		if img.CheckError.Valid {
+			log.Printf("remote image %q (%s) is reachable again", img.SBOMHash, img.DownloadLink)
+		}
+		if _, err := s.queries.updateRemoteCheck.ExecContext(ctx, now, nil, img.SBOMHash); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,207 @@
+package gusserver
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestRemoteImage(t *testing.T) {
+	for _, tc := range testDatabases() {
+		t.Run(tc.databaseType, func(t *testing.T) {
+			ctx := context.Background()
+			ts := newTestServer(t, tc.databaseType)
+
+			zipb := dummyZip(t)
+			var (
+				broken atomic.Bool
+				etag   atomic.Value
+			)
+			etag.Store(`"v1"`)
+			registry := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != "/scan2drive/disk.gaf" || broken.Load() {
+					http.NotFound(w, r)
+					return
+				}
+				w.Header().Set("ETag", etag.Load().(string))
+				w.Header().Set("Content-Type", "application/zip")
+				w.Write(zipb)
+			}))
+			defer registry.Close()
+
+			ingest := func(downloadLink string) error {
+				return ts.postJSON("/api/v1/ingest", &ingestRequest{
+					MachineIDPattern: "scan2drive",
+					SBOMHash:         "abcdefg",
+					RegistryType:     "http",
+					DownloadLink:     downloadLink,
+				}, nil)
+			}
+			for _, downloadLink := range []string{
+				"/images/scan2drive/disk.gaf",
+				"ftp://example.net/disk.gaf",
+				registry.URL + "/doesnotexist/disk.gaf",
+			} {
+				if err := ingest(downloadLink); err == nil || !strings.Contains(err.Error(), "400") {
+					t.Errorf("ingest(%q): got err %v, want HTTP 400", downloadLink, err)
+				}
+			}
+			ts.ensureEmpty(t, "images")
+
+			downloadLink := registry.URL + "/scan2drive/disk.gaf"
+			if err := ingest(downloadLink); err != nil {
+				t.Fatal(err)
+			}
+			const q = "SELECT sbom_hash, remote_etag, COALESCE(check_error, '') AS check_error FROM images"
+			if diff := ts.diffQuery(t, []map[string]any{
+				{"sbom_hash": "abcdefg", "remote_etag": `"v1"`, "check_error": ""},
+			}, q); diff != "" {
+				t.Errorf("images table: unexpected diff (-want +got):\n%s", diff)
+			}
+			images, err := ts.srv.loadImages(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := images[0].Size(), uint64(len(zipb)); got != want {
+				t.Errorf("image.Size() = %d, want %d", got, want)
+			}
+
+			indexContains := func(substr string) bool {
+				t.Helper()
+				resp, err := ts.Client().Get(ts.URL())
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer resp.Body.Close()
+				b, err := io.ReadAll(resp.Body)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return strings.Contains(string(b), substr)
+			}
+
+			// A successful check does not flag the image.
+			if err := ts.srv.checkRemoteImages(ctx); err != nil {
+				t.Fatal(err)
+			}
+			if indexContains("broken:") {
+				t.Errorf("index page unexpectedly flags the image as broken")
+			}
+
+			// Broken links are flagged.
+			broken.Store(true)
+			if err := ts.srv.checkRemoteImages(ctx); err != nil {
+				t.Fatal(err)
+			}
+			if !indexContains("broken: HEAD") {
+				t.Errorf("index page does not flag the unreachable image as broken")
+			}
+
+			// So are changed contents.
+			broken.Store(false)
+			etag.Store(`"v2"`)
+			if err := ts.srv.checkRemoteImages(ctx); err != nil {
+				t.Fatal(err)
+			}
+			if !indexContains("contents changed") {
+				t.Errorf("index page does not flag the changed image as broken")
+			}
+
+			// Once the original contents are back, the flag is cleared.
+			etag.Store(`"v1"`)
+			if err := ts.srv.checkRemoteImages(ctx); err != nil {
+				t.Fatal(err)
+			}
+			if diff := ts.diffQuery(t, []map[string]any{
+				{"sbom_hash": "abcdefg", "remote_etag": `"v1"`, "check_error": ""},
+			}, q); diff != "" {
+				t.Errorf("images table: unexpected diff (-want +got):\n%s", diff)
+			}
+
+			// Devices download remote images directly.
+			if err := ts.postJSON("/api/v1/heartbeat", &heartbeatRequest{MachineID: "scan2drive"}, nil); err != nil {
+				t.Fatal(err)
+			}
+			var ur updateResponse
+			if err := ts.postJSON("/api/v1/update", &updateRequest{MachineID: "scan2drive"}, &ur); err != nil {
+				t.Fatal(err)
+			}
+			if ur.RegistryType != "http" || ur.DownloadLink != downloadLink {
+				t.Errorf("update response: got %s %q, want http %q", ur.RegistryType, ur.DownloadLink, downloadLink)
+			}
+		})
+	}
+}
+
+func TestRemoteImageSigned(t *testing.T) {
+	for _, tc := range testDatabases() {
+		t.Run(tc.databaseType, func(t *testing.T) {
+			ctx := context.Background()
+			ts := newTestServer(t, tc.databaseType)
+
+			zipb := dummyZip(t)
+			registry := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/zip")
+				w.Write(zipb)
+			}))
+			defer registry.Close()
+
+			pub, priv, err := ed25519.GenerateKey(nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := ts.srv.addSigningKey(ctx, "ci", base64.StdEncoding.EncodeToString(pub)); err != nil {
+				t.Fatal(err)
+			}
+
+			const sbomHash = "abcdefg"
+			sum := sha256.Sum256(zipb)
+			diskSHA256 := hex.EncodeToString(sum[:])
+			otherSHA256 := strings.Repeat("0", len(diskSHA256))
+			downloadLink := registry.URL + "/scan2drive/disk.gaf"
+			ingest := func(diskSHA256, signedSHA256 string) error {
+				sig := ed25519.Sign(priv, signedMessage(sbomHash, signedSHA256))
+				return ts.postJSON("/api/v1/ingest", &ingestRequest{
+					MachineIDPattern: "scan2drive",
+					SBOMHash:         sbomHash,
+					RegistryType:     "http",
+					DownloadLink:     downloadLink,
+					Signature:        base64.StdEncoding.EncodeToString(sig),
+					DiskSHA256:       diskSHA256,
+				}, nil)
+			}
+
+			// The signature must cover the contents of the remote image.
+			for _, tt := range []struct {
+				desc         string
+				diskSHA256   string
+				signedSHA256 string
+			}{
+				{"without disk_sha256", "", ""},
+				{"with disk_sha256 of different contents", otherSHA256, otherSHA256},
+			} {
+				if err := ingest(tt.diskSHA256, tt.signedSHA256); err == nil || !strings.Contains(err.Error(), "400") {
+					t.Errorf("ingest %s: got err %v, want HTTP 400", tt.desc, err)
+				}
+			}
+			ts.ensureEmpty(t, "images")
+
+			if err := ingest(diskSHA256, diskSHA256); err != nil {
+				t.Fatal(err)
+			}
+			if diff := ts.diffQuery(t, []map[string]any{
+				{"sbom_hash": sbomHash, "disk_sha256": diskSHA256, "signing_key": "ci"},
+			}, "SELECT sbom_hash, disk_sha256, signing_key FROM images"); diff != "" {
+				t.Errorf("images table: unexpected diff (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
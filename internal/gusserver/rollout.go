@@ -0,0 +1,691 @@
+package gusserver
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Rollout states, stored in rollouts.state.
+const (
+	// rolloutRunning rollouts are advanced by advanceRollouts.
+	rolloutRunning = "running"
+
+	// rolloutPaused rollouts keep their admitted machines, but do not admit
+	// any more machines until resumed.
+	rolloutPaused = "paused"
+
+	// rolloutAborted rollouts do not assign their image to any more machines.
+	rolloutAborted = "aborted"
+
+	// rolloutHalted rollouts exceeded their failure threshold. Like aborted
+	// rollouts, they do not assign their image to any more machines. They
+	// cannot be resumed (the failures would halt them again), only aborted.
+	rolloutHalted = "halted"
+
+	// rolloutCompleted rollouts admitted all machines. Their image is treated
+	// like an image without a rollout, i.e. newly matching machines get it
+	// right away.
+	rolloutCompleted = "completed"
+)
+
+// A rollout stages the assignment of an image (identified by its sbom hash)
+// to the machines matching its machine ID pattern: first, the canary wave is
+// admitted. Once all machines of a wave successfully updated and the soak time
+// has passed, the next wave is admitted, until all machines are admitted.
+type rollout struct {
+	SBOMHash          string
+	CreationTimestamp time.Time
+	State             string
+	CanaryMachines    []string
+	CanaryPercent     int
+	WavePercent       int
+	Soak              time.Duration
+	Wave              int // number of admitted waves, 0 = not started
+	WaveTimestamp     sql.NullTime
+
+	// HaltFailurePercent halts the rollout once at least this percentage of
+	// admitted machines failed to update. Zero disables halting.
+	HaltFailurePercent int
+	// SilenceTimeout is the duration after which machines which attempted
+	// an update, but did not send any heartbeats since, count as failed.
+	// Zero disables this check.
+	SilenceTimeout time.Duration
+	// Rollback sets the desired image of all admitted machines back to their
+	// previous known-good image when halting the rollout.
+	Rollback bool
+
+	// admitted maps machine IDs to the wave in which they were admitted.
+	admitted map[string]int
+}
+
+// admits reports whether the rollout allows assigning its image to the
+// specified machine.
+func (ro *rollout) admits(machineID string) bool {
+	switch ro.State {
+	case rolloutCompleted:
+		return true
+	case rolloutAborted, rolloutHalted:
+		return false
+	default:
+		_, ok := ro.admitted[machineID]
+		return ok
+	}
+}
+
+// Admitted returns the number of admitted machines (for the index page).
+func (ro *rollout) Admitted() int { return len(ro.admitted) }
+
+type rolloutSet struct {
+	rollouts   []*rollout // newest first
+	bySBOMHash map[string]*rollout
+}
+
+func (s *server) loadRollouts(ctx context.Context) (*rolloutSet, error) {
+	rows, err := s.queries.selectRollouts.QueryContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	set := &rolloutSet{
+		bySBOMHash: make(map[string]*rollout),
+	}
+	for rows.Next() {
+		ro := rollout{
+			admitted: make(map[string]int),
+		}
+		var (
+			canaryMachines string
+			soakSeconds    int64
+			silenceSeconds int64
+		)
+		err := rows.Scan(
+			&ro.SBOMHash,
+			&ro.CreationTimestamp,
+			&ro.State,
+			&canaryMachines,
+			&ro.CanaryPercent,
+			&ro.WavePercent,
+			&soakSeconds,
+			&ro.Wave,
+			&ro.WaveTimestamp,
+			&ro.HaltFailurePercent,
+			&silenceSeconds,
+			&ro.Rollback)
+		if err != nil {
+			return nil, err
+		}
+		if canaryMachines != "" {
+			ro.CanaryMachines = strings.Split(canaryMachines, ",")
+		}
+		ro.Soak = time.Duration(soakSeconds) * time.Second
+		ro.SilenceTimeout = time.Duration(silenceSeconds) * time.Second
+		set.rollouts = append(set.rollouts, &ro)
+		set.bySBOMHash[ro.SBOMHash] = &ro
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+
+	rows, err = s.queries.selectRolloutMachines.QueryContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			sbomHash  string
+			machineID string
+			wave      int
+		)
+		if err := rows.Scan(&sbomHash, &machineID, &wave); err != nil {
+			return nil, err
+		}
+		if ro, ok := set.bySBOMHash[sbomHash]; ok {
+			ro.admitted[machineID] = wave
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return set, rows.Close()
+}
+
+// percentOf returns percent% of n, rounded up.
+func percentOf(percent, n int) int {
+	return (percent*n + 99) / 100
+}
+
+// nextWave returns the machines to admit next, or done if the rollout is
+// complete. An empty, not done result means the current wave is still in
+// progress. targets are the machines whose desired image the rollout
+// controls, sorted by machine ID.
+func (ro *rollout) nextWave(targets []desiredMachine, now time.Time) (wave []string, done bool) {
+	var candidates []string
+	for _, m := range targets {
+		if _, ok := ro.admitted[m.MachineID]; !ok {
+			candidates = append(candidates, m.MachineID)
+		}
+	}
+
+	if ro.Wave == 0 {
+		// Admit the canary wave: the explicitly specified canary machines,
+		// plus canary_percent of all targets.
+		explicit := make(map[string]bool)
+		for _, id := range ro.CanaryMachines {
+			explicit[id] = true
+		}
+		var rest []string
+		for _, id := range candidates {
+			if explicit[id] {
+				wave = append(wave, id)
+			} else {
+				rest = append(rest, id)
+			}
+		}
+		n := min(percentOf(ro.CanaryPercent, len(targets)), len(rest))
+		return append(wave, rest[:n]...), false
+	}
+
+	// The current wave must have successfully updated and soaked. Like
+	// exceedsFailureThreshold, this only considers machines which were
+	// assigned the image: machines awaiting approval (manual policy) or
+	// enrollment do not update until an operator acts, which must not stall
+	// the rollout.
+	soakStart := ro.WaveTimestamp.Time
+	for _, m := range targets {
+		if ro.admitted[m.MachineID] != ro.Wave {
+			continue
+		}
+		if m.DesiredImage.String != ro.SBOMHash {
+			continue // not (yet) assigned, e.g. pending approval
+		}
+		if m.UpdateState.String != updateStateSucceeded {
+			return nil, false
+		}
+		if ts := m.UpdateStateTimestamp.Time; ts.After(soakStart) {
+			soakStart = ts
+		}
+	}
+	if now.Sub(soakStart) < ro.Soak {
+		return nil, false
+	}
+
+	if len(candidates) == 0 {
+		return nil, true
+	}
+	n := max(percentOf(ro.WavePercent, len(targets)), 1)
+	return candidates[:min(n, len(candidates))], false
+}
+
+// failed reports whether the machine failed to update to the rollout image:
+// either its update state is failed, or it went silent after attempting the
+// update.
+func (ro *rollout) failed(m desiredMachine, now time.Time) bool {
+	switch m.UpdateState.String {
+	case updateStateFailed:
+		return true
+	case updateStateAttempted:
+		if ro.SilenceTimeout == 0 {
+			return false
+		}
+		lastSign := m.UpdateStateTimestamp.Time
+		if ts := m.LastHeartbeat.Time; ts.After(lastSign) {
+			lastSign = ts
+		}
+		return now.Sub(lastSign) > ro.SilenceTimeout
+	}
+	return false
+}
+
+// exceedsFailureThreshold reports whether too many of the admitted machines
+// failed to update.
+func (ro *rollout) exceedsFailureThreshold(machines []desiredMachine, now time.Time) (failed, admitted int, exceeded bool) {
+	for _, m := range machines {
+		if _, ok := ro.admitted[m.MachineID]; !ok {
+			continue
+		}
+		if m.DesiredImage.String != ro.SBOMHash {
+			continue // not (yet) assigned, e.g. pending approval
+		}
+		admitted++
+		if ro.failed(m, now) {
+			failed++
+		}
+	}
+	if ro.HaltFailurePercent == 0 || failed == 0 {
+		return failed, admitted, false
+	}
+	return failed, admitted, failed*100 >= ro.HaltFailurePercent*admitted
+}
+
+// knownGoodImage returns the image to roll back machineID to if badSBOMHash
+// fails, or "" if there is none.
+func (s *server) knownGoodImage(ctx context.Context, machineID, badSBOMHash string) (string, error) {
+	rows, err := s.queries.selectKnownGoodImage.QueryContext(ctx, machineID, badSBOMHash)
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+	var knownGood string
+	if rows.Next() {
+		if err := rows.Scan(&knownGood); err != nil {
+			return "", err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return "", err
+	}
+	return knownGood, rows.Close()
+}
+
+// halt halts the rollout and, if configured, rolls back all admitted machines
+// to their previous known-good image.
+func (s *server) halt(ctx context.Context, ro *rollout, machines []desiredMachine) error {
+	if _, err := s.queries.updateRolloutState.ExecContext(ctx, rolloutHalted, ro.SBOMHash); err != nil {
+		return err
+	}
+	ro.State = rolloutHalted
+	if !ro.Rollback {
+		return nil
+	}
+	for _, m := range machines {
+		if _, ok := ro.admitted[m.MachineID]; !ok {
+			continue
+		}
+		if m.DesiredImage.String != ro.SBOMHash {
+			continue
+		}
+		knownGood, err := s.knownGoodImage(ctx, m.MachineID, ro.SBOMHash)
+		if err != nil {
+			return err
+		}
+		if knownGood == "" {
+			log.Printf("rollout %q: no known-good image to roll back machine %q to", ro.SBOMHash, m.MachineID)
+			continue
+		}
+		log.Printf("rollout %q: rolling back machine %q to %q", ro.SBOMHash, m.MachineID, knownGood)
+		if _, err := s.queries.updateDesiredImage.ExecContext(ctx, knownGood, m.MachineID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// advanceRollouts halts rollouts which exceed their failure threshold and
+// admits the next wave of machines into each running rollout
+// whose current wave has successfully updated and soaked.
+func (s *server) advanceRollouts(ctx context.Context) error {
+	s.rolloutMu.Lock()
+	defer s.rolloutMu.Unlock()
+
+	rollouts, err := s.loadRollouts(ctx)
+	if err != nil {
+		return err
+	}
+	machines, err := s.loadDesiredMachines(ctx)
+	if err != nil {
+		return err
+	}
+	images, err := s.loadDesiredImages(ctx)
+	if err != nil {
+		return err
+	}
+	sort.Slice(machines, func(i, j int) bool {
+		return machines[i].MachineID < machines[j].MachineID
+	})
+
+	now := time.Now()
+	changed := false
+	for _, ro := range rollouts.rollouts {
+		if ro.State == rolloutRunning || ro.State == rolloutPaused {
+			if failed, admitted, exceeded := ro.exceedsFailureThreshold(machines, now); exceeded {
+				log.Printf("rollout %q: %d of %d admitted machines failed, halting", ro.SBOMHash, failed, admitted)
+				if err := s.halt(ctx, ro, machines); err != nil {
+					return err
+				}
+				changed = true
+			}
+		}
+		if ro.State != rolloutRunning {
+			continue
+		}
+		var targets []desiredMachine
+		for _, m := range machines {
+			if m.IngestionPolicy.String == policyPinned {
+				continue
+			}
+			if img := bestImage(images, m.attrs()); img == nil || img.SBOMHash != ro.SBOMHash {
+				continue
+			}
+			targets = append(targets, m)
+		}
+		if len(targets) == 0 {
+			continue // image not yet ingested, or no machines match
+		}
+
+		wave, done := ro.nextWave(targets, now)
+		if done {
+			log.Printf("rollout %q: completed", ro.SBOMHash)
+			if _, err := s.queries.updateRolloutState.ExecContext(ctx, rolloutCompleted, ro.SBOMHash); err != nil {
+				return err
+			}
+			changed = true
+			continue
+		}
+		if wave == nil && ro.Wave > 0 {
+			continue // current wave still in progress
+		}
+		ro.Wave++
+		log.Printf("rollout %q: admitting wave %d: %q", ro.SBOMHash, ro.Wave, wave)
+		for _, machineID := range wave {
+			if _, err := s.queries.insertRolloutMachine.ExecContext(ctx, ro.SBOMHash, machineID, ro.Wave); err != nil {
+				return err
+			}
+		}
+		if _, err := s.queries.updateRolloutWave.ExecContext(ctx, ro.Wave, now, ro.SBOMHash); err != nil {
+			return err
+		}
+		changed = true
+	}
+	if !changed {
+		return nil
+	}
+	return s.updateDesired()
+}
+
+type rolloutRequest struct {
+	// Action is one of create, pause, resume or abort.
+	Action   string `json:"action"`
+	SBOMHash string `json:"sbom_hash"`
+
+	// The following fields are only used by the create action.
+	CanaryMachineIDs []string `json:"canary_machine_ids"`
+	CanaryPercent    int      `json:"canary_percent"`
+	WavePercent      int      `json:"wave_percent"` // defaults to 100
+	Soak             string   `json:"soak"`         // time.ParseDuration syntax
+
+	// Failure handling, see the corresponding rollout fields. For halting
+	// without staging, use a canary_percent of 100.
+	HaltFailurePercent int    `json:"halt_failure_percent"`
+	SilenceTimeout     string `json:"silence_timeout"` // time.ParseDuration syntax
+	Rollback           bool   `json:"rollback"`
+}
+
+type rolloutResponse struct{}
+
+// newRollout validates req and returns the rollout to create, see
+// insertRollout.
+func (s *server) newRollout(ctx context.Context, req rolloutRequest) (*rollout, error) {
+	if req.SBOMHash == "" {
+		return nil, httpError(http.StatusBadRequest, fmt.Errorf("sbom_hash not set"))
+	}
+	if req.CanaryPercent < 0 || req.CanaryPercent > 100 {
+		return nil, httpError(http.StatusBadRequest, fmt.Errorf("canary_percent must be within [0, 100]"))
+	}
+	if req.WavePercent == 0 {
+		req.WavePercent = 100
+	}
+	if req.WavePercent < 0 || req.WavePercent > 100 {
+		return nil, httpError(http.StatusBadRequest, fmt.Errorf("wave_percent must be within [1, 100]"))
+	}
+	if req.HaltFailurePercent < 0 || req.HaltFailurePercent > 100 {
+		return nil, httpError(http.StatusBadRequest, fmt.Errorf("halt_failure_percent must be within [0, 100]"))
+	}
+	var soak, silenceTimeout time.Duration
+	for _, field := range []struct {
+		name string
+		val  string
+		dest *time.Duration
+	}{
+		{"soak", req.Soak, &soak},
+		{"silence_timeout", req.SilenceTimeout, &silenceTimeout},
+	} {
+		if field.val == "" {
+			continue
+		}
+		d, err := time.ParseDuration(field.val)
+		if err != nil {
+			return nil, httpError(http.StatusBadRequest, fmt.Errorf("invalid %s: %v", field.name, err))
+		}
+		if d < 0 {
+			return nil, httpError(http.StatusBadRequest, fmt.Errorf("%s must not be negative", field.name))
+		}
+		*field.dest = d
+	}
+	for _, id := range req.CanaryMachineIDs {
+		if id == "" || strings.ContainsRune(id, ',') {
+			return nil, httpError(http.StatusBadRequest, fmt.Errorf("invalid canary machine ID %q", id))
+		}
+	}
+
+	rollouts, err := s.loadRollouts(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := rollouts.bySBOMHash[req.SBOMHash]; ok {
+		return nil, httpError(http.StatusConflict, fmt.Errorf("rollout for %q already exists", req.SBOMHash))
+	}
+
+	// Once ingested, an image is assigned to all matching machines right
+	// away (see updateDesired), so a rollout created afterwards would not
+	// stage anything.
+	machines, err := s.loadDesiredMachines(ctx)
+	if err != nil {
+		return nil, err
+	}
+	assigned := 0
+	for _, m := range machines {
+		if m.DesiredImage.String == req.SBOMHash {
+			assigned++
+		}
+	}
+	if assigned > 0 {
+		return nil, httpError(http.StatusConflict, fmt.Errorf("image %q is already assigned to %d machines, create the rollout before or when ingesting the image", req.SBOMHash, assigned))
+	}
+
+	return &rollout{
+		SBOMHash:           req.SBOMHash,
+		CreationTimestamp:  time.Now(),
+		State:              rolloutRunning,
+		CanaryMachines:     req.CanaryMachineIDs,
+		CanaryPercent:      req.CanaryPercent,
+		WavePercent:        req.WavePercent,
+		Soak:               soak,
+		HaltFailurePercent: req.HaltFailurePercent,
+		SilenceTimeout:     silenceTimeout,
+		Rollback:           req.Rollback,
+	}, nil
+}
+
+// insertRollout creates ro, as part of tx if non-nil (see ingest).
+func (s *server) insertRollout(ctx context.Context, tx *sql.Tx, ro *rollout) error {
+	stmt := s.queries.insertRollout
+	if tx != nil {
+		stmt = tx.StmtContext(ctx, stmt)
+	}
+	_, err := stmt.ExecContext(ctx,
+		ro.SBOMHash,
+		ro.CreationTimestamp,
+		ro.State,
+		strings.Join(ro.CanaryMachines, ","),
+		ro.CanaryPercent,
+		ro.WavePercent,
+		int64(ro.Soak/time.Second),
+		ro.HaltFailurePercent,
+		int64(ro.SilenceTimeout/time.Second),
+		ro.Rollback)
+	if err != nil {
+		return err
+	}
+	log.Printf("Created rollout for %q (canaries %q + %d%%, waves of %d%%, soak %v, halt at %d%% failures)", ro.SBOMHash, ro.CanaryMachines, ro.CanaryPercent, ro.WavePercent, ro.Soak, ro.HaltFailurePercent)
+	return nil
+}
+
+func (s *server) createRollout(ctx context.Context, req rolloutRequest) error {
+	ro, err := s.newRollout(ctx, req)
+	if err != nil {
+		return err
+	}
+	return s.insertRollout(ctx, nil, ro)
+}
+
+func (s *server) changeRollout(ctx context.Context, req rolloutRequest) error {
+	if req.Action == "create" {
+		if err := s.createRollout(ctx, req); err != nil {
+			return err
+		}
+		return s.advanceRollouts(ctx)
+	}
+
+	if req.SBOMHash == "" {
+		return httpError(http.StatusBadRequest, fmt.Errorf("sbom_hash not set"))
+	}
+	var from []string
+	var to string
+	switch req.Action {
+	case "pause":
+		from, to = []string{rolloutRunning}, rolloutPaused
+	case "resume":
+		from, to = []string{rolloutPaused}, rolloutRunning
+	case "abort":
+		from, to = []string{rolloutRunning, rolloutPaused, rolloutHalted}, rolloutAborted
+	default:
+		return httpError(http.StatusBadRequest, fmt.Errorf("invalid action: must be one of [create pause resume abort]"))
+	}
+	rollouts, err := s.loadRollouts(ctx)
+	if err != nil {
+		return err
+	}
+	ro, ok := rollouts.bySBOMHash[req.SBOMHash]
+	if !ok {
+		return httpError(http.StatusNotFound, fmt.Errorf("rollout for %q not found", req.SBOMHash))
+	}
+	valid := false
+	for _, state := range from {
+		valid = valid || ro.State == state
+	}
+	if !valid {
+		return httpError(http.StatusConflict, fmt.Errorf("cannot %s rollout in state %q", req.Action, ro.State))
+	}
+	if _, err := s.queries.updateRolloutState.ExecContext(ctx, to, req.SBOMHash); err != nil {
+		return err
+	}
+	log.Printf("rollout %q: %s", req.SBOMHash, to)
+	if to == rolloutRunning {
+		return s.advanceRollouts(ctx)
+	}
+	return nil
+}
+
+// authorizeRollout returns an error unless the API token of r may change the
+// rollout of the image with the specified sbom hash, i.e. its scopes permit
+// the machine ID pattern of the image.
+func (s *server) authorizeRollout(r *http.Request, sbomHash string) error {
+	if !s.cfg.requireAPIToken {
+		return nil
+	}
+	if err := s.authorize(r, ""); err != nil {
+		return err
+	}
+	var pattern string
+	err := s.queries.selectImagePattern.QueryRowContext(r.Context(), sbomHash).Scan(&pattern)
+	if err == sql.ErrNoRows {
+		return httpError(http.StatusNotFound, fmt.Errorf("image %q not found", sbomHash))
+	}
+	if err != nil {
+		return err
+	}
+	return s.authorize(r, pattern)
+}
+
+func (s *server) rollout(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "POST" {
+		return httpError(http.StatusBadRequest, fmt.Errorf("invalid method (expected POST)"))
+	}
+	var req rolloutRequest
+	b, err := io.ReadAll(r.Body)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(b, &req); err != nil {
+		return err
+	}
+
+	if err := s.authorizeRollout(r, req.SBOMHash); err != nil {
+		return err
+	}
+
+	if err := s.changeRollout(r.Context(), req); err != nil {
+		return err
+	}
+
+	b, err = json.Marshal(&rolloutResponse{})
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+	return nil
+}
+
+// rolloutForm handles the rollout forms on the index page.
+func (s *server) rolloutForm(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "POST" {
+		return httpError(http.StatusBadRequest, fmt.Errorf("invalid method (expected POST)"))
+	}
+	req := rolloutRequest{
+		Action:   r.FormValue("action"),
+		SBOMHash: r.FormValue("sbom_hash"),
+		Soak:     r.FormValue("soak"),
+
+		SilenceTimeout: r.FormValue("silence_timeout"),
+		Rollback:       r.FormValue("rollback") == "on",
+	}
+	for _, id := range strings.FieldsFunc(r.FormValue("canary_machine_ids"), func(r rune) bool {
+		return r == ',' || r == ' '
+	}) {
+		req.CanaryMachineIDs = append(req.CanaryMachineIDs, id)
+	}
+	for _, field := range []struct {
+		name string
+		dest *int
+	}{
+		{"canary_percent", &req.CanaryPercent},
+		{"wave_percent", &req.WavePercent},
+		{"halt_failure_percent", &req.HaltFailurePercent},
+	} {
+		val := r.FormValue(field.name)
+		if val == "" {
+			continue
+		}
+		i, err := strconv.Atoi(val)
+		if err != nil {
+			return httpError(http.StatusBadRequest, fmt.Errorf("invalid %s: %v", field.name, err))
+		}
+		*field.dest = i
+	}
+	if err := s.checkSameOrigin(r); err != nil {
+		return err
+	}
+	if err := s.authorizeRollout(r, req.SBOMHash); err != nil {
+		return err
+	}
+
+	if err := s.changeRollout(r.Context(), req); err != nil {
+		return err
+	}
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+	return nil
+}
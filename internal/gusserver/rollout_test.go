@@ -0,0 +1,402 @@
+package gusserver
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/antihax/optional"
+	"github.com/gokrazy/gokapi/gusapi"
+)
+
+func TestRollout(t *testing.T) {
+	testDBs := testDatabases()
+
+	for _, tc := range testDBs {
+		t.Run(tc.databaseType, func(t *testing.T) {
+			ctx := context.Background()
+			ts := newTestServer(t, tc.databaseType)
+			downloadLink := ts.pushImage(t)
+			api := ts.API()
+
+			var machineIDs []string
+			for i := 0; i < 5; i++ {
+				machineIDs = append(machineIDs, fmt.Sprintf("router-%d", i))
+			}
+			heartbeat := func(machineID, sbomHash string) {
+				t.Helper()
+				_, _, err := api.HeartbeatApi.Heartbeat(ctx, &gusapi.HeartbeatApiHeartbeatOpts{
+					Body: optional.NewInterface(&gusapi.HeartbeatRequest{
+						MachineId: machineID,
+						SbomHash:  sbomHash,
+					}),
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			for _, machineID := range machineIDs {
+				heartbeat(machineID, "old")
+			}
+
+			err := ts.postJSON("/api/v1/ingest", ingestRequest{
+				MachineIDPattern: "router-*",
+				SBOMHash:         "new",
+				RegistryType:     "localdisk",
+				DownloadLink:     downloadLink,
+				Rollout: &rolloutRequest{
+					CanaryMachineIDs: []string{"router-3"},
+					CanaryPercent:    20,
+					WavePercent:      50,
+				},
+			}, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			const q = "SELECT machine_id FROM machines WHERE desired_image = 'new' ORDER BY machine_id"
+			wantDesired := func(want ...string) {
+				t.Helper()
+				var rows []map[string]any
+				for _, machineID := range want {
+					rows = append(rows, map[string]any{"machine_id": machineID})
+				}
+				if diff := ts.diffQuery(t, rows, q); diff != "" {
+					t.Errorf("machines table: unexpected diff (-want +got):\n%s", diff)
+				}
+			}
+
+			// Canary wave: the explicit canary plus 20% of 5 machines.
+			wantDesired("router-0", "router-3")
+
+			// Nothing happens until the canaries succeed.
+			if err := ts.srv.advanceRollouts(ctx); err != nil {
+				t.Fatal(err)
+			}
+			wantDesired("router-0", "router-3")
+
+			heartbeat("router-0", "new")
+			heartbeat("router-3", "new")
+			if err := ts.srv.advanceRollouts(ctx); err != nil {
+				t.Fatal(err)
+			}
+			// Next wave: 50% of 5 machines, rounded up.
+			wantDesired("router-0", "router-1", "router-2", "router-3", "router-4")
+
+			for _, machineID := range []string{"router-1", "router-2", "router-4"} {
+				heartbeat(machineID, "new")
+			}
+			if err := ts.srv.advanceRollouts(ctx); err != nil {
+				t.Fatal(err)
+			}
+			if diff := ts.diffQuery(t, []map[string]any{{"state": rolloutCompleted}}, "SELECT state FROM rollouts"); diff != "" {
+				t.Errorf("rollouts table: unexpected diff (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestRolloutPauseAbort(t *testing.T) {
+	testDBs := testDatabases()
+
+	for _, tc := range testDBs {
+		t.Run(tc.databaseType, func(t *testing.T) {
+			ctx := context.Background()
+			ts := newTestServer(t, tc.databaseType)
+			downloadLink := ts.pushImage(t)
+			api := ts.API()
+
+			heartbeat := func(machineID, sbomHash string) {
+				t.Helper()
+				_, _, err := api.HeartbeatApi.Heartbeat(ctx, &gusapi.HeartbeatApiHeartbeatOpts{
+					Body: optional.NewInterface(&gusapi.HeartbeatRequest{
+						MachineId: machineID,
+						SbomHash:  sbomHash,
+					}),
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			heartbeat("router-0", "old")
+			heartbeat("router-1", "old")
+
+			// Rollouts can be created before ingesting their image.
+			if err := ts.postJSON("/api/v1/rollout", rolloutRequest{
+				Action:           "create",
+				SBOMHash:         "new",
+				CanaryMachineIDs: []string{"router-0"},
+			}, nil); err != nil {
+				t.Fatal(err)
+			}
+			if err := ts.postJSON("/api/v1/rollout", rolloutRequest{
+				Action:   "create",
+				SBOMHash: "new",
+			}, nil); err == nil {
+				t.Fatalf("creating a duplicate rollout unexpectedly succeeded")
+			}
+
+			_, _, err := api.IngestApi.Ingest(ctx, &gusapi.IngestApiIngestOpts{
+				Body: optional.NewInterface(&gusapi.IngestRequest{
+					MachineIdPattern: "router-*",
+					SbomHash:         "new",
+					RegistryType:     "localdisk",
+					DownloadLink:     downloadLink,
+				}),
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := ts.srv.advanceRollouts(ctx); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := ts.postJSON("/api/v1/rollout", rolloutRequest{
+				Action:   "pause",
+				SBOMHash: "new",
+			}, nil); err != nil {
+				t.Fatal(err)
+			}
+
+			// Paused rollouts do not advance.
+			heartbeat("router-0", "new")
+			if err := ts.srv.advanceRollouts(ctx); err != nil {
+				t.Fatal(err)
+			}
+			const q = "SELECT machine_id, COALESCE(desired_image, '') AS desired_image FROM machines ORDER BY machine_id"
+			{
+				want := []map[string]any{
+					{"machine_id": "router-0", "desired_image": "new"},
+					{"machine_id": "router-1", "desired_image": ""},
+				}
+				if diff := ts.diffQuery(t, want, q); diff != "" {
+					t.Errorf("machines table: unexpected diff (-want +got):\n%s", diff)
+				}
+			}
+
+			if err := ts.postJSON("/api/v1/rollout", rolloutRequest{
+				Action:   "abort",
+				SBOMHash: "new",
+			}, nil); err != nil {
+				t.Fatal(err)
+			}
+			if err := ts.postJSON("/api/v1/rollout", rolloutRequest{
+				Action:   "resume",
+				SBOMHash: "new",
+			}, nil); err == nil {
+				t.Fatalf("resuming an aborted rollout unexpectedly succeeded")
+			}
+
+			// Aborted rollouts do not assign their image to new machines.
+			heartbeat("router-2", "old")
+			{
+				want := []map[string]any{
+					{"machine_id": "router-0", "desired_image": "new"},
+					{"machine_id": "router-1", "desired_image": ""},
+					{"machine_id": "router-2", "desired_image": ""},
+				}
+				if diff := ts.diffQuery(t, want, q); diff != "" {
+					t.Errorf("machines table: unexpected diff (-want +got):\n%s", diff)
+				}
+			}
+		})
+	}
+}
+
+func TestRolloutHaltRollback(t *testing.T) {
+	testDBs := testDatabases()
+
+	for _, tc := range testDBs {
+		t.Run(tc.databaseType, func(t *testing.T) {
+			ctx := context.Background()
+			ts := newTestServer(t, tc.databaseType)
+			downloadLink := ts.pushImage(t)
+			api := ts.API()
+
+			heartbeat := func(machineID, sbomHash string) {
+				t.Helper()
+				_, _, err := api.HeartbeatApi.Heartbeat(ctx, &gusapi.HeartbeatApiHeartbeatOpts{
+					Body: optional.NewInterface(&gusapi.HeartbeatRequest{
+						MachineId: machineID,
+						SbomHash:  sbomHash,
+					}),
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			ingest := func(req ingestRequest) {
+				t.Helper()
+				if err := ts.postJSON("/api/v1/ingest", req, nil); err != nil {
+					t.Fatal(err)
+				}
+			}
+			attempt := func(machineID, sbomHash string) {
+				t.Helper()
+				_, _, err := api.UpdateApi.Attempt(ctx, &gusapi.UpdateApiAttemptOpts{
+					Body: optional.NewInterface(&gusapi.AttemptRequest{
+						MachineId: machineID,
+						SbomHash:  sbomHash,
+					}),
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			for _, machineID := range []string{"router-0", "router-1", "router-2"} {
+				heartbeat(machineID, "")
+			}
+			ingest(ingestRequest{
+				MachineIDPattern: "router-*",
+				SBOMHash:         "good",
+				RegistryType:     "localdisk",
+				DownloadLink:     downloadLink,
+			})
+			for _, machineID := range []string{"router-0", "router-1", "router-2"} {
+				heartbeat(machineID, "good")
+			}
+
+			// A rollout created after ingesting its image would not stage
+			// anything: the image is already assigned.
+			if err := ts.postJSON("/api/v1/rollout", rolloutRequest{
+				Action:   "create",
+				SBOMHash: "good",
+			}, nil); err == nil || !strings.Contains(err.Error(), "409") {
+				t.Errorf("creating a rollout for an assigned image: got err %v, want HTTP 409", err)
+			}
+
+			ingest(ingestRequest{
+				MachineIDPattern: "router-*",
+				SBOMHash:         "bad",
+				RegistryType:     "localdisk",
+				DownloadLink:     downloadLink,
+				Rollout: &rolloutRequest{
+					CanaryPercent:      50,
+					HaltFailurePercent: 50,
+					Rollback:           true,
+				},
+			})
+
+			// The canaries (router-0 and router-1) attempt the update, but
+			// router-0 comes back with the old image.
+			ts.srv.cfg.updateTimeout = time.Nanosecond
+			attempt("router-0", "bad")
+			attempt("router-1", "bad")
+			heartbeat("router-0", "good")
+
+			if err := ts.srv.advanceRollouts(ctx); err != nil {
+				t.Fatal(err)
+			}
+
+			if diff := ts.diffQuery(t, []map[string]any{{"state": rolloutHalted}}, "SELECT state FROM rollouts"); diff != "" {
+				t.Errorf("rollouts table: unexpected diff (-want +got):\n%s", diff)
+			}
+			want := []map[string]any{
+				{"machine_id": "router-0", "desired_image": "good"},
+				{"machine_id": "router-1", "desired_image": "good"},
+				{"machine_id": "router-2", "desired_image": "good"},
+			}
+			const q = "SELECT machine_id, desired_image FROM machines ORDER BY machine_id"
+			if diff := ts.diffQuery(t, want, q); diff != "" {
+				t.Errorf("machines table: unexpected diff (-want +got):\n%s", diff)
+			}
+
+			// Halted rollouts do not assign their image to further machines.
+			heartbeat("router-3", "")
+			want = append(want, map[string]any{"machine_id": "router-3", "desired_image": ""})
+			const qNull = "SELECT machine_id, COALESCE(desired_image, '') AS desired_image FROM machines ORDER BY machine_id"
+			if diff := ts.diffQuery(t, want, qNull); diff != "" {
+				t.Errorf("machines table: unexpected diff (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestRolloutManualPolicy(t *testing.T) {
+	testDBs := testDatabases()
+
+	for _, tc := range testDBs {
+		t.Run(tc.databaseType, func(t *testing.T) {
+			ctx := context.Background()
+			ts := newTestServer(t, tc.databaseType)
+			downloadLink := ts.pushImage(t)
+			api := ts.API()
+
+			heartbeat := func(machineID, sbomHash string) {
+				t.Helper()
+				_, _, err := api.HeartbeatApi.Heartbeat(ctx, &gusapi.HeartbeatApiHeartbeatOpts{
+					Body: optional.NewInterface(&gusapi.HeartbeatRequest{
+						MachineId: machineID,
+						SbomHash:  sbomHash,
+					}),
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			advance := func() {
+				t.Helper()
+				if err := ts.srv.advanceRollouts(ctx); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for _, machineID := range []string{"router-0", "router-1", "router-2", "router-3"} {
+				heartbeat(machineID, "old")
+			}
+			if err := ts.postJSON("/api/v1/policy", policyRequest{
+				MachineID:       "router-0",
+				IngestionPolicy: policyManual,
+			}, nil); err != nil {
+				t.Fatal(err)
+			}
+
+			// The canary wave only consists of router-0, whose update awaits
+			// approval.
+			if err := ts.postJSON("/api/v1/ingest", ingestRequest{
+				MachineIDPattern: "router-*",
+				SBOMHash:         "new",
+				RegistryType:     "localdisk",
+				DownloadLink:     downloadLink,
+				Rollout: &rolloutRequest{
+					CanaryMachineIDs: []string{"router-0"},
+					WavePercent:      50,
+				},
+			}, nil); err != nil {
+				t.Fatal(err)
+			}
+
+			const q = "SELECT machine_id, COALESCE(desired_image, '') AS desired_image, COALESCE(pending_image, '') AS pending_image FROM machines ORDER BY machine_id"
+			wantImages := func(desired ...string) {
+				t.Helper()
+				want := []map[string]any{
+					{"machine_id": "router-0", "desired_image": "", "pending_image": "new"},
+				}
+				for idx, machineID := range []string{"router-1", "router-2", "router-3"} {
+					want = append(want, map[string]any{"machine_id": machineID, "desired_image": desired[idx], "pending_image": ""})
+				}
+				if diff := ts.diffQuery(t, want, q); diff != "" {
+					t.Errorf("machines table: unexpected diff (-want +got):\n%s", diff)
+				}
+			}
+			wantImages("", "", "")
+
+			// Machines awaiting approval do not stall the rollout.
+			advance()
+			wantImages("new", "new", "")
+
+			heartbeat("router-1", "new")
+			heartbeat("router-2", "new")
+			advance()
+			wantImages("new", "new", "new")
+
+			heartbeat("router-3", "new")
+			advance()
+			if diff := ts.diffQuery(t, []map[string]any{{"state": rolloutCompleted}}, "SELECT state FROM rollouts"); diff != "" {
+				t.Errorf("rollouts table: unexpected diff (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,393 @@
+package gusserver
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"debug/buildinfo"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"runtime/debug"
+	"sort"
+
+	"golang.org/x/mod/semver"
+)
+
+// The SBOM of a gokrazy build does not contain module versions, but the
+// programs of the build do: the Go linker embeds the build information
+// (main module and dependencies, see go version -m) into each program.
+// readGAFModules reads it from the programs in the root file system of a GAF
+// archive, which gokrazy writes as SquashFS image (root.img).
+//
+// The SquashFS reader below only implements what is required to find the
+// regular files and read their data blocks, see
+// https://dr-emann.github.io/squashfs/. Like gokrazy, it only supports zlib
+// compression, and it skips files which end in a fragment (gokrazy does not
+// use fragments).
+
+const gafRootFSName = "root.img"
+
+var errNoRootFS = errors.New("GAF archive contains no " + gafRootFSName)
+
+// maxProgramSize limits the size of the files from which build information is
+// read, as they are read into memory.
+const maxProgramSize = 512 << 20
+
+// readGAFModules returns the Go modules (and their versions) of the programs
+// in the root file system of the GAF archive r.
+func readGAFModules(r io.ReaderAt, size int64) ([]moduleVersion, error) {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range zr.File {
+		if f.Name == gafRootFSName {
+			return rootFSModules(f.Open)
+		}
+	}
+	return nil, errNoRootFS
+}
+
+type squashfsSuperblock struct {
+	Magic               uint32
+	Inodes              uint32
+	MkfsTime            int32
+	BlockSize           uint32
+	Fragments           uint32
+	Compression         uint16
+	BlockLog            uint16
+	Flags               uint16
+	NoIds               uint16
+	Major               uint16
+	Minor               uint16
+	RootInode           int64
+	BytesUsed           int64
+	IdTableStart        int64
+	XattrIdTableStart   int64
+	InodeTableStart     int64
+	DirectoryTableStart int64
+	FragmentTableStart  int64
+	LookupTableStart    int64
+}
+
+const (
+	squashfsMagic = 0x73717368
+	squashfsZlib  = 1
+
+	// squashfsUncompressedBlock is set in the size of data blocks which are
+	// stored uncompressed.
+	squashfsUncompressedBlock = 1 << 24
+	// squashfsUncompressedMeta is set in the header of metadata blocks which
+	// are stored uncompressed.
+	squashfsUncompressedMeta = 0x8000
+
+	squashfsNoFragment = 0xFFFFFFFF
+)
+
+// squashfsFile is a regular file in a SquashFS image.
+type squashfsFile struct {
+	start  int64    // offset of the first data block
+	size   int64    // uncompressed
+	blocks []uint32 // (compressed) size of each data block
+}
+
+// rootFSModules reads the root file system returned by open in two passes:
+// the first pass reads the inode table (located after the file data) to find
+// the regular files, the second pass reads the files in the order in which
+// they are stored. Reading sequentially allows reading root.img from a
+// (compressed) zip archive without buffering it.
+func rootFSModules(open func() (io.ReadCloser, error)) ([]moduleVersion, error) {
+	rc, err := open()
+	if err != nil {
+		return nil, err
+	}
+	sb, files, err := readSquashfsFiles(bufio.NewReader(rc))
+	rc.Close()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", gafRootFSName, err)
+	}
+
+	rc, err = open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	cr := &countingReader{r: bufio.NewReader(rc)}
+	seen := make(map[moduleVersion]bool)
+	var modules []moduleVersion
+	for _, f := range files {
+		if f.start < cr.n {
+			continue // shares data with a previous file
+		}
+		if _, err := io.CopyN(io.Discard, cr, f.start-cr.n); err != nil {
+			return nil, fmt.Errorf("%s: %v", gafRootFSName, err)
+		}
+		content, err := readSquashfsProgram(cr, sb.BlockSize, f)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", gafRootFSName, err)
+		}
+		if content == nil {
+			continue // not a program
+		}
+		info, err := buildinfo.Read(bytes.NewReader(content))
+		if err != nil {
+			continue // not a Go program
+		}
+		for _, m := range append([]*debug.Module{&info.Main}, info.Deps...) {
+			version := m.Version
+			if m.Replace != nil {
+				version = m.Replace.Version // the code of the replacement is used
+			}
+			mv := moduleVersion{Path: m.Path, Version: version}
+			if !semver.IsValid(mv.Version) || seen[mv] {
+				continue // e.g. (devel) or a local replacement
+			}
+			seen[mv] = true
+			modules = append(modules, mv)
+		}
+	}
+	sort.Slice(modules, func(i, j int) bool {
+		if modules[i].Path != modules[j].Path {
+			return modules[i].Path < modules[j].Path
+		}
+		return semver.Compare(modules[i].Version, modules[j].Version) < 0
+	})
+	return modules, nil
+}
+
+// readSquashfsFiles reads the superblock and inode table from r and returns
+// the regular files, sorted by offset.
+func readSquashfsFiles(r io.Reader) (*squashfsSuperblock, []squashfsFile, error) {
+	var sb squashfsSuperblock
+	if err := binary.Read(r, binary.LittleEndian, &sb); err != nil {
+		return nil, nil, err
+	}
+	if sb.Magic != squashfsMagic || sb.Major != 4 {
+		return nil, nil, fmt.Errorf("not a SquashFS 4 file system")
+	}
+	if sb.Compression != squashfsZlib {
+		return nil, nil, fmt.Errorf("unsupported SquashFS compression %d (only zlib is supported)", sb.Compression)
+	}
+	if sb.BlockSize == 0 || sb.BlockSize > 1<<20 {
+		return nil, nil, fmt.Errorf("invalid SquashFS block size %d", sb.BlockSize)
+	}
+	const superblockSize = 96
+	if sb.InodeTableStart < superblockSize || sb.DirectoryTableStart < sb.InodeTableStart {
+		return nil, nil, fmt.Errorf("invalid SquashFS inode table location")
+	}
+	if _, err := io.CopyN(io.Discard, r, sb.InodeTableStart-superblockSize); err != nil {
+		return nil, nil, err
+	}
+	inodes, err := readSquashfsMetadata(io.LimitReader(r, sb.DirectoryTableStart-sb.InodeTableStart))
+	if err != nil {
+		return nil, nil, err
+	}
+	files, err := parseSquashfsInodes(inodes, sb.Inodes, int64(sb.BlockSize))
+	if err != nil {
+		return nil, nil, err
+	}
+	sort.SliceStable(files, func(i, j int) bool {
+		return files[i].start < files[j].start
+	})
+	return &sb, files, nil
+}
+
+// readSquashfsMetadata returns the concatenated contents of the metadata
+// blocks in r.
+func readSquashfsMetadata(r io.Reader) ([]byte, error) {
+	var buf bytes.Buffer
+	for {
+		var header uint16
+		if err := binary.Read(r, binary.LittleEndian, &header); err != nil {
+			if err == io.EOF {
+				return buf.Bytes(), nil
+			}
+			return nil, err
+		}
+		block := io.LimitReader(r, int64(header&^squashfsUncompressedMeta))
+		if header&squashfsUncompressedMeta == 0 {
+			zr, err := zlib.NewReader(block)
+			if err != nil {
+				return nil, err
+			}
+			if _, err := io.Copy(&buf, zr); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if _, err := io.Copy(&buf, block); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// parseSquashfsInodes returns the regular files of the count inodes in b.
+func parseSquashfsInodes(b []byte, count uint32, blockSize int64) ([]squashfsFile, error) {
+	le := binary.LittleEndian
+	var files []squashfsFile
+	off := 0
+	need := func(n int) error {
+		if off+n > len(b) {
+			return fmt.Errorf("truncated SquashFS inode table")
+		}
+		return nil
+	}
+	// blockList returns the block sizes of a file which starts at off.
+	blockList := func(size int64, fragment uint32) ([]uint32, error) {
+		n := size / blockSize
+		if fragment == squashfsNoFragment && size%blockSize != 0 {
+			n++
+		}
+		if err := need(int(n) * 4); err != nil {
+			return nil, err
+		}
+		blocks := make([]uint32, n)
+		for idx := range blocks {
+			blocks[idx] = le.Uint32(b[off:])
+			off += 4
+		}
+		return blocks, nil
+	}
+	for i := uint32(0); i < count; i++ {
+		const headerSize = 16
+		if err := need(headerSize); err != nil {
+			return nil, err
+		}
+		typ := le.Uint16(b[off:])
+		off += headerSize
+		switch typ {
+		case 1: // directory
+			off += 16
+		case 2: // regular file
+			if err := need(16); err != nil {
+				return nil, err
+			}
+			start := int64(le.Uint32(b[off:]))
+			fragment := le.Uint32(b[off+4:])
+			size := int64(le.Uint32(b[off+12:]))
+			off += 16
+			blocks, err := blockList(size, fragment)
+			if err != nil {
+				return nil, err
+			}
+			if fragment == squashfsNoFragment {
+				files = append(files, squashfsFile{start: start, size: size, blocks: blocks})
+			}
+		case 3, 10: // symlink, extended symlink
+			if err := need(8); err != nil {
+				return nil, err
+			}
+			off += 8 + int(le.Uint32(b[off+4:]))
+			if typ == 10 {
+				off += 4
+			}
+		case 4, 5: // block device, character device
+			off += 8
+		case 6, 7: // fifo, socket
+			off += 4
+		case 8: // extended directory
+			if err := need(24); err != nil {
+				return nil, err
+			}
+			indexCount := int(le.Uint16(b[off+16:]))
+			off += 24
+			for idx := 0; idx < indexCount; idx++ {
+				if err := need(12); err != nil {
+					return nil, err
+				}
+				off += 12 + int(le.Uint32(b[off+8:])) + 1
+			}
+		case 9: // extended regular file
+			if err := need(40); err != nil {
+				return nil, err
+			}
+			start := int64(le.Uint64(b[off:]))
+			size := int64(le.Uint64(b[off+8:]))
+			fragment := le.Uint32(b[off+28:])
+			off += 40
+			blocks, err := blockList(size, fragment)
+			if err != nil {
+				return nil, err
+			}
+			if fragment == squashfsNoFragment {
+				files = append(files, squashfsFile{start: start, size: size, blocks: blocks})
+			}
+		case 11, 12: // extended block device, extended character device
+			off += 12
+		case 13, 14: // extended fifo, extended socket
+			off += 8
+		default:
+			return nil, fmt.Errorf("unknown SquashFS inode type %d", typ)
+		}
+		if off > len(b) {
+			return nil, fmt.Errorf("truncated SquashFS inode table")
+		}
+	}
+	return files, nil
+}
+
+// readSquashfsProgram reads the data blocks of f from r. It returns nil if f
+// is not an ELF executable (or too large), in which case the remaining data
+// blocks are skipped.
+func readSquashfsProgram(r io.Reader, blockSize uint32, f squashfsFile) ([]byte, error) {
+	var content []byte
+	for idx, size := range f.blocks {
+		if (idx > 0 && content == nil) || f.size > maxProgramSize {
+			if _, err := io.CopyN(io.Discard, r, int64(size&^squashfsUncompressedBlock)); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		block, err := readSquashfsBlock(r, size, blockSize)
+		if err != nil {
+			return nil, err
+		}
+		if idx == 0 {
+			if !bytes.HasPrefix(block, []byte("\x7fELF")) {
+				continue
+			}
+			content = make([]byte, 0, f.size)
+		}
+		content = append(content, block...)
+	}
+	if int64(len(content)) > f.size {
+		content = content[:f.size]
+	}
+	return content, nil
+}
+
+// readSquashfsBlock reads a data block of the specified (stored) size from r
+// and returns its uncompressed contents.
+func readSquashfsBlock(r io.Reader, size, blockSize uint32) ([]byte, error) {
+	stored := int64(size &^ squashfsUncompressedBlock)
+	if stored == 0 {
+		return make([]byte, blockSize), nil // sparse block
+	}
+	block := make([]byte, stored)
+	if _, err := io.ReadFull(r, block); err != nil {
+		return nil, err
+	}
+	if size&squashfsUncompressedBlock != 0 {
+		return block, nil
+	}
+	zr, err := zlib.NewReader(bytes.NewReader(block))
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(io.LimitReader(zr, int64(blockSize)))
+}
+
+// countingReader counts the bytes read from r.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
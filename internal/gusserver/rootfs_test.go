@@ -0,0 +1,167 @@
+package gusserver
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"os"
+	"runtime/debug"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"golang.org/x/mod/semver"
+)
+
+// squashfsWithFiles returns a SquashFS image containing the specified files,
+// written like gokrazy writes its root file system: zlib-compressed data
+// blocks, uncompressed metadata and no fragments. Only the parts which
+// readSquashfsFiles reads are written (e.g. no directory table).
+func squashfsWithFiles(t *testing.T, files ...[]byte) []byte {
+	t.Helper()
+
+	const blockSize = 1 << 17
+	var (
+		img    bytes.Buffer
+		inodes bytes.Buffer
+		le     = binary.LittleEndian
+	)
+	img.Write(make([]byte, 96)) // superblock, written last
+
+	// The root directory.
+	binary.Write(&inodes, le, []uint16{1, 0755, 0, 0})
+	binary.Write(&inodes, le, []uint32{0, 1})
+	binary.Write(&inodes, le, []uint32{0, 2})
+	binary.Write(&inodes, le, []uint16{3, 0})
+	binary.Write(&inodes, le, uint32(1))
+
+	for idx, contents := range files {
+		start := img.Len()
+		var sizes []uint32
+		for off := 0; off < len(contents); off += blockSize {
+			block := contents[off:min(off+blockSize, len(contents))]
+			var compressed bytes.Buffer
+			zw, err := zlib.NewWriterLevel(&compressed, zlib.BestSpeed)
+			if err != nil {
+				t.Fatal(err)
+			}
+			zw.Write(block)
+			if err := zw.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if compressed.Len() < len(block) {
+				img.Write(compressed.Bytes())
+				sizes = append(sizes, uint32(compressed.Len()))
+			} else {
+				img.Write(block)
+				sizes = append(sizes, uint32(len(block))|squashfsUncompressedBlock)
+			}
+		}
+		binary.Write(&inodes, le, []uint16{2, 0755, 0, 0})
+		binary.Write(&inodes, le, []uint32{0, uint32(idx + 2)})
+		binary.Write(&inodes, le, []uint32{uint32(start), squashfsNoFragment, 0, uint32(len(contents))})
+		binary.Write(&inodes, le, sizes)
+	}
+
+	inodeTableStart := img.Len()
+	for b := inodes.Bytes(); len(b) > 0; {
+		chunk := b[:min(8192, len(b))]
+		b = b[len(chunk):]
+		binary.Write(&img, le, uint16(len(chunk))|squashfsUncompressedMeta)
+		img.Write(chunk)
+	}
+
+	b := img.Bytes()
+	var sb bytes.Buffer
+	if err := binary.Write(&sb, le, &squashfsSuperblock{
+		Magic:               squashfsMagic,
+		Inodes:              uint32(1 + len(files)),
+		BlockSize:           blockSize,
+		Fragments:           0,
+		Compression:         squashfsZlib,
+		BlockLog:            17,
+		Major:               4,
+		BytesUsed:           int64(len(b)),
+		IdTableStart:        -1,
+		XattrIdTableStart:   -1,
+		InodeTableStart:     int64(inodeTableStart),
+		DirectoryTableStart: int64(len(b)),
+		FragmentTableStart:  -1,
+		LookupTableStart:    -1,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	copy(b, sb.Bytes())
+	return b
+}
+
+// testProgram returns the test binary (a Go program) and the modules of its
+// build information, see readGAFModules.
+func testProgram(t *testing.T) ([]byte, []moduleVersion) {
+	t.Helper()
+	exe, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	program, err := os.ReadFile(exe)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		t.Fatal("test binary contains no build information")
+	}
+	var modules []moduleVersion
+	for _, m := range info.Deps {
+		version := m.Version
+		if m.Replace != nil {
+			version = m.Replace.Version
+		}
+		if semver.IsValid(version) {
+			modules = append(modules, moduleVersion{Path: m.Path, Version: version})
+		}
+	}
+	if len(modules) == 0 {
+		t.Fatal("test binary has no dependencies")
+	}
+	return program, modules
+}
+
+func TestReadGAFModules(t *testing.T) {
+	program, want := testProgram(t)
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	f, err := zw.Create("root.img")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Only programs with build information are read, other files are
+	// skipped.
+	if _, err := f.Write(squashfsWithFiles(t,
+		[]byte("#!/bin/sh\necho hello\n"),
+		program,
+		bytes.Repeat([]byte{0}, 3<<17))); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := readGAFModules(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("readGAFModules: unexpected diff (-want +got):\n%s", diff)
+	}
+
+	zipped := zipWithContents(t, "hello")
+	if _, err := readGAFModules(bytes.NewReader(zipped), int64(len(zipped))); err != errNoRootFS {
+		t.Errorf("readGAFModules(zip without root.img) = %v, want %v", err, errNoRootFS)
+	}
+	gaf, _ := gafWithSBOM(t, gafTestSBOM{})
+	if _, err := readGAFModules(bytes.NewReader(gaf), int64(len(gaf))); err == nil {
+		t.Errorf("readGAFModules(GAF with invalid root.img) unexpectedly succeeded")
+	}
+}
@@ -0,0 +1,363 @@
+package gusserver
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// s3Store stores images in a bucket of an S3-compatible object storage (AWS
+// S3, MinIO, Ceph RGW, …). Requests are authenticated with AWS Signature
+// Version 4, which all of these implement.
+//
+// The bucket URL can be path-style (https://minio.example.net/gus-images) or
+// virtual-hosted-style (https://gus-images.s3.eu-central-1.amazonaws.com).
+type s3Store struct {
+	bucketURL       *url.URL
+	region          string
+	accessKeyID     string
+	secretAccessKey string
+	client          *http.Client
+
+	// tempDir is where pushes are buffered before they are uploaded. Empty
+	// means os.TempDir.
+	tempDir string
+}
+
+func newS3Store(bucketURL, region, accessKeyID, secretAccessKey string) (*s3Store, error) {
+	u, err := url.Parse(bucketURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid --s3_bucket_url: %v", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("invalid --s3_bucket_url %q: must be an http:// or https:// URL", bucketURL)
+	}
+	if accessKeyID == "" || secretAccessKey == "" {
+		return nil, fmt.Errorf("S3 credentials not set (AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY environment variables)")
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/")
+	u.RawPath = ""
+	u.RawQuery = ""
+	return &s3Store{
+		bucketURL:       u,
+		region:          region,
+		accessKeyID:     accessKeyID,
+		secretAccessKey: secretAccessKey,
+		client:          &http.Client{Timeout: storeRequestTimeout},
+	}, nil
+}
+
+// s3Escape percent-encodes s as required for canonical requests: everything
+// but unreserved characters is encoded, including the slash unless
+// keepSlash is set.
+func s3Escape(s string, keepSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '.', c == '_', c == '~',
+			c == '/' && keepSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// objectURL returns the URL of the object with the specified key, with the
+// path encoded exactly as it is signed.
+func (st *s3Store) objectURL(key string) *url.URL {
+	u := *st.bucketURL
+	u.Path = st.bucketURL.Path + "/" + key
+	u.RawPath = s3Escape(u.Path, true)
+	return &u
+}
+
+// canonicalQuery returns the query string of u in canonical form.
+func canonicalQuery(v url.Values) string {
+	keys := make([]string, 0, len(v))
+	for k := range v {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		vals := append([]string(nil), v[k]...)
+		sort.Strings(vals)
+		for _, val := range vals {
+			parts = append(parts, s3Escape(k, false)+"="+s3Escape(val, false))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// signature computes the Signature Version 4 signature of the canonical
+// request and returns it along with the credential scope.
+func (st *s3Store) signature(t time.Time, canonicalRequest string) (sig, scope string) {
+	date := t.Format("20060102")
+	scope = date + "/" + st.region + "/s3/aws4_request"
+	crHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" +
+		t.Format("20060102T150405Z") + "\n" +
+		scope + "\n" +
+		hex.EncodeToString(crHash[:])
+	key := hmacSHA256([]byte("AWS4"+st.secretAccessKey), date)
+	key = hmacSHA256(key, st.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	return hex.EncodeToString(hmacSHA256(key, stringToSign)), scope
+}
+
+const unsignedPayload = "UNSIGNED-PAYLOAD"
+
+// sign adds the Authorization header to req. All headers set on req (and
+// the Host header) are signed.
+func (st *s3Store) sign(req *http.Request, payloadHash string, t time.Time) {
+	t = t.UTC()
+	req.Header.Set("X-Amz-Date", t.Format("20060102T150405Z"))
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		headers[strings.ToLower(k)] = strings.TrimSpace(strings.Join(v, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, k := range names {
+		canonicalHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	sig, scope := st.signature(t, canonicalRequest)
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 "+
+		"Credential="+st.accessKeyID+"/"+scope+", "+
+		"SignedHeaders="+signedHeaders+", "+
+		"Signature="+sig)
+}
+
+// presign returns a pre-signed GET URL for u, valid for expiry.
+func (st *s3Store) presign(u *url.URL, expiry time.Duration, t time.Time) string {
+	t = t.UTC()
+	scope := t.Format("20060102") + "/" + st.region + "/s3/aws4_request"
+	q := u.Query()
+	q.Set("X-Amz-Algorithm", "AWS4-HMAC-SHA256")
+	q.Set("X-Amz-Credential", st.accessKeyID+"/"+scope)
+	q.Set("X-Amz-Date", t.Format("20060102T150405Z"))
+	q.Set("X-Amz-Expires", strconv.FormatInt(int64(expiry/time.Second), 10))
+	q.Set("X-Amz-SignedHeaders", "host")
+	canonicalRequest := strings.Join([]string{
+		"GET",
+		u.EscapedPath(),
+		canonicalQuery(q),
+		"host:" + u.Host + "\n",
+		"host",
+		unsignedPayload,
+	}, "\n")
+	sig, _ := st.signature(t, canonicalRequest)
+	signed := *u
+	signed.RawQuery = canonicalQuery(q) + "&X-Amz-Signature=" + sig
+	return signed.String()
+}
+
+// do sends a signed request and returns the response if its status code is
+// one of the expected codes.
+func (st *s3Store) do(ctx context.Context, method string, u *url.URL, header http.Header, body io.Reader, payloadHash string, expected ...int) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	st.sign(req, payloadHash, time.Now())
+	resp, err := st.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	for _, code := range expected {
+		if resp.StatusCode == code {
+			return resp, nil
+		}
+	}
+	b, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	resp.Body.Close()
+	err = fmt.Errorf("S3 %s %s: unexpected HTTP status %v: %s", method, u.Path, resp.Status, strings.TrimSpace(string(b)))
+	if resp.StatusCode == http.StatusNotFound {
+		err = fmt.Errorf("%w: %v", fs.ErrNotExist, err)
+	}
+	return nil, err
+}
+
+// s3PendingImage buffers a push in a temporary file, which is uploaded on
+// Commit. The payload hash is computed while writing, so that the upload is
+// signed in full.
+type s3PendingImage struct {
+	*os.File
+	st        *s3Store
+	h         hash.Hash
+	committed bool
+}
+
+func (p *s3PendingImage) Write(b []byte) (int, error) {
+	n, err := p.File.Write(b)
+	p.h.Write(b[:n])
+	return n, err
+}
+
+func (p *s3PendingImage) Commit(ctx context.Context, key string) error {
+	info, err := p.Stat()
+	if err != nil {
+		return err
+	}
+	body := io.NewSectionReader(p.File, 0, info.Size())
+	header := http.Header{"Content-Type": []string{"application/zip"}}
+	u := p.st.objectURL(key)
+	req, err := http.NewRequestWithContext(ctx, "PUT", u.String(), body)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = info.Size()
+	req.Header = header
+	p.st.sign(req, hex.EncodeToString(p.h.Sum(nil)), time.Now())
+	resp, err := p.st.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return fmt.Errorf("S3 PUT %s: unexpected HTTP status %v: %s", u.Path, resp.Status, strings.TrimSpace(string(b)))
+	}
+	p.committed = true
+	return p.Cleanup()
+}
+
+func (p *s3PendingImage) Cleanup() error {
+	p.File.Close()
+	if err := os.Remove(p.Name()); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (st *s3Store) Create(ctx context.Context) (pendingImage, error) {
+	f, err := os.CreateTemp(st.tempDir, "gus-push-")
+	if err != nil {
+		return nil, err
+	}
+	return &s3PendingImage{
+		File: f,
+		st:   st,
+		h:    sha256.New(),
+	}, nil
+}
+
+func (st *s3Store) Open(ctx context.Context, key string) (storedImage, error) {
+	u := st.objectURL(key)
+	resp, err := st.do(ctx, "HEAD", u, nil, nil, unsignedPayload, http.StatusOK)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.ContentLength < 0 {
+		return nil, fmt.Errorf("S3 HEAD %s: no Content-Length", u.Path)
+	}
+	modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return &rangeImage{
+		get: func(off, length int64) (*http.Response, error) {
+			header := http.Header{"Range": []string{fmt.Sprintf("bytes=%d-%d", off, off+length-1)}}
+			return st.do(ctx, "GET", u, header, nil, unsignedPayload, http.StatusPartialContent, http.StatusOK)
+		},
+		size:    resp.ContentLength,
+		modTime: modTime,
+	}, nil
+}
+
+func (st *s3Store) Delete(ctx context.Context, key string) error {
+	resp, err := st.do(ctx, "DELETE", st.objectURL(key), nil, nil, unsignedPayload, http.StatusNoContent, http.StatusOK, http.StatusNotFound)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// listBucketResult is the response of ListObjectsV2.
+type listBucketResult struct {
+	Contents []struct {
+		Key          string
+		LastModified time.Time
+	}
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+func (st *s3Store) List(ctx context.Context) ([]storedObject, error) {
+	var objects []storedObject
+	var continuation string
+	for {
+		u := *st.bucketURL
+		u.Path += "/"
+		q := url.Values{"list-type": []string{"2"}}
+		if continuation != "" {
+			q.Set("continuation-token", continuation)
+		}
+		u.RawQuery = q.Encode()
+		resp, err := st.do(ctx, "GET", &u, nil, nil, unsignedPayload, http.StatusOK)
+		if err != nil {
+			return nil, err
+		}
+		var result listBucketResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("S3 ListObjectsV2: %v", err)
+		}
+		for _, c := range result.Contents {
+			objects = append(objects, storedObject{
+				Key:     c.Key,
+				ModTime: c.LastModified,
+			})
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return objects, nil
+		}
+		continuation = result.NextContinuationToken
+	}
+}
+
+func (st *s3Store) PresignedURL(key string, expiry time.Duration) (string, error) {
+	return st.presign(st.objectURL(key), expiry, time.Now()), nil
+}
@@ -0,0 +1,341 @@
+package gusserver
+
+import (
+	"cmp"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+
+	"golang.org/x/mod/semver"
+)
+
+// The SBOM of a gokrazy build (see gafSBOMName) records hashes, not versions:
+// the hash of the config, the hash of the go.mod file of each package build
+// directory (one per program, e.g. builddir/github.com/gokrazy/hello/go.mod)
+// and the hashes of extra files. An SBOM diff therefore lists which packages
+// were added or removed and which packages changed, i.e. whose go.mod (and
+// hence the module versions of their build) differs.
+//
+// GUS stores the SBOM of ingested images (read from the GAF archive, or
+// specified in the ingest request) and of the image each machine runs (sent
+// in heartbeats). For images whose module versions GUS read from their
+// programs (see indexSBOM), the diff also lists which module versions changed.
+
+type sbomFileHash struct {
+	Path string `json:"path"`
+	Hash string `json:"hash"`
+}
+
+type parsedSBOM struct {
+	ConfigHash      sbomFileHash   `json:"config_hash"`
+	GoModHashes     []sbomFileHash `json:"go_mod_hashes"`
+	ExtraFileHashes []sbomFileHash `json:"extra_file_hashes"`
+}
+
+// parseSBOM parses a JSON-encoded SBOM, which can also be wrapped in an object
+// with sbom_hash and sbom fields (like in GAF archives). It returns nil if raw
+// is empty or null.
+func parseSBOM(raw []byte) (*parsedSBOM, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return nil, nil
+	}
+	var wrapped gafSBOM
+	if err := json.Unmarshal(raw, &wrapped); err == nil && len(wrapped.SBOM) > 0 {
+		raw = wrapped.SBOM
+	}
+	var sb parsedSBOM
+	if err := json.Unmarshal(raw, &sb); err != nil {
+		return nil, fmt.Errorf("invalid SBOM: %v", err)
+	}
+	return &sb, nil
+}
+
+// Kinds of SBOM changes:
+const (
+	sbomAdded   = "added"
+	sbomRemoved = "removed"
+	sbomChanged = "changed"
+)
+
+type sbomChange struct {
+	// Name is the package (import path of the build directory) for
+	// go_mod_hashes, or the path for extra_file_hashes.
+	Name    string `json:"name"`
+	Path    string `json:"path"`
+	Change  string `json:"change"`
+	OldHash string `json:"old_hash,omitempty"`
+	NewHash string `json:"new_hash,omitempty"`
+}
+
+// moduleChange is a change of the versions of a module. An image can contain
+// multiple versions of a module if its programs were built with different
+// versions.
+type moduleChange struct {
+	Path        string   `json:"path"`
+	Change      string   `json:"change"`
+	OldVersions []string `json:"old_versions,omitempty"`
+	NewVersions []string `json:"new_versions,omitempty"`
+}
+
+type sbomDiff struct {
+	MachineID    string `json:"machine_id,omitempty"`
+	FromSBOMHash string `json:"from_sbom_hash"`
+	ToSBOMHash   string `json:"to_sbom_hash"`
+
+	// Missing lists the SBOM hashes whose SBOM is not known to GUS (images
+	// ingested by older versions of GUS, or without an SBOM). The diff is
+	// empty in that case.
+	Missing []string `json:"missing,omitempty"`
+
+	ConfigChanged bool         `json:"config_changed"`
+	Packages      []sbomChange `json:"packages"`
+	ExtraFiles    []sbomChange `json:"extra_files"`
+
+	// ModulesUnknown lists the SBOM hashes whose module versions are not
+	// known to GUS (see indexSBOM). Modules is empty in that case.
+	ModulesUnknown []string       `json:"modules_unknown,omitempty"`
+	Modules        []moduleChange `json:"modules"`
+}
+
+// packageName returns the package of a go_mod_hashes path.
+func packageName(path string) string {
+	path = strings.TrimPrefix(path, "builddir/")
+	path = strings.TrimSuffix(path, "/go.mod")
+	return path
+}
+
+// diffFileHashes returns the changes between old and new, sorted by name.
+func diffFileHashes(old, new []sbomFileHash, name func(string) string) []sbomChange {
+	oldByPath := make(map[string]string, len(old))
+	for _, fh := range old {
+		oldByPath[fh.Path] = fh.Hash
+	}
+	changes := []sbomChange{}
+	seen := make(map[string]bool, len(new))
+	for _, fh := range new {
+		seen[fh.Path] = true
+		oldHash, ok := oldByPath[fh.Path]
+		switch {
+		case !ok:
+			changes = append(changes, sbomChange{Path: fh.Path, Change: sbomAdded, NewHash: fh.Hash})
+		case oldHash != fh.Hash:
+			changes = append(changes, sbomChange{Path: fh.Path, Change: sbomChanged, OldHash: oldHash, NewHash: fh.Hash})
+		}
+	}
+	for _, fh := range old {
+		if !seen[fh.Path] {
+			changes = append(changes, sbomChange{Path: fh.Path, Change: sbomRemoved, OldHash: fh.Hash})
+		}
+	}
+	for idx := range changes {
+		changes[idx].Name = name(changes[idx].Path)
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Name < changes[j].Name
+	})
+	return changes
+}
+
+func diffSBOMs(old, new *parsedSBOM) *sbomDiff {
+	return &sbomDiff{
+		ConfigChanged: old.ConfigHash.Hash != new.ConfigHash.Hash,
+		Packages:      diffFileHashes(old.GoModHashes, new.GoModHashes, packageName),
+		ExtraFiles:    diffFileHashes(old.ExtraFileHashes, new.ExtraFileHashes, func(path string) string { return path }),
+	}
+}
+
+// diffModules returns the changes between the module versions old and new
+// (keyed by module path), sorted by path.
+func diffModules(old, new map[string][]string) []moduleChange {
+	changes := []moduleChange{}
+	for path, newVersions := range new {
+		oldVersions, ok := old[path]
+		switch {
+		case !ok:
+			changes = append(changes, moduleChange{Path: path, Change: sbomAdded, NewVersions: newVersions})
+		case !slices.Equal(oldVersions, newVersions):
+			changes = append(changes, moduleChange{Path: path, Change: sbomChanged, OldVersions: oldVersions, NewVersions: newVersions})
+		}
+	}
+	for path, oldVersions := range old {
+		if _, ok := new[path]; !ok {
+			changes = append(changes, moduleChange{Path: path, Change: sbomRemoved, OldVersions: oldVersions})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Path < changes[j].Path
+	})
+	return changes
+}
+
+// loadModules returns the module versions (sorted, keyed by module path) of
+// the image with the specified hash, or nil if unknown.
+func (s *server) loadModules(ctx context.Context, sbomHash string) (map[string][]string, error) {
+	rows, err := s.queries.selectSBOMModules.QueryContext(ctx, sbomHash)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var modules map[string][]string
+	for rows.Next() {
+		var path, version string
+		if err := rows.Scan(&path, &version); err != nil {
+			return nil, err
+		}
+		if modules == nil {
+			modules = make(map[string][]string)
+		}
+		modules[path] = append(modules[path], version)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	for _, versions := range modules {
+		sort.Slice(versions, func(i, j int) bool {
+			return semver.Compare(versions[i], versions[j]) < 0
+		})
+	}
+	return modules, rows.Close()
+}
+
+// loadSBOM returns the SBOM with the specified hash, or nil if unknown.
+func (s *server) loadSBOM(ctx context.Context, sbomHash string) (*parsedSBOM, error) {
+	var raw sql.NullString
+	err := s.queries.selectImageSBOM.QueryRowContext(ctx, sbomHash).Scan(&raw)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	if !raw.Valid || raw.String == "null" {
+		// Not ingested (or ingested without SBOM): machines which run the
+		// image report its SBOM in their heartbeats.
+		err := s.queries.selectHeartbeatSBOM.QueryRowContext(ctx, sbomHash).Scan(&raw)
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return parseSBOM([]byte(raw.String))
+}
+
+// diffSBOMHashes returns the diff between the SBOMs with the specified hashes.
+func (s *server) diffSBOMHashes(ctx context.Context, from, to string) (*sbomDiff, error) {
+	fromSBOM, err := s.loadSBOM(ctx, from)
+	if err != nil {
+		return nil, err
+	}
+	toSBOM, err := s.loadSBOM(ctx, to)
+	if err != nil {
+		return nil, err
+	}
+	diff := &sbomDiff{
+		Packages:   []sbomChange{},
+		ExtraFiles: []sbomChange{},
+	}
+	if fromSBOM != nil && toSBOM != nil {
+		diff = diffSBOMs(fromSBOM, toSBOM)
+	}
+	diff.FromSBOMHash = from
+	diff.ToSBOMHash = to
+	if fromSBOM == nil {
+		diff.Missing = append(diff.Missing, from)
+	}
+	if toSBOM == nil && to != from {
+		diff.Missing = append(diff.Missing, to)
+	}
+
+	fromModules, err := s.loadModules(ctx, from)
+	if err != nil {
+		return nil, err
+	}
+	toModules, err := s.loadModules(ctx, to)
+	if err != nil {
+		return nil, err
+	}
+	diff.Modules = []moduleChange{}
+	if fromModules != nil && toModules != nil {
+		diff.Modules = diffModules(fromModules, toModules)
+	}
+	if fromModules == nil {
+		diff.ModulesUnknown = append(diff.ModulesUnknown, from)
+	}
+	if toModules == nil && to != from {
+		diff.ModulesUnknown = append(diff.ModulesUnknown, to)
+	}
+	return diff, nil
+}
+
+// machineSBOMDiff returns the diff between the image machineID runs and the
+// image it is updated to (its pending image, if an update awaits approval, or
+// its desired image). It returns nil if there is no such image.
+func (s *server) machineSBOMDiff(ctx context.Context, machineID string) (*sbomDiff, error) {
+	var current, desired, pending sql.NullString
+	err := s.queries.selectMachineImages.QueryRowContext(ctx, machineID).Scan(
+		&current,
+		&desired,
+		&pending)
+	if err == sql.ErrNoRows {
+		return nil, httpError(http.StatusNotFound, fmt.Errorf("machine %q not found", machineID))
+	}
+	if err != nil {
+		return nil, err
+	}
+	target := cmp.Or(pending.String, desired.String)
+	if target == "" || target == current.String {
+		return nil, nil
+	}
+	diff, err := s.diffSBOMHashes(ctx, current.String, target)
+	if err != nil {
+		return nil, err
+	}
+	diff.MachineID = machineID
+	return diff, nil
+}
+
+// sbomDiffHandler serves the SBOM diff between the image of a machine and the
+// image it is updated to (?machine_id=), or between two SBOM hashes (?from=
+// and ?to=).
+func (s *server) sbomDiffHandler(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "GET" {
+		return httpError(http.StatusBadRequest, fmt.Errorf("invalid method (expected GET)"))
+	}
+	if err := s.authorize(r, ""); err != nil {
+		return err
+	}
+	var (
+		diff *sbomDiff
+		err  error
+	)
+	q := r.URL.Query()
+	if machineID := q.Get("machine_id"); machineID != "" {
+		diff, err = s.machineSBOMDiff(r.Context(), machineID)
+		if err != nil {
+			return err
+		}
+		if diff == nil {
+			return httpError(http.StatusNotFound, fmt.Errorf("machine %q runs its desired image", machineID))
+		}
+	} else {
+		from, to := q.Get("from"), q.Get("to")
+		if from == "" || to == "" {
+			return httpError(http.StatusBadRequest, fmt.Errorf("either machine_id or from and to must be set"))
+		}
+		diff, err = s.diffSBOMHashes(r.Context(), from, to)
+		if err != nil {
+			return err
+		}
+	}
+	b, err := json.Marshal(diff)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+	return nil
+}
@@ -0,0 +1,233 @@
+package gusserver
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParseSBOM(t *testing.T) {
+	const plain = `{"config_hash": {"path": "config.json", "hash": "c0ffee"}}`
+	for _, raw := range []string{
+		plain,
+		`{"sbom_hash": "abc", "sbom": ` + plain + `}`,
+	} {
+		sb, err := parseSBOM([]byte(raw))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := sb.ConfigHash.Hash, "c0ffee"; got != want {
+			t.Errorf("parseSBOM(%s): got config hash %q, want %q", raw, got, want)
+		}
+	}
+	for _, raw := range []string{"", "null"} {
+		if sb, err := parseSBOM([]byte(raw)); sb != nil || err != nil {
+			t.Errorf("parseSBOM(%q) = %v, %v, want nil, nil", raw, sb, err)
+		}
+	}
+	if _, err := parseSBOM([]byte(`[]`)); err == nil {
+		t.Errorf("parseSBOM([]) unexpectedly succeeded")
+	}
+}
+
+func TestDiffSBOMs(t *testing.T) {
+	old := &parsedSBOM{
+		ConfigHash: sbomFileHash{Path: "config.json", Hash: "c1"},
+		GoModHashes: []sbomFileHash{
+			{Path: "builddir/github.com/gokrazy/hello/go.mod", Hash: "h1"},
+			{Path: "builddir/github.com/gokrazy/rsync/go.mod", Hash: "r1"},
+			{Path: "builddir/github.com/gokrazy/breakglass/go.mod", Hash: "b1"},
+		},
+		ExtraFileHashes: []sbomFileHash{
+			{Path: "extrafiles/github.com/gokrazy/hello/etc/hello.conf", Hash: "e1"},
+		},
+	}
+	new := &parsedSBOM{
+		ConfigHash: sbomFileHash{Path: "config.json", Hash: "c1"},
+		GoModHashes: []sbomFileHash{
+			{Path: "builddir/github.com/gokrazy/hello/go.mod", Hash: "h2"},
+			{Path: "builddir/github.com/gokrazy/breakglass/go.mod", Hash: "b1"},
+			{Path: "builddir/github.com/gokrazy/serial-busybox/go.mod", Hash: "s1"},
+		},
+		ExtraFileHashes: []sbomFileHash{
+			{Path: "extrafiles/github.com/gokrazy/hello/etc/hello.conf", Hash: "e1"},
+		},
+	}
+	want := &sbomDiff{
+		Packages: []sbomChange{
+			{Name: "github.com/gokrazy/hello", Path: "builddir/github.com/gokrazy/hello/go.mod", Change: sbomChanged, OldHash: "h1", NewHash: "h2"},
+			{Name: "github.com/gokrazy/rsync", Path: "builddir/github.com/gokrazy/rsync/go.mod", Change: sbomRemoved, OldHash: "r1"},
+			{Name: "github.com/gokrazy/serial-busybox", Path: "builddir/github.com/gokrazy/serial-busybox/go.mod", Change: sbomAdded, NewHash: "s1"},
+		},
+		ExtraFiles: []sbomChange{},
+	}
+	if diff := cmp.Diff(want, diffSBOMs(old, new)); diff != "" {
+		t.Errorf("diffSBOMs: unexpected diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestDiffModules(t *testing.T) {
+	old := map[string][]string{
+		"golang.org/x/net":          {"v0.15.0"},
+		"golang.org/x/sys":          {"v0.10.0", "v0.12.0"},
+		"github.com/gokrazy/rsync":  {"v0.1.0"},
+		"github.com/gokrazy/gokapi": {"v0.0.0-20230221201649-f3b6ca76639a"},
+	}
+	new := map[string][]string{
+		"golang.org/x/net":          {"v0.17.0"},
+		"golang.org/x/sys":          {"v0.12.0"},
+		"github.com/gokrazy/gokapi": {"v0.0.0-20230221201649-f3b6ca76639a"},
+		"github.com/gokrazy/hello":  {"v1.0.0"},
+	}
+	want := []moduleChange{
+		{Path: "github.com/gokrazy/hello", Change: sbomAdded, NewVersions: []string{"v1.0.0"}},
+		{Path: "github.com/gokrazy/rsync", Change: sbomRemoved, OldVersions: []string{"v0.1.0"}},
+		{Path: "golang.org/x/net", Change: sbomChanged, OldVersions: []string{"v0.15.0"}, NewVersions: []string{"v0.17.0"}},
+		{Path: "golang.org/x/sys", Change: sbomChanged, OldVersions: []string{"v0.10.0", "v0.12.0"}, NewVersions: []string{"v0.12.0"}},
+	}
+	if diff := cmp.Diff(want, diffModules(old, new)); diff != "" {
+		t.Errorf("diffModules: unexpected diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestSBOMDiff(t *testing.T) {
+	for _, tc := range testDatabases() {
+		t.Run(tc.databaseType, func(t *testing.T) {
+			ts := newTestServer(t, tc.databaseType)
+
+			// The machine reports the SBOM of the image it runs.
+			if err := ts.postJSON("/api/v1/heartbeat", &heartbeatRequest{
+				MachineID: "scan2drive",
+				SBOMHash:  "running",
+				SBOM: json.RawMessage(`{
+  "config_hash": {"path": "config.json", "hash": "c0ffee"},
+  "go_mod_hashes": [
+    {"path": "builddir/github.com/stapelberg/scan2drive/go.mod", "hash": "abc"},
+    {"path": "builddir/github.com/gokrazy/rsync/go.mod", "hash": "123"}
+  ]
+}`),
+			}, nil); err != nil {
+				t.Fatal(err)
+			}
+
+			// The pushed image contains its SBOM, which is stored on ingestion.
+			gaf, hash := gafWithSBOM(t, gafTestSBOM{
+				ConfigHash: gafTestFileHash{Path: "config.json", Hash: "c0ffee"},
+				GoModHashes: []gafTestFileHash{
+					{Path: "builddir/github.com/stapelberg/scan2drive/go.mod", Hash: "def"},
+					{Path: "builddir/github.com/gokrazy/hello/go.mod", Hash: "456"},
+				},
+			})
+			pr := ts.push(t, gaf)
+			if err := ts.postJSON("/api/v1/ingest", &ingestRequest{
+				MachineIDPattern: "scan2drive",
+				SBOMHash:         hash,
+				RegistryType:     "localdisk",
+				DownloadLink:     pr.DownloadLink,
+			}, nil); err != nil {
+				t.Fatal(err)
+			}
+
+			get := func(path string) (*http.Response, []byte) {
+				t.Helper()
+				resp, err := ts.Client().Get(ts.URL() + path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer resp.Body.Close()
+				b, err := io.ReadAll(resp.Body)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return resp, b
+			}
+
+			resp, b := get("/api/v1/sbomdiff?machine_id=scan2drive")
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("GET sbomdiff: got %v, want %v (body: %s)", resp.Status, http.StatusOK, b)
+			}
+			var got sbomDiff
+			if err := json.Unmarshal(b, &got); err != nil {
+				t.Fatal(err)
+			}
+			want := sbomDiff{
+				MachineID:    "scan2drive",
+				FromSBOMHash: "running",
+				ToSBOMHash:   hash,
+				Packages: []sbomChange{
+					{Name: "github.com/gokrazy/hello", Path: "builddir/github.com/gokrazy/hello/go.mod", Change: sbomAdded, NewHash: "456"},
+					{Name: "github.com/gokrazy/rsync", Path: "builddir/github.com/gokrazy/rsync/go.mod", Change: sbomRemoved, OldHash: "123"},
+					{Name: "github.com/stapelberg/scan2drive", Path: "builddir/github.com/stapelberg/scan2drive/go.mod", Change: sbomChanged, OldHash: "abc", NewHash: "def"},
+				},
+				ExtraFiles: []sbomChange{},
+				// Neither image was pushed with programs.
+				ModulesUnknown: []string{"running", hash},
+				Modules:        []moduleChange{},
+			}
+			if diff := cmp.Diff(want, got); diff != "" {
+				t.Errorf("GET sbomdiff: unexpected diff (-want +got):\n%s", diff)
+			}
+
+			resp, b = get("/machines/scan2drive")
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("GET machine page: got %v, want %v", resp.Status, http.StatusOK)
+			}
+			for _, want := range []string{`id="sbom-diff"`, "github.com/gokrazy/rsync"} {
+				if !strings.Contains(string(b), want) {
+					t.Errorf("machine page does not contain %q", want)
+				}
+			}
+
+			// Images whose SBOM is unknown are reported as missing.
+			resp, b = get("/api/v1/sbomdiff?from=running&to=unknown")
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("GET sbomdiff: got %v, want %v (body: %s)", resp.Status, http.StatusOK, b)
+			}
+			got = sbomDiff{}
+			if err := json.Unmarshal(b, &got); err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff([]string{"unknown"}, got.Missing); diff != "" {
+				t.Errorf("GET sbomdiff: unexpected missing SBOMs (-want +got):\n%s", diff)
+			}
+
+			// The module versions of images pushed with programs are known.
+			program, _ := testProgram(t)
+			var hashes []string
+			for _, config := range []string{"c1", "c2"} {
+				gaf, hash := gafWithRootFS(t, gafTestSBOM{
+					ConfigHash: gafTestFileHash{Path: "config.json", Hash: config},
+				}, squashfsWithFiles(t, program))
+				pr := ts.push(t, gaf)
+				if err := ts.postJSON("/api/v1/ingest", &ingestRequest{
+					MachineIDPattern: "other",
+					SBOMHash:         hash,
+					RegistryType:     "localdisk",
+					DownloadLink:     pr.DownloadLink,
+				}, nil); err != nil {
+					t.Fatal(err)
+				}
+				hashes = append(hashes, hash)
+			}
+			resp, b = get("/api/v1/sbomdiff?from=" + hashes[0] + "&to=" + hashes[1])
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("GET sbomdiff: got %v, want %v (body: %s)", resp.Status, http.StatusOK, b)
+			}
+			got = sbomDiff{}
+			if err := json.Unmarshal(b, &got); err != nil {
+				t.Fatal(err)
+			}
+			if !got.ConfigChanged || got.ModulesUnknown != nil || len(got.Modules) != 0 {
+				t.Errorf("GET sbomdiff: got %+v, want a config change and no module changes", got)
+			}
+
+			if resp, _ := get("/api/v1/sbomdiff?machine_id=nonexistent"); resp.StatusCode != http.StatusNotFound {
+				t.Errorf("GET sbomdiff for nonexistent machine: got %v, want %v", resp.Status, http.StatusNotFound)
+			}
+		})
+	}
+}
@@ -17,6 +17,111 @@ type queries struct {
 	selectImagesForDesired   *sql.Stmt
 	updateDesiredImage       *sql.Stmt
 	updateUpdateState        *sql.Stmt
+	markInformed             *sql.Stmt
+	selectUpdateState        *sql.Stmt
+	updatePendingImage       *sql.Stmt
+	updateIngestionPolicy    *sql.Stmt
+	approvePendingImage      *sql.Stmt
+	selectImage              *sql.Stmt
+	selectUpdateImage        *sql.Stmt
+	selectImagePattern       *sql.Stmt
+	insertRollout            *sql.Stmt
+	selectRollouts           *sql.Stmt
+	selectRolloutMachines    *sql.Stmt
+	updateRolloutState       *sql.Stmt
+	updateRolloutWave        *sql.Stmt
+	insertRolloutMachine     *sql.Stmt
+	upsertImageHistory       *sql.Stmt
+	selectKnownGoodImage     *sql.Stmt
+	selectHeartbeat          *sql.Stmt
+	selectMaintenanceWindows *sql.Stmt
+	upsertMaintenanceWindow  *sql.Stmt
+	deleteMaintenanceWindow  *sql.Stmt
+	updateMachineWindow      *sql.Stmt
+	selectMachineWindow      *sql.Stmt
+	insertToken              *sql.Stmt
+	selectToken              *sql.Stmt
+	selectTokens             *sql.Stmt
+	deleteToken              *sql.Stmt
+	countTokensByName        *sql.Stmt
+	selectEnrollment         *sql.Stmt
+	enrollMachine            *sql.Stmt
+	approveEnrollment        *sql.Stmt
+	resetEnrollment          *sql.Stmt
+	insertSigningKey         *sql.Stmt
+	selectSigningKeys        *sql.Stmt
+	deleteSigningKey         *sql.Stmt
+	selectProtectedImages    *sql.Stmt
+	deleteImage              *sql.Stmt
+	selectImageByDownloadURL *sql.Stmt
+	updateImageDigest        *sql.Stmt
+	selectRemoteImages       *sql.Stmt
+	updateRemoteImage        *sql.Stmt
+	updateRemoteCheck        *sql.Stmt
+	selectImageByDigest      *sql.Stmt
+	insertAlias              *sql.Stmt
+	selectAlias              *sql.Stmt
+	selectAliases            *sql.Stmt
+	deleteAliases            *sql.Stmt
+	updateMigratedImage      *sql.Stmt
+	insertUpload             *sql.Stmt
+	selectUpload             *sql.Stmt
+	updateUploadOffset       *sql.Stmt
+	deleteUpload             *sql.Stmt
+	selectExpiredUploads     *sql.Stmt
+	selectLocalDigest        *sql.Stmt
+	selectDelta              *sql.Stmt
+	upsertDelta              *sql.Stmt
+	deleteDeltas             *sql.Stmt
+	selectDeltas             *sql.Stmt
+	deleteDelta              *sql.Stmt
+	selectTokenQuota         *sql.Stmt
+	selectTokenUsage         *sql.Stmt
+	selectCurrentHistory     *sql.Stmt
+	extendCurrentHistory     *sql.Stmt
+	upsertCurrentHistory     *sql.Stmt
+	insertHistory            *sql.Stmt
+	selectHistory            *sql.Stmt
+	selectHistoryBefore      *sql.Stmt
+	deleteHistoryEntry       *sql.Stmt
+	deleteHistory            *sql.Stmt
+	deleteCurrentHistory     *sql.Stmt
+	selectAvailability       *sql.Stmt
+	updateAvailability       *sql.Stmt
+	updateNotified           *sql.Stmt
+	insertTransition         *sql.Stmt
+	selectTransitions        *sql.Stmt
+	deleteTransitions        *sql.Stmt
+	countByAvailability      *sql.Stmt
+	countBySBOMHash          *sql.Stmt
+	countByUpdateState       *sql.Stmt
+	countImages              *sql.Stmt
+	selectImageSBOM          *sql.Stmt
+	selectHeartbeatSBOM      *sql.Stmt
+	selectMachineImages      *sql.Stmt
+	upsertModule             *sql.Stmt
+	selectUnindexedSBOMs     *sql.Stmt
+	deleteSBOMModules        *sql.Stmt
+	selectSBOMModules        *sql.Stmt
+	countSBOMIndex           *sql.Stmt
+	deleteStaleModules       *sql.Stmt
+	upsertSBOMIndex          *sql.Stmt
+	deleteStaleIndex         *sql.Stmt
+	selectModuleMachines     *sql.Stmt
+	selectModuleImages       *sql.Stmt
+}
+
+// addColumn adds a column to a table created by an older version of GUS.
+// CREATE TABLE IF NOT EXISTS does not modify existing tables, and SQLite
+// does not support ALTER TABLE … ADD COLUMN IF NOT EXISTS, so we check whether
+// the column exists by selecting it.
+func addColumn(db *sql.DB, table, column, definition string) error {
+	rows, err := db.Query("SELECT " + column + " FROM " + table + " LIMIT 0")
+	if err == nil {
+		return rows.Close()
+	}
+	_, err = db.Exec("ALTER TABLE " + table + " ADD COLUMN " + column + " " + definition)
+	return err
 }
 
 func initDatabase(db *sql.DB, dbType string) (*queries, error) {
@@ -46,24 +151,172 @@ CREATE TABLE IF NOT EXISTS heartbeats (
 	remote_ip TEXT NULL,
 	hostname TEXT NULL
 );
+
+CREATE TABLE IF NOT EXISTS rollouts (
+	sbom_hash TEXT NOT NULL PRIMARY KEY,
+	creation_timestamp %[1]s NOT NULL,
+	state TEXT NOT NULL,
+	canary_machines TEXT NOT NULL,
+	canary_percent INTEGER NOT NULL,
+	wave_percent INTEGER NOT NULL,
+	soak_seconds BIGINT NOT NULL,
+	wave INTEGER NOT NULL,
+	wave_timestamp %[1]s NULL
+);
+
+CREATE TABLE IF NOT EXISTS rollout_machines (
+	sbom_hash TEXT NOT NULL,
+	machine_id TEXT NOT NULL,
+	wave INTEGER NOT NULL,
+	PRIMARY KEY (sbom_hash, machine_id)
+);
+
+CREATE TABLE IF NOT EXISTS image_history (
+	machine_id TEXT NOT NULL,
+	sbom_hash TEXT NOT NULL,
+	first_heartbeat %[1]s NOT NULL,
+	last_heartbeat %[1]s NOT NULL,
+	PRIMARY KEY (machine_id, sbom_hash)
+);
+
+CREATE TABLE IF NOT EXISTS maintenance_windows (
+	machine_id_pattern TEXT NOT NULL PRIMARY KEY,
+	schedule TEXT NOT NULL,
+	timezone TEXT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS api_tokens (
+	token_hash TEXT NOT NULL PRIMARY KEY,
+	name TEXT NOT NULL,
+	scopes TEXT NOT NULL,
+	creation_timestamp %[1]s NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS signing_keys (
+	name TEXT NOT NULL PRIMARY KEY,
+	public_key TEXT NOT NULL,
+	creation_timestamp %[1]s NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS image_aliases (
+	download_url TEXT NOT NULL PRIMARY KEY,
+	disk_sha256 TEXT NOT NULL,
+	creation_timestamp %[1]s NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS image_deltas (
+	base_sha256 TEXT NOT NULL,
+	target_sha256 TEXT NOT NULL,
+	delta_sha256 TEXT NULL,
+	delta_size BIGINT NULL,
+	creation_timestamp %[1]s NOT NULL,
+	PRIMARY KEY (base_sha256, target_sha256)
+);
+
+CREATE TABLE IF NOT EXISTS upload_sessions (
+	upload_id TEXT NOT NULL PRIMARY KEY,
+	size BIGINT NULL,
+	received BIGINT NOT NULL,
+	creation_timestamp %[1]s NOT NULL,
+	last_activity_timestamp %[1]s NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS heartbeat_history (
+	machine_id TEXT NOT NULL,
+	first_heartbeat %[1]s NOT NULL,
+	last_heartbeat %[1]s NOT NULL,
+	heartbeats BIGINT NOT NULL,
+	sbom_hash TEXT NOT NULL,
+	kernel TEXT NOT NULL,
+	remote_ip TEXT NOT NULL,
+	hostname TEXT NOT NULL,
+	PRIMARY KEY (machine_id, first_heartbeat)
+);
+
+CREATE TABLE IF NOT EXISTS current_history (
+	machine_id TEXT NOT NULL PRIMARY KEY,
+	first_heartbeat %[1]s NOT NULL,
+	last_heartbeat %[1]s NOT NULL,
+	heartbeats BIGINT NOT NULL,
+	sbom_hash TEXT NOT NULL,
+	kernel TEXT NOT NULL,
+	remote_ip TEXT NOT NULL,
+	hostname TEXT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS availability_transitions (
+	machine_id TEXT NOT NULL,
+	timestamp %[1]s NOT NULL,
+	availability TEXT NOT NULL,
+	PRIMARY KEY (machine_id, timestamp)
+);
+
+CREATE TABLE IF NOT EXISTS sbom_index (
+	sbom_hash TEXT NOT NULL PRIMARY KEY,
+	indexed_timestamp %[1]s NOT NULL,
+	source TEXT NOT NULL,
+	error TEXT NULL
+);
+
+CREATE TABLE IF NOT EXISTS sbom_modules (
+	sbom_hash TEXT NOT NULL,
+	module_path TEXT NOT NULL,
+	version TEXT NOT NULL,
+	PRIMARY KEY (sbom_hash, module_path, version)
+);
 	`
 
-	var schema string
+	var timestampType string
 	switch strings.TrimPrefix(dbType, "txdb/") {
 	case "sqlite":
-		schema = fmt.Sprintf(schemaTemplate, "DATETIME")
+		timestampType = "DATETIME"
 	case "postgres":
-		schema = fmt.Sprintf(schemaTemplate, "TIMESTAMPTZ")
+		timestampType = "TIMESTAMPTZ"
 	}
+	schema := fmt.Sprintf(schemaTemplate, timestampType)
 
 	if _, err := db.Exec(schema); err != nil {
 		return nil, err
 	}
 
+	// Columns which were added after the initial schema:
+	for _, col := range []struct {
+		table, column, definition string
+	}{
+		{"machines", "pending_image", "TEXT NULL"},
+		{"machines", "pinned_image", "TEXT NULL"},
+		{"machines", "update_state_timestamp", timestampType + " NULL"},
+		{"rollouts", "halt_failure_percent", "INTEGER NOT NULL DEFAULT 0"},
+		{"rollouts", "silence_timeout_seconds", "BIGINT NOT NULL DEFAULT 0"},
+		{"rollouts", "rollback", "BOOLEAN NOT NULL DEFAULT FALSE"},
+		{"machines", "enrollment", "TEXT NULL"},
+		{"machines", "device_secret_hash", "TEXT NULL"},
+		{"images", "disk_sha256", "TEXT NULL"},
+		{"images", "signature", "TEXT NULL"},
+		{"images", "signing_key", "TEXT NULL"},
+		{"images", "disk_size", "BIGINT NULL"},
+		{"images", "remote_etag", "TEXT NULL"},
+		{"images", "last_check", timestampType + " NULL"},
+		{"images", "check_error", "TEXT NULL"},
+		{"api_tokens", "quota_bytes", "BIGINT NULL"},
+		{"image_aliases", "disk_size", "BIGINT NULL"},
+		{"image_aliases", "token_hash", "TEXT NULL"},
+		{"machines", "availability", "TEXT NULL"},
+		{"machines", "availability_timestamp", timestampType + " NULL"},
+		{"machines", "notified_availability", "TEXT NULL"},
+		{"images", "sbom", "TEXT NULL"},
+		{"upload_sessions", "token_hash", "TEXT NULL"},
+		{"machines", "maintenance_window", "TEXT NULL"},
+	} {
+		if err := addColumn(db, col.table, col.column, col.definition); err != nil {
+			return nil, fmt.Errorf("adding column %s.%s: %v", col.table, col.column, err)
+		}
+	}
+
 	insertImage, err := db.Prepare(`
-INSERT INTO images (sbom_hash, ingestion_timestamp, machine_id_pattern, registry_type, download_url)
-VALUES ($1, $2, $3, $4, $5)
-ON CONFLICT (sbom_hash) DO UPDATE SET ingestion_timestamp = $2, machine_id_pattern = $3, registry_type = $4, download_url = $5
+INSERT INTO images (sbom_hash, ingestion_timestamp, machine_id_pattern, registry_type, download_url, disk_sha256, signature, signing_key, disk_size, sbom)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+ON CONFLICT (sbom_hash) DO UPDATE SET ingestion_timestamp = $2, machine_id_pattern = $3, registry_type = $4, download_url = $5, disk_sha256 = $6, signature = $7, signing_key = $8, disk_size = $9, sbom = $10
 `)
 	if err != nil {
 		return nil, err
@@ -93,6 +346,10 @@ SELECT
   machines.desired_image,
   machines.update_state,
   machines.ingestion_policy,
+  machines.pending_image,
+  machines.pinned_image,
+  machines.enrollment,
+  machines.availability,
   heartbeats.sbom_hash,
   heartbeats.timestamp,
   heartbeats.model,
@@ -107,7 +364,21 @@ ORDER BY heartbeats.hostname, heartbeats.machine_id ASC
 	}
 
 	selectMachinesForDesired, err := db.Prepare(`
-SELECT machine_id, desired_image, ingestion_policy FROM machines
+SELECT
+  machines.machine_id,
+  machines.desired_image,
+  machines.ingestion_policy,
+  machines.pending_image,
+  machines.pinned_image,
+  machines.update_state,
+  machines.update_state_timestamp,
+  machines.enrollment,
+  heartbeats.timestamp,
+  heartbeats.hostname,
+  heartbeats.model,
+  machines.maintenance_window
+FROM machines
+LEFT JOIN heartbeats ON (machines.machine_id = heartbeats.machine_id)
 `)
 	if err != nil {
 		return nil, err
@@ -117,7 +388,9 @@ SELECT machine_id, desired_image, ingestion_policy FROM machines
 SELECT
   machines.desired_image,
   images.registry_type,
-  images.download_url
+  images.download_url,
+  images.disk_sha256,
+  images.signature
 FROM machines
 INNER JOIN images ON (machines.desired_image = images.sbom_hash)
 WHERE machine_id = $1
@@ -132,7 +405,10 @@ SELECT
   ingestion_timestamp,
   machine_id_pattern,
   registry_type,
-  download_url
+  download_url,
+  disk_size,
+  check_error,
+  disk_sha256
 FROM images
 ORDER BY ingestion_timestamp DESC
 `)
@@ -153,7 +429,7 @@ ORDER BY ingestion_timestamp DESC
 
 	updateDesiredImage, err := db.Prepare(`
 UPDATE machines
-SET desired_image = $1
+SET desired_image = $1, update_state = NULL, update_state_timestamp = NULL
 WHERE machine_id = $2
 `)
 	if err != nil {
@@ -162,23 +438,1109 @@ WHERE machine_id = $2
 
 	updateUpdateState, err := db.Prepare(`
 UPDATE machines
-SET update_state = $1
+SET update_state = $1, update_state_timestamp = $2
+WHERE machine_id = $3
+`)
+	if err != nil {
+		return nil, err
+	}
+
+	// markInformed only transitions machines which have not yet progressed
+	// further, as devices keep polling the update API.
+	markInformed, err := db.Prepare(`
+UPDATE machines
+SET update_state = $1, update_state_timestamp = $2
+WHERE machine_id = $3 AND update_state IS NULL
+`)
+	if err != nil {
+		return nil, err
+	}
+
+	selectUpdateState, err := db.Prepare(`
+SELECT
+  desired_image,
+  update_state,
+  update_state_timestamp
+FROM machines
+WHERE machine_id = $1
+`)
+	if err != nil {
+		return nil, err
+	}
+
+	updatePendingImage, err := db.Prepare(`
+UPDATE machines
+SET pending_image = $1
 WHERE machine_id = $2
 `)
 	if err != nil {
 		return nil, err
 	}
 
-	return &queries{
-		insertHeartbeat:          insertHeartbeat,
-		insertMachine:            insertMachine,
-		selectMachinesForIndex:   selectMachinesForIndex,
-		selectMachinesForDesired: selectMachinesForDesired,
-		selectDesired:            selectDesired,
-		insertImage:              insertImage,
-		selectImagesForIndex:     selectImagesForIndex,
-		selectImagesForDesired:   selectImagesForDesired,
-		updateDesiredImage:       updateDesiredImage,
-		updateUpdateState:        updateUpdateState,
-	}, nil
+	updateIngestionPolicy, err := db.Prepare(`
+UPDATE machines
+SET ingestion_policy = $1, pinned_image = $2, pending_image = NULL
+WHERE machine_id = $3
+`)
+	if err != nil {
+		return nil, err
+	}
+
+	approvePendingImage, err := db.Prepare(`
+UPDATE machines
+SET desired_image = pending_image, pending_image = NULL, update_state = NULL, update_state_timestamp = NULL
+WHERE machine_id = $1 AND pending_image IS NOT NULL
+`)
+	if err != nil {
+		return nil, err
+	}
+
+	selectImage, err := db.Prepare(`
+SELECT
+  sbom_hash,
+  registry_type,
+  download_url
+FROM images
+WHERE sbom_hash = $1
+`)
+	if err != nil {
+		return nil, err
+	}
+
+	selectUpdateImage, err := db.Prepare(`
+SELECT
+  sbom_hash,
+  registry_type,
+  download_url,
+  disk_sha256,
+  signature
+FROM images
+WHERE sbom_hash = $1
+`)
+	if err != nil {
+		return nil, err
+	}
+
+	selectImagePattern, err := db.Prepare(`
+SELECT machine_id_pattern
+FROM images
+WHERE sbom_hash = $1
+`)
+	if err != nil {
+		return nil, err
+	}
+
+	insertRollout, err := db.Prepare(`
+INSERT INTO rollouts (sbom_hash, creation_timestamp, state, canary_machines, canary_percent, wave_percent, soak_seconds, wave, halt_failure_percent, silence_timeout_seconds, rollback)
+VALUES ($1, $2, $3, $4, $5, $6, $7, 0, $8, $9, $10)
+`)
+	if err != nil {
+		return nil, err
+	}
+
+	selectRollouts, err := db.Prepare(`
+SELECT
+  sbom_hash,
+  creation_timestamp,
+  state,
+  canary_machines,
+  canary_percent,
+  wave_percent,
+  soak_seconds,
+  wave,
+  wave_timestamp,
+  halt_failure_percent,
+  silence_timeout_seconds,
+  rollback
+FROM rollouts
+ORDER BY creation_timestamp DESC
+`)
+	if err != nil {
+		return nil, err
+	}
+
+	selectRolloutMachines, err := db.Prepare(`
+SELECT
+  sbom_hash,
+  machine_id,
+  wave
+FROM rollout_machines
+`)
+	if err != nil {
+		return nil, err
+	}
+
+	updateRolloutState, err := db.Prepare(`
+UPDATE rollouts
+SET state = $1
+WHERE sbom_hash = $2
+`)
+	if err != nil {
+		return nil, err
+	}
+
+	updateRolloutWave, err := db.Prepare(`
+UPDATE rollouts
+SET wave = $1, wave_timestamp = $2
+WHERE sbom_hash = $3
+`)
+	if err != nil {
+		return nil, err
+	}
+
+	insertRolloutMachine, err := db.Prepare(`
+INSERT INTO rollout_machines (sbom_hash, machine_id, wave)
+VALUES ($1, $2, $3)
+ON CONFLICT (sbom_hash, machine_id) DO NOTHING
+`)
+	if err != nil {
+		return nil, err
+	}
+
+	upsertImageHistory, err := db.Prepare(`
+INSERT INTO image_history (machine_id, sbom_hash, first_heartbeat, last_heartbeat)
+VALUES ($1, $2, $3, $3)
+ON CONFLICT (machine_id, sbom_hash) DO UPDATE SET last_heartbeat = $3
+`)
+	if err != nil {
+		return nil, err
+	}
+
+	// selectKnownGoodImage returns the image which the machine most recently
+	// ran, excluding the specified (bad) image. Only images which GUS can
+	// serve via the update API are considered.
+	selectKnownGoodImage, err := db.Prepare(`
+SELECT
+  image_history.sbom_hash
+FROM image_history
+INNER JOIN images ON (image_history.sbom_hash = images.sbom_hash)
+WHERE image_history.machine_id = $1 AND image_history.sbom_hash <> $2
+ORDER BY image_history.last_heartbeat DESC
+LIMIT 1
+`)
+	if err != nil {
+		return nil, err
+	}
+
+	selectHeartbeat, err := db.Prepare(`
+SELECT
+  sbom_hash,
+  hostname,
+  model
+FROM heartbeats
+WHERE machine_id = $1
+`)
+	if err != nil {
+		return nil, err
+	}
+
+	selectMaintenanceWindows, err := db.Prepare(`
+SELECT
+  machine_id_pattern,
+  schedule,
+  timezone
+FROM maintenance_windows
+ORDER BY machine_id_pattern ASC
+`)
+	if err != nil {
+		return nil, err
+	}
+
+	upsertMaintenanceWindow, err := db.Prepare(`
+INSERT INTO maintenance_windows (machine_id_pattern, schedule, timezone)
+VALUES ($1, $2, $3)
+ON CONFLICT (machine_id_pattern) DO UPDATE SET schedule = $2, timezone = $3
+`)
+	if err != nil {
+		return nil, err
+	}
+
+	deleteMaintenanceWindow, err := db.Prepare(`
+DELETE FROM maintenance_windows
+WHERE machine_id_pattern = $1
+`)
+	if err != nil {
+		return nil, err
+	}
+
+	updateMachineWindow, err := db.Prepare(`
+UPDATE machines
+SET maintenance_window = $1
+WHERE machine_id = $2
+`)
+	if err != nil {
+		return nil, err
+	}
+
+	selectMachineWindow, err := db.Prepare(`
+SELECT
+  heartbeats.sbom_hash,
+  maintenance_windows.machine_id_pattern,
+  maintenance_windows.schedule,
+  maintenance_windows.timezone
+FROM heartbeats
+LEFT JOIN machines ON (heartbeats.machine_id = machines.machine_id)
+LEFT JOIN maintenance_windows ON (machines.maintenance_window = maintenance_windows.machine_id_pattern)
+WHERE heartbeats.machine_id = $1
+`)
+	if err != nil {
+		return nil, err
+	}
+
+	insertToken, err := db.Prepare(`
+INSERT INTO api_tokens (token_hash, name, scopes, creation_timestamp, quota_bytes)
+VALUES ($1, $2, $3, $4, $5)
+`)
+	if err != nil {
+		return nil, err
+	}
+
+	selectToken, err := db.Prepare(`
+SELECT
+  name,
+  scopes
+FROM api_tokens
+WHERE token_hash = $1
+`)
+	if err != nil {
+		return nil, err
+	}
+
+	selectTokens, err := db.Prepare(`
+SELECT
+  name,
+  scopes,
+  creation_timestamp,
+  quota_bytes
+FROM api_tokens
+ORDER BY creation_timestamp ASC
+`)
+	if err != nil {
+		return nil, err
+	}
+
+	countTokensByName, err := db.Prepare(`
+SELECT COUNT(*)
+FROM api_tokens
+WHERE name = $1
+`)
+	if err != nil {
+		return nil, err
+	}
+
+	deleteToken, err := db.Prepare(`
+DELETE FROM api_tokens
+WHERE name = $1
+`)
+	if err != nil {
+		return nil, err
+	}
+
+	selectEnrollment, err := db.Prepare(`
+SELECT
+  enrollment,
+  device_secret_hash
+FROM machines
+WHERE machine_id = $1
+`)
+	if err != nil {
+		return nil, err
+	}
+
+	enrollMachine, err := db.Prepare(`
+INSERT INTO machines (machine_id, enrollment, device_secret_hash)
+VALUES ($1, $2, $3)
+ON CONFLICT (machine_id) DO UPDATE SET enrollment = $2, device_secret_hash = $3
+WHERE machines.device_secret_hash IS NULL
+`)
+	if err != nil {
+		return nil, err
+	}
+
+	approveEnrollment, err := db.Prepare(`
+UPDATE machines
+SET enrollment = $1
+WHERE machine_id = $2
+  AND device_secret_hash IS NOT NULL
+`)
+	if err != nil {
+		return nil, err
+	}
+
+	resetEnrollment, err := db.Prepare(`
+UPDATE machines
+SET enrollment = NULL, device_secret_hash = NULL
+WHERE machine_id = $1
+  AND device_secret_hash IS NOT NULL
+`)
+	if err != nil {
+		return nil, err
+	}
+
+	insertSigningKey, err := db.Prepare(`
+INSERT INTO signing_keys (name, public_key, creation_timestamp)
+VALUES ($1, $2, $3)
+`)
+	if err != nil {
+		return nil, err
+	}
+
+	selectSigningKeys, err := db.Prepare(`
+SELECT
+  name,
+  public_key,
+  creation_timestamp
+FROM signing_keys
+ORDER BY name ASC
+`)
+	if err != nil {
+		return nil, err
+	}
+
+	deleteSigningKey, err := db.Prepare(`
+DELETE FROM signing_keys
+WHERE name = $1
+`)
+	if err != nil {
+		return nil, err
+	}
+
+	selectProtectedImages, err := db.Prepare(`
+SELECT desired_image FROM machines WHERE desired_image IS NOT NULL
+UNION
+SELECT pending_image FROM machines WHERE pending_image IS NOT NULL
+UNION
+SELECT pinned_image FROM machines WHERE pinned_image IS NOT NULL
+UNION
+SELECT sbom_hash FROM heartbeats WHERE sbom_hash IS NOT NULL
+UNION
+SELECT sbom_hash FROM rollouts WHERE state IN ($1, $2, $3)
+`)
+	if err != nil {
+		return nil, err
+	}
+
+	deleteImage, err := db.Prepare(`
+DELETE FROM images
+WHERE sbom_hash = $1
+`)
+	if err != nil {
+		return nil, err
+	}
+
+	selectImageByDownloadURL, err := db.Prepare(`
+SELECT
+  sbom_hash,
+  disk_sha256
+FROM images
+WHERE download_url = $1
+  AND registry_type = 'localdisk'
+ORDER BY ingestion_timestamp DESC
+LIMIT 1
+`)
+	if err != nil {
+		return nil, err
+	}
+
+	updateImageDigest, err := db.Prepare(`
+UPDATE images
+SET disk_sha256 = $1, disk_size = $2
+WHERE sbom_hash = $3
+`)
+	if err != nil {
+		return nil, err
+	}
+
+	selectRemoteImages, err := db.Prepare(`
+SELECT
+  sbom_hash,
+  download_url,
+  disk_size,
+  remote_etag,
+  check_error
+FROM images
+WHERE registry_type = $1
+`)
+	if err != nil {
+		return nil, err
+	}
+
+	updateRemoteImage, err := db.Prepare(`
+UPDATE images
+SET remote_etag = $1, last_check = $2, check_error = NULL
+WHERE sbom_hash = $3
+`)
+	if err != nil {
+		return nil, err
+	}
+
+	updateRemoteCheck, err := db.Prepare(`
+UPDATE images
+SET last_check = $1, check_error = $2
+WHERE sbom_hash = $3
+`)
+	if err != nil {
+		return nil, err
+	}
+
+	selectImageByDigest, err := db.Prepare(`
+SELECT
+  sbom_hash,
+  disk_size
+FROM images
+WHERE registry_type = $1
+  AND disk_sha256 = $2
+ORDER BY ingestion_timestamp DESC
+LIMIT 1
+`)
+	if err != nil {
+		return nil, err
+	}
+
+	insertAlias, err := db.Prepare(`
+INSERT INTO image_aliases (download_url, disk_sha256, creation_timestamp, disk_size, token_hash)
+VALUES ($1, $2, $3, $4, $5)
+ON CONFLICT (download_url) DO NOTHING
+`)
+	if err != nil {
+		return nil, err
+	}
+
+	selectAlias, err := db.Prepare(`
+SELECT disk_sha256
+FROM image_aliases
+WHERE download_url = $1
+`)
+	if err != nil {
+		return nil, err
+	}
+
+	selectAliases, err := db.Prepare(`
+SELECT
+  disk_sha256,
+  creation_timestamp
+FROM image_aliases
+`)
+	if err != nil {
+		return nil, err
+	}
+
+	deleteAliases, err := db.Prepare(`
+DELETE FROM image_aliases
+WHERE disk_sha256 = $1
+`)
+	if err != nil {
+		return nil, err
+	}
+
+	updateMigratedImage, err := db.Prepare(`
+UPDATE images
+SET disk_sha256 = $1, disk_size = $2
+WHERE download_url = $3
+  AND registry_type = 'localdisk'
+  AND disk_sha256 IS NULL
+`)
+	if err != nil {
+		return nil, err
+	}
+
+	insertUpload, err := db.Prepare(`
+INSERT INTO upload_sessions (upload_id, size, received, creation_timestamp, last_activity_timestamp, token_hash)
+VALUES ($1, $2, 0, $3, $3, $4)
+`)
+	if err != nil {
+		return nil, err
+	}
+
+	selectUpload, err := db.Prepare(`
+SELECT
+  size,
+  received,
+  last_activity_timestamp,
+  token_hash
+FROM upload_sessions
+WHERE upload_id = $1
+`)
+	if err != nil {
+		return nil, err
+	}
+
+	updateUploadOffset, err := db.Prepare(`
+UPDATE upload_sessions
+SET received = $1, last_activity_timestamp = $2
+WHERE upload_id = $3
+`)
+	if err != nil {
+		return nil, err
+	}
+
+	deleteUpload, err := db.Prepare(`
+DELETE FROM upload_sessions
+WHERE upload_id = $1
+`)
+	if err != nil {
+		return nil, err
+	}
+
+	selectExpiredUploads, err := db.Prepare(`
+SELECT upload_id
+FROM upload_sessions
+WHERE last_activity_timestamp < $1
+`)
+	if err != nil {
+		return nil, err
+	}
+
+	selectLocalDigest, err := db.Prepare(`
+SELECT disk_sha256
+FROM images
+WHERE sbom_hash = $1
+  AND registry_type = 'localdisk'
+  AND download_url LIKE '/images/%'
+  AND disk_sha256 IS NOT NULL
+`)
+	if err != nil {
+		return nil, err
+	}
+
+	selectDelta, err := db.Prepare(`
+SELECT
+  delta_sha256,
+  delta_size
+FROM image_deltas
+WHERE base_sha256 = $1
+  AND target_sha256 = $2
+`)
+	if err != nil {
+		return nil, err
+	}
+
+	upsertDelta, err := db.Prepare(`
+INSERT INTO image_deltas (base_sha256, target_sha256, delta_sha256, delta_size, creation_timestamp)
+VALUES ($1, $2, $3, $4, $5)
+ON CONFLICT (base_sha256, target_sha256) DO UPDATE SET delta_sha256 = $3, delta_size = $4, creation_timestamp = $5
+`)
+	if err != nil {
+		return nil, err
+	}
+
+	deleteDeltas, err := db.Prepare(`
+DELETE FROM image_deltas
+WHERE target_sha256 = $1
+`)
+	if err != nil {
+		return nil, err
+	}
+
+	selectDeltas, err := db.Prepare(`
+SELECT
+  base_sha256,
+  target_sha256,
+  delta_sha256
+FROM image_deltas
+`)
+	if err != nil {
+		return nil, err
+	}
+
+	deleteDelta, err := db.Prepare(`
+DELETE FROM image_deltas
+WHERE base_sha256 = $1
+  AND target_sha256 = $2
+`)
+	if err != nil {
+		return nil, err
+	}
+
+	selectTokenQuota, err := db.Prepare(`
+SELECT
+  name,
+  quota_bytes
+FROM api_tokens
+WHERE token_hash = $1
+`)
+	if err != nil {
+		return nil, err
+	}
+
+	selectTokenUsage, err := db.Prepare(`
+SELECT COALESCE(SUM(disk_size), 0)
+FROM (
+  SELECT DISTINCT disk_sha256, disk_size
+  FROM image_aliases
+  WHERE token_hash = $1
+) AS pushed
+`)
+	if err != nil {
+		return nil, err
+	}
+
+	selectCurrentHistory, err := db.Prepare(`
+SELECT
+  first_heartbeat,
+  last_heartbeat,
+  heartbeats,
+  sbom_hash,
+  kernel,
+  remote_ip,
+  hostname
+FROM current_history
+WHERE machine_id = $1
+`)
+	if err != nil {
+		return nil, err
+	}
+
+	extendCurrentHistory, err := db.Prepare(`
+UPDATE current_history
+SET last_heartbeat = $2, heartbeats = heartbeats + 1
+WHERE machine_id = $1
+`)
+	if err != nil {
+		return nil, err
+	}
+
+	upsertCurrentHistory, err := db.Prepare(`
+INSERT INTO current_history (machine_id, first_heartbeat, last_heartbeat, heartbeats, sbom_hash, kernel, remote_ip, hostname)
+VALUES ($1, $2, $2, 1, $3, $4, $5, $6)
+ON CONFLICT (machine_id) DO UPDATE SET first_heartbeat = $2, last_heartbeat = $2, heartbeats = 1, sbom_hash = $3, kernel = $4, remote_ip = $5, hostname = $6
+`)
+	if err != nil {
+		return nil, err
+	}
+
+	insertHistory, err := db.Prepare(`
+INSERT INTO heartbeat_history (machine_id, first_heartbeat, last_heartbeat, heartbeats, sbom_hash, kernel, remote_ip, hostname)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+`)
+	if err != nil {
+		return nil, err
+	}
+
+	selectHistory, err := db.Prepare(`
+SELECT
+  first_heartbeat,
+  last_heartbeat,
+  heartbeats,
+  sbom_hash,
+  kernel,
+  remote_ip,
+  hostname
+FROM heartbeat_history
+WHERE machine_id = $1
+UNION ALL
+SELECT
+  first_heartbeat,
+  last_heartbeat,
+  heartbeats,
+  sbom_hash,
+  kernel,
+  remote_ip,
+  hostname
+FROM current_history
+WHERE machine_id = $1
+ORDER BY first_heartbeat ASC
+`)
+	if err != nil {
+		return nil, err
+	}
+
+	selectHistoryBefore, err := db.Prepare(`
+SELECT
+  machine_id,
+  first_heartbeat,
+  last_heartbeat,
+  heartbeats,
+  sbom_hash,
+  kernel,
+  remote_ip,
+  hostname
+FROM heartbeat_history
+WHERE last_heartbeat < $1
+ORDER BY machine_id, first_heartbeat ASC
+`)
+	if err != nil {
+		return nil, err
+	}
+
+	deleteHistoryEntry, err := db.Prepare(`
+DELETE FROM heartbeat_history
+WHERE machine_id = $1 AND first_heartbeat = $2
+`)
+	if err != nil {
+		return nil, err
+	}
+
+	deleteHistory, err := db.Prepare(`
+DELETE FROM heartbeat_history
+WHERE last_heartbeat < $1
+`)
+	if err != nil {
+		return nil, err
+	}
+
+	deleteCurrentHistory, err := db.Prepare(`
+DELETE FROM current_history
+WHERE last_heartbeat < $1
+`)
+	if err != nil {
+		return nil, err
+	}
+
+	selectAvailability, err := db.Prepare(`
+SELECT
+  machines.machine_id,
+  heartbeats.hostname,
+  heartbeats.timestamp,
+  machines.availability,
+  machines.availability_timestamp,
+  machines.notified_availability
+FROM machines
+INNER JOIN heartbeats ON (machines.machine_id = heartbeats.machine_id)
+`)
+	if err != nil {
+		return nil, err
+	}
+
+	updateAvailability, err := db.Prepare(`
+UPDATE machines
+SET availability = $2, availability_timestamp = $3
+WHERE machine_id = $1
+`)
+	if err != nil {
+		return nil, err
+	}
+
+	updateNotified, err := db.Prepare(`
+UPDATE machines
+SET notified_availability = $2
+WHERE machine_id = $1
+`)
+	if err != nil {
+		return nil, err
+	}
+
+	insertTransition, err := db.Prepare(`
+INSERT INTO availability_transitions (machine_id, timestamp, availability)
+VALUES ($1, $2, $3)
+ON CONFLICT (machine_id, timestamp) DO NOTHING
+`)
+	if err != nil {
+		return nil, err
+	}
+
+	selectTransitions, err := db.Prepare(`
+SELECT
+  timestamp,
+  availability
+FROM availability_transitions
+WHERE machine_id = $1
+ORDER BY timestamp ASC
+`)
+	if err != nil {
+		return nil, err
+	}
+
+	deleteTransitions, err := db.Prepare(`
+DELETE FROM availability_transitions
+WHERE timestamp < $1
+`)
+	if err != nil {
+		return nil, err
+	}
+
+	countByAvailability, err := db.Prepare(`
+SELECT availability, COUNT(*)
+FROM machines
+GROUP BY availability
+`)
+	if err != nil {
+		return nil, err
+	}
+
+	countBySBOMHash, err := db.Prepare(`
+SELECT sbom_hash, COUNT(*)
+FROM heartbeats
+GROUP BY sbom_hash
+`)
+	if err != nil {
+		return nil, err
+	}
+
+	countByUpdateState, err := db.Prepare(`
+SELECT update_state, COUNT(*)
+FROM machines
+GROUP BY update_state
+`)
+	if err != nil {
+		return nil, err
+	}
+
+	countImages, err := db.Prepare(`
+SELECT registry_type, COUNT(*)
+FROM images
+GROUP BY registry_type
+`)
+	if err != nil {
+		return nil, err
+	}
+
+	selectImageSBOM, err := db.Prepare(`
+SELECT sbom
+FROM images
+WHERE sbom_hash = $1
+`)
+	if err != nil {
+		return nil, err
+	}
+
+	selectHeartbeatSBOM, err := db.Prepare(`
+SELECT sbom
+FROM heartbeats
+WHERE sbom_hash = $1
+AND sbom NOT IN ('', 'null')
+LIMIT 1
+`)
+	if err != nil {
+		return nil, err
+	}
+
+	selectMachineImages, err := db.Prepare(`
+SELECT
+  heartbeats.sbom_hash,
+  machines.desired_image,
+  machines.pending_image
+FROM machines
+LEFT JOIN heartbeats ON (machines.machine_id = heartbeats.machine_id)
+WHERE machines.machine_id = $1
+`)
+	if err != nil {
+		return nil, err
+	}
+
+	upsertModule, err := db.Prepare(`
+INSERT INTO sbom_modules (sbom_hash, module_path, version)
+VALUES ($1, $2, $3)
+ON CONFLICT (sbom_hash, module_path, version) DO NOTHING
+`)
+	if err != nil {
+		return nil, err
+	}
+
+	selectUnindexedSBOMs, err := db.Prepare(`
+SELECT sbom_hash, sbom
+FROM images
+WHERE sbom IS NOT NULL
+AND sbom_hash NOT IN (SELECT sbom_hash FROM sbom_index)
+UNION
+SELECT sbom_hash, sbom
+FROM heartbeats
+WHERE sbom NOT IN ('', 'null')
+AND sbom_hash NOT IN (SELECT sbom_hash FROM sbom_index)
+`)
+	if err != nil {
+		return nil, err
+	}
+
+	upsertSBOMIndex, err := db.Prepare(`
+INSERT INTO sbom_index (sbom_hash, indexed_timestamp, source, error)
+VALUES ($1, $2, $3, $4)
+ON CONFLICT (sbom_hash) DO UPDATE SET indexed_timestamp = $2, source = $3, error = $4
+`)
+	if err != nil {
+		return nil, err
+	}
+
+	deleteStaleIndex, err := db.Prepare(`
+DELETE FROM sbom_index
+WHERE sbom_hash NOT IN (SELECT sbom_hash FROM images)
+AND sbom_hash NOT IN (SELECT sbom_hash FROM heartbeats)
+`)
+	if err != nil {
+		return nil, err
+	}
+
+	deleteSBOMModules, err := db.Prepare(`
+DELETE FROM sbom_modules WHERE sbom_hash = $1
+`)
+	if err != nil {
+		return nil, err
+	}
+
+	selectSBOMModules, err := db.Prepare(`
+SELECT module_path, version
+FROM sbom_modules
+WHERE sbom_hash = $1
+AND version != ''
+`)
+	if err != nil {
+		return nil, err
+	}
+
+	countSBOMIndex, err := db.Prepare(`
+SELECT COUNT(*) FROM sbom_index WHERE source = $1
+`)
+	if err != nil {
+		return nil, err
+	}
+
+	deleteStaleModules, err := db.Prepare(`
+DELETE FROM sbom_modules
+WHERE sbom_hash NOT IN (SELECT sbom_hash FROM images)
+AND sbom_hash NOT IN (SELECT sbom_hash FROM heartbeats)
+`)
+	if err != nil {
+		return nil, err
+	}
+
+	selectModuleMachines, err := db.Prepare(`
+SELECT
+  heartbeats.machine_id,
+  heartbeats.hostname,
+  sbom_modules.sbom_hash,
+  sbom_modules.module_path,
+  sbom_modules.version,
+  sbom_index.source
+FROM sbom_modules
+INNER JOIN heartbeats ON (heartbeats.sbom_hash = sbom_modules.sbom_hash)
+INNER JOIN sbom_index ON (sbom_index.sbom_hash = sbom_modules.sbom_hash)
+WHERE sbom_modules.module_path = $1
+OR substr(sbom_modules.module_path, 1, $3) = $2
+ORDER BY heartbeats.machine_id, sbom_modules.module_path, sbom_modules.version
+`)
+	if err != nil {
+		return nil, err
+	}
+
+	selectModuleImages, err := db.Prepare(`
+SELECT
+  sbom_modules.sbom_hash,
+  images.machine_id_pattern,
+  sbom_modules.module_path,
+  sbom_modules.version,
+  sbom_index.source
+FROM sbom_modules
+INNER JOIN sbom_index ON (sbom_index.sbom_hash = sbom_modules.sbom_hash)
+LEFT JOIN images ON (images.sbom_hash = sbom_modules.sbom_hash)
+WHERE sbom_modules.module_path = $1
+OR substr(sbom_modules.module_path, 1, $3) = $2
+ORDER BY sbom_modules.sbom_hash, sbom_modules.module_path, sbom_modules.version
+`)
+	if err != nil {
+		return nil, err
+	}
+
+	return &queries{
+		insertHeartbeat:          insertHeartbeat,
+		insertMachine:            insertMachine,
+		selectMachinesForIndex:   selectMachinesForIndex,
+		selectMachinesForDesired: selectMachinesForDesired,
+		selectDesired:            selectDesired,
+		insertImage:              insertImage,
+		selectImagesForIndex:     selectImagesForIndex,
+		selectImagesForDesired:   selectImagesForDesired,
+		updateDesiredImage:       updateDesiredImage,
+		updateUpdateState:        updateUpdateState,
+		markInformed:             markInformed,
+		selectUpdateState:        selectUpdateState,
+		updatePendingImage:       updatePendingImage,
+		updateIngestionPolicy:    updateIngestionPolicy,
+		approvePendingImage:      approvePendingImage,
+		selectImage:              selectImage,
+		selectUpdateImage:        selectUpdateImage,
+		selectImagePattern:       selectImagePattern,
+		insertRollout:            insertRollout,
+		selectRollouts:           selectRollouts,
+		selectRolloutMachines:    selectRolloutMachines,
+		updateRolloutState:       updateRolloutState,
+		updateRolloutWave:        updateRolloutWave,
+		insertRolloutMachine:     insertRolloutMachine,
+		upsertImageHistory:       upsertImageHistory,
+		selectKnownGoodImage:     selectKnownGoodImage,
+		selectHeartbeat:          selectHeartbeat,
+		selectMaintenanceWindows: selectMaintenanceWindows,
+		upsertMaintenanceWindow:  upsertMaintenanceWindow,
+		deleteMaintenanceWindow:  deleteMaintenanceWindow,
+		updateMachineWindow:      updateMachineWindow,
+		selectMachineWindow:      selectMachineWindow,
+		insertToken:              insertToken,
+		selectToken:              selectToken,
+		selectTokens:             selectTokens,
+		deleteToken:              deleteToken,
+		countTokensByName:        countTokensByName,
+		selectEnrollment:         selectEnrollment,
+		enrollMachine:            enrollMachine,
+		approveEnrollment:        approveEnrollment,
+		resetEnrollment:          resetEnrollment,
+		insertSigningKey:         insertSigningKey,
+		selectSigningKeys:        selectSigningKeys,
+		deleteSigningKey:         deleteSigningKey,
+		selectProtectedImages:    selectProtectedImages,
+		deleteImage:              deleteImage,
+		selectImageByDownloadURL: selectImageByDownloadURL,
+		updateImageDigest:        updateImageDigest,
+		selectRemoteImages:       selectRemoteImages,
+		updateRemoteImage:        updateRemoteImage,
+		updateRemoteCheck:        updateRemoteCheck,
+		selectImageByDigest:      selectImageByDigest,
+		insertAlias:              insertAlias,
+		selectAlias:              selectAlias,
+		selectAliases:            selectAliases,
+		deleteAliases:            deleteAliases,
+		updateMigratedImage:      updateMigratedImage,
+		insertUpload:             insertUpload,
+		selectUpload:             selectUpload,
+		updateUploadOffset:       updateUploadOffset,
+		deleteUpload:             deleteUpload,
+		selectExpiredUploads:     selectExpiredUploads,
+		selectLocalDigest:        selectLocalDigest,
+		selectDelta:              selectDelta,
+		upsertDelta:              upsertDelta,
+		deleteDeltas:             deleteDeltas,
+		selectDeltas:             selectDeltas,
+		deleteDelta:              deleteDelta,
+		selectTokenQuota:         selectTokenQuota,
+		selectTokenUsage:         selectTokenUsage,
+		selectCurrentHistory:     selectCurrentHistory,
+		extendCurrentHistory:     extendCurrentHistory,
+		upsertCurrentHistory:     upsertCurrentHistory,
+		insertHistory:            insertHistory,
+		selectHistory:            selectHistory,
+		selectHistoryBefore:      selectHistoryBefore,
+		deleteHistoryEntry:       deleteHistoryEntry,
+		deleteHistory:            deleteHistory,
+		deleteCurrentHistory:     deleteCurrentHistory,
+		selectAvailability:       selectAvailability,
+		updateAvailability:       updateAvailability,
+		updateNotified:           updateNotified,
+		insertTransition:         insertTransition,
+		selectTransitions:        selectTransitions,
+		deleteTransitions:        deleteTransitions,
+		countByAvailability:      countByAvailability,
+		countBySBOMHash:          countBySBOMHash,
+		countByUpdateState:       countByUpdateState,
+		countImages:              countImages,
+		selectImageSBOM:          selectImageSBOM,
+		selectHeartbeatSBOM:      selectHeartbeatSBOM,
+		selectMachineImages:      selectMachineImages,
+		upsertModule:             upsertModule,
+		selectUnindexedSBOMs:     selectUnindexedSBOMs,
+		deleteSBOMModules:        deleteSBOMModules,
+		selectSBOMModules:        selectSBOMModules,
+		countSBOMIndex:           countSBOMIndex,
+		deleteStaleModules:       deleteStaleModules,
+		upsertSBOMIndex:          upsertSBOMIndex,
+		deleteStaleIndex:         deleteStaleIndex,
+		selectModuleMachines:     selectModuleMachines,
+		selectModuleImages:       selectModuleImages,
+	}, nil
+}
+
+// nullIfEmpty returns nil (i.e. SQL NULL) for the empty string, for storing
+// optional values.
+func nullIfEmpty(s string) any {
+	if s == "" {
+		return nil
+	}
+	return s
 }
@@ -0,0 +1,204 @@
+package gusserver
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"text/tabwriter"
+	"time"
+)
+
+// Images can be signed by the build system with an ed25519 key. Once at least
+// one signing key is registered (see keyCommand), GUS only ingests images
+// carrying a valid signature by one of the registered keys.
+//
+// The signature is a detached ed25519 signature (standard base64 encoding)
+// over the following message, which ties the SBOM hash to the exact disk
+// image contents:
+//
+//	gus-image-v1\n
+//	<sbom hash>\n
+//	<hex-encoded SHA-256 hash of disk.gaf>\n
+//
+// GUS stores the signature with the image and returns it from /api/v1/update,
+// so that devices can verify the image independently of GUS.
+
+// signedMessage returns the message which image signatures sign.
+func signedMessage(sbomHash, diskSHA256 string) []byte {
+	return []byte("gus-image-v1\n" + sbomHash + "\n" + diskSHA256 + "\n")
+}
+
+type signingKey struct {
+	Name      string
+	PublicKey ed25519.PublicKey
+}
+
+func parsePublicKey(s string) (ed25519.PublicKey, error) {
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid public key: %v", err)
+	}
+	if len(b) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("invalid public key: got %d bytes, want %d", len(b), ed25519.PublicKeySize)
+	}
+	return ed25519.PublicKey(b), nil
+}
+
+func (s *server) loadSigningKeys(ctx context.Context) ([]signingKey, error) {
+	rows, err := s.queries.selectSigningKeys.QueryContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var keys []signingKey
+	for rows.Next() {
+		var (
+			name, publicKey string
+			created         time.Time
+		)
+		if err := rows.Scan(&name, &publicKey, &created); err != nil {
+			return nil, err
+		}
+		pub, err := parsePublicKey(publicKey)
+		if err != nil {
+			log.Printf("skipping signing key %q: %v", name, err)
+			continue
+		}
+		keys = append(keys, signingKey{Name: name, PublicKey: pub})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return keys, rows.Close()
+}
+
+// verifySignature verifies the signature (if any) of an image to be ingested
+// and returns the name of the signing key. A signature is required once
+// signing keys are registered.
+func (s *server) verifySignature(ctx context.Context, req ingestRequest, diskSHA256 string) (keyName string, _ error) {
+	keys, err := s.loadSigningKeys(ctx)
+	if err != nil {
+		return "", err
+	}
+	if req.Signature == "" {
+		if len(keys) > 0 {
+			return "", httpError(http.StatusBadRequest, fmt.Errorf("signature not set (required because signing keys are registered)"))
+		}
+		return "", nil
+	}
+	if len(keys) == 0 {
+		return "", httpError(http.StatusBadRequest, fmt.Errorf("cannot verify signature: no signing keys registered"))
+	}
+	if diskSHA256 == "" {
+		// Only possible for remote images: a signature which does not
+		// cover the disk image contents could be replayed for any image.
+		return "", httpError(http.StatusBadRequest, fmt.Errorf("disk_sha256 not set (required because signing keys are registered)"))
+	}
+	sig, err := base64.StdEncoding.DecodeString(req.Signature)
+	if err != nil {
+		return "", httpError(http.StatusBadRequest, fmt.Errorf("invalid signature: %v", err))
+	}
+	msg := signedMessage(req.SBOMHash, diskSHA256)
+	for _, key := range keys {
+		if ed25519.Verify(key.PublicKey, msg, sig) {
+			return key.Name, nil
+		}
+	}
+	return "", httpError(http.StatusBadRequest, fmt.Errorf("signature verification failed for image %q (disk.gaf SHA-256 %s)", req.SBOMHash, diskSHA256))
+}
+
+// readerSHA256 returns the hex-encoded SHA-256 hash of the contents of r.
+func readerSHA256(r io.Reader) (string, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func (s *server) addSigningKey(ctx context.Context, name, publicKey string) error {
+	if name == "" {
+		return fmt.Errorf("key name not set")
+	}
+	if _, err := parsePublicKey(publicKey); err != nil {
+		return err
+	}
+	if _, err := s.queries.insertSigningKey.ExecContext(ctx, name, publicKey, time.Now()); err != nil {
+		return err
+	}
+	log.Printf("Added signing key %q", name)
+	return nil
+}
+
+// keyCommand implements the key subcommand:
+//
+//	gus-server [flags] key add -name=ci -public_key=base64…
+//	gus-server [flags] key list
+//	gus-server [flags] key remove -name=ci
+func (s *server) keyCommand(ctx context.Context, args []string) error {
+	const usage = "syntax: key add|list|remove [flags]"
+	if len(args) == 0 {
+		return fmt.Errorf(usage)
+	}
+	fset := flag.NewFlagSet("key "+args[0], flag.ExitOnError)
+	name := fset.String("name", "", "name of the signing key, e.g. the build system using it")
+	publicKey := fset.String("public_key", "", "ed25519 public key (standard base64 encoding of the 32 key bytes)")
+	fset.Parse(args[1:])
+
+	switch args[0] {
+	case "add":
+		return s.addSigningKey(ctx, *name, *publicKey)
+
+	case "list":
+		rows, err := s.queries.selectSigningKeys.QueryContext(ctx)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintf(tw, "NAME\tPUBLIC KEY\tCREATED\n")
+		for rows.Next() {
+			var (
+				name, publicKey string
+				created         time.Time
+			)
+			if err := rows.Scan(&name, &publicKey, &created); err != nil {
+				return err
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\n", name, publicKey, created.Format(time.RFC3339))
+		}
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		return tw.Flush()
+
+	case "remove":
+		if *name == "" {
+			return fmt.Errorf("-name not set")
+		}
+		res, err := s.queries.deleteSigningKey.ExecContext(ctx, *name)
+		if err != nil {
+			return err
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return fmt.Errorf("signing key %q not found", *name)
+		}
+		log.Printf("Removed signing key %q", *name)
+		return nil
+
+	default:
+		return fmt.Errorf("unknown key command %q, %s", args[0], usage)
+	}
+}
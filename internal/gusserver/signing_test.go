@@ -0,0 +1,115 @@
+package gusserver
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestSigning(t *testing.T) {
+	for _, tc := range testDatabases() {
+		t.Run(tc.databaseType, func(t *testing.T) {
+			ctx := context.Background()
+			ts := newTestServer(t, tc.databaseType)
+
+			pub, priv, err := ed25519.GenerateKey(nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, otherPriv, err := ed25519.GenerateKey(nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := ts.srv.addSigningKey(ctx, "ci", base64.StdEncoding.EncodeToString(pub)); err != nil {
+				t.Fatal(err)
+			}
+
+			req, err := http.NewRequest("PUT", ts.URL()+"/api/v1/push", bytes.NewReader(dummyZip(t)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err := ts.Client().Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, err := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			var pr pushResponse
+			if err := json.Unmarshal(body, &pr); err != nil {
+				t.Fatal(err)
+			}
+
+			const machineID = "router-1"
+			const sbomHash = "abcdefg"
+			sign := func(key ed25519.PrivateKey, sbomHash string) string {
+				sig := ed25519.Sign(key, signedMessage(sbomHash, pr.DiskSHA256))
+				return base64.StdEncoding.EncodeToString(sig)
+			}
+			ingest := func(signature string) error {
+				return ts.postJSON("/api/v1/ingest", &ingestRequest{
+					MachineIDPattern: machineID,
+					SBOMHash:         sbomHash,
+					RegistryType:     "localdisk",
+					DownloadLink:     pr.DownloadLink,
+					Signature:        signature,
+				}, nil)
+			}
+
+			for _, tt := range []struct {
+				desc      string
+				signature string
+			}{
+				{"unsigned", ""},
+				{"signed by unknown key", sign(otherPriv, sbomHash)},
+				{"signature for different sbom hash", sign(priv, "hijklmn")},
+				{"invalid base64", "not base64!"},
+			} {
+				if err := ingest(tt.signature); err == nil || !strings.Contains(err.Error(), "400") {
+					t.Errorf("ingest %s: got err %v, want HTTP 400", tt.desc, err)
+				}
+			}
+			ts.ensureEmpty(t, "images")
+
+			signature := sign(priv, sbomHash)
+			if err := ingest(signature); err != nil {
+				t.Fatal(err)
+			}
+			if diff := ts.diffQuery(t, []map[string]any{
+				{"sbom_hash": sbomHash, "disk_sha256": pr.DiskSHA256, "signing_key": "ci"},
+			}, "SELECT sbom_hash, disk_sha256, signing_key FROM images"); diff != "" {
+				t.Errorf("images table: unexpected diff (-want +got):\n%s", diff)
+			}
+
+			if err := ts.postJSON("/api/v1/heartbeat", &heartbeatRequest{
+				MachineID: machineID,
+			}, nil); err != nil {
+				t.Fatal(err)
+			}
+			var ur updateResponse
+			if err := ts.postJSON("/api/v1/update", &updateRequest{
+				MachineID: machineID,
+			}, &ur); err != nil {
+				t.Fatal(err)
+			}
+			if ur.Signature != signature || ur.DiskSHA256 != pr.DiskSHA256 {
+				t.Errorf("update response: got signature %q, disk_sha256 %q, want %q, %q", ur.Signature, ur.DiskSHA256, signature, pr.DiskSHA256)
+			}
+			sig, err := base64.StdEncoding.DecodeString(ur.Signature)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !ed25519.Verify(pub, signedMessage(ur.SBOMHash, ur.DiskSHA256), sig) {
+				t.Errorf("signature from update response does not verify")
+			}
+		})
+	}
+}
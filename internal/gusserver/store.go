@@ -0,0 +1,353 @@
+package gusserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// storeRequestTimeout bounds each request to a remote image store (see s3Store
+// and ociRegistry). Requests transfer entire images, so the timeout is more
+// generous than that of httpClient.
+const storeRequestTimeout = 10 * time.Minute
+
+// An imageStore stores the images pushed to this server (registry_type
+// localdisk). Images are identified by their key, which is content-addressed
+// (see contentKey), e.g. sha256/<hex>/disk.gaf. Stores which were created by
+// older versions of GUS also contain keys like
+// 2024-06-01T10:00:00Z-1234/disk.gaf until they are migrated (see
+// migrateImageStore).
+//
+// There are two implementations: fsStore (--image_dir) and s3Store
+// (--s3_bucket_url).
+type imageStore interface {
+	// Create starts storing a new image. The image only becomes visible once
+	// Commit is called.
+	Create(ctx context.Context) (pendingImage, error)
+
+	// Open returns the image stored under key. If there is no such image, the
+	// returned error wraps fs.ErrNotExist.
+	Open(ctx context.Context, key string) (storedImage, error)
+
+	// Delete removes the image stored under key. Removing a non-existing image
+	// is not an error.
+	Delete(ctx context.Context, key string) error
+
+	// List returns all stored images.
+	List(ctx context.Context) ([]storedObject, error)
+
+	// PresignedURL returns a URL from which devices can download the image
+	// stored under key for the specified duration, without involving GUS. It
+	// returns the empty string if the store does not support pre-signed URLs.
+	PresignedURL(key string, expiry time.Duration) (string, error)
+}
+
+// pendingImage is an image which is being pushed, see imageStore.Create.
+type pendingImage interface {
+	io.Writer
+	io.ReaderAt
+
+	// Commit makes the image available under key. An existing image with the
+	// same key is replaced.
+	Commit(ctx context.Context, key string) error
+
+	// Cleanup discards the image unless Commit was called. It is safe to
+	// call Cleanup after Commit.
+	Cleanup() error
+}
+
+// storedImage is an image opened with imageStore.Open. It can be served with
+// http.ServeContent.
+type storedImage interface {
+	io.ReadSeekCloser
+	io.ReaderAt
+	Size() int64
+	ModTime() time.Time
+}
+
+type storedObject struct {
+	Key     string
+	ModTime time.Time
+}
+
+var errNoImageStore = errors.New("no --image_dir or --s3_bucket_url configured on this GUS server")
+
+// store returns the image store of this server, or nil if none is configured.
+func (s *server) store() imageStore {
+	if s.cfg.imageStore != nil {
+		return s.cfg.imageStore
+	}
+	if s.cfg.imageDir != "" {
+		return &fsStore{dir: s.cfg.imageDir}
+	}
+	return nil
+}
+
+// imageKey returns the key of the image with the specified download link (see
+// push).
+func imageKey(downloadLink string) (string, error) {
+	rel, ok := strings.CutPrefix(downloadLink, "/images/")
+	if !ok {
+		return "", fmt.Errorf("download_link %q does not start with /images/", downloadLink)
+	}
+	// Cleaning the path as an absolute path removes any .. elements.
+	key := strings.TrimPrefix(path.Clean("/"+rel), "/")
+	if key == "" {
+		return "", fmt.Errorf("download_link %q does not refer to an image", downloadLink)
+	}
+	return key, nil
+}
+
+// fsStore stores images in a directory on the local file system. Pushes are
+// written to the tmp subdirectory and atomically renamed into place.
+type fsStore struct {
+	dir string
+}
+
+func (st *fsStore) path(key string) string {
+	return filepath.Join(st.dir, filepath.FromSlash(key))
+}
+
+// move renames the file at oldPath, which must be on the file system of the
+// store, to key. An existing image with the same key is replaced.
+func (st *fsStore) move(oldPath, key string) error {
+	path := st.path(key)
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	if err := os.Rename(oldPath, path); err != nil {
+		return err
+	}
+	// Persist the rename.
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+type fsPendingImage struct {
+	*os.File
+	st        *fsStore
+	committed bool
+}
+
+func (p *fsPendingImage) Commit(ctx context.Context, key string) error {
+	if err := p.Sync(); err != nil {
+		return err
+	}
+	if err := p.Close(); err != nil {
+		return err
+	}
+	if err := p.st.move(p.Name(), key); err != nil {
+		return err
+	}
+	p.committed = true
+	return nil
+}
+
+func (p *fsPendingImage) Cleanup() error {
+	if p.committed {
+		return nil
+	}
+	p.Close()
+	if err := os.Remove(p.Name()); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (st *fsStore) Create(ctx context.Context) (pendingImage, error) {
+	tempDir := filepath.Join(st.dir, "tmp")
+	if err := os.MkdirAll(tempDir, 0700); err != nil {
+		return nil, err
+	}
+	f, err := os.CreateTemp(tempDir, "push-")
+	if err != nil {
+		return nil, err
+	}
+	return &fsPendingImage{File: f, st: st}, nil
+}
+
+type fsImage struct {
+	*os.File
+	info fs.FileInfo
+}
+
+func (i *fsImage) Size() int64        { return i.info.Size() }
+func (i *fsImage) ModTime() time.Time { return i.info.ModTime() }
+
+func (st *fsStore) Open(ctx context.Context, key string) (storedImage, error) {
+	f, err := os.Open(st.path(key))
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if !info.Mode().IsRegular() {
+		f.Close()
+		return nil, fmt.Errorf("%s: %w (not a file)", key, fs.ErrNotExist)
+	}
+	return &fsImage{File: f, info: info}, nil
+}
+
+func (st *fsStore) Delete(ctx context.Context, key string) error {
+	path := st.path(key)
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if dir := filepath.Dir(path); dir != filepath.Clean(st.dir) {
+		os.Remove(dir) // only succeeds if empty
+	}
+	return nil
+}
+
+func (st *fsStore) List(ctx context.Context) ([]storedObject, error) {
+	var objects []storedObject
+	err := filepath.WalkDir(st.dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && path == st.dir {
+				return filepath.SkipDir // nothing pushed yet
+			}
+			return err
+		}
+		rel, err := filepath.Rel(st.dir, path)
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if rel == "tmp" || rel == uploadsDir {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil // removed concurrently
+		}
+		objects = append(objects, storedObject{
+			Key:     filepath.ToSlash(rel),
+			ModTime: info.ModTime(),
+		})
+		return nil
+	})
+	return objects, err
+}
+
+func (st *fsStore) PresignedURL(key string, expiry time.Duration) (string, error) {
+	return "", nil // not supported
+}
+
+// rangeImage is a storedImage which is read with ranged HTTP GET requests.
+// Sequential reads share one response body.
+type rangeImage struct {
+	// get requests length bytes starting at off. Servers which do not support
+	// Range requests reply with the entire content (HTTP 200).
+	get     func(off, length int64) (*http.Response, error)
+	size    int64
+	modTime time.Time
+
+	offset int64
+	body   io.ReadCloser // positioned at offset, if non-nil
+}
+
+func (i *rangeImage) Size() int64        { return i.size }
+func (i *rangeImage) ModTime() time.Time { return i.modTime }
+
+func (i *rangeImage) open(off, length int64) (io.ReadCloser, error) {
+	resp, err := i.get(off, length)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusOK && off > 0 {
+		// Range not supported, skip to the requested offset.
+		if _, err := io.CopyN(io.Discard, resp.Body, off); err != nil {
+			resp.Body.Close()
+			return nil, err
+		}
+	}
+	return resp.Body, nil
+}
+
+func (i *rangeImage) Read(p []byte) (int, error) {
+	if i.offset >= i.size {
+		return 0, io.EOF
+	}
+	if i.body == nil {
+		body, err := i.open(i.offset, i.size-i.offset)
+		if err != nil {
+			return 0, err
+		}
+		i.body = body
+	}
+	n, err := i.body.Read(p)
+	i.offset += int64(n)
+	if err == io.EOF && i.offset < i.size {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func (i *rangeImage) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += i.offset
+	case io.SeekEnd:
+		offset += i.size
+	default:
+		return 0, fmt.Errorf("invalid whence %d", whence)
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("negative offset %d", offset)
+	}
+	if offset != i.offset && i.body != nil {
+		i.body.Close()
+		i.body = nil
+	}
+	i.offset = offset
+	return offset, nil
+}
+
+func (i *rangeImage) ReadAt(p []byte, off int64) (int, error) {
+	if off >= i.size {
+		return 0, io.EOF
+	}
+	want := int64(len(p))
+	if rest := i.size - off; want > rest {
+		want = rest
+	}
+	body, err := i.open(off, want)
+	if err != nil {
+		return 0, err
+	}
+	defer body.Close()
+	n, err := io.ReadFull(body, p[:want])
+	if err != nil {
+		return n, err
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (i *rangeImage) Close() error {
+	if i.body != nil {
+		return i.body.Close()
+	}
+	return nil
+}
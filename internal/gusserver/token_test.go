@@ -0,0 +1,265 @@
+package gusserver
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestScopeAllows(t *testing.T) {
+	for _, tt := range []struct {
+		scope   string
+		pattern string
+		want    bool
+	}{
+		{"*", "router-7", true},
+		{"*", "hostname:/router-[0-9]+/", true},
+		{"router-7", "router-7", true},
+		{"router-7", "router-8", false},
+		{"router-*", "router-*", true},
+		{"router-*", "router-7", true},
+		{"router-*", "hostname:router-7", false},
+		{"hostname:*", "hostname:/router-[0-9]+/", true},
+		{"router-?", "router-10", false},
+		{"router.7", "router-7", false},
+	} {
+		if got := scopeAllows(tt.scope, tt.pattern); got != tt.want {
+			t.Errorf("scopeAllows(%q, %q) = %v, want %v", tt.scope, tt.pattern, got, tt.want)
+		}
+	}
+}
+
+func TestAPIToken(t *testing.T) {
+	for _, tc := range testDatabases() {
+		t.Run(tc.databaseType, func(t *testing.T) {
+			ctx := context.Background()
+			ts := newTestServer(t, tc.databaseType)
+			downloadLink := ts.pushImage(t)
+			ts.srv.cfg.requireAPIToken = true
+
+			routers, err := ts.srv.createToken(ctx, "routers", []string{"router-*"}, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			all, err := ts.srv.createToken(ctx, "all", []string{"*"}, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := ts.srv.createToken(ctx, "all", []string{"router-*"}, 0); err == nil {
+				t.Errorf("creating a second token named %q unexpectedly succeeded", "all")
+			}
+
+			ingest := func(pattern string) error {
+				return ts.postJSON("/api/v1/ingest", &ingestRequest{
+					MachineIDPattern: pattern,
+					SBOMHash:         "abcdefg",
+					RegistryType:     "localdisk",
+					DownloadLink:     downloadLink,
+				}, nil)
+			}
+
+			if err := ingest("router-7"); err == nil || !strings.Contains(err.Error(), "401") {
+				t.Errorf("ingest without token: got err %v, want HTTP 401", err)
+			}
+
+			ts.apiToken = "gus_invalid"
+			if err := ingest("router-7"); err == nil || !strings.Contains(err.Error(), "401") {
+				t.Errorf("ingest with invalid token: got err %v, want HTTP 401", err)
+			}
+
+			ts.apiToken = routers
+			if err := ingest("router-7"); err != nil {
+				t.Errorf("ingest with scoped token: %v", err)
+			}
+			if err := ingest("printer-1"); err == nil || !strings.Contains(err.Error(), "403") {
+				t.Errorf("ingest outside of token scope: got err %v, want HTTP 403", err)
+			}
+			if err := ts.postJSON("/api/v1/window", &windowRequest{
+				MachineIDPattern: "printer-*",
+				Schedule:         "02:00-05:00",
+			}, nil); err == nil || !strings.Contains(err.Error(), "403") {
+				t.Errorf("window outside of token scope: got err %v, want HTTP 403", err)
+			}
+
+			ts.apiToken = all
+			if err := ingest("printer-1"); err != nil {
+				t.Errorf("ingest with unrestricted token: %v", err)
+			}
+
+			// Rollouts are authorized against the machine ID pattern of the
+			// image, garbage collection requires the * scope.
+			ts.apiToken = routers
+			if err := ts.postJSON("/api/v1/rollout", &rolloutRequest{
+				Action:   "create",
+				SBOMHash: "abcdefg",
+			}, nil); err == nil || !strings.Contains(err.Error(), "403") {
+				t.Errorf("rollout outside of token scope: got err %v, want HTTP 403", err)
+			}
+			if err := ts.postJSON("/api/v1/gc", &gcRequest{DryRun: true}, nil); err == nil || !strings.Contains(err.Error(), "403") {
+				t.Errorf("gc with scoped token: got err %v, want HTTP 403", err)
+			}
+			ts.apiToken = all
+			if err := ts.postJSON("/api/v1/gc", &gcRequest{DryRun: true}, nil); err != nil {
+				t.Errorf("gc with unrestricted token: %v", err)
+			}
+
+			// Browsers send the token via HTTP basic authentication.
+			push := func(username, password string) *http.Response {
+				req, err := http.NewRequest("PUT", ts.URL()+"/api/v1/push", bytes.NewReader(dummyZip(t)))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if password != "" {
+					req.SetBasicAuth(username, password)
+				}
+				resp, err := ts.Client().Do(req)
+				if err != nil {
+					t.Fatal(err)
+				}
+				resp.Body.Close()
+				return resp
+			}
+			resp := push("", "")
+			if got, want := resp.StatusCode, http.StatusUnauthorized; got != want {
+				t.Errorf("push without token: got HTTP status %v, want %v", resp.Status, want)
+			}
+			if got := resp.Header.Get("WWW-Authenticate"); got == "" {
+				t.Errorf("push without token: WWW-Authenticate header unexpectedly empty")
+			}
+			if resp := push("gus", routers); resp.StatusCode != http.StatusOK {
+				t.Errorf("push with token: got HTTP status %v, want %v", resp.Status, http.StatusOK)
+			}
+
+			// Revoked tokens no longer work.
+			if err := ts.srv.tokenCommand(ctx, []string{"revoke", "-name=all"}); err != nil {
+				t.Fatal(err)
+			}
+			if err := ingest("printer-1"); err == nil || !strings.Contains(err.Error(), "401") {
+				t.Errorf("ingest with revoked token: got err %v, want HTTP 401", err)
+			}
+
+			if diff := ts.diffQuery(t, []map[string]any{
+				{"name": "routers", "scopes": "router-*"},
+			}, "SELECT name, scopes FROM api_tokens"); diff != "" {
+				t.Errorf("api_tokens table: unexpected diff (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestMachineScopes(t *testing.T) {
+	for _, tc := range testDatabases() {
+		t.Run(tc.databaseType, func(t *testing.T) {
+			ctx := context.Background()
+			ts := newTestServer(t, tc.databaseType)
+			for machineID, hostname := range map[string]string{
+				"0123456789abcdef": "router-7",
+				"fedcba9876543210": "printer-1",
+			} {
+				if err := ts.postJSON("/api/v1/heartbeat", &heartbeatRequest{
+					MachineID: machineID,
+					Hostname:  hostname,
+					SBOMHash:  "abcdefg",
+				}, nil); err != nil {
+					t.Fatal(err)
+				}
+			}
+			ts.srv.cfg.requireAPIToken = true
+			routers, err := ts.srv.createToken(ctx, "routers", []string{"hostname:router-*"}, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ts.apiToken = routers
+
+			setPolicy := func(machineID string) error {
+				return ts.postJSON("/api/v1/policy", &policyRequest{
+					MachineID:       machineID,
+					IngestionPolicy: policyManual,
+				}, nil)
+			}
+			if err := setPolicy("0123456789abcdef"); err != nil {
+				t.Errorf("policy for machine with matching hostname: %v", err)
+			}
+			if err := setPolicy("fedcba9876543210"); err == nil || !strings.Contains(err.Error(), "403") {
+				t.Errorf("policy outside of token scope: got err %v, want HTTP 403", err)
+			}
+		})
+	}
+}
+
+func TestFormCrossOrigin(t *testing.T) {
+	ts := newTestServer(t, "sqlite")
+	if err := ts.postJSON("/api/v1/heartbeat", &heartbeatRequest{
+		MachineID: "router-7",
+		SBOMHash:  "abcdefg",
+	}, nil); err != nil {
+		t.Fatal(err)
+	}
+	u, err := url.Parse(ts.URL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		desc   string
+		header http.Header
+		want   int
+	}{
+		{"no browser", http.Header{}, http.StatusOK},
+		{"same origin", http.Header{"Sec-Fetch-Site": {"same-origin"}, "Origin": {ts.URL()}}, http.StatusOK},
+		{"same origin (Origin only)", http.Header{"Origin": {"http://" + u.Host}}, http.StatusOK},
+		{"cross site", http.Header{"Sec-Fetch-Site": {"cross-site"}, "Origin": {"https://evil.example"}}, http.StatusForbidden},
+		{"cross origin (Origin only)", http.Header{"Origin": {"https://evil.example"}}, http.StatusForbidden},
+	} {
+		t.Run(tt.desc, func(t *testing.T) {
+			form := url.Values{
+				"machine_id":       {"router-7"},
+				"ingestion_policy": {policyManual},
+			}
+			req, err := http.NewRequest("POST", ts.URL()+"/ui/policy", strings.NewReader(form.Encode()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header = tt.header
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			client := *ts.Client()
+			client.CheckRedirect = func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			}
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			got := resp.StatusCode
+			if got == http.StatusSeeOther {
+				got = http.StatusOK
+			}
+			if got != tt.want {
+				t.Errorf("POST /ui/policy: got HTTP status %v, want %v", resp.Status, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckTokensExist(t *testing.T) {
+	ctx := context.Background()
+	ts := newTestServer(t, "sqlite")
+	ts.srv.cfg.requireAPIToken = true
+	args := []string{"gus-server", "--database_source=/var/lib/gus", "--listen=:8655"}
+	err := ts.srv.checkTokensExist(ctx, args)
+	if err == nil {
+		t.Fatalf("checkTokensExist without tokens unexpectedly succeeded")
+	}
+	if want := "gus-server --database_source=/var/lib/gus --listen=:8655 token create -name=admin '-scope=*'"; !strings.Contains(err.Error(), want) {
+		t.Errorf("checkTokensExist: got err %v, want it to contain %q", err, want)
+	}
+	if _, err := ts.srv.createToken(ctx, "admin", []string{"*"}, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := ts.srv.checkTokensExist(ctx, args); err != nil {
+		t.Errorf("checkTokensExist with token: %v", err)
+	}
+}
@@ -1,10 +1,36 @@
 package gusserver
 
 import (
+	"context"
+	"database/sql"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
+	"strings"
+	"time"
+)
+
+// Update states, stored in machines.update_state. The update state refers to
+// the desired_image of the machine and is reset when the desired_image
+// changes.
+const (
+	// updateStateInformed means the device was told about the desired image
+	// via /api/v1/update.
+	updateStateInformed = "informed"
+
+	// updateStateAttempted means the device started updating to the desired
+	// image, see /api/v1/attempt.
+	updateStateAttempted = "attempted"
+
+	// updateStateSucceeded means the device sent a heartbeat with the sbom
+	// hash of the desired image.
+	updateStateSucceeded = "succeeded"
+
+	// updateStateFailed means the device still sent heartbeats with a
+	// different sbom hash after config.updateTimeout elapsed since the
+	// attempt.
+	updateStateFailed = "failed"
 )
 
 type updateRequest struct {
@@ -15,6 +41,18 @@ type updateResponse struct {
 	SBOMHash     string `json:"sbom_hash"`
 	RegistryType string `json:"registry_type"`
 	DownloadLink string `json:"download_link"`
+
+	// DiskSHA256 and Signature are set for signed images, so that devices can
+	// verify the image (see signedMessage).
+	DiskSHA256 string `json:"disk_sha256,omitempty"`
+	Signature  string `json:"signature,omitempty"`
+
+	// DeltaLink, if set, is a delta (see writeDelta) from the image the device
+	// currently runs, whose SHA-256 hash is DeltaBaseSHA256, to the desired
+	// image. Devices which support deltas can download it instead of
+	// DownloadLink, and verify the result with DiskSHA256.
+	DeltaLink       string `json:"delta_link,omitempty"`
+	DeltaBaseSHA256 string `json:"delta_base_sha256,omitempty"`
 }
 
 func (s *server) update(w http.ResponseWriter, r *http.Request) error {
@@ -34,38 +72,127 @@ func (s *server) update(w http.ResponseWriter, r *http.Request) error {
 		return httpError(http.StatusBadRequest, fmt.Errorf("machine_id not set"))
 	}
 
-	// TODO: this query should also update the machine’s update_state to INFORMED
+	enrollment, _, err := s.authenticateDevice(r, req.MachineID, false)
+	if err != nil {
+		return err
+	}
+	if s.cfg.requireEnrollment && enrollment != enrollmentApproved {
+		return httpError(http.StatusForbidden, fmt.Errorf("machine %q is not approved", req.MachineID))
+	}
 
 	rows, err := s.queries.selectDesired.QueryContext(r.Context(), req.MachineID)
 	if err != nil {
 		return err
 	}
 	defer rows.Close()
-	type desired struct {
-		DesiredImage string
-		RegistryType string
-		DownloadLink string
-	}
 	if !rows.Next() {
 		return httpError(http.StatusNotFound, fmt.Errorf("machine_id not found"))
 	}
-	var d desired
+	var d updateImage
 	err = rows.Scan(
-		&d.DesiredImage,
+		&d.SBOMHash,
 		&d.RegistryType,
-		&d.DownloadLink)
+		&d.DownloadLink,
+		&d.DiskSHA256,
+		&d.Signature)
 	if err != nil {
 		return err
 	}
 	if err := rows.Err(); err != nil {
 		return err
 	}
+	if err := rows.Close(); err != nil {
+		return err
+	}
+
+	current, open, err := s.maintenanceWindowOpen(r.Context(), req.MachineID, time.Now())
+	if err != nil {
+		return err
+	}
+	if !open && current != d.SBOMHash {
+		// Outside of its maintenance window, reply with the image the machine
+		// currently runs, which means there is no update available. If GUS
+		// does not know that image, reply without content.
+		var cur updateImage
+		err := s.queries.selectUpdateImage.QueryRowContext(r.Context(), current).Scan(
+			&cur.SBOMHash,
+			&cur.RegistryType,
+			&cur.DownloadLink,
+			&cur.DiskSHA256,
+			&cur.Signature)
+		if err == sql.ErrNoRows {
+			w.WriteHeader(http.StatusNoContent)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		resp, err := s.newUpdateResponse(r.Context(), cur)
+		if err != nil {
+			return err
+		}
+		return writeUpdateResponse(w, resp)
+	}
+
+	if _, err := s.queries.markInformed.ExecContext(r.Context(), updateStateInformed, time.Now(), req.MachineID); err != nil {
+		return err
+	}
+
+	var deltaLink, deltaBase string
+	if s.cfg.deltaUpdates &&
+		d.RegistryType == "localdisk" &&
+		strings.HasPrefix(d.DownloadLink, "/images/") &&
+		d.DiskSHA256.Valid &&
+		current != "" &&
+		current != d.SBOMHash {
+		deltaLink, deltaBase, err = s.deltaFor(r.Context(), current, d.DiskSHA256.String)
+		if err != nil {
+			return err
+		}
+	}
 
-	b, err = json.Marshal(&updateResponse{
-		SBOMHash:     d.DesiredImage,
-		RegistryType: d.RegistryType,
-		DownloadLink: d.DownloadLink,
-	})
+	resp, err := s.newUpdateResponse(r.Context(), d)
+	if err != nil {
+		return err
+	}
+	resp.DeltaLink = deltaLink
+	resp.DeltaBaseSHA256 = deltaBase
+	return writeUpdateResponse(w, resp)
+}
+
+// updateImage is an image record as offered to devices by /api/v1/update.
+type updateImage struct {
+	SBOMHash     string
+	RegistryType string
+	DownloadLink string
+	DiskSHA256   sql.NullString
+	Signature    sql.NullString
+}
+
+// newUpdateResponse returns the response which offers img to devices.
+func (s *server) newUpdateResponse(ctx context.Context, img updateImage) (*updateResponse, error) {
+	switch img.RegistryType {
+	case "localdisk":
+		var err error
+		img.RegistryType, img.DownloadLink, err = s.presignedDownload(ctx, img.DownloadLink)
+		if err != nil {
+			return nil, err
+		}
+	case registryOCI:
+		// Devices download OCI images via GUS.
+		img.RegistryType, img.DownloadLink = "localdisk", ociDownloadLink(img.DiskSHA256.String)
+	}
+	return &updateResponse{
+		SBOMHash:     img.SBOMHash,
+		RegistryType: img.RegistryType,
+		DownloadLink: img.DownloadLink,
+		DiskSHA256:   img.DiskSHA256.String,
+		Signature:    img.Signature.String,
+	}, nil
+}
+
+func writeUpdateResponse(w http.ResponseWriter, resp *updateResponse) error {
+	b, err := json.Marshal(resp)
 	if err != nil {
 		return err
 	}
@@ -73,3 +200,25 @@ func (s *server) update(w http.ResponseWriter, r *http.Request) error {
 	w.Write(b)
 	return nil
 }
+
+// presignedDownload returns the registry type and download link which devices
+// should use for a pushed image: a pre-signed URL of the image store (which
+// devices download like any remote image), or the GUS-proxied /images/ link.
+func (s *server) presignedDownload(ctx context.Context, downloadLink string) (registryType, link string, _ error) {
+	store := s.store()
+	if s.cfg.presignExpiry == 0 || store == nil {
+		return "localdisk", downloadLink, nil
+	}
+	key, _, err := s.resolveImage(ctx, downloadLink)
+	if err != nil {
+		return "", "", err
+	}
+	u, err := store.PresignedURL(key, s.cfg.presignExpiry)
+	if err != nil {
+		return "", "", err
+	}
+	if u == "" {
+		return "localdisk", downloadLink, nil // not supported
+	}
+	return registryHTTP, u, nil
+}
@@ -3,6 +3,7 @@ package gusserver
 import (
 	"context"
 	"testing"
+	"time"
 
 	"github.com/antihax/optional"
 	"github.com/gokrazy/gokapi/gusapi"
@@ -16,6 +17,7 @@ func TestUpdate(t *testing.T) {
 		t.Run(tc.databaseType, func(t *testing.T) {
 			ctx := context.Background()
 			ts := newTestServer(t, tc.databaseType)
+			downloadLink := ts.pushImage(t)
 			api := ts.API()
 
 			const machineID = "scan2drive"
@@ -35,7 +37,7 @@ func TestUpdate(t *testing.T) {
 					MachineIdPattern: "scan2drive",
 					SbomHash:         "abcdefg",
 					RegistryType:     "localdisk",
-					DownloadLink:     "/doesnotexist/disk.gaf",
+					DownloadLink:     downloadLink,
 				}),
 			})
 			if err != nil {
@@ -55,7 +57,7 @@ func TestUpdate(t *testing.T) {
 			want := gusapi.UpdateResponse{
 				SbomHash:     "abcdefg",
 				RegistryType: "localdisk",
-				DownloadLink: "/doesnotexist/disk.gaf",
+				DownloadLink: downloadLink,
 			}
 			if diff := cmp.Diff(want, upResp); diff != "" {
 				t.Fatalf("update: diff (-want +got):\n%s", diff)
@@ -63,3 +65,95 @@ func TestUpdate(t *testing.T) {
 		})
 	}
 }
+
+func TestUpdateStateLifecycle(t *testing.T) {
+	testDBs := testDatabases()
+
+	for _, tc := range testDBs {
+		t.Run(tc.databaseType, func(t *testing.T) {
+			ctx := context.Background()
+			ts := newTestServer(t, tc.databaseType)
+			downloadLink := ts.pushImage(t)
+			api := ts.API()
+
+			const machineID = "scan2drive"
+
+			heartbeat := func(sbomHash string) {
+				t.Helper()
+				_, _, err := api.HeartbeatApi.Heartbeat(ctx, &gusapi.HeartbeatApiHeartbeatOpts{
+					Body: optional.NewInterface(&gusapi.HeartbeatRequest{
+						MachineId: machineID,
+						SbomHash:  sbomHash,
+					}),
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			wantState := func(want string) {
+				t.Helper()
+				q := "SELECT COALESCE(update_state, '') AS update_state FROM machines WHERE machine_id = $1"
+				if diff := ts.diffQuery(t, []map[string]any{{"update_state": want}}, q, machineID); diff != "" {
+					t.Errorf("machines table: unexpected diff (-want +got):\n%s", diff)
+				}
+			}
+
+			heartbeat("old")
+
+			_, _, err := api.IngestApi.Ingest(ctx, &gusapi.IngestApiIngestOpts{
+				Body: optional.NewInterface(&gusapi.IngestRequest{
+					MachineIdPattern: machineID,
+					SbomHash:         "new",
+					RegistryType:     "localdisk",
+					DownloadLink:     downloadLink,
+				}),
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			wantState("")
+
+			update := func() {
+				t.Helper()
+				_, _, err := api.UpdateApi.Update(ctx, &gusapi.UpdateApiUpdateOpts{
+					Body: optional.NewInterface(&gusapi.UpdateRequest{
+						MachineId: machineID,
+					}),
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			update()
+			wantState(updateStateInformed)
+
+			_, _, err = api.UpdateApi.Attempt(ctx, &gusapi.UpdateApiAttemptOpts{
+				Body: optional.NewInterface(&gusapi.AttemptRequest{
+					MachineId: machineID,
+					SbomHash:  "new",
+				}),
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			wantState(updateStateAttempted)
+
+			// Polling the update API again does not regress the state.
+			update()
+			wantState(updateStateAttempted)
+
+			// Within the update timeout, heartbeats with the old image are
+			// expected (the device might not have rebooted yet).
+			ts.srv.cfg.updateTimeout = time.Hour
+			heartbeat("old")
+			wantState(updateStateAttempted)
+
+			ts.srv.cfg.updateTimeout = time.Nanosecond
+			heartbeat("old")
+			wantState(updateStateFailed)
+
+			heartbeat("new")
+			wantState(updateStateSucceeded)
+		})
+	}
+}
@@ -0,0 +1,529 @@
+package gusserver
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Resumable uploads allow pushing large images over unreliable connections.
+// Instead of a single PUT /api/v1/push, clients:
+//
+//  1. create an upload session with POST /api/v1/upload (optionally declaring
+//     the total size), which replies with the session URL
+//     /api/v1/upload/<id>,
+//  2. send the image in chunks with PATCH /api/v1/upload/<id>, each with an
+//     Upload-Offset header (the number of bytes received so far) and an
+//     Upload-SHA256 header (the hex-encoded SHA-256 hash of the chunk),
+//  3. after an interruption, query the number of bytes received with GET (or
+//     HEAD) /api/v1/upload/<id> and continue from there,
+//  4. finalize the upload with PUT /api/v1/upload/<id>, which replies like
+//     /api/v1/push.
+//
+// Upload sessions belong to the API token which created them (if any): all
+// further requests must carry the same token.
+//
+// DELETE /api/v1/upload/<id> cancels an upload. Sessions without activity for
+// config.uploadExpiry are removed (see expireUploads).
+//
+// The received bytes are kept in the uploads directory (see uploadDir) until
+// the upload is finalized.
+
+const (
+	uploadPathPrefix = "/api/v1/upload/"
+	uploadIDPrefix   = "gusup_"
+
+	// uploadsDir is the subdirectory of --image_dir which holds the received
+	// bytes of upload sessions.
+	uploadsDir = "uploads"
+)
+
+type createUploadRequest struct {
+	// Size is the total size of the image in bytes, or zero if unknown. If
+	// set, chunks beyond the size are rejected and finalizing requires the
+	// upload to be complete.
+	Size int64 `json:"size"`
+}
+
+type uploadStatus struct {
+	UploadID string `json:"upload_id"`
+	// URL is the path of the upload session, to which chunks are sent.
+	URL string `json:"url"`
+	// Offset is the number of bytes received so far, i.e. where the next chunk
+	// starts.
+	Offset int64 `json:"offset"`
+	Size   int64 `json:"size,omitempty"`
+	// ExpiresAt is when the session is removed unless there is further
+	// activity, or nil if sessions do not expire.
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+// uploadDir returns the directory in which the received bytes of upload
+// sessions are kept: within the directory of the file system store, so that
+// finalizing can rename the upload into place, or in the system temporary
+// directory.
+func (s *server) uploadDir() string {
+	if fss, ok := s.store().(*fsStore); ok {
+		return filepath.Join(fss.dir, uploadsDir)
+	}
+	return filepath.Join(os.TempDir(), "gus-"+uploadsDir)
+}
+
+func (s *server) uploadPath(uploadID string) string {
+	return filepath.Join(s.uploadDir(), uploadID)
+}
+
+// lockUpload marks the specified upload session as busy, so that concurrent
+// requests cannot interleave their writes. The returned function releases the
+// session.
+func (s *server) lockUpload(uploadID string) (func(), error) {
+	s.uploadsMu.Lock()
+	defer s.uploadsMu.Unlock()
+	if s.uploadsBusy[uploadID] {
+		return nil, httpError(http.StatusConflict, fmt.Errorf("upload %q is busy with another request", uploadID))
+	}
+	if s.uploadsBusy == nil {
+		s.uploadsBusy = make(map[string]bool)
+	}
+	s.uploadsBusy[uploadID] = true
+	return func() {
+		s.uploadsMu.Lock()
+		defer s.uploadsMu.Unlock()
+		delete(s.uploadsBusy, uploadID)
+	}, nil
+}
+
+type uploadSession struct {
+	id           string
+	size         int64 // zero if unknown
+	received     int64
+	lastActivity time.Time
+	tokenHash    string // of the API token which created the session, if any
+}
+
+// status returns the status of the session, which expires after the
+// specified duration without activity (zero: never).
+func (sess *uploadSession) status(expiry time.Duration) *uploadStatus {
+	st := &uploadStatus{
+		UploadID: sess.id,
+		URL:      uploadPathPrefix + sess.id,
+		Offset:   sess.received,
+		Size:     sess.size,
+	}
+	if expiry > 0 {
+		expiresAt := sess.lastActivity.Add(expiry)
+		st.ExpiresAt = &expiresAt
+	}
+	return st
+}
+
+// loadUpload returns the specified upload session, which must belong to the
+// API token of r. Expired sessions are treated as non-existing, even if
+// expireUploads did not remove them yet.
+func (s *server) loadUpload(r *http.Request, uploadID string) (*uploadSession, error) {
+	var (
+		size      sql.NullInt64
+		tokenHash sql.NullString
+	)
+	sess := uploadSession{id: uploadID}
+	err := s.queries.selectUpload.QueryRowContext(r.Context(), uploadID).Scan(
+		&size,
+		&sess.received,
+		&sess.lastActivity,
+		&tokenHash)
+	if err == sql.ErrNoRows {
+		return nil, httpError(http.StatusNotFound, fmt.Errorf("upload %q not found", uploadID))
+	}
+	if err != nil {
+		return nil, err
+	}
+	sess.size = size.Int64
+	sess.tokenHash = tokenHash.String
+	if sess.tokenHash != "" && hashToken(requestToken(r)) != sess.tokenHash {
+		return nil, httpError(http.StatusForbidden, fmt.Errorf("upload %q was created with another API token", uploadID))
+	}
+	if s.cfg.uploadExpiry > 0 && time.Since(sess.lastActivity) > s.cfg.uploadExpiry {
+		return nil, httpError(http.StatusNotFound, fmt.Errorf("upload %q expired", uploadID))
+	}
+	return &sess, nil
+}
+
+// removeUpload removes the upload session and its received bytes.
+func (s *server) removeUpload(ctx context.Context, uploadID string) error {
+	if err := os.Remove(s.uploadPath(uploadID)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	_, err := s.queries.deleteUpload.ExecContext(ctx, uploadID)
+	return err
+}
+
+func writeUploadStatus(w http.ResponseWriter, code int, st *uploadStatus) error {
+	b, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Upload-Offset", strconv.FormatInt(st.Offset, 10))
+	w.WriteHeader(code)
+	_, err = w.Write(b)
+	return err
+}
+
+// createUpload handles POST /api/v1/upload, which starts a resumable upload.
+func (s *server) createUpload(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "POST" {
+		return httpError(http.StatusBadRequest, fmt.Errorf("invalid method (expected POST)"))
+	}
+	var req createUploadRequest
+	b, err := io.ReadAll(r.Body)
+	if err != nil {
+		return err
+	}
+	if len(b) > 0 {
+		if err := json.Unmarshal(b, &req); err != nil {
+			return httpError(http.StatusBadRequest, err)
+		}
+	}
+	if req.Size < 0 {
+		return httpError(http.StatusBadRequest, fmt.Errorf("invalid size %d", req.Size))
+	}
+
+	if err := s.authorize(r, ""); err != nil {
+		return err
+	}
+
+	if s.store() == nil {
+		return httpError(http.StatusForbidden, errNoImageStore)
+	}
+
+	limits, err := s.pushLimits(r, s.uploadDir())
+	if err != nil {
+		return err
+	}
+	if err := limits.check(req.Size); err != nil {
+		return err
+	}
+
+	var rb [16]byte
+	if _, err := rand.Read(rb[:]); err != nil {
+		return err
+	}
+	sess := &uploadSession{
+		id:           uploadIDPrefix + hex.EncodeToString(rb[:]),
+		size:         req.Size,
+		lastActivity: time.Now(),
+	}
+	if token := requestToken(r); token != "" {
+		sess.tokenHash = hashToken(token)
+	}
+	if err := os.MkdirAll(s.uploadDir(), 0700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(s.uploadPath(sess.id), os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	var size any
+	if req.Size > 0 {
+		size = req.Size
+	}
+	if _, err := s.queries.insertUpload.ExecContext(r.Context(), sess.id, size, sess.lastActivity, nullIfEmpty(sess.tokenHash)); err != nil {
+		return err
+	}
+	st := sess.status(s.cfg.uploadExpiry)
+	w.Header().Set("Location", st.URL)
+	return writeUploadStatus(w, http.StatusCreated, st)
+}
+
+// upload handles requests to an upload session, see createUpload.
+func (s *server) upload(w http.ResponseWriter, r *http.Request) error {
+	uploadID := strings.TrimPrefix(r.URL.Path, uploadPathPrefix)
+	if !strings.HasPrefix(uploadID, uploadIDPrefix) || strings.Contains(uploadID, "/") {
+		return httpError(http.StatusNotFound, fmt.Errorf("invalid upload ID %q", uploadID))
+	}
+
+	if err := s.authorize(r, ""); err != nil {
+		return err
+	}
+
+	switch r.Method {
+	case "GET", "HEAD":
+		sess, err := s.loadUpload(r, uploadID)
+		if err != nil {
+			return err
+		}
+		return writeUploadStatus(w, http.StatusOK, sess.status(s.cfg.uploadExpiry))
+
+	case "PATCH":
+		return s.uploadChunk(w, r, uploadID)
+
+	case "PUT":
+		return s.finalizeUpload(w, r, uploadID)
+
+	case "DELETE":
+		unlock, err := s.lockUpload(uploadID)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+		if _, err := s.loadUpload(r, uploadID); err != nil {
+			return err
+		}
+		if err := s.removeUpload(r.Context(), uploadID); err != nil {
+			return err
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+
+	default:
+		return httpError(http.StatusMethodNotAllowed, fmt.Errorf("invalid method (expected GET, HEAD, PATCH, PUT or DELETE)"))
+	}
+}
+
+// uploadChunk appends the request body to the upload session. The chunk is
+// only accepted (and the offset advanced) if it was received completely and
+// matches its Upload-SHA256 header. Otherwise, the client should query the
+// offset and resend the chunk.
+func (s *server) uploadChunk(w http.ResponseWriter, r *http.Request, uploadID string) error {
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil {
+		return httpError(http.StatusBadRequest, fmt.Errorf("invalid or missing Upload-Offset header: %v", err))
+	}
+	wantSHA256 := strings.ToLower(r.Header.Get("Upload-SHA256"))
+	if !sha256DigestRe.MatchString("sha256:" + wantSHA256) {
+		return httpError(http.StatusBadRequest, fmt.Errorf("invalid or missing Upload-SHA256 header (expected the hex-encoded SHA-256 hash of the chunk)"))
+	}
+
+	unlock, err := s.lockUpload(uploadID)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	sess, err := s.loadUpload(r, uploadID)
+	if err != nil {
+		return err
+	}
+	limits, err := s.pushLimits(r, s.uploadDir())
+	if err != nil {
+		return err
+	}
+	if r.ContentLength > 0 {
+		if err := limits.checkSize(sess.received + r.ContentLength); err != nil {
+			return err
+		}
+	}
+	if err := limits.checkFreeSpace(max(r.ContentLength, 0)); err != nil {
+		return err
+	}
+	if offset != sess.received {
+		w.Header().Set("Upload-Offset", strconv.FormatInt(sess.received, 10))
+		return httpError(http.StatusConflict, fmt.Errorf("chunk starts at offset %d, but %d bytes were received so far", offset, sess.received))
+	}
+
+	f, err := os.OpenFile(s.uploadPath(uploadID), os.O_RDWR, 0600)
+	if err != nil {
+		if os.IsNotExist(err) {
+			// The uploads directory is gone (e.g. a temporary directory which
+			// was cleaned on reboot), so the session cannot be resumed.
+			if err := s.removeUpload(r.Context(), uploadID); err != nil {
+				return err
+			}
+			return httpError(http.StatusNotFound, fmt.Errorf("upload %q: received data lost, start a new upload", uploadID))
+		}
+		return err
+	}
+	defer f.Close()
+	// Discard any incomplete chunk from an earlier, interrupted request.
+	if err := f.Truncate(sess.received); err != nil {
+		return err
+	}
+	if _, err := f.Seek(sess.received, io.SeekStart); err != nil {
+		return err
+	}
+	body := limits.reader(r.Body, sess.received)
+	if sess.size > 0 {
+		// Read one byte more than allowed to detect oversized chunks.
+		body = io.LimitReader(body, sess.size-sess.received+1)
+	}
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(f, h), body)
+	if err == nil && sess.size > 0 && sess.received+n > sess.size {
+		err = httpError(http.StatusBadRequest, fmt.Errorf("chunk exceeds the declared size of %d bytes", sess.size))
+	}
+	if err == nil {
+		if got := hex.EncodeToString(h.Sum(nil)); got != wantSHA256 {
+			err = httpError(http.StatusBadRequest, fmt.Errorf("chunk checksum mismatch: got SHA-256 %s, want %s", got, wantSHA256))
+		}
+	}
+	if err != nil {
+		if terr := f.Truncate(sess.received); terr != nil {
+			log.Printf("upload %s: discarding rejected chunk: %v", uploadID, terr)
+		}
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	sess.received += n
+	sess.lastActivity = time.Now()
+	if _, err := s.queries.updateUploadOffset.ExecContext(r.Context(), sess.received, sess.lastActivity, uploadID); err != nil {
+		return err
+	}
+	return writeUploadStatus(w, http.StatusOK, sess.status(s.cfg.uploadExpiry))
+}
+
+// finalizeUpload stores the uploaded image like push and removes the upload
+// session. With ?disk_sha256=, the upload is only finalized if the image has
+// the specified SHA-256 hash.
+func (s *server) finalizeUpload(w http.ResponseWriter, r *http.Request, uploadID string) error {
+	store := s.store()
+	if store == nil {
+		return httpError(http.StatusForbidden, errNoImageStore)
+	}
+
+	unlock, err := s.lockUpload(uploadID)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	sess, err := s.loadUpload(r, uploadID)
+	if err != nil {
+		return err
+	}
+	if sess.size > 0 && sess.received != sess.size {
+		return httpError(http.StatusBadRequest, fmt.Errorf("upload incomplete: received %d of %d bytes", sess.received, sess.size))
+	}
+	if sess.received == 0 {
+		return httpError(http.StatusBadRequest, fmt.Errorf("upload is empty"))
+	}
+
+	limits, err := s.pushLimits(r, s.spoolDir())
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(s.uploadPath(uploadID), os.O_RDWR, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	// Discard any incomplete chunk from an earlier, interrupted request.
+	if err := f.Truncate(sess.received); err != nil {
+		return err
+	}
+	h := sha256.New()
+	var (
+		out  pendingImage
+		size int64
+	)
+	if fss, ok := store.(*fsStore); ok {
+		// The upload is on the file system of the store (see uploadDir), so
+		// committing renames it into place.
+		if err := limits.checkSize(sess.received); err != nil {
+			return err
+		}
+		size, err = io.Copy(h, f)
+		if err != nil {
+			return err
+		}
+		out = &fsPendingImage{File: f, st: fss}
+	} else {
+		// Finalizing copies the upload into the image store, which needs
+		// space for a second copy (until the upload is removed).
+		if err := limits.check(sess.received); err != nil {
+			return err
+		}
+		pending, err := store.Create(r.Context())
+		if err != nil {
+			return err
+		}
+		defer pending.Cleanup()
+		size, err = io.Copy(io.MultiWriter(pending, h), limits.reader(f, 0))
+		if err != nil {
+			return err
+		}
+		out = pending
+	}
+	if size != sess.received {
+		return fmt.Errorf("upload %q: read %d bytes, want %d", uploadID, size, sess.received)
+	}
+	diskSHA256 := hex.EncodeToString(h.Sum(nil))
+	if want := r.FormValue("disk_sha256"); want != "" && !strings.EqualFold(want, diskSHA256) {
+		return httpError(http.StatusBadRequest, fmt.Errorf("upload checksum mismatch: got SHA-256 %s, want %s", diskSHA256, want))
+	}
+	resp, err := s.commitPush(r.Context(), store, out, size, diskSHA256, limits.tokenHash)
+	if err != nil {
+		return err
+	}
+	if err := s.removeUpload(r.Context(), uploadID); err != nil {
+		return err
+	}
+	log.Printf("Finalized upload %s (%d bytes) as %s", uploadID, size, resp.DownloadLink)
+
+	b, err := json.Marshal(resp)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, err = w.Write(b)
+	return err
+}
+
+// expireUploads removes upload sessions without activity for
+// config.uploadExpiry.
+func (s *server) expireUploads(ctx context.Context) error {
+	if s.cfg.uploadExpiry <= 0 {
+		return nil
+	}
+	rows, err := s.queries.selectExpiredUploads.QueryContext(ctx, time.Now().Add(-s.cfg.uploadExpiry))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	var expired []string
+	for rows.Next() {
+		var uploadID string
+		if err := rows.Scan(&uploadID); err != nil {
+			return err
+		}
+		expired = append(expired, uploadID)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if err := rows.Close(); err != nil {
+		return err
+	}
+	var errs []error
+	for _, uploadID := range expired {
+		unlock, err := s.lockUpload(uploadID)
+		if err != nil {
+			continue // in use, i.e. not abandoned after all
+		}
+		err = s.removeUpload(ctx, uploadID)
+		unlock()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %v", uploadID, err))
+			continue
+		}
+		log.Printf("Removed abandoned upload %s", uploadID)
+	}
+	return errors.Join(errs...)
+}
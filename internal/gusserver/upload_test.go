@@ -0,0 +1,224 @@
+package gusserver
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestResumableUpload(t *testing.T) {
+	for _, tc := range testDatabases() {
+		t.Run(tc.databaseType, func(t *testing.T) {
+			ctx := context.Background()
+			ts := newTestServer(t, tc.databaseType)
+			ts.srv.cfg.uploadExpiry = time.Hour
+
+			do := func(method, path string, header http.Header, body []byte) (*http.Response, []byte) {
+				t.Helper()
+				req, err := http.NewRequest(method, ts.URL()+path, bytes.NewReader(body))
+				if err != nil {
+					t.Fatal(err)
+				}
+				for k, v := range header {
+					req.Header[k] = v
+				}
+				if ts.apiToken != "" {
+					req.Header.Set("Authorization", "Bearer "+ts.apiToken)
+				}
+				resp, err := ts.Client().Do(req)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer resp.Body.Close()
+				b, err := io.ReadAll(resp.Body)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return resp, b
+			}
+			chunkHeader := func(offset int64, chunk []byte) http.Header {
+				sum := sha256.Sum256(chunk)
+				return http.Header{
+					"Upload-Offset": []string{strconv.FormatInt(offset, 10)},
+					"Upload-Sha256": []string{hex.EncodeToString(sum[:])},
+				}
+			}
+			decodeStatus := func(b []byte) uploadStatus {
+				t.Helper()
+				var st uploadStatus
+				if err := json.Unmarshal(b, &st); err != nil {
+					t.Fatal(err)
+				}
+				return st
+			}
+
+			zipb := dummyZip(t)
+			first, second := zipb[:len(zipb)/2], zipb[len(zipb)/2:]
+
+			createReq, err := json.Marshal(&createUploadRequest{Size: int64(len(zipb))})
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, b := do("POST", "/api/v1/upload", nil, createReq)
+			if resp.StatusCode != http.StatusCreated {
+				t.Fatalf("create upload: got %v, want %v (body: %s)", resp.Status, http.StatusCreated, b)
+			}
+			st := decodeStatus(b)
+			if got := resp.Header.Get("Location"); got != st.URL {
+				t.Errorf("Location: got %q, want %q", got, st.URL)
+			}
+			if st.Offset != 0 || st.Size != int64(len(zipb)) || st.ExpiresAt == nil {
+				t.Errorf("create upload: unexpected status %+v", st)
+			}
+
+			// First chunk.
+			resp, b = do("PATCH", st.URL, chunkHeader(0, first), first)
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("first chunk: got %v (body: %s)", resp.Status, b)
+			}
+			if got := decodeStatus(b).Offset; got != int64(len(first)) {
+				t.Errorf("after first chunk: offset = %d, want %d", got, len(first))
+			}
+
+			// A corrupted chunk is rejected and does not advance the offset.
+			corrupted := bytes.Clone(second)
+			corrupted[0] ^= 0xff
+			resp, b = do("PATCH", st.URL, chunkHeader(int64(len(first)), second), corrupted)
+			if resp.StatusCode != http.StatusBadRequest {
+				t.Errorf("corrupted chunk: got %v, want %v (body: %s)", resp.Status, http.StatusBadRequest, b)
+			}
+
+			// A chunk at the wrong offset (e.g. resent after a lost response)
+			// is rejected with the current offset.
+			resp, b = do("PATCH", st.URL, chunkHeader(0, first), first)
+			if resp.StatusCode != http.StatusConflict {
+				t.Errorf("chunk at wrong offset: got %v, want %v (body: %s)", resp.Status, http.StatusConflict, b)
+			}
+			if got, want := resp.Header.Get("Upload-Offset"), strconv.Itoa(len(first)); got != want {
+				t.Errorf("chunk at wrong offset: Upload-Offset = %q, want %q", got, want)
+			}
+
+			// Finalizing an incomplete upload fails.
+			if resp, b := do("PUT", st.URL, nil, nil); resp.StatusCode != http.StatusBadRequest {
+				t.Errorf("finalize incomplete upload: got %v, want %v (body: %s)", resp.Status, http.StatusBadRequest, b)
+			}
+
+			// Resume: query the progress, then send the rest.
+			resp, b = do("GET", st.URL, nil, nil)
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("query progress: got %v (body: %s)", resp.Status, b)
+			}
+			offset := decodeStatus(b).Offset
+			if offset != int64(len(first)) {
+				t.Fatalf("query progress: offset = %d, want %d", offset, len(first))
+			}
+			rest := zipb[offset:]
+			if resp, b := do("PATCH", st.URL, chunkHeader(offset, rest), rest); resp.StatusCode != http.StatusOK {
+				t.Fatalf("second chunk: got %v (body: %s)", resp.Status, b)
+			}
+
+			resp, b = do("PUT", st.URL+"?disk_sha256="+hex.EncodeToString(make([]byte, sha256.Size)), nil, nil)
+			if resp.StatusCode != http.StatusBadRequest {
+				t.Errorf("finalize with wrong disk_sha256: got %v, want %v (body: %s)", resp.Status, http.StatusBadRequest, b)
+			}
+			uploadInfo, err := os.Stat(ts.srv.uploadPath(st.UploadID))
+			if err != nil {
+				t.Fatal(err)
+			}
+			sum := sha256.Sum256(zipb)
+			resp, b = do("PUT", st.URL+"?disk_sha256="+hex.EncodeToString(sum[:]), nil, nil)
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("finalize: got %v (body: %s)", resp.Status, b)
+			}
+			var pr pushResponse
+			if err := json.Unmarshal(b, &pr); err != nil {
+				t.Fatal(err)
+			}
+			if pr.DiskSHA256 != hex.EncodeToString(sum[:]) {
+				t.Errorf("finalize: disk_sha256 = %q, want %x", pr.DiskSHA256, sum)
+			}
+			img, err := ts.srv.store().Open(ctx, contentKey(pr.DiskSHA256))
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := io.ReadAll(img)
+			img.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, zipb) {
+				t.Errorf("stored image differs from uploaded image")
+			}
+			// The file system store renames the upload instead of copying it.
+			if !os.SameFile(img.(*fsImage).info, uploadInfo) {
+				t.Errorf("finalized upload was copied, want it renamed")
+			}
+			if resp, _ := do("GET", st.URL, nil, nil); resp.StatusCode != http.StatusNotFound {
+				t.Errorf("finalized upload: got %v, want %v", resp.Status, http.StatusNotFound)
+			}
+			ts.ensureEmpty(t, "upload_sessions")
+
+			// Abandoned uploads expire.
+			resp, b = do("POST", "/api/v1/upload", nil, nil)
+			if resp.StatusCode != http.StatusCreated {
+				t.Fatalf("create upload: got %v (body: %s)", resp.Status, b)
+			}
+			abandoned := decodeStatus(b)
+			if resp, b := do("PATCH", abandoned.URL, chunkHeader(0, first), first); resp.StatusCode != http.StatusOK {
+				t.Fatalf("chunk: got %v (body: %s)", resp.Status, b)
+			}
+			if _, err := ts.srv.db.Exec("UPDATE upload_sessions SET last_activity_timestamp = $1 WHERE upload_id = $2", time.Now().Add(-2*time.Hour), abandoned.UploadID); err != nil {
+				t.Fatal(err)
+			}
+			if resp, _ := do("PATCH", abandoned.URL, chunkHeader(int64(len(first)), second), second); resp.StatusCode != http.StatusNotFound {
+				t.Errorf("chunk for expired upload: got %v, want %v", resp.Status, http.StatusNotFound)
+			}
+			if err := ts.srv.expireUploads(ctx); err != nil {
+				t.Fatal(err)
+			}
+			ts.ensureEmpty(t, "upload_sessions")
+			if _, err := os.Stat(ts.srv.uploadPath(abandoned.UploadID)); !os.IsNotExist(err) {
+				t.Errorf("received bytes of expired upload not removed (err: %v)", err)
+			}
+
+			// Upload sessions belong to the API token which created them.
+			ts.srv.cfg.requireAPIToken = true
+			owner, err := ts.srv.createToken(ctx, "owner", []string{"*"}, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			other, err := ts.srv.createToken(ctx, "other", []string{"*"}, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ts.apiToken = owner
+			resp, b = do("POST", "/api/v1/upload", nil, createReq)
+			if resp.StatusCode != http.StatusCreated {
+				t.Fatalf("create upload: got %v (body: %s)", resp.Status, b)
+			}
+			owned := decodeStatus(b)
+			ts.apiToken = other
+			if resp, _ := do("PATCH", owned.URL, chunkHeader(0, zipb), zipb); resp.StatusCode != http.StatusForbidden {
+				t.Errorf("chunk with another API token: got %v, want %v", resp.Status, http.StatusForbidden)
+			}
+			if resp, _ := do("PUT", owned.URL, nil, nil); resp.StatusCode != http.StatusForbidden {
+				t.Errorf("finalize with another API token: got %v, want %v", resp.Status, http.StatusForbidden)
+			}
+			ts.apiToken = owner
+			if resp, b := do("PATCH", owned.URL, chunkHeader(0, zipb), zipb); resp.StatusCode != http.StatusOK {
+				t.Fatalf("chunk with owning API token: got %v (body: %s)", resp.Status, b)
+			}
+			if resp, b := do("PUT", owned.URL, nil, nil); resp.StatusCode != http.StatusOK {
+				t.Errorf("finalize with owning API token: got %v (body: %s)", resp.Status, b)
+			}
+		})
+	}
+}
@@ -0,0 +1,367 @@
+package gusserver
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	// gokrazy does not ship a time zone database, so embed one.
+	_ "time/tzdata"
+)
+
+// A maintenance window schedule restricts when GUS offers updates to
+// machines. The grammar is:
+//
+//	schedule = range { ";" range }
+//	range    = [ days " " ] time "-" time
+//	days     = dayrange { "," dayrange }
+//	dayrange = day [ "-" day ]
+//	day      = "Mon" | "Tue" | "Wed" | "Thu" | "Fri" | "Sat" | "Sun"
+//	time     = hh ":" mm
+//
+// Without days, the range applies to every day. Days refer to the start of the
+// range, so a range like 22:00-02:00 ends on the following day. Times are
+// interpreted in the time zone of the window.
+//
+// Examples:
+//
+//	02:00-05:00
+//	Mon-Fri 22:00-02:00; Sat,Sun 10:00-18:00
+type schedule struct {
+	ranges []timeRange
+}
+
+type timeRange struct {
+	days       [7]bool // indexed by time.Weekday
+	start, end int     // minutes since midnight; end <= start wraps
+}
+
+var weekdays = map[string]time.Weekday{
+	"Sun": time.Sunday,
+	"Mon": time.Monday,
+	"Tue": time.Tuesday,
+	"Wed": time.Wednesday,
+	"Thu": time.Thursday,
+	"Fri": time.Friday,
+	"Sat": time.Saturday,
+}
+
+func parseClock(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q (expected hh:mm)", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+func parseDays(s string) ([7]bool, error) {
+	var days [7]bool
+	for _, dayrange := range strings.Split(s, ",") {
+		from, to, isRange := strings.Cut(dayrange, "-")
+		first, ok := weekdays[from]
+		if !ok {
+			return days, fmt.Errorf("invalid day %q", from)
+		}
+		last := first
+		if isRange {
+			if last, ok = weekdays[to]; !ok {
+				return days, fmt.Errorf("invalid day %q", to)
+			}
+		}
+		for d := first; ; d = (d + 1) % 7 {
+			days[d] = true
+			if d == last {
+				break
+			}
+		}
+	}
+	return days, nil
+}
+
+func parseSchedule(s string) (*schedule, error) {
+	var sched schedule
+	for _, r := range strings.Split(s, ";") {
+		fields := strings.Fields(r)
+		var tr timeRange
+		switch len(fields) {
+		case 1:
+			for d := range tr.days {
+				tr.days[d] = true
+			}
+		case 2:
+			days, err := parseDays(fields[0])
+			if err != nil {
+				return nil, fmt.Errorf("invalid schedule %q: %v", s, err)
+			}
+			tr.days = days
+			fields = fields[1:]
+		default:
+			return nil, fmt.Errorf("invalid schedule %q: range %q is not of the form [days ]hh:mm-hh:mm", s, strings.TrimSpace(r))
+		}
+		from, to, ok := strings.Cut(fields[0], "-")
+		if !ok {
+			return nil, fmt.Errorf("invalid schedule %q: range %q is not of the form [days ]hh:mm-hh:mm", s, fields[0])
+		}
+		var err error
+		if tr.start, err = parseClock(from); err != nil {
+			return nil, fmt.Errorf("invalid schedule %q: %v", s, err)
+		}
+		if tr.end, err = parseClock(to); err != nil {
+			return nil, fmt.Errorf("invalid schedule %q: %v", s, err)
+		}
+		sched.ranges = append(sched.ranges, tr)
+	}
+	return &sched, nil
+}
+
+// occurrence returns the window of tr which opens on day, if any.
+func (tr *timeRange) occurrence(day time.Time) (start, end time.Time, ok bool) {
+	if !tr.days[day.Weekday()] {
+		return time.Time{}, time.Time{}, false
+	}
+	y, m, d := day.Date()
+	loc := day.Location()
+	start = time.Date(y, m, d, 0, tr.start, 0, 0, loc)
+	end = time.Date(y, m, d, 0, tr.end, 0, 0, loc)
+	if tr.end <= tr.start {
+		end = time.Date(y, m, d+1, 0, tr.end, 0, 0, loc)
+	}
+	return start, end, true
+}
+
+// window returns the currently open window, or the next window if none is
+// open at t. t must be in the time zone of the schedule.
+func (s *schedule) window(t time.Time) (start, end time.Time) {
+	// Windows can start on the previous day (when wrapping midnight) and the
+	// next window might only open in a week.
+	y, m, d := t.Date()
+	for offset := -1; offset <= 7; offset++ {
+		day := time.Date(y, m, d+offset, 0, 0, 0, 0, t.Location())
+		for _, tr := range s.ranges {
+			wstart, wend, ok := tr.occurrence(day)
+			if !ok || !wend.After(t) {
+				continue
+			}
+			if start.IsZero() || wstart.Before(start) {
+				start, end = wstart, wend
+			}
+		}
+		if !start.IsZero() && !start.After(t) {
+			break // currently open
+		}
+	}
+	return start, end
+}
+
+// contains reports whether t lies within a maintenance window.
+func (s *schedule) contains(t time.Time) bool {
+	start, _ := s.window(t)
+	return !start.IsZero() && !start.After(t)
+}
+
+type maintenanceWindow struct {
+	MachineIDPattern string
+	Schedule         string
+	Timezone         string
+
+	pattern  *machinePattern
+	schedule *schedule
+	location *time.Location
+}
+
+// Next describes the currently open or next maintenance window at now, for
+// the index page.
+func (w *maintenanceWindow) Next(now time.Time) string {
+	now = now.In(w.location)
+	start, end := w.schedule.window(now)
+	if start.IsZero() {
+		return "never"
+	}
+	const layout = "Mon 2006-01-02 15:04 MST"
+	if !start.After(now) {
+		return "open until " + end.Format(layout)
+	}
+	return start.Format(layout)
+}
+
+func parseMaintenanceWindow(machineIDPattern, sched, timezone string) (*maintenanceWindow, error) {
+	pattern, err := parseMachinePattern(machineIDPattern)
+	if err != nil {
+		return nil, err
+	}
+	parsed, err := parseSchedule(sched)
+	if err != nil {
+		return nil, err
+	}
+	loc, err := time.LoadLocation(timezone)
+	if err != nil {
+		return nil, fmt.Errorf("invalid timezone %q: %v", timezone, err)
+	}
+	return &maintenanceWindow{
+		MachineIDPattern: machineIDPattern,
+		Schedule:         sched,
+		Timezone:         timezone,
+		pattern:          pattern,
+		schedule:         parsed,
+		location:         loc,
+	}, nil
+}
+
+func (s *server) loadMaintenanceWindows(ctx context.Context) ([]*maintenanceWindow, error) {
+	rows, err := s.queries.selectMaintenanceWindows.QueryContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var windows []*maintenanceWindow
+	for rows.Next() {
+		var pattern, sched, timezone string
+		if err := rows.Scan(&pattern, &sched, &timezone); err != nil {
+			return nil, err
+		}
+		w, err := parseMaintenanceWindow(pattern, sched, timezone)
+		if err != nil {
+			log.Printf("skipping maintenance window for %q: %v", pattern, err)
+			continue
+		}
+		windows = append(windows, w)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return windows, rows.Close()
+}
+
+// windowFor returns the maintenance window which applies to the machine, or
+// nil if updates can be offered at any time. Like with images, the window
+// with the most specific matching pattern wins.
+func windowFor(windows []*maintenanceWindow, attrs machineAttrs) *maintenanceWindow {
+	patterns := make([]*machinePattern, len(windows))
+	for idx, w := range windows {
+		patterns[idx] = w.pattern
+	}
+	if idx := mostSpecific(patterns, attrs); idx > -1 {
+		return windows[idx]
+	}
+	return nil
+}
+
+// maintenanceWindowOpen reports whether updates may be offered to the machine
+// at t, and returns the sbom hash of the image the machine currently runs. The
+// maintenance window of each machine is determined by updateDesired.
+func (s *server) maintenanceWindowOpen(ctx context.Context, machineID string, t time.Time) (current string, open bool, _ error) {
+	var pattern, sched, timezone sql.NullString
+	err := s.queries.selectMachineWindow.QueryRowContext(ctx, machineID).Scan(
+		&current,
+		&pattern,
+		&sched,
+		&timezone)
+	if err == sql.ErrNoRows {
+		return "", true, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	if !pattern.Valid {
+		return current, true, nil
+	}
+	w, err := parseMaintenanceWindow(pattern.String, sched.String, timezone.String)
+	if err != nil {
+		log.Printf("skipping maintenance window for %q: %v", pattern.String, err)
+		return current, true, nil
+	}
+	return current, w.schedule.contains(t.In(w.location)), nil
+}
+
+type windowRequest struct {
+	MachineIDPattern string `json:"machine_id_pattern"`
+	// Schedule is the maintenance window schedule (see schedule). An empty
+	// schedule removes the maintenance window.
+	Schedule string `json:"schedule"`
+	// Timezone is an IANA time zone name like Europe/Zurich. Defaults to UTC.
+	Timezone string `json:"timezone"`
+}
+
+type windowResponse struct{}
+
+func (s *server) setWindow(ctx context.Context, req windowRequest) error {
+	if req.MachineIDPattern == "" {
+		return httpError(http.StatusBadRequest, fmt.Errorf("machine_id_pattern not set"))
+	}
+	if req.Schedule == "" {
+		if _, err := s.queries.deleteMaintenanceWindow.ExecContext(ctx, req.MachineIDPattern); err != nil {
+			return err
+		}
+		log.Printf("Removed maintenance window for %q", req.MachineIDPattern)
+		return s.updateDesired()
+	}
+	if req.Timezone == "" {
+		req.Timezone = "UTC"
+	}
+	if _, err := parseMaintenanceWindow(req.MachineIDPattern, req.Schedule, req.Timezone); err != nil {
+		return httpError(http.StatusBadRequest, err)
+	}
+	_, err := s.queries.upsertMaintenanceWindow.ExecContext(ctx, req.MachineIDPattern, req.Schedule, req.Timezone)
+	if err != nil {
+		return err
+	}
+	log.Printf("Set maintenance window for %q to %q (%s)", req.MachineIDPattern, req.Schedule, req.Timezone)
+	return s.updateDesired()
+}
+
+func (s *server) window(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "POST" {
+		return httpError(http.StatusBadRequest, fmt.Errorf("invalid method (expected POST)"))
+	}
+	var req windowRequest
+	b, err := io.ReadAll(r.Body)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(b, &req); err != nil {
+		return err
+	}
+
+	if err := s.authorize(r, req.MachineIDPattern); err != nil {
+		return err
+	}
+
+	if err := s.setWindow(r.Context(), req); err != nil {
+		return err
+	}
+
+	b, err = json.Marshal(&windowResponse{})
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+	return nil
+}
+
+// windowForm handles the maintenance window forms on the index page.
+func (s *server) windowForm(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "POST" {
+		return httpError(http.StatusBadRequest, fmt.Errorf("invalid method (expected POST)"))
+	}
+	req := windowRequest{
+		MachineIDPattern: r.FormValue("machine_id_pattern"),
+		Schedule:         r.FormValue("schedule"),
+		Timezone:         r.FormValue("timezone"),
+	}
+	if err := s.authorizeForm(r, req.MachineIDPattern); err != nil {
+		return err
+	}
+
+	if err := s.setWindow(r.Context(), req); err != nil {
+		return err
+	}
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+	return nil
+}
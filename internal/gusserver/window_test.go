@@ -0,0 +1,184 @@
+package gusserver
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/antihax/optional"
+	"github.com/gokrazy/gokapi/gusapi"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestSchedule(t *testing.T) {
+	loc, err := time.LoadLocation("Europe/Zurich")
+	if err != nil {
+		t.Fatal(err)
+	}
+	at := func(s string) time.Time {
+		t.Helper()
+		tm, err := time.ParseInLocation("2006-01-02 15:04", s, loc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tm
+	}
+
+	for _, tt := range []struct {
+		schedule  string
+		t         string
+		wantOpen  bool
+		wantStart string
+	}{
+		{"02:00-05:00", "2024-06-03 03:00", true, "2024-06-03 02:00"},
+		{"02:00-05:00", "2024-06-03 05:00", false, "2024-06-04 02:00"},
+		{"02:00-05:00", "2024-06-03 01:59", false, "2024-06-03 02:00"},
+		// 2024-06-03 is a Monday
+		{"Sat,Sun 02:00-05:00", "2024-06-03 03:00", false, "2024-06-08 02:00"},
+		{"Mon-Fri 22:00-02:00", "2024-06-08 01:00", true, "2024-06-07 22:00"},
+		{"Mon-Fri 22:00-02:00", "2024-06-08 03:00", false, "2024-06-10 22:00"},
+		{"Fri-Mon 12:00-13:00", "2024-06-04 12:30", false, "2024-06-07 12:00"},
+		{"Tue 12:00-13:00; Wed 08:00-09:00", "2024-06-04 14:00", false, "2024-06-05 08:00"},
+	} {
+		sched, err := parseSchedule(tt.schedule)
+		if err != nil {
+			t.Fatalf("parseSchedule(%q): %v", tt.schedule, err)
+		}
+		now := at(tt.t)
+		if got := sched.contains(now); got != tt.wantOpen {
+			t.Errorf("schedule %q contains(%s) = %v, want %v", tt.schedule, tt.t, got, tt.wantOpen)
+		}
+		start, _ := sched.window(now)
+		if got, want := start, at(tt.wantStart); !got.Equal(want) {
+			t.Errorf("schedule %q window(%s) starts at %v, want %v", tt.schedule, tt.t, got, want)
+		}
+	}
+
+	for _, schedule := range []string{
+		"",
+		"02:00",
+		"2:00-5:00x",
+		"Foo 02:00-05:00",
+		"Mon Tue 02:00-05:00",
+		"25:00-26:00",
+	} {
+		if _, err := parseSchedule(schedule); err == nil {
+			t.Errorf("parseSchedule(%q) unexpectedly succeeded", schedule)
+		}
+	}
+}
+
+func TestUpdateMaintenanceWindow(t *testing.T) {
+	testDBs := testDatabases()
+
+	for _, tc := range testDBs {
+		t.Run(tc.databaseType, func(t *testing.T) {
+			ctx := context.Background()
+			ts := newTestServer(t, tc.databaseType)
+			downloadLink := ts.pushImage(t)
+			api := ts.API()
+
+			const machineID = "router7"
+
+			_, _, err := api.HeartbeatApi.Heartbeat(ctx, &gusapi.HeartbeatApiHeartbeatOpts{
+				Body: optional.NewInterface(&gusapi.HeartbeatRequest{
+					MachineId: machineID,
+					Hostname:  machineID,
+					SbomHash:  "old",
+				}),
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, _, err = api.IngestApi.Ingest(ctx, &gusapi.IngestApiIngestOpts{
+				Body: optional.NewInterface(&gusapi.IngestRequest{
+					MachineIdPattern: machineID,
+					SbomHash:         "new",
+					RegistryType:     "localdisk",
+					DownloadLink:     downloadLink,
+				}),
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Configure a maintenance window which is closed right now.
+			tomorrow := time.Now().UTC().Add(24 * time.Hour).Weekday().String()[:3]
+			if err := ts.postJSON("/api/v1/window", windowRequest{
+				MachineIDPattern: "hostname:router*",
+				Schedule:         tomorrow + " 00:00-00:01",
+			}, nil); err != nil {
+				t.Fatal(err)
+			}
+			if diff := ts.diffQuery(t, []map[string]any{
+				{"maintenance_window": "hostname:router*"},
+			}, "SELECT maintenance_window FROM machines WHERE machine_id = $1", machineID); diff != "" {
+				t.Errorf("machines table: unexpected diff (-want +got):\n%s", diff)
+			}
+
+			update := func() (gusapi.UpdateResponse, int) {
+				t.Helper()
+				resp, hr, err := api.UpdateApi.Update(ctx, &gusapi.UpdateApiUpdateOpts{
+					Body: optional.NewInterface(&gusapi.UpdateRequest{
+						MachineId: machineID,
+					}),
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+				return resp, hr.StatusCode
+			}
+
+			// Outside the window, the update API returns no content while the
+			// machine runs an image which GUS does not know…
+			if _, code := update(); code != http.StatusNoContent {
+				t.Errorf("update: got HTTP status %d, want %d", code, http.StatusNoContent)
+			}
+
+			// …and the current image otherwise.
+			oldLink := ts.push(t, zipWithContents(t, "old")).DownloadLink
+			if err := ts.postJSON("/api/v1/ingest", &ingestRequest{
+				MachineIDPattern: "retired-*",
+				SBOMHash:         "old",
+				RegistryType:     "localdisk",
+				DownloadLink:     oldLink,
+			}, nil); err != nil {
+				t.Fatal(err)
+			}
+			got, _ := update()
+			if diff := cmp.Diff(gusapi.UpdateResponse{
+				SbomHash:     "old",
+				RegistryType: "localdisk",
+				DownloadLink: oldLink,
+			}, got); diff != "" {
+				t.Errorf("update: diff (-want +got):\n%s", diff)
+			}
+
+			// Removing the window offers the update again.
+			if err := ts.postJSON("/api/v1/window", windowRequest{
+				MachineIDPattern: "hostname:router*",
+			}, nil); err != nil {
+				t.Fatal(err)
+			}
+			want := gusapi.UpdateResponse{
+				SbomHash:     "new",
+				RegistryType: "localdisk",
+				DownloadLink: downloadLink,
+			}
+			got, _ = update()
+			if diff := cmp.Diff(want, got); diff != "" {
+				t.Errorf("update: diff (-want +got):\n%s", diff)
+			}
+
+			if err := ts.postJSON("/api/v1/window", windowRequest{
+				MachineIDPattern: machineID,
+				Schedule:         "02:00-05:00",
+				Timezone:         "Mars/Olympus_Mons",
+			}, nil); err == nil {
+				t.Fatalf("setting a window with an invalid time zone unexpectedly succeeded")
+			}
+		})
+	}
+}